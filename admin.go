@@ -0,0 +1,59 @@
+// admin.go
+package main
+
+import "github.com/gorilla/mux"
+
+// registerAdminRoutes mounts operational endpoints under /admin, behind admin auth
+func registerAdminRoutes(router *mux.Router) {
+	admin := router.PathPrefix("/admin").Subrouter()
+	admin.Use(requireAdmin)
+	if faultRoutes != nil {
+		faultRoutes(admin)
+	}
+	admin.HandleFunc("/reload", reloadConfigHandler).Methods("POST")
+	admin.HandleFunc("/loglevel", getLogLevel).Methods("GET")
+	admin.HandleFunc("/loglevel", putLogLevel).Methods("PUT")
+	admin.HandleFunc("/jobs", getJobs).Methods("GET")
+	admin.HandleFunc("/jobs/{name}/run", runJobNow).Methods("POST")
+	admin.HandleFunc("/write_buffer", getWriteBuffer).Methods("GET")
+	admin.HandleFunc("/query", runConsoleQuery).Methods("POST")
+	admin.HandleFunc("/snapshot", getSnapshot).Methods("GET")
+	admin.HandleFunc("/integrity", getDayHashes).Methods("GET")
+	admin.HandleFunc("/integrity/verify", verifyIntegrity).Methods("GET")
+	admin.HandleFunc("/duplicates", getDuplicates).Methods("GET")
+	admin.HandleFunc("/duplicates/merge", mergeDuplicates).Methods("POST")
+	admin.HandleFunc("/recalculate", recalculateUsage).Methods("POST")
+	admin.HandleFunc("/token_usage/delete_by_filter", deleteByFilter).Methods("POST")
+	admin.HandleFunc("/pricing/recompute", recomputePricing).Methods("POST")
+	admin.HandleFunc("/archives", getUsageArchives).Methods("GET")
+	admin.HandleFunc("/export", exportArchive).Methods("GET")
+	admin.HandleFunc("/import", importArchive).Methods("POST")
+	admin.HandleFunc("/partitions", getPartitions).Methods("GET")
+	admin.HandleFunc("/partitions/{month}", dropPartition).Methods("DELETE")
+	admin.HandleFunc("/upstreams", getUpstreams).Methods("GET")
+	admin.HandleFunc("/upstreams/usage", getUpstreamUsage).Methods("GET")
+	admin.HandleFunc("/upstreams/{name}", putUpstream).Methods("PUT")
+	admin.HandleFunc("/upstreams/{name}", deleteUpstream).Methods("DELETE")
+	admin.HandleFunc("/upstream_routes", createUpstreamRoute).Methods("POST")
+	admin.HandleFunc("/upstream_routes", getUpstreamRoutes).Methods("GET")
+	admin.HandleFunc("/upstream_routes/{id}", deleteUpstreamRoute).Methods("DELETE")
+	admin.HandleFunc("/concurrency_limits", createConcurrencyLimit).Methods("POST")
+	admin.HandleFunc("/concurrency_limits", getConcurrencyLimits).Methods("GET")
+	admin.HandleFunc("/concurrency_limits/{id}", deleteConcurrencyLimit).Methods("DELETE")
+	admin.HandleFunc("/samples", getSamples).Methods("GET")
+	admin.HandleFunc("/samples/{id}", getSample).Methods("GET")
+	admin.HandleFunc("/samples/{id}", deleteSample).Methods("DELETE")
+	admin.HandleFunc("/federation/sources", getFederationSources).Methods("GET")
+	admin.HandleFunc("/federation/sources/{name}", putFederationSource).Methods("PUT")
+	admin.HandleFunc("/federation/sources/{name}", deleteFederationSource).Methods("DELETE")
+	admin.HandleFunc("/keys", getKeys).Methods("GET")
+	admin.HandleFunc("/sources", getIngestionSources).Methods("GET")
+	admin.HandleFunc("/replication", getReplicationStatus).Methods("GET")
+	admin.HandleFunc("/replication/catchup", catchUpReplication).Methods("POST")
+	admin.HandleFunc("/dead_letters", getDeadLetters).Methods("GET")
+	admin.HandleFunc("/dead_letters/replay", replayDeadLetters).Methods("POST")
+	admin.HandleFunc("/dead_letters/{id}", deleteDeadLetter).Methods("DELETE")
+	if seedEnabled() {
+		admin.HandleFunc("/seed", seedUsage).Methods("POST")
+	}
+}
@@ -0,0 +1,111 @@
+// annotations.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// An Annotation marks an event on the usage timeline, such as a deployment, an experiment or a
+// price change, so a jump in usage can be explained. Events with a duration set EndsAt. Chart
+// and report responses include the annotations that overlap their date range.
+type Annotation struct {
+	ID        int        `json:"id"`
+	Timestamp time.Time  `json:"timestamp"`
+	EndsAt    *time.Time `json:"ends_at,omitempty"`
+	Text      string     `json:"text"`
+	Tags      []string   `json:"tags"`
+}
+
+const annotationColumns = "id, ts, ends_at, text, tags"
+
+// annotationsBetween returns the annotations overlapping the days start to end, oldest first,
+// only those tagged tag if it is not empty
+func annotationsBetween(ctx context.Context, start, end time.Time, tag string) ([]Annotation, error) {
+	rows, err := db.QueryContext(ctx, "SELECT "+annotationColumns+` FROM annotations
+        WHERE ts < $2 AND COALESCE(ends_at, ts) >= $1 AND ($3 = '' OR $3 = ANY(tags))
+        ORDER BY ts, id`, start, end.AddDate(0, 0, 1), tag)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	annotations := []Annotation{}
+	for rows.Next() {
+		var a Annotation
+		if err := rows.Scan(&a.ID, &a.Timestamp, &a.EndsAt, &a.Text, pq.Array(&a.Tags)); err != nil {
+			return nil, err
+		}
+		annotations = append(annotations, a)
+	}
+	return annotations, rows.Err()
+}
+
+func createAnnotation(w http.ResponseWriter, r *http.Request) {
+	var a Annotation
+	if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request payload", err)
+		return
+	}
+	if a.Text == "" {
+		respondJSON(w, http.StatusBadRequest, map[string]string{"message": "text is required"})
+		return
+	}
+	if a.Timestamp.IsZero() {
+		a.Timestamp = time.Now()
+	}
+	if a.EndsAt != nil && a.EndsAt.Before(a.Timestamp) {
+		respondJSON(w, http.StatusBadRequest, map[string]string{"message": "ends_at must not be before timestamp"})
+		return
+	}
+	// A nil slice would be stored as NULL
+	if a.Tags == nil {
+		a.Tags = []string{}
+	}
+	err := db.QueryRowContext(r.Context(), "INSERT INTO annotations (ts, ends_at, text, tags) VALUES ($1, $2, $3, $4) RETURNING id",
+		a.Timestamp, a.EndsAt, a.Text, pq.Array(a.Tags)).Scan(&a.ID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to create annotation", err)
+		return
+	}
+	respondJSON(w, http.StatusCreated, a)
+}
+
+// getAnnotations lists annotations overlapping a date range, this month by default. ?tag=
+// narrows it to one tag.
+func getAnnotations(w http.ResponseWriter, r *http.Request) {
+	start, end, err := parseDateRange(r.URL.Query(), "month")
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid date range", err)
+		return
+	}
+	annotations, err := annotationsBetween(r.Context(), start, end, r.URL.Query().Get("tag"))
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database query error", err)
+		return
+	}
+	respondJSON(w, http.StatusOK, annotations)
+}
+
+func deleteAnnotation(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid annotation id", err)
+		return
+	}
+	res, err := db.ExecContext(r.Context(), "DELETE FROM annotations WHERE id = $1", id)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to delete annotation", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		respondJSON(w, http.StatusNotFound, map[string]string{"message": "Annotation not found"})
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]string{"message": "Annotation deleted successfully"})
+}
@@ -0,0 +1,221 @@
+// api.go
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// The token usage endpoints are served in two versions, so reporters written against the
+// original API keep working as the record grows:
+//
+//	/api/v1/token_usage...  the original API. Records are {id, date, model, total_tokens},
+//	                        one per date and model, and the lookups answer in their original
+//	                        shapes. Fields added since are neither accepted nor returned.
+//	/api/v2/token_usage...  the current API, with project, cost, measures, provider and the
+//	                        prompt/completion split.
+//
+// The unversioned paths serve the current version. They still accept a v1 body, as every
+// field added since is optional, and their responses only ever gained fields.
+//
+// v1 is a translation layer over v2 rather than a separate implementation: v1TokenUsage.toV2
+// turns an old body into a current record, and v1Records folds current records back into the
+// old shape. Adding a field to TokenUsage needs no change here, as long as it is optional on
+// ingest; a field v1 reporters would have to send needs a default in toV2. v1 responses are
+// written through rawJSONWriter, so response_envelope and field_naming, which v1 clients
+// predate, don't reshape them.
+const (
+	apiV1Prefix = "/api/v1"
+	apiV2Prefix = "/api/v2"
+)
+
+// datedUsagePath and periodUsagePath are the routes of the date and model and the period
+// lookups. Model names may contain slashes, such as openai/gpt-4o on OpenRouter, so the model
+// takes every segment up to the period, or after the date. The date must look like one, or the
+// dated route would also catch the period lookup of a model, and it must be registered first.
+const (
+	datedUsagePath  = "/token_usage/{date:[0-9]{4}-[0-9]{2}-[0-9]{2}}/{model:.+}"
+	periodUsagePath = "/token_usage/{model:.+}/{period}"
+)
+
+// UsageBreakdown details a record's tokens when the reporter knows more than the total.
+// Provider is the API that served the usage, such as a proxy upstream, and PromptTokens and
+// CompletionTokens split TotalTokens; a record that sends only the split gets their sum as its
+// total. Like measures, they follow the record's write mode.
+type UsageBreakdown struct {
+	Provider         string `json:"provider,omitempty"`
+	PromptTokens     int    `json:"prompt_tokens,omitempty"`
+	CompletionTokens int    `json:"completion_tokens,omitempty"`
+}
+
+func (b *UsageBreakdown) add(o UsageBreakdown) {
+	if o.Provider != "" {
+		b.Provider = o.Provider
+	}
+	b.PromptTokens += o.PromptTokens
+	b.CompletionTokens += o.CompletionTokens
+}
+
+func (b UsageBreakdown) validate(totalTokens int) error {
+	if b.PromptTokens < 0 || b.CompletionTokens < 0 {
+		return fmt.Errorf("prompt_tokens and completion_tokens must not be negative")
+	}
+	if b.PromptTokens+b.CompletionTokens > totalTokens {
+		return fmt.Errorf("prompt_tokens and completion_tokens add up to more than total_tokens")
+	}
+	return nil
+}
+
+// v1TokenUsage is a record as the v1 API sends and receives it
+type v1TokenUsage struct {
+	ID          int       `json:"id"`
+	Date        time.Time `json:"date"`
+	Model       string    `json:"model"`
+	TotalTokens int       `json:"total_tokens"`
+}
+
+// toV2 translates a v1 body into a current record; v1 reporters report for no project
+func (u v1TokenUsage) toV2() TokenUsage {
+	return TokenUsage{Date: u.Date, Model: u.Model, TotalTokens: u.TotalTokens}
+}
+
+// v1Records folds current records into v1 ones. v1 had a single record per date and model, so
+// the records of each project are summed into one, identified by the lowest of their IDs.
+func v1Records(usages []TokenUsage) []v1TokenUsage {
+	type dateModel struct {
+		date  string
+		model string
+	}
+	byKey := map[dateModel]*v1TokenUsage{}
+	records := []v1TokenUsage{}
+	var keys []dateModel
+	for _, usage := range usages {
+		key := dateModel{usage.Date.Format("2006-01-02"), usage.Model}
+		record, ok := byKey[key]
+		if !ok {
+			record = &v1TokenUsage{ID: usage.ID, Date: usage.Date, Model: usage.Model}
+			byKey[key] = record
+			keys = append(keys, key)
+		}
+		record.TotalTokens += usage.TotalTokens
+		if usage.ID < record.ID {
+			record.ID = usage.ID
+		}
+	}
+	for _, key := range keys {
+		records = append(records, *byKey[key])
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].ID < records[j].ID })
+	return records
+}
+
+// unversionedPath strips the API version prefix from a path
+func unversionedPath(path string) string {
+	for _, prefix := range []string{apiV1Prefix, apiV2Prefix} {
+		if rest, ok := strings.CutPrefix(path, prefix); ok && strings.HasPrefix(rest, "/") {
+			return rest
+		}
+	}
+	return path
+}
+
+// rawJSONWriter marks a response as exempt from shapeResponse: respondJSON writes payloads to
+// it as they are
+type rawJSONWriter struct {
+	http.ResponseWriter
+}
+
+func (w rawJSONWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// rawJSONResponses writes a route's responses through rawJSONWriter
+func rawJSONResponses(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(rawJSONWriter{w}, r)
+	})
+}
+
+// registerAPIRoutes adds the token usage endpoints of both API versions
+func registerAPIRoutes(router *mux.Router) {
+	v1 := router.PathPrefix(apiV1Prefix).Subrouter()
+	v1.Use(rawJSONResponses)
+	v1.HandleFunc("/token_usage", recordTokenUsageV1).Methods("POST")
+	v1.HandleFunc("/token_usage", getTokenUsageAllV1).Methods("GET")
+	v1.HandleFunc(datedUsagePath, getTokenUsageByDateAndModelV1).Methods("GET")
+	v1.HandleFunc(periodUsagePath, getTokenUsageByPeriodV1).Methods("GET")
+
+	v2 := router.PathPrefix(apiV2Prefix).Subrouter()
+	v2.HandleFunc("/token_usage", recordTokenUsage).Methods("POST")
+	v2.HandleFunc("/token_usage", getTokenUsageAll).Methods("GET")
+	v2.HandleFunc(datedUsagePath, getTokenUsageByDateAndModel).Methods("GET")
+	v2.HandleFunc(periodUsagePath, getTokenUsageByPeriod).Methods("GET")
+}
+
+// recordTokenUsageV1 accepts the original {date, model, total_tokens} body
+func recordTokenUsageV1(w http.ResponseWriter, r *http.Request) {
+	var usage v1TokenUsage
+	if err := json.NewDecoder(r.Body).Decode(&usage); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request payload", err)
+		return
+	}
+	recordUsage(w, r, usage.toV2())
+}
+
+// getTokenUsageAllV1 lists every record in the v1 shape
+func getTokenUsageAllV1(w http.ResponseWriter, r *http.Request) {
+	usages, err := store.ListUsage(r.Context(), time.Time{})
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database query error", err)
+		return
+	}
+	respondJSON(w, http.StatusOK, v1Records(usages))
+}
+
+// getTokenUsageByDateAndModelV1 answers {total_tokens, status: 1}, or {message, status: 0}
+// when nothing was recorded
+func getTokenUsageByDateAndModelV1(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	date, err := time.Parse("2006-01-02", vars["date"])
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid date format", err)
+		return
+	}
+	totalTokens, found, err := store.SumUsage(r.Context(), vars["model"], date, date)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database query error", err)
+		return
+	}
+	if !found {
+		respondJSON(w, http.StatusOK, map[string]interface{}{"message": "No token usage data found for this date and model", "status": 0})
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{"total_tokens": totalTokens, "status": 1})
+}
+
+// getTokenUsageByPeriodV1 answers {total_tokens}, or 404 when nothing was recorded
+func getTokenUsageByPeriodV1(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	today := time.Now().Truncate(24 * time.Hour)
+	start, ok := periodStart(vars["period"], today)
+	if !ok {
+		respondJSON(w, http.StatusBadRequest, map[string]string{"message": "Invalid period. Use 'week', 'month' or 'lifetime'"})
+		return
+	}
+	totalTokens, _, err := store.SumUsage(r.Context(), vars["model"], start, today)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database query error", err)
+		return
+	}
+	if totalTokens == 0 {
+		respondJSON(w, http.StatusNotFound, map[string]string{"message": "No token usage data found for this model"})
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]int64{"total_tokens": totalTokens})
+}
@@ -0,0 +1,323 @@
+// archive.go
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// archiveFormatVersion is bumped whenever the layout of an export archive changes.
+// Restores accept any version up to and including this one.
+//
+//	1: token_usage.jsonl with id, date, model, total_tokens
+//	2: adds project to token_usage records (absent in v1, restored as the default project)
+//	3: adds the optional provider-reported cost
+//	4: adds requests, characters and credits (absent before v4, restored as zero)
+//	5: adds provider, prompt_tokens and completion_tokens (absent before v5, restored empty)
+const archiveFormatVersion = 5
+
+const (
+	archiveManifestName   = "manifest.json"
+	archiveTokenUsageName = "token_usage.jsonl"
+)
+
+// maxImportBody bounds the size of an uploaded archive, and maxArchiveEntry the size of each
+// file in it once decompressed, as the files are read into memory
+const (
+	maxImportBody   = 256 << 20
+	maxArchiveEntry = 1 << 30
+)
+
+// ArchiveManifest is written as the first entry of every export archive
+type ArchiveManifest struct {
+	FormatVersion int           `json:"format_version"`
+	CreatedAt     time.Time     `json:"created_at"`
+	Files         []ArchiveFile `json:"files"`
+}
+
+// ArchiveFile describes one data file inside an archive
+type ArchiveFile struct {
+	Name    string `json:"name"`
+	Size    int64  `json:"size"`
+	Records int    `json:"records"`
+	SHA256  string `json:"sha256"`
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// archiveEntry is one file written into an archive
+type archiveEntry struct {
+	name string
+	body []byte
+}
+
+// buildArchive collects the data files and their manifest
+func buildArchive(ctx context.Context) (*ArchiveManifest, []archiveEntry, error) {
+	rows, err := db.QueryContext(ctx, `SELECT id, date, model, project, total_tokens, cost, requests, characters, credits, provider, prompt_tokens, completion_tokens
+        FROM token_usage ORDER BY date, model, project, id`)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	var data bytes.Buffer
+	enc := json.NewEncoder(&data)
+	records := 0
+	for rows.Next() {
+		var usage TokenUsage
+		if err := rows.Scan(&usage.ID, &usage.Date, &usage.Model, &usage.Project, &usage.TotalTokens, &usage.Cost, &usage.Requests, &usage.Characters, &usage.Credits,
+			&usage.Provider, &usage.PromptTokens, &usage.CompletionTokens); err != nil {
+			return nil, nil, err
+		}
+		if err := enc.Encode(usage); err != nil {
+			return nil, nil, err
+		}
+		records++
+	}
+	if err = rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	manifest := &ArchiveManifest{
+		FormatVersion: archiveFormatVersion,
+		CreatedAt:     time.Now().UTC(),
+		Files: []ArchiveFile{{
+			Name:    archiveTokenUsageName,
+			Size:    int64(data.Len()),
+			Records: records,
+			SHA256:  sha256Hex(data.Bytes()),
+		}},
+	}
+	return manifest, []archiveEntry{{archiveTokenUsageName, data.Bytes()}}, nil
+}
+
+// writeArchive writes the manifest followed by the data files as a gzipped tar
+func writeArchive(w io.Writer, manifest *ArchiveManifest, entries []archiveEntry) error {
+	manifestBytes, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	for _, f := range append([]archiveEntry{{archiveManifestName, manifestBytes}}, entries...) {
+		hdr := &tar.Header{Name: f.name, Mode: 0644, Size: int64(len(f.body)), ModTime: manifest.CreatedAt}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(f.body); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+func archiveFilename(manifest *ArchiveManifest) string {
+	return fmt.Sprintf("tokencounter-%s.tar.gz", manifest.CreatedAt.Format("20060102-150405"))
+}
+
+// exportArchive streams a gzipped tar containing a manifest and one JSONL file per table
+func exportArchive(w http.ResponseWriter, r *http.Request) {
+	manifest, entries, err := buildArchive(r.Context())
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to build archive", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", archiveFilename(manifest)))
+	w.WriteHeader(http.StatusOK)
+	if err := writeArchive(w, manifest, entries); err != nil {
+		log.Printf("Failed to write archive: %v", err)
+		return
+	}
+	infof("Exported %d token usage records\n", manifest.Files[0].Records)
+}
+
+// exportArchiveJob writes an archive into EXPORT_DIR; it backs the scheduled "export" job
+func exportArchiveJob(ctx context.Context) error {
+	dir := os.Getenv("EXPORT_DIR")
+	if dir == "" {
+		return fmt.Errorf("EXPORT_DIR is not set")
+	}
+	manifest, entries, err := buildArchive(ctx)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	path := filepath.Join(dir, archiveFilename(manifest))
+	f, err := os.CreateTemp(dir, ".export-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := writeArchive(f, manifest, entries); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return err
+	}
+	infof("Exported %d token usage records to %s\n", manifest.Files[0].Records, path)
+	return nil
+}
+
+// readArchive unpacks an archive and verifies its manifest version and file checksums
+func readArchive(r io.Reader) (*ArchiveManifest, map[string][]byte, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, nil, fmt.Errorf("not a gzip archive: %w", err)
+	}
+	defer gz.Close()
+
+	files := make(map[string][]byte)
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("corrupt archive: %w", err)
+		}
+		if hdr.Size > maxArchiveEntry {
+			return nil, nil, fmt.Errorf("archive entry %s is %d bytes, more than the %d allowed", hdr.Name, hdr.Size, maxArchiveEntry)
+		}
+		body, err := io.ReadAll(io.LimitReader(tr, maxArchiveEntry+1))
+		if err != nil {
+			return nil, nil, fmt.Errorf("corrupt archive entry %s: %w", hdr.Name, err)
+		}
+		if len(body) > maxArchiveEntry {
+			return nil, nil, fmt.Errorf("archive entry %s is more than the %d bytes allowed", hdr.Name, maxArchiveEntry)
+		}
+		files[hdr.Name] = body
+	}
+
+	manifestBytes, ok := files[archiveManifestName]
+	if !ok {
+		return nil, nil, fmt.Errorf("archive has no %s", archiveManifestName)
+	}
+	var manifest ArchiveManifest
+	if err := json.Unmarshal(manifestBytes, &manifest); err != nil {
+		return nil, nil, fmt.Errorf("invalid manifest: %w", err)
+	}
+	if manifest.FormatVersion < 1 || manifest.FormatVersion > archiveFormatVersion {
+		return nil, nil, fmt.Errorf("unsupported archive format version %d (supported up to %d)", manifest.FormatVersion, archiveFormatVersion)
+	}
+	for _, f := range manifest.Files {
+		body, ok := files[f.Name]
+		if !ok {
+			return nil, nil, fmt.Errorf("archive is missing %s", f.Name)
+		}
+		if got := sha256Hex(body); got != f.SHA256 {
+			return nil, nil, fmt.Errorf("checksum mismatch for %s: expected %s, got %s", f.Name, f.SHA256, got)
+		}
+	}
+	return &manifest, files, nil
+}
+
+// importArchive restores records from an export archive, replacing totals for matching date, model and project
+func importArchive(w http.ResponseWriter, r *http.Request) {
+	manifest, files, err := readArchive(http.MaxBytesReader(w, r.Body, maxImportBody))
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid archive", err)
+		return
+	}
+
+	var usages []TokenUsage
+	scanner := bufio.NewScanner(bytes.NewReader(files[archiveTokenUsageName]))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var usage TokenUsage
+		if err := json.Unmarshal(scanner.Bytes(), &usage); err != nil {
+			respondError(w, http.StatusBadRequest, "Invalid archive record", err)
+			return
+		}
+		usages = append(usages, usage)
+	}
+	if err := scanner.Err(); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid archive record", err)
+		return
+	}
+
+	if isDryRun(r) {
+		respondJSON(w, http.StatusOK, map[string]interface{}{
+			"dry_run":        true,
+			"message":        "Archive is valid",
+			"format_version": manifest.FormatVersion,
+			"records":        len(usages),
+		})
+		return
+	}
+
+	// Partitions are created up front: creating one inside the transaction would wait on
+	// the transaction's own lock on token_usage
+	for _, usage := range usages {
+		if err := ensurePartition(r.Context(), usage.Date); err != nil {
+			respondError(w, http.StatusInternalServerError, "Failed to create partition", err)
+			return
+		}
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to start transaction", err)
+		return
+	}
+	defer tx.Rollback()
+	for _, usage := range usages {
+		res, err := tx.ExecContext(r.Context(), `UPDATE token_usage SET total_tokens = $1, cost = $2, requests = $6, characters = $7, credits = $8,
+            provider = $9, prompt_tokens = $10, completion_tokens = $11 WHERE date = $3 AND model = $4 AND project = $5`,
+			usage.TotalTokens, usage.Cost, usage.Date, usage.Model, usage.Project, usage.Requests, usage.Characters, usage.Credits,
+			usage.Provider, usage.PromptTokens, usage.CompletionTokens)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, "Failed to restore token usage", err)
+			return
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			continue
+		}
+		if _, err := tx.ExecContext(r.Context(), `INSERT INTO token_usage (date, model, project, total_tokens, cost, requests, characters, credits, provider, prompt_tokens, completion_tokens)
+            VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`,
+			usage.Date, usage.Model, usage.Project, usage.TotalTokens, usage.Cost, usage.Requests, usage.Characters, usage.Credits,
+			usage.Provider, usage.PromptTokens, usage.CompletionTokens); err != nil {
+			respondError(w, http.StatusInternalServerError, "Failed to restore token usage", err)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to commit restore", err)
+		return
+	}
+	infof("Imported %d token usage records from archive format v%d\n", len(usages), manifest.FormatVersion)
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"message":        "Archive restored successfully",
+		"format_version": manifest.FormatVersion,
+		"records":        len(usages),
+	})
+}
@@ -0,0 +1,71 @@
+// arrow.go
+package main
+
+import (
+	"io"
+
+	"github.com/apache/arrow-go/v18/arrow"
+	"github.com/apache/arrow-go/v18/arrow/array"
+	"github.com/apache/arrow-go/v18/arrow/ipc"
+	"github.com/apache/arrow-go/v18/arrow/memory"
+)
+
+// Tables are handed to pyarrow, polars or DuckDB as Arrow IPC streams
+// (https://arrow.apache.org/docs/format/Columnar.html), written with the Arrow Go library: the
+// schema, then record batches of up to arrowBatchRows rows, each built column by column and
+// written once full so a long table is never held in memory whole.
+
+const arrowStreamType = "application/vnd.apache.arrow.stream"
+
+// arrowBatchRows is the number of rows per record batch
+const arrowBatchRows = 65536
+
+// arrowStreamWriter writes an Arrow IPC stream of one schema. Rows are appended to the
+// columns of builder, then counted with endRow.
+type arrowStreamWriter struct {
+	w       *ipc.Writer
+	builder *array.RecordBuilder
+	rows    int
+}
+
+func newArrowStreamWriter(w io.Writer, schema *arrow.Schema) *arrowStreamWriter {
+	return &arrowStreamWriter{
+		w:       ipc.NewWriter(w, ipc.WithSchema(schema)),
+		builder: array.NewRecordBuilder(memory.DefaultAllocator, schema),
+	}
+}
+
+// endRow counts a row appended to the columns, writing the batch once it is full; it reports
+// whether it did
+func (a *arrowStreamWriter) endRow() (bool, error) {
+	a.rows++
+	if a.rows < arrowBatchRows {
+		return false, nil
+	}
+	return true, a.writeBatch()
+}
+
+// writeBatch writes the rows appended since the last batch, if any
+func (a *arrowStreamWriter) writeBatch() error {
+	if a.rows == 0 {
+		return nil
+	}
+	record := a.builder.NewRecord()
+	defer record.Release()
+	a.rows = 0
+	return a.w.Write(record)
+}
+
+// close writes the last batch and ends the stream, with the schema alone if there were no rows
+func (a *arrowStreamWriter) close() error {
+	if err := a.writeBatch(); err != nil {
+		return err
+	}
+	return a.w.Close()
+}
+
+// release frees the columns; a stream cut short by an error is released without close, so
+// readers see it end early rather than complete
+func (a *arrowStreamWriter) release() {
+	a.builder.Release()
+}
@@ -0,0 +1,436 @@
+// ask.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// POST /ask answers questions about usage in plain English, such as "how many tokens did
+// claude models use last week compared to the week before". A small grammar turns the question
+// into an AskQuery: what to measure, which models and project, the period, an optional
+// comparison with the period before, and an optional grouping. Questions the grammar can't
+// place can be handed to a model through an upstream configured in the "ask" config section.
+
+// AskConfig sets up model-assisted interpretation for POST /ask
+type AskConfig struct {
+	// Upstream names an OpenAI-compatible (openrouter provider) upstream; empty disables it
+	Upstream string `json:"upstream"`
+	Model    string `json:"model"`
+}
+
+// AskQuery is what a question was understood to ask. Models are globs, as in reports.
+type AskQuery struct {
+	Measure      string   `json:"measure"`
+	Models       []string `json:"models"`
+	Project      string   `json:"project,omitempty"`
+	Start        string   `json:"start"`
+	End          string   `json:"end"`
+	CompareStart string   `json:"compare_start,omitempty"`
+	CompareEnd   string   `json:"compare_end,omitempty"`
+	GroupBy      string   `json:"group_by,omitempty"`
+}
+
+// AskPeriod is the answer for one period of a query
+type AskPeriod struct {
+	Start string  `json:"start"`
+	End   string  `json:"end"`
+	Value float64 `json:"value"`
+	// Groups break Value down when the query has a grouping
+	Groups map[string]float64 `json:"groups,omitempty"`
+}
+
+// askMeasures maps measures to their aggregate over token_usage u joined to its price
+var askMeasures = map[string]string{
+	"tokens":   "SUM(u.total_tokens)::DOUBLE PRECISION",
+	"cost":     "SUM(" + usageCostMicrosExpr + ")::DOUBLE PRECISION",
+	"requests": "SUM(u.requests)::DOUBLE PRECISION",
+}
+
+// askGroups maps groupings to their column
+var askGroups = map[string]string{
+	"model":   "u.model",
+	"project": "u.project",
+	"day":     "to_char(u.date, 'YYYY-MM-DD')",
+}
+
+var (
+	askLastDays = regexp.MustCompile(`\b(?:last|past|previous)\s+(\d+)\s+days?\b`)
+	askGroupBy  = regexp.MustCompile(`\b(?:by|per|each)\s+(model|project|day)s?\b`)
+	askProject  = regexp.MustCompile(`\bproject\s+["']?([\w.-]+)`)
+	askCompare  = regexp.MustCompile(`\b(?:compared?|vs\.?|versus|than|before|previous|prior)\b`)
+	askWord     = regexp.MustCompile(`[a-z0-9][a-z0-9.:_-]*[a-z0-9]|[a-z0-9]`)
+)
+
+// askStopWords are never taken for model names
+var askStopWords = map[string]bool{
+	"how": true, "many": true, "much": true, "what": true, "was": true, "were": true, "did": true, "does": true,
+	"the": true, "a": true, "an": true, "and": true, "or": true, "of": true, "in": true, "on": true, "for": true,
+	"to": true, "by": true, "per": true, "use": true, "used": true, "using": true, "spend": true, "spent": true,
+	"cost": true, "costs": true, "tokens": true, "token": true, "requests": true, "request": true, "calls": true,
+	"model": true, "models": true, "project": true, "projects": true, "day": true, "days": true, "week": true,
+	"month": true, "today": true, "yesterday": true, "this": true, "last": true, "past": true, "previous": true,
+	"compared": true, "compare": true, "with": true, "vs": true, "versus": true, "than": true, "before": true,
+	"all": true, "total": true, "we": true, "i": true, "our": true, "my": true, "is": true, "it": true,
+}
+
+// parseAskQuestion interprets a question with the grammar. understood is false when it
+// recognized nothing but defaults, so the question may be better put to a model.
+func parseAskQuestion(question string, knownModels []string, today time.Time) (AskQuery, bool) {
+	text := strings.ToLower(question)
+	q := AskQuery{Measure: "tokens", Models: []string{}}
+	understood := false
+
+	switch {
+	case strings.Contains(text, "cost") || strings.Contains(text, "spen") || strings.Contains(text, "$") ||
+		strings.Contains(text, "dollar") || strings.Contains(text, "usd"):
+		q.Measure, understood = "cost", true
+	case strings.Contains(text, "request") || strings.Contains(text, "calls"):
+		q.Measure, understood = "requests", true
+	case strings.Contains(text, "token"):
+		understood = true
+	}
+
+	if m := askGroupBy.FindStringSubmatch(text); m != nil {
+		q.GroupBy, understood = m[1], true
+		text = strings.Replace(text, m[0], " ", 1)
+	}
+	if m := askProject.FindStringSubmatch(text); m != nil {
+		q.Project, understood = m[1], true
+		text = strings.Replace(text, m[0], " ", 1)
+	}
+
+	// The period decides the comparison period too: the one before, of the same kind
+	start, end, prevStart, prevEnd, phrase := askPeriod(text, today)
+	if phrase != "" {
+		understood = true
+		text = strings.Replace(text, phrase, " ", 1)
+	}
+	q.Start, q.End = start.Format("2006-01-02"), end.Format("2006-01-02")
+	// With the period itself removed, what is left of "last week compared to the week
+	// before" still says to compare
+	if askCompare.MatchString(text) {
+		q.CompareStart, q.CompareEnd = prevStart.Format("2006-01-02"), prevEnd.Format("2006-01-02")
+	}
+
+	for _, word := range askWord.FindAllString(text, -1) {
+		if len(word) < 2 || askStopWords[word] || strings.HasSuffix(word, "s") && askStopWords[strings.TrimSuffix(word, "s")] {
+			continue
+		}
+		if glob := askModelGlob(word, knownModels); glob != "" {
+			q.Models = append(q.Models, glob)
+			understood = true
+		}
+	}
+	return q, understood
+}
+
+// askPeriod finds the period a question asks about, this month by default, and the period
+// before it of the same kind. phrase is the text that named the period, if any.
+func askPeriod(text string, today time.Time) (start, end, prevStart, prevEnd time.Time, phrase string) {
+	monthStart, _ := periodStart("month", today)
+	weekStart, _ := periodStart("week", today)
+	if m := askLastDays.FindStringSubmatch(text); m != nil {
+		n, _ := strconv.Atoi(m[1])
+		if n < 1 {
+			n = 1
+		}
+		start = today.AddDate(0, 0, -n+1)
+		return start, today, start.AddDate(0, 0, -n), start.AddDate(0, 0, -1), m[0]
+	}
+	for _, p := range []string{"yesterday", "today", "last week", "previous week", "past week", "this week", "last month", "previous month", "past month", "this month"} {
+		if !strings.Contains(text, p) {
+			continue
+		}
+		switch p {
+		case "yesterday":
+			start = today.AddDate(0, 0, -1)
+			return start, start, start.AddDate(0, 0, -1), start.AddDate(0, 0, -1), p
+		case "today":
+			return today, today, today.AddDate(0, 0, -1), today.AddDate(0, 0, -1), p
+		case "this week":
+			return weekStart, today, weekStart.AddDate(0, 0, -7), weekStart.AddDate(0, 0, -1), p
+		case "this month":
+			return monthStart, today, monthStart.AddDate(0, -1, 0), monthStart.AddDate(0, 0, -1), p
+		}
+		if strings.HasSuffix(p, "week") {
+			start = weekStart.AddDate(0, 0, -7)
+			return start, weekStart.AddDate(0, 0, -1), start.AddDate(0, 0, -7), start.AddDate(0, 0, -1), p
+		}
+		start = monthStart.AddDate(0, -1, 0)
+		return start, monthStart.AddDate(0, 0, -1), start.AddDate(0, -1, 0), start.AddDate(0, 0, -1), p
+	}
+	return monthStart, today, monthStart.AddDate(0, -1, 0), monthStart.AddDate(0, 0, -1), ""
+}
+
+// askModelGlob matches a word of a question to the models seen in usage: a model name as
+// is, or a prefix of some, such as a family ("claude") or a plural of one ("gpts")
+func askModelGlob(word string, knownModels []string) string {
+	for _, candidate := range []string{word, strings.TrimSuffix(word, "s")} {
+		if candidate == "" {
+			continue
+		}
+		prefixed := false
+		for _, m := range knownModels {
+			if strings.ToLower(m) == candidate {
+				return m
+			}
+			if strings.HasPrefix(strings.ToLower(m), candidate) {
+				prefixed = true
+			}
+		}
+		if prefixed {
+			return candidate + "*"
+		}
+	}
+	return ""
+}
+
+// validate checks a query, which may have come from a model, before it is run
+func (q *AskQuery) validate() error {
+	if _, ok := askMeasures[q.Measure]; !ok {
+		return fmt.Errorf("unknown measure %q", q.Measure)
+	}
+	if q.GroupBy != "" {
+		if _, ok := askGroups[q.GroupBy]; !ok {
+			return fmt.Errorf("unknown group_by %q", q.GroupBy)
+		}
+	}
+	if q.Models == nil {
+		q.Models = []string{}
+	}
+	if err := validateAskRange(q.Start, q.End); err != nil {
+		return err
+	}
+	if q.CompareStart == "" && q.CompareEnd == "" {
+		return nil
+	}
+	return validateAskRange(q.CompareStart, q.CompareEnd)
+}
+
+func validateAskRange(startStr, endStr string) error {
+	start, err := time.Parse("2006-01-02", startStr)
+	if err != nil {
+		return fmt.Errorf("invalid date %q", startStr)
+	}
+	end, err := time.Parse("2006-01-02", endStr)
+	if err != nil {
+		return fmt.Errorf("invalid date %q", endStr)
+	}
+	if end.Before(start) {
+		return fmt.Errorf("end date is before start date")
+	}
+	return nil
+}
+
+// runAskPeriod answers a query for one period
+func runAskPeriod(ctx context.Context, q AskQuery, start, end string) (AskPeriod, error) {
+	p := AskPeriod{Start: start, End: end}
+	likes := make([]string, len(q.Models))
+	for i, m := range q.Models {
+		likes[i] = globToLike(m)
+	}
+	// The measure and group come from askMeasures and askGroups, never from the question
+	group := "''"
+	if q.GroupBy != "" {
+		group = askGroups[q.GroupBy]
+		p.Groups = map[string]float64{}
+	}
+	rows, err := db.QueryContext(ctx, "SELECT "+group+", COALESCE("+askMeasures[q.Measure]+`, 0)
+        FROM token_usage u `+usagePriceJoin+`
+        WHERE u.date >= $1 AND u.date <= $2
+            AND (cardinality($3::TEXT[]) = 0 OR u.model ILIKE ANY($3))
+            AND ($4 = '' OR u.project = $4)
+        GROUP BY 1 ORDER BY 1`, start, end, pq.Array(likes), q.Project)
+	if err != nil {
+		return p, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key string
+		var value float64
+		if err := rows.Scan(&key, &value); err != nil {
+			return p, err
+		}
+		p.Value += value
+		if p.Groups != nil {
+			p.Groups[key] = value
+		}
+	}
+	// Costs are summed in micro-dollars, exactly, then converted
+	if q.Measure == "cost" {
+		p.Value = costFromMicros(int64(p.Value))
+		for key, value := range p.Groups {
+			p.Groups[key] = costFromMicros(int64(value))
+		}
+	}
+	return p, rows.Err()
+}
+
+// askModel has the configured upstream translate a question into an AskQuery
+func askModel(ctx context.Context, cfg AskConfig, question string, today time.Time) (AskQuery, error) {
+	var q AskQuery
+	target, err := resolveUpstream(ctx, cfg.Upstream)
+	if err != nil {
+		return q, err
+	}
+	if target.provider.baseURLEnv != proxyProviders["openrouter"].baseURLEnv {
+		return q, fmt.Errorf("upstream %s is not OpenAI-compatible", cfg.Upstream)
+	}
+	prompt := `Translate the question about LLM usage into JSON with these fields and nothing else:
+measure ("tokens", "cost" or "requests"), models (array of model name globs, e.g. "claude*"; empty for all),
+project (string, empty for all), start and end (YYYY-MM-DD, inclusive), compare_start and compare_end
+(YYYY-MM-DD, only when the question compares with another period), group_by ("model", "project", "day" or empty).
+Weeks start on Sunday. Today is ` + today.Format("Monday 2006-01-02") + "."
+	body, err := json.Marshal(map[string]interface{}{
+		"model": cfg.Model,
+		"messages": []map[string]string{
+			{"role": "system", "content": prompt},
+			{"role": "user", "content": question},
+		},
+		"response_format": map[string]string{"type": "json_object"},
+	})
+	if err != nil {
+		return q, err
+	}
+	path := "/api/v1/chat/completions"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(target.baseURL.String(), "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return q, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if target.apiKey != "" {
+		target.provider.setAPIKey(req.Header, target.apiKey)
+	}
+	resp, err := (&http.Client{Timeout: target.timeout}).Do(req)
+	if err != nil {
+		return q, err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, maxCapturedBody))
+	if err != nil {
+		return q, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return q, fmt.Errorf("upstream %s returned %s", cfg.Upstream, resp.Status)
+	}
+	if usage, ok := target.provider.extractUsage(path, respBody); ok {
+		caller := proxyCaller{feature: "ask"}
+		caller.project, _ = projectScope(ctx)
+		recordProxyUsage(ctx, target.name, usage, caller)
+	}
+	var completion struct {
+		Choices []struct {
+			Message struct {
+				Content string `json:"content"`
+			} `json:"message"`
+		} `json:"choices"`
+	}
+	if err := json.Unmarshal(respBody, &completion); err != nil || len(completion.Choices) == 0 {
+		return q, fmt.Errorf("upstream %s returned no answer", cfg.Upstream)
+	}
+	content := strings.TrimSpace(completion.Choices[0].Message.Content)
+	content = strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(content, "```json"), "```"), "```")
+	if err := json.Unmarshal([]byte(content), &q); err != nil {
+		return q, fmt.Errorf("upstream %s answered with something other than a query: %w", cfg.Upstream, err)
+	}
+	return q, nil
+}
+
+// ask answers POST /ask {"question": ..., "use_model": false}. The grammar is used unless
+// use_model is set or it understood nothing of the question, and a model is configured.
+func ask(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Question string `json:"question"`
+		UseModel bool   `json:"use_model"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request payload", err)
+		return
+	}
+	if strings.TrimSpace(req.Question) == "" {
+		respondJSON(w, http.StatusBadRequest, map[string]string{"message": "question is required"})
+		return
+	}
+	today := time.Now().Truncate(24 * time.Hour)
+	knownModels, err := distinctModels(r.Context())
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database query error", err)
+		return
+	}
+	q, understood := parseAskQuestion(req.Question, knownModels, today)
+	interpretedBy := "grammar"
+	cfg := currentConfig.Load().Ask
+	if req.UseModel && cfg.Upstream == "" {
+		respondJSON(w, http.StatusBadRequest, map[string]string{"message": "use_model needs an upstream in the ask config"})
+		return
+	}
+	if cfg.Upstream != "" && (req.UseModel || !understood) {
+		mq, err := askModel(r.Context(), cfg, req.Question, today)
+		if err == nil {
+			err = mq.validate()
+		}
+		if err != nil {
+			respondError(w, http.StatusBadGateway, "Failed to interpret the question", err)
+			return
+		}
+		q, interpretedBy = mq, "model"
+	}
+
+	current, err := runAskPeriod(r.Context(), q, q.Start, q.End)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database query error", err)
+		return
+	}
+	out := map[string]interface{}{
+		"question":       req.Question,
+		"interpreted_by": interpretedBy,
+		"query":          q,
+		"result":         current,
+	}
+	if q.CompareStart != "" {
+		previous, err := runAskPeriod(r.Context(), q, q.CompareStart, q.CompareEnd)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, "Database query error", err)
+			return
+		}
+		out["comparison"] = previous
+		change := current.Value - previous.Value
+		if q.Measure == "cost" {
+			change = roundCost(change)
+		}
+		out["change"] = change
+		if previous.Value != 0 {
+			out["change_percent"] = (current.Value - previous.Value) / previous.Value * 100
+		}
+	}
+	respondJSON(w, http.StatusOK, out)
+}
+
+// distinctModels lists every model with recorded usage
+func distinctModels(ctx context.Context) ([]string, error) {
+	rows, err := db.QueryContext(ctx, "SELECT DISTINCT model FROM token_usage")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var models []string
+	for rows.Next() {
+		var m string
+		if err := rows.Scan(&m); err != nil {
+			return nil, err
+		}
+		models = append(models, m)
+	}
+	return models, rows.Err()
+}
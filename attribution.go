@@ -0,0 +1,113 @@
+// attribution.go
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// proxyCaller is who a proxied request is billed to, from the X-TokenCounter-Project (or -Key),
+// -Feature and -User headers, and the conversation it is part of, from -Conversation
+type proxyCaller struct {
+	project, feature, user, conversation string
+}
+
+// recordAttribution adds proxied usage to the per-feature and per-user totals. Like upstream
+// usage it is a side table, so usage records keep their one row per day, model and project.
+func recordAttribution(ctx context.Context, caller proxyCaller, date time.Time, usage proxyUsage) error {
+	_, err := db.ExecContext(ctx, `INSERT INTO usage_attribution (date, model, project, feature, end_user, requests, total_tokens, cost)
+        VALUES ($1, $2, $3, $4, $5, 1, $6, $7)
+        ON CONFLICT (date, model, project, feature, end_user) DO UPDATE SET requests = usage_attribution.requests + 1,
+            total_tokens = usage_attribution.total_tokens + EXCLUDED.total_tokens,
+            cost = CASE WHEN EXCLUDED.cost IS NULL THEN usage_attribution.cost ELSE COALESCE(usage_attribution.cost, 0) + EXCLUDED.cost END`,
+		date, usage.Model, caller.project, caller.feature, caller.user, usage.total(), usage.Cost)
+	return err
+}
+
+// recordConversation adds proxied usage to its conversation's totals, kept per day like the
+// attribution totals
+func recordConversation(ctx context.Context, caller proxyCaller, date time.Time, usage proxyUsage) error {
+	_, err := db.ExecContext(ctx, `INSERT INTO usage_conversations (date, model, project, conversation_id, requests, total_tokens, cost)
+        VALUES ($1, $2, $3, $4, 1, $5, $6)
+        ON CONFLICT (date, model, project, conversation_id) DO UPDATE SET requests = usage_conversations.requests + 1,
+            total_tokens = usage_conversations.total_tokens + EXCLUDED.total_tokens,
+            cost = CASE WHEN EXCLUDED.cost IS NULL THEN usage_conversations.cost ELSE COALESCE(usage_conversations.cost, 0) + EXCLUDED.cost END`,
+		date, usage.Model, caller.project, caller.conversation, usage.total(), usage.Cost)
+	return err
+}
+
+// attributionDimensions maps ?group_by= values to usage_attribution columns
+var attributionDimensions = map[string]string{
+	"feature": "u.feature",
+	"user":    "u.end_user",
+	"model":   "u.model",
+	"project": "u.project",
+}
+
+// getAttribution splits proxied usage by feature and user, or any of ?group_by=feature,user,
+// model,project, over a date range, costliest first. ?project= narrows it to one project.
+func getAttribution(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	start, end, err := parseDateRange(q, "month")
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid date range", err)
+		return
+	}
+	groupBy := []string{"feature", "user"}
+	if v := q.Get("group_by"); v != "" {
+		groupBy = strings.Split(v, ",")
+	}
+	// Group columns come from attributionDimensions, never from the request
+	var columns []string
+	for _, dim := range groupBy {
+		column, ok := attributionDimensions[dim]
+		if !ok {
+			respondJSON(w, http.StatusBadRequest, map[string]string{"message": "Unknown group_by " + dim + ", use feature, user, model or project"})
+			return
+		}
+		columns = append(columns, column)
+	}
+	cols := strings.Join(columns, ", ")
+	rows, err := db.QueryContext(r.Context(), `
+        SELECT `+cols+`, SUM(u.requests), SUM(u.total_tokens), `+usageCostMicrosSum+`
+        FROM usage_attribution u `+usagePriceJoin+`
+        WHERE u.date >= $1 AND u.date <= $2 AND ($3 = '' OR u.project = $3)
+        GROUP BY `+cols+` ORDER BY `+fmt.Sprint(len(columns)+3)+` DESC`, start, end, q.Get("project"))
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database query error", err)
+		return
+	}
+	defer rows.Close()
+	out := []map[string]interface{}{}
+	for rows.Next() {
+		keys := make([]string, len(groupBy))
+		var requests, tokens, cost int64
+		dest := make([]interface{}, 0, len(keys)+3)
+		for i := range keys {
+			dest = append(dest, &keys[i])
+		}
+		dest = append(dest, &requests, &tokens, &cost)
+		if err := rows.Scan(dest...); err != nil {
+			respondError(w, http.StatusInternalServerError, "Error scanning row", err)
+			return
+		}
+		row := map[string]interface{}{"requests": requests, "total_tokens": tokens, "cost": costFromMicros(cost)}
+		for i, dim := range groupBy {
+			row[dim] = keys[i]
+		}
+		out = append(out, row)
+	}
+	if err = rows.Err(); err != nil {
+		respondError(w, http.StatusInternalServerError, "Error reading data", err)
+		return
+	}
+	annotations, err := annotationsBetween(r.Context(), start, end, "")
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database query error", err)
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{"start": start.Format("2006-01-02"), "end": end.Format("2006-01-02"), "usage": out, "annotations": annotations})
+}
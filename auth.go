@@ -0,0 +1,385 @@
+// auth.go
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Callers are identified by authentication providers, picked and ordered by auth.providers
+// in the config file (AUTH_PROVIDERS). Each request goes through them in turn and the first
+// that recognizes its credentials decides who the caller is, or rejects them as invalid:
+//
+//	static          keys listed in the config file, and ADMIN_TOKEN as an admin key, sent as
+//	                "Authorization: Bearer <key>" or in X-Tokencounter-Key
+//	database        project keys created through the API, sent in X-Tokencounter-Key
+//	jwt             bearer JWTs signed with a key published at a JWKS URL, or found through
+//	                the issuer's OpenID configuration (see jwt.go)
+//	trusted_header  the identity a gateway that already authenticated the caller passes on
+//	                in headers; only requests from the listed proxy addresses are trusted
+//
+// The default, static and database, is how the service authenticated before providers could
+// be configured. A caller with a project is scoped to it (see scope.go); an admin caller may use
+// the admin endpoints.
+
+// AuthConfig configures the authentication providers
+type AuthConfig struct {
+	// Providers lists the providers in the order they are tried; static and database by default
+	Providers     []string                `json:"providers"`
+	StaticKeys    []StaticKey             `json:"static_keys"`
+	JWT           JWTAuthConfig           `json:"jwt"`
+	TrustedHeader TrustedHeaderAuthConfig `json:"trusted_header"`
+}
+
+// StaticKey is a key listed in the config file. A key with a project is scoped to it.
+type StaticKey struct {
+	Name    string `json:"name"`
+	Key     string `json:"key"`
+	Project string `json:"project"`
+	Admin   bool   `json:"admin"`
+}
+
+// TrustedHeaderAuthConfig names the headers a gateway sets for the callers it authenticated
+type TrustedHeaderAuthConfig struct {
+	// TrustedProxies lists the addresses or CIDR ranges of the gateways; the headers of
+	// requests from anywhere else are ignored
+	TrustedProxies []string `json:"trusted_proxies"`
+	// UserHeader carries the caller's name, X-Forwarded-User by default
+	UserHeader string `json:"user_header"`
+	// ProjectHeader, if set, carries the project to scope the caller to
+	ProjectHeader string `json:"project_header"`
+	// GroupsHeader carries the caller's groups separated by commas, X-Forwarded-Groups by
+	// default; members of AdminGroup are admins
+	GroupsHeader string `json:"groups_header"`
+	AdminGroup   string `json:"admin_group"`
+}
+
+const (
+	staticAuth        = "static"
+	databaseAuth      = "database"
+	jwtAuth           = "jwt"
+	trustedHeaderAuth = "trusted_header"
+)
+
+var defaultAuthProviders = []string{staticAuth, databaseAuth}
+
+// authFromEnv reads AUTH_PROVIDERS, JWT_JWKS_URL, JWT_ISSUER, JWT_AUDIENCE and TRUSTED_PROXIES
+func authFromEnv() AuthConfig {
+	c := AuthConfig{JWT: JWTAuthConfig{
+		JWKSURL:  os.Getenv("JWT_JWKS_URL"),
+		Issuer:   os.Getenv("JWT_ISSUER"),
+		Audience: os.Getenv("JWT_AUDIENCE"),
+	}}
+	for _, list := range []struct {
+		env  string
+		dest *[]string
+	}{{"AUTH_PROVIDERS", &c.Providers}, {"TRUSTED_PROXIES", &c.TrustedHeader.TrustedProxies}} {
+		for _, v := range strings.Split(os.Getenv(list.env), ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				*list.dest = append(*list.dest, v)
+			}
+		}
+	}
+	return c
+}
+
+func (c AuthConfig) validate() error {
+	seen := map[string]bool{}
+	for _, name := range c.Providers {
+		if seen[name] {
+			return fmt.Errorf("provider %s is listed twice", name)
+		}
+		seen[name] = true
+		switch name {
+		case staticAuth, databaseAuth:
+		case jwtAuth:
+			if err := c.JWT.validate(); err != nil {
+				return fmt.Errorf("jwt: %w", err)
+			}
+		case trustedHeaderAuth:
+			if len(c.TrustedHeader.TrustedProxies) == 0 {
+				return fmt.Errorf("trusted_header: trusted_proxies is required")
+			}
+			if _, err := parseTrustedProxies(c.TrustedHeader.TrustedProxies); err != nil {
+				return fmt.Errorf("trusted_header: %w", err)
+			}
+		default:
+			return fmt.Errorf("unknown provider %q, use static, database, jwt or trusted_header", name)
+		}
+	}
+	for _, k := range c.StaticKeys {
+		if k.Key == "" {
+			return fmt.Errorf("static key %q has no key", k.Name)
+		}
+	}
+	return nil
+}
+
+// Principal is an authenticated caller
+type Principal struct {
+	// Subject names the caller: a static key's name, a token's subject or a gateway's user
+	Subject string
+	// Project scopes the caller, "" for none
+	Project string
+	Admin   bool
+	// header is where the credentials came from, for Vary
+	header string
+	// key is the project key the database provider matched, for key activity
+	key string
+}
+
+// AuthProvider identifies callers from one kind of credentials
+type AuthProvider interface {
+	// Authenticate returns the caller of r, or nil if r carries no credentials of this
+	// provider's. Credentials it recognizes but rejects give a credentialError.
+	Authenticate(r *http.Request) (*Principal, error)
+	// GrantsAdmin reports whether the provider is set up to authenticate admins
+	GrantsAdmin() bool
+}
+
+// credentialError rejects credentials; its text is returned to the caller
+type credentialError string
+
+func (e credentialError) Error() string {
+	return string(e)
+}
+
+// authProviders builds the configured providers, in order
+func authProviders() []AuthProvider {
+	cfg := currentConfig.Load().Auth
+	names := cfg.Providers
+	if len(names) == 0 {
+		names = defaultAuthProviders
+	}
+	providers := make([]AuthProvider, 0, len(names))
+	for _, name := range names {
+		switch name {
+		case staticAuth:
+			providers = append(providers, staticKeys(cfg.StaticKeys))
+		case databaseAuth:
+			providers = append(providers, projectKeys{})
+		case jwtAuth:
+			providers = append(providers, jwtBearer(cfg.JWT))
+		case trustedHeaderAuth:
+			// Validated on load, so the ranges parse
+			nets, _ := parseTrustedProxies(cfg.TrustedHeader.TrustedProxies)
+			providers = append(providers, trustedHeaders{cfg: cfg.TrustedHeader, proxies: nets})
+		}
+	}
+	return providers
+}
+
+// authenticate identifies the caller of r with the first provider that recognizes its
+// credentials; it returns nil for a request without any
+func authenticate(r *http.Request) (*Principal, error) {
+	for _, p := range authProviders() {
+		principal, err := p.Authenticate(r)
+		if err != nil || principal != nil {
+			return principal, err
+		}
+	}
+	return nil, nil
+}
+
+// respondAuthError answers a failed authentication: 401 for rejected credentials, 500 when
+// they could not be checked
+func respondAuthError(w http.ResponseWriter, err error) {
+	var rejected credentialError
+	if errors.As(err, &rejected) {
+		respondJSON(w, http.StatusUnauthorized, map[string]string{"message": rejected.Error()})
+		return
+	}
+	respondError(w, http.StatusInternalServerError, "Authentication failed", err)
+}
+
+type principalKey struct{}
+
+func withPrincipal(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// requestPrincipal returns the caller scopeByKey authenticated, nil for an anonymous one
+func requestPrincipal(ctx context.Context) *Principal {
+	p, _ := ctx.Value(principalKey{}).(*Principal)
+	return p
+}
+
+// requireAdmin only lets through admin callers. Admin endpoints are disabled entirely while no
+// provider can authenticate an admin, as with the defaults and ADMIN_TOKEN unset.
+func requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		granted := false
+		for _, p := range authProviders() {
+			granted = granted || p.GrantsAdmin()
+		}
+		if !granted {
+			respondJSON(w, http.StatusForbidden, map[string]string{"message": "Admin endpoints are disabled; set ADMIN_TOKEN or configure an admin credential to enable them"})
+			return
+		}
+		p, err := authenticate(r)
+		if err != nil {
+			respondAuthError(w, err)
+			return
+		}
+		if p == nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="tokencounter-admin"`)
+			respondJSON(w, http.StatusUnauthorized, map[string]string{"message": "Admin authorization required"})
+			return
+		}
+		if !p.Admin {
+			respondJSON(w, http.StatusForbidden, map[string]string{"message": "Admin authorization required"})
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(withPrincipal(r.Context(), p)))
+	})
+}
+
+// bearerToken returns the token of an "Authorization: Bearer" header
+func bearerToken(r *http.Request) (string, bool) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return token, ok && token != ""
+}
+
+// staticKeys authenticates the keys in the config file and ADMIN_TOKEN
+type staticKeys []StaticKey
+
+func (s staticKeys) keys() []StaticKey {
+	if token := os.Getenv("ADMIN_TOKEN"); token != "" {
+		return append([]StaticKey{{Name: "admin", Key: token, Admin: true}}, s...)
+	}
+	return s
+}
+
+func (s staticKeys) Authenticate(r *http.Request) (*Principal, error) {
+	given, header := r.Header.Get(projectKeyHeader), projectKeyHeader
+	if token, ok := bearerToken(r); ok {
+		given, header = token, "Authorization"
+	}
+	if given == "" {
+		return nil, nil
+	}
+	// Every key is compared, so the time taken says nothing about which one matched
+	var match *StaticKey
+	keys := s.keys()
+	for i := range keys {
+		if subtle.ConstantTimeCompare([]byte(given), []byte(keys[i].Key)) == 1 && match == nil {
+			match = &keys[i]
+		}
+	}
+	if match == nil {
+		return nil, nil
+	}
+	return &Principal{Subject: match.Name, Project: match.Project, Admin: match.Admin, header: header}, nil
+}
+
+func (s staticKeys) GrantsAdmin() bool {
+	for _, k := range s.keys() {
+		if k.Admin {
+			return true
+		}
+	}
+	return false
+}
+
+// projectKeys authenticates the project keys stored in the database
+type projectKeys struct{}
+
+func (projectKeys) Authenticate(r *http.Request) (*Principal, error) {
+	key := r.Header.Get(projectKeyHeader)
+	if key == "" {
+		return nil, nil
+	}
+	project, ok, err := resolveProjectKey(key)
+	if err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, credentialError("Unknown project key")
+	}
+	return &Principal{Subject: project, Project: project, header: projectKeyHeader, key: key}, nil
+}
+
+func (projectKeys) GrantsAdmin() bool {
+	return false
+}
+
+// trustedHeaders authenticates the callers a gateway passes on
+type trustedHeaders struct {
+	cfg     TrustedHeaderAuthConfig
+	proxies []*net.IPNet
+}
+
+func parseTrustedProxies(list []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(list))
+	for _, v := range list {
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid proxy address %q", v)
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy range %q", v)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func (t trustedHeaders) header(name, fallback string) string {
+	if name == "" {
+		return fallback
+	}
+	return name
+}
+
+func (t trustedHeaders) trusted(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return t.trustedIP(host)
+}
+
+func (t trustedHeaders) trustedIP(host string) bool {
+	ip := net.ParseIP(host)
+	for _, n := range t.proxies {
+		if ip != nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t trustedHeaders) Authenticate(r *http.Request) (*Principal, error) {
+	userHeader := t.header(t.cfg.UserHeader, "X-Forwarded-User")
+	user := r.Header.Get(userHeader)
+	if user == "" || !t.trusted(r) {
+		return nil, nil
+	}
+	p := &Principal{Subject: user, header: userHeader}
+	if t.cfg.ProjectHeader != "" {
+		p.Project = r.Header.Get(t.cfg.ProjectHeader)
+		p.header += ", " + t.cfg.ProjectHeader
+	}
+	if t.cfg.AdminGroup != "" {
+		for _, g := range strings.Split(r.Header.Get(t.header(t.cfg.GroupsHeader, "X-Forwarded-Groups")), ",") {
+			if strings.TrimSpace(g) == t.cfg.AdminGroup {
+				p.Admin = true
+			}
+		}
+	}
+	return p, nil
+}
+
+func (t trustedHeaders) GrantsAdmin() bool {
+	return t.cfg.AdminGroup != ""
+}
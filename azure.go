@@ -0,0 +1,86 @@
+// azure.go
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// AzureDeployment maps an Azure OpenAI deployment name to the model it serves
+type AzureDeployment struct {
+	Deployment string `json:"deployment"`
+	Model      string `json:"model"`
+}
+
+// resolveAzureDeployment returns the model behind a deployment name; ok is false if none is mapped
+func resolveAzureDeployment(deployment string) (string, bool, error) {
+	var model string
+	err := db.QueryRow("SELECT model FROM azure_deployments WHERE deployment = $1", deployment).Scan(&model)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return model, true, nil
+}
+
+func getAzureDeployments(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.QueryContext(r.Context(), "SELECT deployment, model FROM azure_deployments ORDER BY deployment")
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database query error", err)
+		return
+	}
+	defer rows.Close()
+	deployments := []AzureDeployment{}
+	for rows.Next() {
+		var d AzureDeployment
+		if err := rows.Scan(&d.Deployment, &d.Model); err != nil {
+			respondError(w, http.StatusInternalServerError, "Error scanning row", err)
+			return
+		}
+		deployments = append(deployments, d)
+	}
+	if err = rows.Err(); err != nil {
+		respondError(w, http.StatusInternalServerError, "Error reading data", err)
+		return
+	}
+	respondJSON(w, http.StatusOK, deployments)
+}
+
+func putAzureDeployment(w http.ResponseWriter, r *http.Request) {
+	var d AzureDeployment
+	if err := json.NewDecoder(r.Body).Decode(&d); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request payload", err)
+		return
+	}
+	d.Deployment = mux.Vars(r)["deployment"]
+	if d.Model == "" {
+		respondJSON(w, http.StatusBadRequest, map[string]string{"message": "model is required"})
+		return
+	}
+	_, err := db.ExecContext(r.Context(), `INSERT INTO azure_deployments (deployment, model) VALUES ($1, $2)
+        ON CONFLICT (deployment) DO UPDATE SET model = EXCLUDED.model`, d.Deployment, d.Model)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to save deployment mapping", err)
+		return
+	}
+	infof("Mapped Azure deployment %s to %s\n", d.Deployment, d.Model)
+	respondJSON(w, http.StatusOK, d)
+}
+
+func deleteAzureDeployment(w http.ResponseWriter, r *http.Request) {
+	res, err := db.ExecContext(r.Context(), "DELETE FROM azure_deployments WHERE deployment = $1", mux.Vars(r)["deployment"])
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to delete deployment mapping", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		respondJSON(w, http.StatusNotFound, map[string]string{"message": "Deployment not found"})
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]string{"message": "Deployment mapping deleted successfully"})
+}
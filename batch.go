@@ -0,0 +1,214 @@
+// batch.go
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Under sustained per-request ingestion every increment costs a transaction of several round
+// trips. With write_batching enabled, increments are instead held for up to max_delay_ms and
+// written together, max_records at a time, by a single statement; each caller still waits for
+// its batch, so it sees the write's outcome as before. A batch succeeds or fails as a whole.
+
+// WriteBatchConfig configures batching of increments. It is off by default; MaxDelayMs
+// defaults to 50 and MaxRecords to 100.
+type WriteBatchConfig struct {
+	Enabled    bool `json:"enabled"`
+	MaxDelayMs int  `json:"max_delay_ms"`
+	MaxRecords int  `json:"max_records"`
+}
+
+const (
+	defaultBatchDelay   = 50 * time.Millisecond
+	defaultBatchRecords = 100
+)
+
+func (c WriteBatchConfig) validate() error {
+	if c.MaxDelayMs < 0 || c.MaxRecords < 0 {
+		return fmt.Errorf("max_delay_ms and max_records must not be negative")
+	}
+	return nil
+}
+
+func (c WriteBatchConfig) delay() time.Duration {
+	if c.MaxDelayMs == 0 {
+		return defaultBatchDelay
+	}
+	return time.Duration(c.MaxDelayMs) * time.Millisecond
+}
+
+func (c WriteBatchConfig) maxRecords() int {
+	if c.MaxRecords == 0 {
+		return defaultBatchRecords
+	}
+	return c.MaxRecords
+}
+
+// writeBatchingFromEnv reads WRITE_BATCHING, WRITE_BATCH_DELAY_MS and WRITE_BATCH_SIZE
+func writeBatchingFromEnv() WriteBatchConfig {
+	c := WriteBatchConfig{Enabled: os.Getenv("WRITE_BATCHING") == "true"}
+	c.MaxDelayMs, _ = strconv.Atoi(os.Getenv("WRITE_BATCH_DELAY_MS"))
+	c.MaxRecords, _ = strconv.Atoi(os.Getenv("WRITE_BATCH_SIZE"))
+	return c
+}
+
+// batchedAdd is an increment waiting for its batch
+type batchedAdd struct {
+	usage TokenUsage
+	done  chan error
+}
+
+type writeBatcher struct {
+	mu      sync.Mutex
+	pending []batchedAdd
+	timer   *time.Timer
+}
+
+var writeBatches = &writeBatcher{}
+
+// add queues an increment and waits until its batch is written
+func (b *writeBatcher) add(usage TokenUsage) error {
+	cfg := currentConfig.Load().WriteBatching
+	done := make(chan error, 1)
+	liveUsage.addIncrement(usage)
+	b.mu.Lock()
+	b.pending = append(b.pending, batchedAdd{usage: usage, done: done})
+	if len(b.pending) >= cfg.maxRecords() {
+		batch := b.take()
+		b.mu.Unlock()
+		b.write(batch)
+	} else {
+		if b.timer == nil {
+			b.timer = time.AfterFunc(cfg.delay(), b.flush)
+		}
+		b.mu.Unlock()
+	}
+	return <-done
+}
+
+// take removes the pending increments; the caller holds b.mu
+func (b *writeBatcher) take() []batchedAdd {
+	batch := b.pending
+	b.pending = nil
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	return batch
+}
+
+func (b *writeBatcher) flush() {
+	b.mu.Lock()
+	batch := b.take()
+	b.mu.Unlock()
+	if len(batch) > 0 {
+		b.write(batch)
+	}
+}
+
+func (b *writeBatcher) write(batch []batchedAdd) {
+	usages := make([]TokenUsage, len(batch))
+	for i, add := range batch {
+		usages[i] = add.usage
+	}
+	err := addTokenUsageBatch(context.Background(), usages)
+	for _, add := range batch {
+		liveUsage.incrementFlushed(add.usage)
+		add.done <- err
+	}
+}
+
+// addTokenUsageBatch applies increments as addTokenUsage does, in one statement: it logs each
+// to usage_requests, sums them per date, model and project, adds the sums to the existing rows
+// and inserts rows for the rest, in a single upsert once token_usage has its unique index.
+func addTokenUsageBatch(ctx context.Context, usages []TokenUsage) error {
+	n := len(usages)
+	var (
+		dates                                = make([]string, n)
+		models, projects, providers          = make([]string, n), make([]string, n), make([]string, n)
+		tokens, requests, characters         = make([]int64, n), make([]int64, n), make([]int64, n)
+		prompt, completion                   = make([]int64, n), make([]int64, n)
+		credits                              = make([]float64, n)
+		costs                                = make([]*float64, n)
+		distinctModels, distinctMonths, seen = []string{}, map[string]time.Time{}, map[string]bool{}
+	)
+	for i, u := range usages {
+		dates[i] = u.Date.Format("2006-01-02")
+		models[i], projects[i], providers[i] = u.Model, u.Project, u.Provider
+		tokens[i], requests[i], characters[i], credits[i] = int64(u.TotalTokens), u.Requests, u.Characters, u.Credits
+		prompt[i], completion[i] = int64(u.PromptTokens), int64(u.CompletionTokens)
+		costs[i] = u.Cost
+		if !seen[u.Model] {
+			seen[u.Model] = true
+			distinctModels = append(distinctModels, u.Model)
+		}
+		distinctMonths[u.Date.Format("2006-01")] = u.Date
+	}
+	for month, date := range distinctMonths {
+		if err := ensurePartition(ctx, date); err != nil {
+			log.Printf("Failed to create partition for %s, using the default partition: %v", month, err)
+		}
+	}
+	var newModels []string
+	if err := db.QueryRowContext(ctx, `SELECT COALESCE(ARRAY_AGG(m), '{}') FROM unnest($1::TEXT[]) m
+        WHERE NOT EXISTS (SELECT 1 FROM token_usage WHERE model = m)`, pq.Array(distinctModels)).Scan(pq.Array(&newModels)); err != nil {
+		return err
+	}
+
+	query := `
+        WITH batch AS (
+            SELECT * FROM unnest($1::DATE[], $2::TEXT[], $3::TEXT[], $4::BIGINT[], $5::DOUBLE PRECISION[], $6::BIGINT[], $7::BIGINT[],
+                $8::DOUBLE PRECISION[], $9::TEXT[], $10::BIGINT[], $11::BIGINT[])
+                WITH ORDINALITY AS b(date, model, project, total_tokens, cost, requests, characters, credits, provider, prompt_tokens, completion_tokens, ord)
+        ), logged AS (
+            INSERT INTO usage_requests (date, model, project, total_tokens, cost, requests)
+            SELECT date, model, project, total_tokens, cost, requests FROM batch
+        ), sums AS (
+            SELECT date, model, project, SUM(total_tokens) AS total_tokens,
+                SUM(ROUND(cost::NUMERIC, 6)) AS cost, SUM(requests) AS requests, SUM(characters) AS characters, SUM(credits) AS credits,
+                (ARRAY_AGG(provider ORDER BY ord DESC) FILTER (WHERE provider <> ''))[1] AS provider,
+                SUM(prompt_tokens) AS prompt_tokens, SUM(completion_tokens) AS completion_tokens
+            FROM batch GROUP BY date, model, project
+        )`
+	if usageKeyIndexed.Load() {
+		query += `
+        INSERT INTO token_usage (date, model, project, total_tokens, cost, requests, characters, credits, provider, prompt_tokens, completion_tokens)
+        SELECT date, model, project, total_tokens, cost::DOUBLE PRECISION, requests, characters, credits, COALESCE(provider, ''), prompt_tokens, completion_tokens
+        FROM sums` + usageIncrementOnConflict
+	} else {
+		query += `, updated AS (
+            UPDATE token_usage u SET total_tokens = u.total_tokens + s.total_tokens,
+                cost = CASE WHEN s.cost IS NULL THEN u.cost ELSE ROUND(COALESCE(u.cost, 0)::NUMERIC + s.cost, 6)::DOUBLE PRECISION END,
+                requests = u.requests + s.requests, characters = u.characters + s.characters, credits = u.credits + s.credits,
+                provider = COALESCE(s.provider, u.provider), prompt_tokens = u.prompt_tokens + s.prompt_tokens,
+                completion_tokens = u.completion_tokens + s.completion_tokens
+            FROM sums s WHERE u.date = s.date AND u.model = s.model AND u.project = s.project
+            RETURNING u.date, u.model, u.project
+        )
+        INSERT INTO token_usage (date, model, project, total_tokens, cost, requests, characters, credits, provider, prompt_tokens, completion_tokens)
+        SELECT date, model, project, total_tokens, cost::DOUBLE PRECISION, requests, characters, credits, COALESCE(provider, ''), prompt_tokens, completion_tokens
+        FROM sums s WHERE NOT EXISTS (SELECT 1 FROM updated x WHERE x.date = s.date AND x.model = s.model AND x.project = s.project)`
+	}
+	_, err := db.ExecContext(ctx, query,
+		pq.Array(dates), pq.Array(models), pq.Array(projects), pq.Array(tokens), pq.Array(costs), pq.Array(requests), pq.Array(characters),
+		pq.Array(credits), pq.Array(providers), pq.Array(prompt), pq.Array(completion))
+	if err != nil {
+		return err
+	}
+	debugf("Wrote a batch of %d increments\n", n)
+	for _, model := range newModels {
+		applyModelDefaults(model)
+	}
+	for _, model := range distinctModels {
+		go checkBudgets(model)
+	}
+	return nil
+}
@@ -0,0 +1,303 @@
+// batchjobs.go
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// Bulk runs, such as embedding a document corpus, are reported like any other usage but with
+// job_id set, and job_type saying what kind of run it is ("embedding_batch"; "batch" when not
+// given). A job's record is its own running total for the day, model and project: the job's
+// usage is kept per job in usage_jobs, and the day's total moves by the difference from what
+// the job reported before, so it still counts everything. GET /batch_jobs lists the jobs and
+// GET /batch_jobs/summary splits usage between the job types and interactive traffic, which is
+// all the usage not reported under a job.
+
+const defaultJobType = "batch"
+
+// BatchJob is a job's usage within a date range
+type BatchJob struct {
+	JobID       string    `json:"job_id"`
+	JobType     string    `json:"job_type"`
+	FirstDate   string    `json:"first_date"`
+	LastDate    string    `json:"last_date"`
+	Models      []string  `json:"models"`
+	Projects    []string  `json:"projects"`
+	TotalTokens int64     `json:"total_tokens"`
+	Requests    int64     `json:"requests"`
+	Cost        float64   `json:"cost"`
+	StartedAt   time.Time `json:"started_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// BatchJobDay is a job's usage on one day for a model and project
+type BatchJobDay struct {
+	Date             string  `json:"date"`
+	Model            string  `json:"model"`
+	Project          string  `json:"project"`
+	TotalTokens      int64   `json:"total_tokens"`
+	Requests         int64   `json:"requests"`
+	PromptTokens     int64   `json:"prompt_tokens"`
+	CompletionTokens int64   `json:"completion_tokens"`
+	Cost             float64 `json:"cost"`
+}
+
+// UsageShare is part of the usage and its share of all tokens, null when there were none
+type UsageShare struct {
+	JobType     string   `json:"job_type,omitempty"`
+	Jobs        int      `json:"jobs,omitempty"`
+	TotalTokens int64    `json:"total_tokens"`
+	Cost        float64  `json:"cost"`
+	TokenShare  *float64 `json:"token_share"`
+}
+
+// validateJob checks the job fields of a record
+func validateJob(usage TokenUsage) error {
+	if usage.JobID == "" && usage.JobType != "" {
+		return fmt.Errorf("job_type needs job_id")
+	}
+	if len(usage.JobID) > 255 || len(usage.JobType) > 64 {
+		return fmt.Errorf("job_id must be at most 255 characters and job_type 64")
+	}
+	return nil
+}
+
+// setJobUsage stores a job's running total for a day, model and project and adds the
+// difference from the job's previous total to the day's total. It reports whether the job had
+// no record for the day yet.
+func setJobUsage(ctx context.Context, usage TokenUsage, source string) (bool, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	// A job's type is the one last reported, on all its days; a new day without one keeps it
+	res, err := tx.ExecContext(ctx, `INSERT INTO usage_jobs (job_id, job_type, date, model, project)
+        VALUES ($1, COALESCE(NULLIF($2, ''), (SELECT job_type FROM usage_jobs WHERE job_id = $1 LIMIT 1), $6), $3, $4, $5)
+        ON CONFLICT (job_id, date, model, project) DO NOTHING`, usage.JobID, usage.JobType, usage.Date, usage.Model, usage.Project, defaultJobType)
+	if err != nil {
+		return false, err
+	}
+	created, _ := res.RowsAffected()
+	// The row lock serializes reports of the same job, so each difference is taken once
+	var prev TokenUsage
+	err = tx.QueryRowContext(ctx, `SELECT total_tokens, requests, characters, credits, prompt_tokens, completion_tokens, cost
+        FROM usage_jobs WHERE job_id = $1 AND date = $2 AND model = $3 AND project = $4 FOR UPDATE`,
+		usage.JobID, usage.Date, usage.Model, usage.Project).Scan(&prev.TotalTokens, &prev.Requests, &prev.Characters, &prev.Credits,
+		&prev.PromptTokens, &prev.CompletionTokens, &prev.Cost)
+	if err != nil {
+		return false, err
+	}
+	_, err = tx.ExecContext(ctx, `UPDATE usage_jobs SET total_tokens = $5, requests = $6, characters = $7, credits = $8,
+            prompt_tokens = $9, completion_tokens = $10, cost = $11, updated_at = NOW()
+        WHERE job_id = $1 AND date = $2 AND model = $3 AND project = $4`,
+		usage.JobID, usage.Date, usage.Model, usage.Project, usage.TotalTokens, usage.Requests, usage.Characters, usage.Credits,
+		usage.PromptTokens, usage.CompletionTokens, usage.Cost)
+	if err != nil {
+		return false, err
+	}
+	if usage.JobType != "" {
+		if _, err := tx.ExecContext(ctx, "UPDATE usage_jobs SET job_type = $2 WHERE job_id = $1 AND job_type <> $2", usage.JobID, usage.JobType); err != nil {
+			return false, err
+		}
+	}
+
+	delta := usage
+	delta.JobID, delta.JobType = "", ""
+	delta.TotalTokens -= prev.TotalTokens
+	delta.Requests -= prev.Requests
+	delta.Characters -= prev.Characters
+	delta.Credits -= prev.Credits
+	delta.PromptTokens -= prev.PromptTokens
+	delta.CompletionTokens -= prev.CompletionTokens
+	if usage.Cost != nil && prev.Cost != nil {
+		cost := *usage.Cost - *prev.Cost
+		delta.Cost = &cost
+	}
+	changed := delta.TotalTokens != 0 || delta.Requests != 0 || delta.Characters != 0 || delta.Credits != 0 ||
+		delta.PromptTokens != 0 || delta.CompletionTokens != 0 || (delta.Cost != nil && *delta.Cost != 0)
+	// The day's total is written in a transaction of its own while the job's row stays locked;
+	// should that fail the job's report is rolled back with it
+	if changed {
+		if err := addTokenUsage(ctx, delta); err != nil {
+			return false, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	infof("Recorded job %s usage on %s for %s with %d\n", usage.JobID, usage.Date.Format("2006-01-02"), usage.Model, usage.TotalTokens)
+	if changed {
+		usageRecorded(UsageEvent{Date: usage.Date, Model: usage.Model, Project: usage.Project, Source: source, TotalTokens: delta.TotalTokens, Cost: delta.Cost})
+	}
+	return created > 0, nil
+}
+
+// getBatchJobs lists the jobs with usage in a date range, this month by default, costliest
+// first. ?job_type= and ?project= narrow it down.
+func getBatchJobs(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	start, end, err := parseDateRange(q, "month")
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid date range", err)
+		return
+	}
+	rows, err := db.QueryContext(r.Context(), `
+        SELECT u.job_id, MAX(u.job_type), MIN(u.date), MAX(u.date), ARRAY_AGG(DISTINCT u.model ORDER BY u.model),
+            ARRAY_AGG(DISTINCT u.project ORDER BY u.project), SUM(u.total_tokens), SUM(u.requests), `+usageCostMicrosSum+`,
+            MIN(u.created_at), MAX(u.updated_at)
+        FROM usage_jobs u `+usagePriceJoin+`
+        WHERE u.date >= $1 AND u.date <= $2 AND ($3 = '' OR u.job_type = $3) AND ($4 = '' OR u.project = $4)
+        GROUP BY u.job_id
+        ORDER BY 9 DESC, u.job_id`, start, end, q.Get("job_type"), q.Get("project"))
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database query error", err)
+		return
+	}
+	defer rows.Close()
+	jobs := []BatchJob{}
+	for rows.Next() {
+		var j BatchJob
+		var first, last time.Time
+		var cost int64
+		if err := rows.Scan(&j.JobID, &j.JobType, &first, &last, pq.Array(&j.Models), pq.Array(&j.Projects), &j.TotalTokens, &j.Requests,
+			&cost, &j.StartedAt, &j.UpdatedAt); err != nil {
+			respondError(w, http.StatusInternalServerError, "Error scanning row", err)
+			return
+		}
+		j.FirstDate, j.LastDate = first.Format("2006-01-02"), last.Format("2006-01-02")
+		j.Cost = costFromMicros(cost)
+		jobs = append(jobs, j)
+	}
+	if err = rows.Err(); err != nil {
+		respondError(w, http.StatusInternalServerError, "Error reading data", err)
+		return
+	}
+	respondJSON(w, http.StatusOK, jobs)
+}
+
+// getBatchJob details a job's usage per day, model and project
+func getBatchJob(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	rows, err := db.QueryContext(r.Context(), `
+        SELECT u.date, u.model, u.project, u.total_tokens, u.requests, u.prompt_tokens, u.completion_tokens, `+usageCostMicrosExpr+`
+        FROM usage_jobs u `+usagePriceJoin+`
+        WHERE u.job_id = $1
+        ORDER BY u.date, u.model, u.project`, id)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database query error", err)
+		return
+	}
+	defer rows.Close()
+	days := []BatchJobDay{}
+	var tokens, costMicros int64
+	for rows.Next() {
+		var d BatchJobDay
+		var date time.Time
+		var cost int64
+		if err := rows.Scan(&date, &d.Model, &d.Project, &d.TotalTokens, &d.Requests, &d.PromptTokens, &d.CompletionTokens, &cost); err != nil {
+			respondError(w, http.StatusInternalServerError, "Error scanning row", err)
+			return
+		}
+		d.Date = date.Format("2006-01-02")
+		d.Cost = costFromMicros(cost)
+		tokens += d.TotalTokens
+		costMicros += cost
+		days = append(days, d)
+	}
+	if err = rows.Err(); err != nil {
+		respondError(w, http.StatusInternalServerError, "Error reading data", err)
+		return
+	}
+	if len(days) == 0 {
+		respondJSON(w, http.StatusNotFound, map[string]string{"message": "Batch job not found"})
+		return
+	}
+	var jobType string
+	if err := db.QueryRowContext(r.Context(), "SELECT job_type FROM usage_jobs WHERE job_id = $1 LIMIT 1", id).Scan(&jobType); err != nil && err != sql.ErrNoRows {
+		respondError(w, http.StatusInternalServerError, "Database query error", err)
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"job_id":       id,
+		"job_type":     jobType,
+		"total_tokens": tokens,
+		"cost":         costFromMicros(costMicros),
+		"usage":        days,
+	})
+}
+
+// getBatchJobSummary splits the usage in a date range, this month by default, between the job
+// types and interactive traffic. ?project= narrows it to one project.
+func getBatchJobSummary(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	start, end, err := parseDateRange(q, "month")
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid date range", err)
+		return
+	}
+	project := q.Get("project")
+	var totalTokens, totalCost int64
+	err = db.QueryRowContext(r.Context(), `
+        SELECT COALESCE(SUM(u.total_tokens), 0), `+usageCostMicrosSum+`
+        FROM token_usage u `+usagePriceJoin+`
+        WHERE u.date >= $1 AND u.date <= $2 AND ($3 = '' OR u.project = $3)`, start, end, project).Scan(&totalTokens, &totalCost)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database query error", err)
+		return
+	}
+	rows, err := db.QueryContext(r.Context(), `
+        SELECT u.job_type, COUNT(DISTINCT u.job_id), SUM(u.total_tokens), `+usageCostMicrosSum+`
+        FROM usage_jobs u `+usagePriceJoin+`
+        WHERE u.date >= $1 AND u.date <= $2 AND ($3 = '' OR u.project = $3)
+        GROUP BY u.job_type
+        ORDER BY 3 DESC, u.job_type`, start, end, project)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database query error", err)
+		return
+	}
+	defer rows.Close()
+	types := []UsageShare{}
+	interactiveTokens, interactiveCost := totalTokens, totalCost
+	for rows.Next() {
+		var s UsageShare
+		var cost int64
+		if err := rows.Scan(&s.JobType, &s.Jobs, &s.TotalTokens, &cost); err != nil {
+			respondError(w, http.StatusInternalServerError, "Error scanning row", err)
+			return
+		}
+		s.Cost = costFromMicros(cost)
+		s.TokenShare = tokenShare(s.TotalTokens, totalTokens)
+		interactiveTokens -= s.TotalTokens
+		interactiveCost -= cost
+		types = append(types, s)
+	}
+	if err = rows.Err(); err != nil {
+		respondError(w, http.StatusInternalServerError, "Error reading data", err)
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"start":       start.Format("2006-01-02"),
+		"end":         end.Format("2006-01-02"),
+		"total":       UsageShare{TotalTokens: totalTokens, Cost: costFromMicros(totalCost), TokenShare: tokenShare(totalTokens, totalTokens)},
+		"job_types":   types,
+		"interactive": UsageShare{TotalTokens: interactiveTokens, Cost: costFromMicros(interactiveCost), TokenShare: tokenShare(interactiveTokens, totalTokens)},
+	})
+}
+
+// tokenShare is part over total rounded to four places, nil when total is zero
+func tokenShare(part, total int64) *float64 {
+	if total == 0 {
+		return nil
+	}
+	s := math.Round(float64(part)/float64(total)*10000) / 10000
+	return &s
+}
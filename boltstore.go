@@ -0,0 +1,165 @@
+// boltstore.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"sort"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// boltStore keeps usage in a single bbolt file, for personal installs that want persistence
+// without running Postgres. Rows are keyed model/date/project so a model's totals over a
+// date range are a single ordered scan.
+type boltStore struct {
+	db *bolt.DB
+}
+
+var usageBucket = []byte("token_usage")
+
+func openBoltStore(path string) (*boltStore, error) {
+	bdb, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = bdb.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(usageBucket)
+		return err
+	})
+	if err != nil {
+		bdb.Close()
+		return nil, err
+	}
+	return &boltStore{db: bdb}, nil
+}
+
+func boltKey(model, date, project string) []byte {
+	return []byte(model + "\x00" + date + "\x00" + project)
+}
+
+func boltKeyOf(u TokenUsage) []byte {
+	return boltKey(u.Model, u.Date.Format("2006-01-02"), u.Project)
+}
+
+// update applies change to the row for usage, creating it if needed, and stores the result.
+// change gets nil for a new row and returns the new row, the tokens it added and whether the
+// row changed at all; unchanged rows keep their updated_at.
+func (s *boltStore) update(usage TokenUsage, change func(row *TokenUsage) (TokenUsage, int, bool)) (created bool, delta int, err error) {
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(usageBucket)
+		key := boltKeyOf(usage)
+		var existing *TokenUsage
+		if v := b.Get(key); v != nil {
+			existing = &TokenUsage{}
+			if err := json.Unmarshal(v, existing); err != nil {
+				return err
+			}
+		}
+		row, d, changed := change(existing)
+		delta = d
+		if !changed {
+			return nil
+		}
+		now := time.Now()
+		if existing == nil {
+			id, err := b.NextSequence()
+			if err != nil {
+				return err
+			}
+			row.ID = int(id)
+			row.CreatedAt = &now
+			created = true
+		}
+		row.UpdatedAt = &now
+		v, err := json.Marshal(row)
+		if err != nil {
+			return err
+		}
+		return b.Put(key, v)
+	})
+	return created, delta, err
+}
+
+func (s *boltStore) SetUsage(ctx context.Context, usage TokenUsage, source string) (bool, error) {
+	created, delta, err := s.update(usage, func(row *TokenUsage) (TokenUsage, int, bool) {
+		if row == nil {
+			return usage, usage.TotalTokens, true
+		}
+		previous := *row
+		row.TotalTokens, row.Cost, row.UsageMeasures, row.UsageBreakdown = usage.TotalTokens, usage.Cost, usage.UsageMeasures, usage.UsageBreakdown
+		changed := previous.TotalTokens != usage.TotalTokens || !sameCost(previous.Cost, usage.Cost) || previous.UsageMeasures != usage.UsageMeasures ||
+			previous.UsageBreakdown != usage.UsageBreakdown
+		return *row, usage.TotalTokens - previous.TotalTokens, changed
+	})
+	if err != nil {
+		return false, err
+	}
+	usageRecorded(UsageEvent{Date: usage.Date, Model: usage.Model, Project: usage.Project, Source: source, TotalTokens: delta, Cost: usage.Cost})
+	return created, nil
+}
+
+func (s *boltStore) AddUsage(ctx context.Context, usage TokenUsage, source string) error {
+	_, _, err := s.update(usage, func(row *TokenUsage) (TokenUsage, int, bool) {
+		if row == nil {
+			return usage, usage.TotalTokens, true
+		}
+		row.TotalTokens += usage.TotalTokens
+		row.UsageMeasures.add(usage.UsageMeasures)
+		row.UsageBreakdown.add(usage.UsageBreakdown)
+		if usage.Cost != nil {
+			cost := *usage.Cost
+			if row.Cost != nil {
+				cost = float64(toMicros(cost)+toMicros(*row.Cost)) / microsPerDollar
+			}
+			row.Cost = &cost
+		}
+		return *row, usage.TotalTokens, true
+	})
+	if err != nil {
+		return err
+	}
+	usageRecorded(UsageEvent{Date: usage.Date, Model: usage.Model, Project: usage.Project, Source: source, TotalTokens: usage.TotalTokens, Cost: usage.Cost})
+	return nil
+}
+
+func (s *boltStore) ListUsage(ctx context.Context, since time.Time) ([]TokenUsage, error) {
+	usages := []TokenUsage{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(usageBucket).ForEach(func(k, v []byte) error {
+			var row TokenUsage
+			if err := json.Unmarshal(v, &row); err != nil {
+				return err
+			}
+			if row.UpdatedAt.After(since) {
+				usages = append(usages, row)
+			}
+			return nil
+		})
+	})
+	sort.Slice(usages, func(i, j int) bool { return usages[i].ID < usages[j].ID })
+	return usages, err
+}
+
+func (s *boltStore) SumUsage(ctx context.Context, model string, start, end time.Time) (int64, bool, error) {
+	var total int64
+	found := false
+	from := boltKey(model, start.Format("2006-01-02"), "")
+	// Every key for the end date sorts before the end date followed by \x01
+	to := []byte(model + "\x00" + end.Format("2006-01-02") + "\x01")
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(usageBucket).Cursor()
+		for k, v := c.Seek(from); k != nil && bytes.Compare(k, to) < 0; k, v = c.Next() {
+			var row TokenUsage
+			if err := json.Unmarshal(v, &row); err != nil {
+				return err
+			}
+			total += int64(row.TotalTokens)
+			found = true
+		}
+		return nil
+	})
+	return total, found, err
+}
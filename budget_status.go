@@ -0,0 +1,116 @@
+// budget_status.go
+package main
+
+import (
+	"database/sql"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ProjectBudgetStatus compares a project's spend this month with its monthly budget.
+// Burn rate is the average daily spend so far; projections assume it continues. With
+// ?exclude_outages= the burn rate leaves out the provider outage days listed in ExcludedDays,
+// so a day of lost traffic doesn't pull the projection down.
+type ProjectBudgetStatus struct {
+	Project                string   `json:"project"`
+	Month                  string   `json:"month"`
+	BudgetUSD              *float64 `json:"budget_usd"`
+	SpendUSD               float64  `json:"spend_usd"`
+	TotalTokens            int64    `json:"total_tokens"`
+	RemainingUSD           *float64 `json:"remaining_usd"`
+	PercentUsed            *float64 `json:"percent_used"`
+	BurnRateUSDPerDay      float64  `json:"burn_rate_usd_per_day"`
+	ProjectedSpendUSD      float64  `json:"projected_spend_usd"`
+	ProjectedOvershootDate *string  `json:"projected_overshoot_date"`
+	ExceededOn             *string  `json:"exceeded_on"`
+	ExcludedDays           []string `json:"excluded_days,omitempty"`
+}
+
+func getProjectBudgetStatus(w http.ResponseWriter, r *http.Request) {
+	project := mux.Vars(r)["name"]
+	today := time.Now().Truncate(24 * time.Hour)
+	monthStart := time.Date(today.Year(), today.Month(), 1, 0, 0, 0, 0, time.UTC)
+	monthEnd := monthStart.AddDate(0, 1, -1)
+
+	status := ProjectBudgetStatus{Project: project, Month: monthStart.Format("2006-01")}
+	excluded := map[string]bool{}
+	if providers := parseExcludeOutages(r.URL.Query().Get("exclude_outages")); providers != nil {
+		days, err := outageDays(r.Context(), monthStart, today, providers)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, "Database query error", err)
+			return
+		}
+		// With every day so far an outage day there is nothing left to take the rate from
+		if len(days) < today.Day() {
+			status.ExcludedDays = days
+			for _, d := range days {
+				excluded[d] = true
+			}
+		}
+	}
+	err := db.QueryRowContext(r.Context(), "SELECT monthly_budget_usd FROM projects WHERE name = $1", project).Scan(&status.BudgetUSD)
+	if err == sql.ErrNoRows {
+		respondJSON(w, http.StatusNotFound, map[string]string{"message": "Project not found"})
+		return
+	} else if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database query error", err)
+		return
+	}
+
+	rows, err := db.QueryContext(r.Context(), `
+        SELECT u.date, SUM(u.total_tokens), `+usageCostMicrosSum+`
+        FROM token_usage u `+usagePriceJoin+`
+        WHERE u.project = $1 AND u.date >= $2 AND u.date <= $3
+        GROUP BY u.date ORDER BY u.date`, project, monthStart, today)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database query error", err)
+		return
+	}
+	defer rows.Close()
+	var spend, rateSpend int64
+	for rows.Next() {
+		var date time.Time
+		var tokens, cost int64
+		if err := rows.Scan(&date, &tokens, &cost); err != nil {
+			respondError(w, http.StatusInternalServerError, "Error scanning row", err)
+			return
+		}
+		status.TotalTokens += tokens
+		spend += cost
+		if !excluded[date.Format("2006-01-02")] {
+			rateSpend += cost
+		}
+		if status.BudgetUSD != nil && status.ExceededOn == nil && spend > toMicros(*status.BudgetUSD) {
+			d := date.Format("2006-01-02")
+			status.ExceededOn = &d
+		}
+	}
+	if err = rows.Err(); err != nil {
+		respondError(w, http.StatusInternalServerError, "Error reading data", err)
+		return
+	}
+
+	daysElapsed := today.Day()
+	status.SpendUSD = costFromMicros(spend)
+	burnRate := float64(rateSpend) / float64(daysElapsed-len(excluded)) / microsPerDollar
+	status.BurnRateUSDPerDay = roundCost(burnRate)
+	status.ProjectedSpendUSD = roundCost(float64(spend)/microsPerDollar + burnRate*float64(monthEnd.Day()-daysElapsed))
+	if b := status.BudgetUSD; b != nil {
+		remaining := costFromMicros(toMicros(*b) - spend)
+		percent := float64(spend) / float64(toMicros(*b)) * 100
+		status.RemainingUSD = &remaining
+		status.PercentUsed = &percent
+		// The overshoot date is only projected within this month, since budgets reset monthly
+		if status.ExceededOn == nil && burnRate > 0 {
+			overshoot := today.AddDate(0, 0, int(math.Ceil((*b-float64(spend)/microsPerDollar)/burnRate)))
+			if !overshoot.After(monthEnd) {
+				d := overshoot.Format("2006-01-02")
+				status.ProjectedOvershootDate = &d
+			}
+		}
+	}
+	respondJSON(w, http.StatusOK, status)
+}
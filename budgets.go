@@ -0,0 +1,484 @@
+// budgets.go
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Budget caps the tokens a model may use per period and alerts as thresholds are crossed.
+// Week and month budgets reset at the start of each calendar week (from Sunday) or month; a
+// rolling budget counts the last WindowDays days, today included, and never resets. A week or
+// month budget with CarryOverMaxTokens set adds what the previous cycle left unused, up to that
+// many tokens, to its limit. Only unused budget of the previous cycle is carried, not what it
+// carried itself, and only from a cycle the budget existed for in full.
+type Budget struct {
+	ID                 int               `json:"id"`
+	Model              string            `json:"model"`
+	Period             string            `json:"period"`
+	WindowDays         int               `json:"window_days,omitempty"`
+	LimitTokens        int64             `json:"limit_tokens"`
+	CarryOverMaxTokens int64             `json:"carry_over_max_tokens"`
+	CooldownMinutes    int               `json:"cooldown_minutes"`
+	Enforce            bool              `json:"enforce"`
+	Thresholds         []BudgetThreshold `json:"thresholds"`
+	CreatedAt          time.Time         `json:"created_at"`
+}
+
+// budgetCycle is the span a budget currently counts usage over
+type budgetCycle struct {
+	Start time.Time
+	// ResetsOn is the start of the next cycle; rolling budgets have none
+	ResetsOn *time.Time
+	// Limit is the budget's limit plus CarriedOver
+	Limit       int64
+	CarriedOver int64
+}
+
+// maxBudgetWindowDays bounds rolling windows
+const maxBudgetWindowDays = 366
+
+// BudgetThreshold is a percentage of the limit with its own notification channel
+type BudgetThreshold struct {
+	ID      int    `json:"id"`
+	Percent int    `json:"percent"`
+	Channel string `json:"channel"`
+	Target  string `json:"target,omitempty"`
+}
+
+// BudgetAlert records that a threshold fired for a given period
+type BudgetAlert struct {
+	ThresholdID int       `json:"threshold_id"`
+	Percent     int       `json:"percent"`
+	Channel     string    `json:"channel"`
+	PeriodStart time.Time `json:"period_start"`
+	TotalTokens int64     `json:"total_tokens"`
+	SentAt      time.Time `json:"sent_at"`
+}
+
+const defaultBudgetCooldownMinutes = 60
+
+const budgetColumns = "id, model, period, window_days, limit_tokens, carry_over_max_tokens, cooldown_minutes, enforce, created_at"
+
+var defaultBudgetThresholds = []BudgetThreshold{
+	{Percent: 50, Channel: "log"},
+	{Percent: 80, Channel: "log"},
+	{Percent: 100, Channel: "log"},
+}
+
+// budgetCheckMu serializes evaluations so concurrent records cannot send the same alert twice
+var budgetCheckMu sync.Mutex
+
+func createBudget(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Model              string            `json:"model"`
+		Period             string            `json:"period"`
+		WindowDays         int               `json:"window_days"`
+		LimitTokens        int64             `json:"limit_tokens"`
+		CarryOverMaxTokens int64             `json:"carry_over_max_tokens"`
+		CooldownMinutes    *int              `json:"cooldown_minutes"`
+		Enforce            bool              `json:"enforce"`
+		Thresholds         []BudgetThreshold `json:"thresholds"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request payload", err)
+		return
+	}
+	budget := Budget{
+		Model:              req.Model,
+		Period:             req.Period,
+		WindowDays:         req.WindowDays,
+		LimitTokens:        req.LimitTokens,
+		CarryOverMaxTokens: req.CarryOverMaxTokens,
+		CooldownMinutes:    defaultBudgetCooldownMinutes,
+		Enforce:            req.Enforce,
+		Thresholds:         req.Thresholds,
+	}
+	if req.CooldownMinutes != nil {
+		budget.CooldownMinutes = *req.CooldownMinutes
+	}
+	if len(budget.Thresholds) == 0 {
+		budget.Thresholds = append([]BudgetThreshold(nil), defaultBudgetThresholds...)
+	}
+	if err := validateBudget(&budget, currentConfig.Load().Notifications); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid budget", err)
+		return
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to start transaction", err)
+		return
+	}
+	defer tx.Rollback()
+	err = tx.QueryRowContext(r.Context(), `INSERT INTO budgets (model, period, window_days, limit_tokens, carry_over_max_tokens, cooldown_minutes, enforce)
+        VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id, created_at`,
+		budget.Model, budget.Period, budget.WindowDays, budget.LimitTokens, budget.CarryOverMaxTokens, budget.CooldownMinutes, budget.Enforce).Scan(&budget.ID, &budget.CreatedAt)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to create budget", err)
+		return
+	}
+	for i := range budget.Thresholds {
+		t := &budget.Thresholds[i]
+		err = tx.QueryRowContext(r.Context(), "INSERT INTO budget_thresholds (budget_id, percent, channel, target) VALUES ($1, $2, $3, $4) RETURNING id",
+			budget.ID, t.Percent, t.Channel, t.Target).Scan(&t.ID)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, "Failed to create budget threshold", err)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to commit budget", err)
+		return
+	}
+	infof("Created %s budget for %s with limit %d\n", budget.Period, budget.Model, budget.LimitTokens)
+	respondJSON(w, http.StatusCreated, budget)
+}
+
+// validateBudget checks a budget and sorts its thresholds; defaults supplies fallback channel targets
+func validateBudget(b *Budget, defaults NotificationConfig) error {
+	if b.Model == "" {
+		return fmt.Errorf("model is required")
+	}
+	switch b.Period {
+	case "week", "month":
+		if b.WindowDays != 0 {
+			return fmt.Errorf("window_days only applies to rolling budgets")
+		}
+	case "rolling":
+		if b.WindowDays < 1 || b.WindowDays > maxBudgetWindowDays {
+			return fmt.Errorf("rolling budgets need window_days between 1 and %d", maxBudgetWindowDays)
+		}
+		if b.CarryOverMaxTokens != 0 {
+			return fmt.Errorf("rolling budgets can't carry over unused budget")
+		}
+	default:
+		return fmt.Errorf("period must be 'week', 'month' or 'rolling'")
+	}
+	if b.LimitTokens <= 0 {
+		return fmt.Errorf("limit_tokens must be positive")
+	}
+	if b.CarryOverMaxTokens < 0 {
+		return fmt.Errorf("carry_over_max_tokens must not be negative")
+	}
+	if b.CooldownMinutes < 0 {
+		return fmt.Errorf("cooldown_minutes must not be negative")
+	}
+	for _, t := range b.Thresholds {
+		if t.Percent <= 0 || t.Percent > 1000 {
+			return fmt.Errorf("threshold percent %d out of range", t.Percent)
+		}
+		if err := defaults.checkChannel(t.Channel, t.Target); err != nil {
+			return err
+		}
+	}
+	sort.Slice(b.Thresholds, func(i, j int) bool { return b.Thresholds[i].Percent < b.Thresholds[j].Percent })
+	return nil
+}
+
+func getBudgets(w http.ResponseWriter, r *http.Request) {
+	budgets, err := loadBudgets(r.Context(), "SELECT "+budgetColumns+" FROM budgets ORDER BY id")
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database query error", err)
+		return
+	}
+	respondJSON(w, http.StatusOK, budgets)
+}
+
+func getBudget(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid budget id", err)
+		return
+	}
+	budgets, err := loadBudgets(r.Context(), "SELECT "+budgetColumns+" FROM budgets WHERE id = $1", id)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database query error", err)
+		return
+	}
+	if len(budgets) == 0 {
+		respondJSON(w, http.StatusNotFound, map[string]string{"message": "Budget not found"})
+		return
+	}
+	respondJSON(w, http.StatusOK, budgets[0])
+}
+
+func deleteBudget(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid budget id", err)
+		return
+	}
+	res, err := db.ExecContext(r.Context(), "DELETE FROM budgets WHERE id = $1", id)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to delete budget", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		respondJSON(w, http.StatusNotFound, map[string]string{"message": "Budget not found"})
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]string{"message": "Budget deleted successfully"})
+}
+
+// getBudgetAlerts lists a budget's alerts. The totals they fired at count every project, so
+// scoped callers can't list them.
+func getBudgetAlerts(w http.ResponseWriter, r *http.Request) {
+	if scope, ok := projectScope(r.Context()); ok {
+		respondJSON(w, http.StatusForbidden, map[string]string{"message": "Budget alerts count every project's usage; this key is limited to project " + scope})
+		return
+	}
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid budget id", err)
+		return
+	}
+	rows, err := db.QueryContext(r.Context(), `SELECT a.threshold_id, t.percent, t.channel, a.period_start, a.total_tokens, a.sent_at
+        FROM budget_alerts a JOIN budget_thresholds t ON t.id = a.threshold_id
+        WHERE a.budget_id = $1 ORDER BY a.sent_at DESC`, id)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database query error", err)
+		return
+	}
+	defer rows.Close()
+	alerts := []BudgetAlert{}
+	for rows.Next() {
+		var a BudgetAlert
+		if err := rows.Scan(&a.ThresholdID, &a.Percent, &a.Channel, &a.PeriodStart, &a.TotalTokens, &a.SentAt); err != nil {
+			respondError(w, http.StatusInternalServerError, "Error scanning row", err)
+			return
+		}
+		alerts = append(alerts, a)
+	}
+	if err = rows.Err(); err != nil {
+		respondError(w, http.StatusInternalServerError, "Error reading data", err)
+		return
+	}
+	respondJSON(w, http.StatusOK, alerts)
+}
+
+// loadBudgets runs a budgets query and attaches each budget's thresholds
+func loadBudgets(ctx context.Context, query string, args ...interface{}) ([]Budget, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	budgets := []Budget{}
+	for rows.Next() {
+		var b Budget
+		if err := rows.Scan(&b.ID, &b.Model, &b.Period, &b.WindowDays, &b.LimitTokens, &b.CarryOverMaxTokens, &b.CooldownMinutes, &b.Enforce, &b.CreatedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		budgets = append(budgets, b)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for i := range budgets {
+		tRows, err := db.QueryContext(ctx, "SELECT id, percent, channel, target FROM budget_thresholds WHERE budget_id = $1 ORDER BY percent, id", budgets[i].ID)
+		if err != nil {
+			return nil, err
+		}
+		budgets[i].Thresholds = []BudgetThreshold{}
+		for tRows.Next() {
+			var t BudgetThreshold
+			if err := tRows.Scan(&t.ID, &t.Percent, &t.Channel, &t.Target); err != nil {
+				tRows.Close()
+				return nil, err
+			}
+			budgets[i].Thresholds = append(budgets[i].Thresholds, t)
+		}
+		tRows.Close()
+		if err := tRows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return budgets, nil
+}
+
+// budgetUsage returns the budget's cycle containing today, with the carried over budget it
+// allows, and sums the model's tokens in it, only the scoped project's if ctx has a scope
+func budgetUsage(ctx context.Context, b Budget, today time.Time) (budgetCycle, int64, error) {
+	c := budgetCycle{Limit: b.LimitTokens}
+	if b.Period == "rolling" {
+		c.Start = today.AddDate(0, 0, 1-b.WindowDays)
+		var total int64
+		err := db.QueryRowContext(ctx, "SELECT COALESCE(SUM(total_tokens), 0) FROM token_usage WHERE model = $1 AND date >= $2", b.Model, c.Start).Scan(&total)
+		return c, total, err
+	}
+	c.Start, _ = periodStart(b.Period, today)
+	next := c.Start.AddDate(0, 0, 7)
+	if b.Period == "month" {
+		next = c.Start.AddDate(0, 1, 0)
+	}
+	c.ResetsOn = &next
+	// Without carry-over the previous cycle is left out of the sum
+	from := c.Start
+	prevStart, _ := periodStart(b.Period, c.Start.AddDate(0, 0, -1))
+	carry := b.CarryOverMaxTokens > 0 && !b.CreatedAt.After(prevStart)
+	if carry {
+		from = prevStart
+	}
+	var total, previous int64
+	err := db.QueryRowContext(ctx, `SELECT COALESCE(SUM(total_tokens) FILTER (WHERE date >= $2), 0), COALESCE(SUM(total_tokens) FILTER (WHERE date < $2), 0)
+        FROM token_usage WHERE model = $1 AND date >= $3`, b.Model, c.Start, from).Scan(&total, &previous)
+	if err != nil {
+		return c, 0, err
+	}
+	if carry {
+		c.CarriedOver = min(max(b.LimitTokens-previous, 0), b.CarryOverMaxTokens)
+		c.Limit += c.CarriedOver
+	}
+	return c, total, nil
+}
+
+// span describes the budget's period for alert messages
+func (b Budget) span() string {
+	if b.Period == "rolling" {
+		return fmt.Sprintf("in the last %d days", b.WindowDays)
+	}
+	return "this " + b.Period
+}
+
+// checkBudgets evaluates every budget for a model after new usage has been recorded.
+// Each threshold fires at most once per period. When several thresholds on the same
+// channel are crossed at once only the highest is sent, and a channel that alerted
+// within the budget's cooldown is held back until a later record re-evaluates it.
+func checkBudgets(model string) {
+	budgetCheckMu.Lock()
+	defer budgetCheckMu.Unlock()
+
+	budgets, err := loadBudgets(context.Background(), "SELECT "+budgetColumns+" FROM budgets WHERE model = $1", model)
+	if err != nil {
+		log.Printf("Failed to load budgets for %s: %v", model, err)
+		return
+	}
+	today := time.Now().Truncate(24 * time.Hour)
+	for _, b := range budgets {
+		if err := checkBudget(b, today); err != nil {
+			log.Printf("Failed to evaluate budget %d: %v", b.ID, err)
+		}
+	}
+}
+
+// checkAllBudgets re-evaluates every budget, delivering alerts that cooldowns held back
+func checkAllBudgets(ctx context.Context) error {
+	rows, err := db.QueryContext(ctx, "SELECT DISTINCT model FROM budgets")
+	if err != nil {
+		return err
+	}
+	var models []string
+	for rows.Next() {
+		var model string
+		if err := rows.Scan(&model); err != nil {
+			rows.Close()
+			return err
+		}
+		models = append(models, model)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, model := range models {
+		checkBudgets(model)
+	}
+	return nil
+}
+
+// checkBudget alerts on a budget's thresholds, as percentages of the current cycle's limit.
+// Alerts are remembered per cycle; a rolling budget's cycle starts anew every day, so a
+// threshold its usage stays above fires again the next day, cooldown permitting.
+func checkBudget(b Budget, today time.Time) error {
+	cycle, total, err := budgetUsage(context.Background(), b, today)
+	if err != nil {
+		return err
+	}
+	start := cycle.Start
+	fired := map[int]bool{}
+	rows, err := db.Query("SELECT threshold_id FROM budget_alerts WHERE budget_id = $1 AND period_start = $2", b.ID, start)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		fired[id] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	// Group crossed, not-yet-fired thresholds by destination; thresholds are sorted ascending
+	type destination struct{ channel, target string }
+	pending := map[destination][]BudgetThreshold{}
+	var order []destination
+	for _, t := range b.Thresholds {
+		if fired[t.ID] || total*100 < int64(t.Percent)*cycle.Limit {
+			continue
+		}
+		d := destination{t.Channel, t.Target}
+		if _, ok := pending[d]; !ok {
+			order = append(order, d)
+		}
+		pending[d] = append(pending[d], t)
+	}
+
+	for _, d := range order {
+		var lastSent sql.NullTime
+		err := db.QueryRow(`SELECT MAX(a.sent_at) FROM budget_alerts a JOIN budget_thresholds t ON t.id = a.threshold_id
+            WHERE a.budget_id = $1 AND t.channel = $2 AND t.target = $3`, b.ID, d.channel, d.target).Scan(&lastSent)
+		if err != nil {
+			return err
+		}
+		if lastSent.Valid && time.Since(lastSent.Time) < time.Duration(b.CooldownMinutes)*time.Minute {
+			continue
+		}
+		thresholds := pending[d]
+		top := thresholds[len(thresholds)-1]
+		alert := Alert{
+			Kind: "budget_threshold",
+			Message: fmt.Sprintf("%s has used %d of %d tokens (%d%%) %s, crossing the %d%% budget threshold",
+				b.Model, total, cycle.Limit, total*100/cycle.Limit, b.span(), top.Percent),
+			Details: map[string]interface{}{
+				"budget_id":           b.ID,
+				"model":               b.Model,
+				"period":              b.Period,
+				"period_start":        start.Format("2006-01-02"),
+				"limit_tokens":        cycle.Limit,
+				"carried_over_tokens": cycle.CarriedOver,
+				"total_tokens":        total,
+				"threshold":           top.Percent,
+			},
+			Time: time.Now().UTC(),
+		}
+		if err := sendNotification(context.Background(), d.channel, d.target, alert); err != nil {
+			log.Printf("Failed to send budget alert for budget %d via %s: %v", b.ID, d.channel, err)
+			continue
+		}
+		for _, t := range thresholds {
+			_, err := db.Exec("INSERT INTO budget_alerts (budget_id, threshold_id, period_start, total_tokens) VALUES ($1, $2, $3, $4) ON CONFLICT DO NOTHING",
+				b.ID, t.ID, start, total)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
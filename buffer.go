@@ -0,0 +1,270 @@
+// buffer.go
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// writeBuffer holds usage writes accepted while the database is unreachable and replays them,
+// in order, once it is back. It is bounded (WRITE_BUFFER_SIZE, default 10000) and, when
+// WRITE_BUFFER_FILE is set, mirrored to disk so a restart during an outage loses nothing.
+// Each write replayed is marked applied on disk as soon as it is stored, so a crash while
+// flushing doesn't replay it again on restart; the file is compacted once the flush ends.
+type writeBuffer struct {
+	mu       sync.Mutex
+	entries  []DeadLetter
+	capacity int
+	path     string
+	wake     chan struct{}
+}
+
+var errBufferFull = errors.New("write buffer is full")
+
+var pendingWrites = newWriteBuffer()
+
+func newWriteBuffer() *writeBuffer {
+	b := &writeBuffer{capacity: 10000, path: os.Getenv("WRITE_BUFFER_FILE"), wake: make(chan struct{}, 1)}
+	if n, err := strconv.Atoi(os.Getenv("WRITE_BUFFER_SIZE")); err == nil && n >= 0 {
+		b.capacity = n
+	}
+	return b
+}
+
+// isUnavailable reports whether err means the database could not be reached, as opposed to
+// rejecting the write itself
+func isUnavailable(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, driver.ErrBadConn) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		// Class 08 is connection exceptions, 57P covers shutdowns and the server still starting
+		class := pqErr.Code.Class()
+		return class == "08" || (class == "57" && len(pqErr.Code) == 5 && pqErr.Code[2] == 'P')
+	}
+	return false
+}
+
+// applyWrite stores a usage write with its original semantics:
+// "set" replaces the day's total, "add" increments it. created is only meaningful for "set".
+func applyWrite(ctx context.Context, entry DeadLetter) (created bool, err error) {
+	switch entry.Mode {
+	case "set":
+		return store.SetUsage(ctx, entry.Usage, entry.Source)
+	case "add":
+		return false, store.AddUsage(ctx, entry.Usage, entry.Source)
+	}
+	return false, errors.New("unknown write mode " + entry.Mode)
+}
+
+// active reports whether writes are queued; new writes must then queue behind them so a
+// replayed total never overwrites a newer one
+func (b *writeBuffer) active() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.entries) > 0
+}
+
+func (b *writeBuffer) enqueue(entry DeadLetter) error {
+	entry.ID = newUUID()
+	entry.ReceivedAt = time.Now()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.entries) >= b.capacity {
+		return errBufferFull
+	}
+	if err := b.appendLine(entry); err != nil {
+		return err
+	}
+	if len(b.entries) == 0 {
+		log.Printf("Database unavailable, buffering usage writes")
+	}
+	b.entries = append(b.entries, entry)
+	b.notify()
+	return nil
+}
+
+// appliedMode marks a line of the buffer file recording that the write with its ID was stored
+const appliedMode = "applied"
+
+// appendLine appends an entry to the disk copy, if there is one; b.mu must be held
+func (b *writeBuffer) appendLine(entry DeadLetter) error {
+	if b.path == "" {
+		return nil
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(b.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(line, '\n'))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// notify prompts run to try flushing now rather than at the next tick
+func (b *writeBuffer) notify() {
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+}
+
+// load restores writes left on disk by a previous run
+func (b *writeBuffer) load() error {
+	if b.path == "" {
+		return nil
+	}
+	lines, err := readWriteLog(b.path)
+	if err != nil {
+		return err
+	}
+	applied := map[string]bool{}
+	for _, line := range lines {
+		if line.Mode == appliedMode {
+			applied[line.ID] = true
+		}
+	}
+	entries := []DeadLetter{}
+	for _, line := range lines {
+		if line.Mode != appliedMode && !applied[line.ID] {
+			entries = append(entries, line)
+		}
+	}
+	b.mu.Lock()
+	b.entries = append(entries, b.entries...)
+	b.mu.Unlock()
+	if len(entries) > 0 {
+		infof("Restored %d buffered usage writes from %s\n", len(entries), b.path)
+	}
+	return nil
+}
+
+// run drains the buffer whenever the database is available, checking every few seconds
+func (b *writeBuffer) run() {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-b.wake:
+			// Give a blip a moment to pass before the first retry
+			time.Sleep(time.Second)
+		}
+		if b.active() && dbHealth.available() {
+			b.flush()
+		}
+	}
+}
+
+// flush replays queued writes in order until the buffer is empty or the database goes away
+// again. Writes the database rejects outright go to the dead-letter queue.
+func (b *writeBuffer) flush() {
+	flushed := 0
+	for {
+		b.mu.Lock()
+		if len(b.entries) == 0 {
+			b.mu.Unlock()
+			break
+		}
+		entry := b.entries[0]
+		b.mu.Unlock()
+
+		_, err := applyWrite(context.Background(), entry)
+		if err != nil && isUnavailable(err) {
+			dbHealth.trip(err)
+			log.Printf("Database still unavailable, %d usage writes remain buffered: %v", b.size(), err)
+			break
+		}
+		if err != nil {
+			deadLetter(entry.Mode, entry.Source, entry.Usage, err)
+		}
+		if entry.Mode == "set" {
+			liveUsage.flushed(entry.Usage)
+		}
+		b.mu.Lock()
+		b.entries = b.entries[1:]
+		if err := b.appendLine(DeadLetter{ID: entry.ID, Mode: appliedMode}); err != nil {
+			log.Printf("Failed to mark buffered write %s applied in %s: %v", entry.ID, b.path, err)
+		}
+		b.mu.Unlock()
+		flushed++
+	}
+	if flushed > 0 {
+		infof("Flushed %d buffered usage writes\n", flushed)
+		b.persist()
+	}
+}
+
+func (b *writeBuffer) size() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.entries)
+}
+
+// persist rewrites the disk copy to match what is still queued
+func (b *writeBuffer) persist() {
+	if b.path == "" {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := writeWriteLog(b.path, b.entries); err != nil {
+		log.Printf("Failed to update write buffer file %s: %v", b.path, err)
+	}
+}
+
+func getWriteBuffer(w http.ResponseWriter, r *http.Request) {
+	pendingWrites.mu.Lock()
+	status := map[string]interface{}{
+		"pending":  len(pendingWrites.entries),
+		"capacity": pendingWrites.capacity,
+		"file":     pendingWrites.path,
+	}
+	if len(pendingWrites.entries) > 0 {
+		status["oldest"] = pendingWrites.entries[0].ReceivedAt
+	}
+	pendingWrites.mu.Unlock()
+	respondJSON(w, http.StatusOK, status)
+}
+
+// storeOrBuffer applies a write, or queues it if the database is unavailable or earlier
+// writes are still queued. When buffered is false the write has finished, successfully or not.
+func storeOrBuffer(ctx context.Context, entry DeadLetter) (created, buffered bool, err error) {
+	if dbHealth.available() && !pendingWrites.active() {
+		created, err = applyWrite(ctx, entry)
+		if err == nil || !isUnavailable(err) {
+			return created, false, err
+		}
+		dbHealth.trip(err)
+	}
+	if qerr := pendingWrites.enqueue(entry); qerr != nil {
+		if err == nil {
+			err = qerr
+		} else {
+			err = fmt.Errorf("%w (%v)", qerr, err)
+		}
+		return false, false, err
+	}
+	return false, true, nil
+}
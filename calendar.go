@@ -0,0 +1,144 @@
+// calendar.go
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// calendarLevels is the number of intensity levels above zero, as on GitHub's contribution
+// calendar
+const calendarLevels = 4
+
+// CalendarDay is a day of the usage calendar. Level is 0 for days without usage and 1 to 4
+// for the quartiles of the days with usage.
+type CalendarDay struct {
+	Date        string `json:"date"`
+	TotalTokens int64  `json:"total_tokens"`
+	Level       int    `json:"level"`
+}
+
+// getUsageCalendar returns daily totals for ?year= (this year by default) and, if given,
+// ?month= (otherwise the whole year, reported as month 0) as a calendar matrix for the
+// dashboard's heat calendar: weeks from Sunday to Saturday, each day with its intensity level,
+// and days of a week outside the range null. thresholds are the upper bounds of levels 1 to 3,
+// for the legend. ?model= and ?project= narrow it down.
+func getUsageCalendar(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	today := time.Now().Truncate(24 * time.Hour)
+	year := today.Year()
+	if v := q.Get("year"); v != "" {
+		y, err := strconv.Atoi(v)
+		if err != nil || y < 1 || y > 9999 {
+			respondJSON(w, http.StatusBadRequest, map[string]string{"message": "Invalid year " + v})
+			return
+		}
+		year = y
+	}
+	start := time.Date(year, time.January, 1, 0, 0, 0, 0, time.UTC)
+	end := start.AddDate(1, 0, -1)
+	month := 0
+	if v := q.Get("month"); v != "" {
+		m, err := strconv.Atoi(v)
+		if err != nil || m < 1 || m > 12 {
+			respondJSON(w, http.StatusBadRequest, map[string]string{"message": "Invalid month " + v + ", use 1 to 12"})
+			return
+		}
+		month = m
+		start = time.Date(year, time.Month(m), 1, 0, 0, 0, 0, time.UTC)
+		end = start.AddDate(0, 1, -1)
+	}
+	model, project := q.Get("model"), q.Get("project")
+	where := "u.date >= $1 AND u.date <= $2 AND ($3 = '' OR u.model = $3) AND ($4 = '' OR u.project = $4)"
+	if notModified(w, r, false, where, start, end, model, project) {
+		return
+	}
+	rows, err := db.QueryContext(r.Context(), "SELECT u.date, SUM(u.total_tokens) FROM token_usage u WHERE "+where+
+		" GROUP BY u.date", start, end, model, project)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database query error", err)
+		return
+	}
+	defer rows.Close()
+	totals := map[string]int64{}
+	for rows.Next() {
+		var date time.Time
+		var tokens int64
+		if err := rows.Scan(&date, &tokens); err != nil {
+			respondError(w, http.StatusInternalServerError, "Error scanning row", err)
+			return
+		}
+		totals[date.Format("2006-01-02")] = tokens
+	}
+	if err = rows.Err(); err != nil {
+		respondError(w, http.StatusInternalServerError, "Error reading data", err)
+		return
+	}
+
+	thresholds := calendarThresholds(totals)
+	var weeks [][]*CalendarDay
+	var total, peak int64
+	// The first week starts on the Sunday on or before start
+	for weekStart := start.AddDate(0, 0, -int(start.Weekday())); !weekStart.After(end); weekStart = weekStart.AddDate(0, 0, 7) {
+		week := make([]*CalendarDay, 7)
+		for i := range week {
+			day := weekStart.AddDate(0, 0, i)
+			if day.Before(start) || day.After(end) {
+				continue
+			}
+			key := day.Format("2006-01-02")
+			tokens := totals[key]
+			week[i] = &CalendarDay{Date: key, TotalTokens: tokens, Level: calendarLevel(tokens, thresholds)}
+			total += tokens
+			peak = max(peak, tokens)
+		}
+		weeks = append(weeks, week)
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"model":        model,
+		"project":      project,
+		"year":         year,
+		"month":        month,
+		"start":        start.Format("2006-01-02"),
+		"end":          end.Format("2006-01-02"),
+		"weeks":        weeks,
+		"thresholds":   thresholds,
+		"total_tokens": total,
+		"max_tokens":   peak,
+	})
+}
+
+// calendarThresholds splits the days with positive usage into quartiles and returns the
+// largest total of each of the lower three
+func calendarThresholds(totals map[string]int64) []int64 {
+	var values []int64
+	for _, v := range totals {
+		if v > 0 {
+			values = append(values, v)
+		}
+	}
+	thresholds := make([]int64, calendarLevels-1)
+	if len(values) == 0 {
+		return thresholds
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+	for i := range thresholds {
+		thresholds[i] = values[(len(values)*(i+1)-1)/calendarLevels]
+	}
+	return thresholds
+}
+
+func calendarLevel(tokens int64, thresholds []int64) int {
+	if tokens <= 0 {
+		return 0
+	}
+	level := 1
+	for _, t := range thresholds {
+		if tokens > t {
+			level++
+		}
+	}
+	return level
+}
@@ -0,0 +1,185 @@
+// catalog.go
+package main
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// The pricing catalog prices models nobody has priced by hand, so costs are reported out of the
+// box. It ships embedded in the binary and can be kept current by the pricing_catalog job, which
+// fetches a community price list in LiteLLM's model_prices_and_context_window.json format.
+// Catalog prices are the last resort after model_pricing and the price history, and a catalog
+// change reprices all of a model's usage; set a price with PUT /pricing/{model} to pin it.
+//
+//go:embed pricing_catalog.json
+var embeddedPricingCatalog []byte
+
+// embeddedCatalogSource marks catalog entries from the binary, which a fetched list overrides
+const embeddedCatalogSource = "embedded"
+
+var catalogClient = &http.Client{Timeout: time.Minute}
+
+// PricingCatalogConfig controls the pricing catalog
+type PricingCatalogConfig struct {
+	// Disabled turns the catalog off, leaving unpriced models at no cost
+	Disabled bool `json:"disabled"`
+	// URL of a LiteLLM-format price list fetched daily; none keeps the embedded catalog
+	URL string `json:"url"`
+}
+
+// CatalogPrice is a catalog entry as listed by GET /pricing/catalog
+type CatalogPrice struct {
+	Model           string    `json:"model"`
+	PricePerMillion float64   `json:"price_per_million"`
+	Source          string    `json:"source"`
+	UpdatedAt       time.Time `json:"updated_at"`
+}
+
+// catalogEntry is the part of a LiteLLM price list entry the catalog uses
+type catalogEntry struct {
+	InputCostPerToken  *float64 `json:"input_cost_per_token"`
+	OutputCostPerToken *float64 `json:"output_cost_per_token"`
+}
+
+// parsePricingCatalog turns a LiteLLM-format price list into prices per million tokens. Usage
+// is recorded as total tokens only, so the price blends input and output at an even split;
+// entries without an output price, such as embeddings, take the input price. Keys prefixed
+// with a provider ("gemini/gemini-1.5-pro") are also listed under the bare model name unless
+// the list has an entry of its own for it. Entries without prices are skipped.
+func parsePricingCatalog(data []byte) (map[string]float64, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	prices := make(map[string]float64)
+	bare := make(map[string]float64)
+	for key, msg := range raw {
+		var e catalogEntry
+		// Not every entry is a model (LiteLLM has a sample_spec), so skip what doesn't fit
+		if json.Unmarshal(msg, &e) != nil || e.InputCostPerToken == nil {
+			continue
+		}
+		price := *e.InputCostPerToken
+		if e.OutputCostPerToken != nil && *e.OutputCostPerToken > 0 {
+			price = (price + *e.OutputCostPerToken) / 2
+		}
+		if price < 0 {
+			continue
+		}
+		prices[key] = price * 1e6
+		if i := strings.LastIndex(key, "/"); i >= 0 {
+			bare[key[i+1:]] = price * 1e6
+		}
+	}
+	for model, price := range bare {
+		if _, ok := prices[model]; !ok {
+			prices[model] = price
+		}
+	}
+	if len(prices) == 0 {
+		return nil, fmt.Errorf("no priced models in catalog")
+	}
+	return prices, nil
+}
+
+// storeCatalog upserts catalog prices from source. The embedded catalog only replaces its own
+// entries, so prices fetched earlier survive a restart.
+func storeCatalog(ctx context.Context, prices map[string]float64, source string) error {
+	models := make([]string, 0, len(prices))
+	for model := range prices {
+		models = append(models, model)
+	}
+	sort.Strings(models)
+	values := make([]float64, len(models))
+	for i, model := range models {
+		values[i] = prices[model]
+	}
+	_, err := db.ExecContext(ctx, `INSERT INTO pricing_catalog (model, price_per_million, source)
+        SELECT model, price, $3 FROM unnest($1::TEXT[], $2::DOUBLE PRECISION[]) AS c(model, price)
+        ON CONFLICT (model) DO UPDATE SET price_per_million = EXCLUDED.price_per_million, source = EXCLUDED.source, updated_at = NOW()
+        WHERE (pricing_catalog.price_per_million <> EXCLUDED.price_per_million OR pricing_catalog.source <> EXCLUDED.source)
+            AND ($3 <> '`+embeddedCatalogSource+`' OR pricing_catalog.source = $3)`,
+		pq.Array(models), pq.Array(values), source)
+	return err
+}
+
+// syncPricingCatalog applies the catalog settings on (re)load: it loads the embedded catalog,
+// or empties the catalog when it is disabled
+func syncPricingCatalog(cfg PricingCatalogConfig) error {
+	if cfg.Disabled {
+		_, err := db.Exec("DELETE FROM pricing_catalog")
+		return err
+	}
+	prices, err := parsePricingCatalog(embeddedPricingCatalog)
+	if err != nil {
+		return fmt.Errorf("embedded catalog: %w", err)
+	}
+	return storeCatalog(context.Background(), prices, embeddedCatalogSource)
+}
+
+// refreshPricingCatalog is the pricing_catalog job: it fetches the configured price list
+func refreshPricingCatalog(ctx context.Context) error {
+	cfg := currentConfig.Load().PricingCatalog
+	if cfg.Disabled || cfg.URL == "" {
+		return nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, cfg.URL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := catalogClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetching pricing catalog: %s", resp.Status)
+	}
+	var data json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return fmt.Errorf("reading pricing catalog: %w", err)
+	}
+	prices, err := parsePricingCatalog(data)
+	if err != nil {
+		return fmt.Errorf("parsing pricing catalog: %w", err)
+	}
+	if err := storeCatalog(ctx, prices, cfg.URL); err != nil {
+		return err
+	}
+	infof("Refreshed pricing catalog with %d models from %s\n", len(prices), cfg.URL)
+	return nil
+}
+
+// getPricingCatalog lists catalog prices, only those for models containing ?model= if given
+func getPricingCatalog(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.QueryContext(r.Context(), `SELECT model, price_per_million, source, updated_at FROM pricing_catalog
+        WHERE $1 = '' OR strpos(model, $1) > 0 ORDER BY model`, r.URL.Query().Get("model"))
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database query error", err)
+		return
+	}
+	defer rows.Close()
+	prices := []CatalogPrice{}
+	for rows.Next() {
+		var p CatalogPrice
+		if err := rows.Scan(&p.Model, &p.PricePerMillion, &p.Source, &p.UpdatedAt); err != nil {
+			respondError(w, http.StatusInternalServerError, "Error scanning row", err)
+			return
+		}
+		prices = append(prices, p)
+	}
+	if err = rows.Err(); err != nil {
+		respondError(w, http.StatusInternalServerError, "Error reading data", err)
+		return
+	}
+	respondJSON(w, http.StatusOK, prices)
+}
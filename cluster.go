@@ -0,0 +1,157 @@
+// cluster.go
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// When several replicas share a database behind a load balancer, each write is announced
+// with NOTIFY so the others can push the change to their own event stream clients.
+const usageChannel = "tokencounter_usage"
+
+// UsageChange is the event published for every stored increment of usage. A change with
+// Resync set carries no data and means events may have been missed, so clients should refetch.
+type UsageChange struct {
+	Date        string `json:"date,omitempty"`
+	Model       string `json:"model,omitempty"`
+	Project     string `json:"project,omitempty"`
+	Source      string `json:"source,omitempty"`
+	TotalTokens int    `json:"total_tokens,omitempty"`
+	Replica     string `json:"replica"`
+	Resync      bool   `json:"resync,omitempty"`
+}
+
+// replicaID tells this process's notifications apart from other replicas'
+var replicaID = newUUID()
+
+// usageHub fans usage changes, local or remote, out to in-process subscribers
+type usageHub struct {
+	mu   sync.Mutex
+	subs map[chan UsageChange]bool
+}
+
+var usageChanges = &usageHub{subs: map[chan UsageChange]bool{}}
+
+func (h *usageHub) subscribe() chan UsageChange {
+	ch := make(chan UsageChange, 64)
+	h.mu.Lock()
+	h.subs[ch] = true
+	h.mu.Unlock()
+	return ch
+}
+
+func (h *usageHub) unsubscribe(ch chan UsageChange) {
+	h.mu.Lock()
+	delete(h.subs, ch)
+	h.mu.Unlock()
+}
+
+// broadcast delivers a change to every subscriber; slow subscribers miss events rather than
+// block writers
+func (h *usageHub) broadcast(change UsageChange) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs {
+		select {
+		case ch <- change:
+		default:
+		}
+	}
+}
+
+// publishUsageChange announces a local write to this replica's subscribers and to the others
+func publishUsageChange(event UsageEvent) {
+	change := UsageChange{
+		Date:        event.Date.Format("2006-01-02"),
+		Model:       event.Model,
+		Project:     event.Project,
+		Source:      event.Source,
+		TotalTokens: event.TotalTokens,
+		Replica:     replicaID,
+	}
+	usageChanges.broadcast(change)
+	payload, err := json.Marshal(change)
+	if err != nil || db == nil || !dbHealth.available() {
+		return
+	}
+	go func() {
+		if _, err := db.Exec("SELECT pg_notify($1, $2)", usageChannel, string(payload)); err != nil {
+			debugf("Failed to notify other replicas: %v\n", err)
+		}
+	}()
+}
+
+// listenForUsageChanges relays other replicas' writes to local subscribers. The listener
+// reconnects on its own; after a reconnect subscribers are told to resync, since
+// notifications sent in the meantime are lost.
+func listenForUsageChanges(dbUrl string) {
+	listener := pq.NewListener(dbUrl, time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("Usage change listener: %v", err)
+		}
+	})
+	if err := listener.Listen(usageChannel); err != nil {
+		log.Printf("Failed to listen for usage changes, other replicas' writes won't be streamed: %v", err)
+		return
+	}
+	for n := range listener.Notify {
+		if n == nil {
+			usageChanges.broadcast(UsageChange{Replica: replicaID, Resync: true})
+			continue
+		}
+		var change UsageChange
+		if err := json.Unmarshal([]byte(n.Extra), &change); err != nil {
+			log.Printf("Ignoring malformed usage notification: %v", err)
+			continue
+		}
+		if change.Replica != replicaID {
+			usageChanges.broadcast(change)
+		}
+	}
+}
+
+// streamUsageEvents streams usage changes from every replica as server-sent events,
+// optionally filtered to one model with ?model=
+func streamUsageEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		respondJSON(w, http.StatusInternalServerError, map[string]string{"message": "Streaming not supported"})
+		return
+	}
+	model := r.URL.Query().Get("model")
+	scope, scoped := projectScope(r.Context())
+	ch := usageChanges.subscribe()
+	defer usageChanges.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	keepalive := time.NewTicker(30 * time.Second)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case change := <-ch:
+			if model != "" && !change.Resync && change.Model != model {
+				continue
+			}
+			if scoped && !change.Resync && change.Project != scope {
+				continue
+			}
+			data, _ := json.Marshal(change)
+			fmt.Fprintf(w, "event: usage\ndata: %s\n\n", data)
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,488 @@
+// coldstorage.go
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+	"github.com/lib/pq"
+)
+
+// Usage older than cold_storage.after_days is moved out of the database a month at a time by
+// the cold_storage job. A month's records are written as gzipped JSONL, one TokenUsage per
+// line, to the destination: a directory, such as a mounted bucket, or an http(s) URL each
+// object is PUT under, with COLD_STORAGE_TOKEN as a bearer token if set. Only once the object
+// is written are the records deleted, in the transaction that adds the object to the
+// usage_archives manifest. The month's request log is archived the same way, one UsageRequest
+// per line, to a second object beside it. Records and requests that arrive later for an
+// archived month are archived into other objects on the next run.
+//
+// Monthly summaries of archived months are kept, and sealed days in them are no longer
+// compared with their hash. `tokencounter restore-archive <id>` brings an archive's records
+// and request log back.
+
+// ColdStorageConfig configures archival; it is off until both are set
+type ColdStorageConfig struct {
+	Destination string `json:"destination"`
+	// AfterDays is how many days old the last day of a month must be for it to be archived
+	AfterDays int `json:"after_days"`
+}
+
+func (c ColdStorageConfig) validate() error {
+	if c.AfterDays < 0 {
+		return fmt.Errorf("after_days must not be negative")
+	}
+	if c.Destination != "" && c.AfterDays == 0 {
+		return fmt.Errorf("after_days is required with a destination")
+	}
+	return nil
+}
+
+func (c ColdStorageConfig) enabled() bool {
+	return c.Destination != "" && c.AfterDays > 0
+}
+
+// coldStorageFromEnv reads COLD_STORAGE_DESTINATION and COLD_STORAGE_AFTER_DAYS
+func coldStorageFromEnv() ColdStorageConfig {
+	c := ColdStorageConfig{Destination: os.Getenv("COLD_STORAGE_DESTINATION")}
+	c.AfterDays, _ = strconv.Atoi(os.Getenv("COLD_STORAGE_AFTER_DAYS"))
+	return c
+}
+
+// UsageArchive is an entry of the usage_archives manifest
+type UsageArchive struct {
+	ID          int    `json:"id"`
+	Month       string `json:"month"`
+	Object      string `json:"object"`
+	Destination string `json:"destination"`
+	Records     int    `json:"records"`
+	TotalTokens int64  `json:"total_tokens"`
+	Bytes       int64  `json:"bytes"`
+	SHA256      string `json:"sha256"`
+	// RequestsObject holds the month's request log; it is "" if there was none to archive
+	RequestsObject string     `json:"requests_object"`
+	RequestRecords int        `json:"request_records"`
+	RequestsSHA256 string     `json:"requests_sha256"`
+	ArchivedAt     time.Time  `json:"archived_at"`
+	RestoredAt     *time.Time `json:"restored_at,omitempty"`
+}
+
+const usageArchiveColumns = "id, to_char(month, 'YYYY-MM'), object, destination, records, total_tokens, bytes, sha256, " +
+	"requests_object, request_records, requests_sha256, archived_at, restored_at"
+
+func scanUsageArchive(row interface{ Scan(...interface{}) error }) (UsageArchive, error) {
+	var a UsageArchive
+	err := row.Scan(&a.ID, &a.Month, &a.Object, &a.Destination, &a.Records, &a.TotalTokens, &a.Bytes, &a.SHA256,
+		&a.RequestsObject, &a.RequestRecords, &a.RequestsSHA256, &a.ArchivedAt, &a.RestoredAt)
+	return a, err
+}
+
+// archivedMonths returns the months, as YYYY-MM, with records in cold storage
+func archivedMonths(ctx context.Context) (map[string]bool, error) {
+	rows, err := db.QueryContext(ctx, "SELECT DISTINCT to_char(month, 'YYYY-MM') FROM usage_archives WHERE restored_at IS NULL")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	months := map[string]bool{}
+	for rows.Next() {
+		var month string
+		if err := rows.Scan(&month); err != nil {
+			return nil, err
+		}
+		months[month] = true
+	}
+	return months, rows.Err()
+}
+
+// coldObjectURL returns where an object lives under an http(s) destination, or "" for a directory
+func coldObjectURL(destination, name string) string {
+	if strings.HasPrefix(destination, "http://") || strings.HasPrefix(destination, "https://") {
+		return strings.TrimSuffix(destination, "/") + "/" + name
+	}
+	return ""
+}
+
+func putColdObject(ctx context.Context, destination, name string, body []byte) error {
+	u := coldObjectURL(destination, name)
+	if u == "" {
+		if err := os.MkdirAll(destination, 0755); err != nil {
+			return err
+		}
+		// Written under a temporary name so a partial object never carries the real one
+		tmp := filepath.Join(destination, "."+name+".tmp")
+		if err := os.WriteFile(tmp, body, 0644); err != nil {
+			return err
+		}
+		return os.Rename(tmp, filepath.Join(destination, name))
+	}
+	req, err := http.NewRequestWithContext(ctx, "PUT", u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/gzip")
+	resp, err := coldStorageRequest(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func getColdObject(ctx context.Context, destination, name string) ([]byte, error) {
+	u := coldObjectURL(destination, name)
+	if u == "" {
+		return os.ReadFile(filepath.Join(destination, name))
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := coldStorageRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+var coldStorageClient = &http.Client{Timeout: 5 * time.Minute}
+
+// coldStorageRequest sends a request to an http(s) destination, failing on any status but 2xx
+func coldStorageRequest(req *http.Request) (*http.Response, error) {
+	if token := os.Getenv("COLD_STORAGE_TOKEN"); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := coldStorageClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s %s: %s: %s", req.Method, req.URL.Redacted(), resp.Status, strings.TrimSpace(string(body)))
+	}
+	return resp, nil
+}
+
+// archiveColdUsage is the cold_storage job: it archives every month whose last day is at least
+// after_days old, oldest first
+func archiveColdUsage(ctx context.Context) error {
+	cfg := currentConfig.Load().ColdStorage
+	if !cfg.enabled() {
+		return nil
+	}
+	cutoff := time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, -cfg.AfterDays)
+	// Months ending on or before the cutoff
+	before := startOfMonth(cutoff.AddDate(0, 0, 1))
+	rows, err := db.QueryContext(ctx, "SELECT DISTINCT date_trunc('month', date)::DATE FROM token_usage WHERE date < $1 ORDER BY 1", before)
+	if err != nil {
+		return err
+	}
+	var months []time.Time
+	for rows.Next() {
+		var month time.Time
+		if err := rows.Scan(&month); err != nil {
+			rows.Close()
+			return err
+		}
+		months = append(months, month)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, month := range months {
+		archive, err := archiveMonth(ctx, cfg.Destination, month)
+		if err != nil {
+			return fmt.Errorf("%s: %w", month.Format("2006-01"), err)
+		}
+		infof("Archived %d records of %s to %s\n", archive.Records, archive.Month, archive.Object)
+	}
+	return nil
+}
+
+// archiveMonth writes a month's records to cold storage and deletes them. The records are
+// locked while the object is written, so none can change between being archived and deleted.
+func archiveMonth(ctx context.Context, destination string, month time.Time) (UsageArchive, error) {
+	archive := UsageArchive{Month: month.Format("2006-01"), Destination: destination}
+	next := month.AddDate(0, 1, 0)
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return archive, err
+	}
+	defer tx.Rollback()
+	rows, err := tx.QueryContext(ctx, `SELECT id, date, model, project, total_tokens, cost, requests, characters, credits, provider, prompt_tokens, completion_tokens, created_at, updated_at
+        FROM token_usage WHERE date >= $1 AND date < $2 ORDER BY date, model, project, id FOR UPDATE`, month, next)
+	if err != nil {
+		return archive, err
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	enc := json.NewEncoder(zw)
+	var ids []int64
+	for rows.Next() {
+		var usage TokenUsage
+		if err := rows.Scan(&usage.ID, &usage.Date, &usage.Model, &usage.Project, &usage.TotalTokens, &usage.Cost, &usage.Requests, &usage.Characters, &usage.Credits,
+			&usage.Provider, &usage.PromptTokens, &usage.CompletionTokens, &usage.CreatedAt, &usage.UpdatedAt); err != nil {
+			rows.Close()
+			return archive, err
+		}
+		if err := enc.Encode(usage); err != nil {
+			rows.Close()
+			return archive, err
+		}
+		ids = append(ids, int64(usage.ID))
+		archive.Records++
+		archive.TotalTokens += int64(usage.TotalTokens)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return archive, err
+	}
+	if err := zw.Close(); err != nil {
+		return archive, err
+	}
+	requests, requestIDs, err := archiveRequestLog(ctx, tx, month, next)
+	if err != nil {
+		return archive, err
+	}
+	stamp := time.Now().Unix()
+	archive.Object = fmt.Sprintf("token_usage-%s-%d.jsonl.gz", archive.Month, stamp)
+	archive.Bytes = int64(buf.Len())
+	archive.SHA256 = sha256Hex(buf.Bytes())
+	if err := putColdObject(ctx, destination, archive.Object, buf.Bytes()); err != nil {
+		return archive, fmt.Errorf("writing %s: %w", archive.Object, err)
+	}
+	if len(requestIDs) > 0 {
+		archive.RequestsObject = fmt.Sprintf("usage_requests-%s-%d.jsonl.gz", archive.Month, stamp)
+		archive.RequestRecords = len(requestIDs)
+		archive.RequestsSHA256 = sha256Hex(requests)
+		if err := putColdObject(ctx, destination, archive.RequestsObject, requests); err != nil {
+			return archive, fmt.Errorf("writing %s: %w", archive.RequestsObject, err)
+		}
+	}
+
+	err = tx.QueryRowContext(ctx, `INSERT INTO usage_archives (month, object, destination, records, total_tokens, bytes, sha256, requests_object, request_records, requests_sha256)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) RETURNING id, archived_at`,
+		month, archive.Object, destination, archive.Records, archive.TotalTokens, archive.Bytes, archive.SHA256,
+		archive.RequestsObject, archive.RequestRecords, archive.RequestsSHA256).Scan(&archive.ID, &archive.ArchivedAt)
+	if err != nil {
+		return archive, err
+	}
+	// Records and requests added while the objects were written are left for the next run
+	if _, err := tx.ExecContext(ctx, "DELETE FROM token_usage WHERE id = ANY($1) AND date >= $2 AND date < $3", pq.Array(ids), month, next); err != nil {
+		return archive, err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM usage_requests WHERE id = ANY($1)", pq.Array(requestIDs)); err != nil {
+		return archive, err
+	}
+	return archive, tx.Commit()
+}
+
+// archiveRequestLog reads and locks a month's request log, returning it as a gzipped JSONL
+// object and the IDs of the requests it holds
+func archiveRequestLog(ctx context.Context, tx *sql.Tx, month, next time.Time) ([]byte, []int64, error) {
+	rows, err := tx.QueryContext(ctx, `SELECT id, logged_at, date, model, project, total_tokens, cost, requests
+        FROM usage_requests WHERE date >= $1 AND date < $2 ORDER BY id FOR UPDATE`, month, next)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	enc := json.NewEncoder(zw)
+	var ids []int64
+	for rows.Next() {
+		u, _, err := scanUsageRequest(rows)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := enc.Encode(u); err != nil {
+			return nil, nil, err
+		}
+		ids = append(ids, u.ID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, nil, err
+	}
+	return buf.Bytes(), ids, nil
+}
+
+// getUsageArchives lists the usage_archives manifest, newest first
+func getUsageArchives(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.QueryContext(r.Context(), "SELECT "+usageArchiveColumns+" FROM usage_archives ORDER BY month DESC, id DESC")
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database query error", err)
+		return
+	}
+	defer rows.Close()
+	archives := []UsageArchive{}
+	for rows.Next() {
+		archive, err := scanUsageArchive(rows)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, "Error scanning row", err)
+			return
+		}
+		archives = append(archives, archive)
+	}
+	if err = rows.Err(); err != nil {
+		respondError(w, http.StatusInternalServerError, "Error reading data", err)
+		return
+	}
+	respondJSON(w, http.StatusOK, archives)
+}
+
+// restoreUsageArchive reads an archive's objects back into token_usage and usage_requests,
+// checking them against their manifest entry first. Records whose date, model and project have
+// a row again, recorded after the month was archived, are left out rather than overwrite it;
+// it returns how many records were restored and skipped.
+func restoreUsageArchive(ctx context.Context, id int) (restored, skipped int, err error) {
+	archive, err := scanUsageArchive(db.QueryRowContext(ctx, "SELECT "+usageArchiveColumns+" FROM usage_archives WHERE id = $1", id))
+	if err == sql.ErrNoRows {
+		return 0, 0, fmt.Errorf("no archive %d", id)
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	if archive.RestoredAt != nil {
+		return 0, 0, fmt.Errorf("archive %d was already restored at %s", id, archive.RestoredAt.Format(time.RFC3339))
+	}
+	var usages []TokenUsage
+	err = readColdLines(ctx, archive.Destination, archive.Object, archive.SHA256, archive.Records, func(line []byte) error {
+		var usage TokenUsage
+		err := json.Unmarshal(line, &usage)
+		usages = append(usages, usage)
+		return err
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	var requests []UsageRequest
+	if archive.RequestsObject != "" {
+		err = readColdLines(ctx, archive.Destination, archive.RequestsObject, archive.RequestsSHA256, archive.RequestRecords, func(line []byte) error {
+			var request UsageRequest
+			err := json.Unmarshal(line, &request)
+			requests = append(requests, request)
+			return err
+		})
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	month, _ := time.Parse("2006-01", archive.Month)
+	if err := ensurePartition(ctx, month); err != nil {
+		return 0, 0, err
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+	for _, u := range usages {
+		res, err := tx.ExecContext(ctx, `INSERT INTO token_usage (date, model, project, total_tokens, cost, requests, characters, credits, provider, prompt_tokens, completion_tokens, created_at)
+            SELECT $1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, COALESCE($12, NOW())
+            WHERE NOT EXISTS (SELECT 1 FROM token_usage WHERE date = $1 AND model = $2 AND project = $3)`,
+			u.Date, u.Model, u.Project, u.TotalTokens, u.Cost, u.Requests, u.Characters, u.Credits, u.Provider, u.PromptTokens, u.CompletionTokens, u.CreatedAt)
+		if err != nil {
+			return 0, 0, err
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			restored++
+		} else {
+			skipped++
+		}
+	}
+	// Requests keep their IDs, so the log reads in the order it was written
+	for _, u := range requests {
+		_, err := tx.ExecContext(ctx, `INSERT INTO usage_requests (id, logged_at, date, model, project, total_tokens, cost, requests)
+            VALUES ($1, $2, $3, $4, $5, $6, $7, $8) ON CONFLICT (id) DO NOTHING`,
+			u.ID, u.LoggedAt, u.Date, u.Model, u.Project, u.TotalTokens, u.Cost, u.Requests)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE usage_archives SET restored_at = NOW() WHERE id = $1", id); err != nil {
+		return 0, 0, err
+	}
+	return restored, skipped, tx.Commit()
+}
+
+// readColdLines reads a gzipped JSONL object, checking it has the SHA-256 and number of lines
+// its manifest entry records, and passes each line to decode
+func readColdLines(ctx context.Context, destination, name, sha string, lines int, decode func([]byte) error) error {
+	body, err := getColdObject(ctx, destination, name)
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", name, err)
+	}
+	if sum := sha256Hex(body); sum != sha {
+		return fmt.Errorf("%s has SHA-256 %s, the manifest records %s", name, sum, sha)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	n := 0
+	scanner := bufio.NewScanner(zr)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if err := decode(scanner.Bytes()); err != nil {
+			return fmt.Errorf("invalid line in %s: %w", name, err)
+		}
+		n++
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if n != lines {
+		return fmt.Errorf("%s holds %d lines, the manifest records %d", name, n, lines)
+	}
+	return nil
+}
+
+// runRestoreArchive is `tokencounter restore-archive <id>`, run against DATABASE_URL
+func runRestoreArchive(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: tokencounter restore-archive <archive id>")
+	}
+	id, err := strconv.Atoi(args[0])
+	if err != nil {
+		return fmt.Errorf("invalid archive id %q", args[0])
+	}
+	godotenv.Load()
+	dbUrl := os.Getenv("DATABASE_URL")
+	if dbUrl == "" {
+		return fmt.Errorf("DATABASE_URL environment variable not set")
+	}
+	if db, err = openScopedDB(dbUrl); err != nil {
+		return err
+	}
+	defer db.Close()
+	restored, skipped, err := restoreUsageArchive(context.Background(), id)
+	if err != nil {
+		return err
+	}
+	message := fmt.Sprintf("Restored %d records from archive %d", restored, id)
+	if skipped > 0 {
+		message += fmt.Sprintf(", skipped %d recorded again since", skipped)
+	}
+	infof("%s\n", message)
+	return nil
+}
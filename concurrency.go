@@ -0,0 +1,218 @@
+// concurrency.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// A ConcurrencyLimit caps the proxied requests in flight to upstreams and models matching its
+// globs. All matching requests share the limit's slots. A request that finds them full moves
+// on to the next upstream of its pool; on the last one it waits up to QueueSeconds for a slot
+// and is otherwise rejected with 429.
+type ConcurrencyLimit struct {
+	ID            int    `json:"id"`
+	Upstream      string `json:"upstream"`
+	Model         string `json:"model"`
+	MaxConcurrent int    `json:"max_concurrent"`
+	QueueSeconds  int    `json:"queue_seconds"`
+	// InFlight is reported by GET, counting requests on this instance only
+	InFlight int `json:"in_flight"`
+}
+
+// ConcurrencyExceeded describes the limit that turned a proxied request away
+type ConcurrencyExceeded struct {
+	Error         string `json:"error"`
+	Message       string `json:"message"`
+	LimitID       int    `json:"limit_id"`
+	Upstream      string `json:"upstream"`
+	Model         string `json:"model"`
+	MaxConcurrent int    `json:"max_concurrent"`
+}
+
+const concurrencyLimitColumns = "id, upstream, model, max_concurrent, queue_seconds"
+
+// limitSlots holds a semaphore per limit. Changing a limit's size starts a fresh semaphore;
+// requests already holding slots of the old one finish uncounted.
+type limitSlots struct {
+	mu    sync.Mutex
+	slots map[int]chan struct{}
+}
+
+var proxySlots = &limitSlots{slots: map[int]chan struct{}{}}
+
+func (s *limitSlots) get(l ConcurrencyLimit) chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ch, ok := s.slots[l.ID]
+	if !ok || cap(ch) != l.MaxConcurrent {
+		ch = make(chan struct{}, l.MaxConcurrent)
+		s.slots[l.ID] = ch
+	}
+	return ch
+}
+
+func (s *limitSlots) inFlight(id int) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.slots[id])
+}
+
+// acquire takes a slot of every limit, in ID order so concurrent callers cannot deadlock.
+// If wait, a full limit is waited on for up to its QueueSeconds. It returns the limit that
+// could not be acquired, or a func releasing the slots taken.
+func (s *limitSlots) acquire(ctx context.Context, limits []ConcurrencyLimit, wait bool) (func(), *ConcurrencyLimit) {
+	var held []chan struct{}
+	release := func() {
+		for _, ch := range held {
+			<-ch
+		}
+	}
+	for i, l := range limits {
+		ch := s.get(l)
+		select {
+		case ch <- struct{}{}:
+			held = append(held, ch)
+			continue
+		default:
+		}
+		if !wait || l.QueueSeconds <= 0 {
+			release()
+			return nil, &limits[i]
+		}
+		timer := time.NewTimer(time.Duration(l.QueueSeconds) * time.Second)
+		select {
+		case ch <- struct{}{}:
+			held = append(held, ch)
+			timer.Stop()
+		case <-timer.C:
+			release()
+			return nil, &limits[i]
+		case <-ctx.Done():
+			timer.Stop()
+			release()
+			return nil, &limits[i]
+		}
+	}
+	return release, nil
+}
+
+// loadConcurrencyLimits returns the configured limits, or none while the database is down:
+// like budgets, limits fail open
+func loadConcurrencyLimits(ctx context.Context) ([]ConcurrencyLimit, error) {
+	if !dbHealth.available() {
+		return nil, nil
+	}
+	rows, err := db.QueryContext(ctx, "SELECT "+concurrencyLimitColumns+" FROM concurrency_limits ORDER BY id")
+	if err != nil {
+		if isUnavailable(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer rows.Close()
+	var limits []ConcurrencyLimit
+	for rows.Next() {
+		var l ConcurrencyLimit
+		if err := rows.Scan(&l.ID, &l.Upstream, &l.Model, &l.MaxConcurrent, &l.QueueSeconds); err != nil {
+			return nil, err
+		}
+		limits = append(limits, l)
+	}
+	return limits, rows.Err()
+}
+
+// matchingLimits picks the limits that apply to a request for model sent to upstream
+func matchingLimits(limits []ConcurrencyLimit, upstream, model string) []ConcurrencyLimit {
+	var matched []ConcurrencyLimit
+	for _, l := range limits {
+		if matchModelPattern(l.Upstream, upstream) && matchModelPattern(l.Model, model) {
+			matched = append(matched, l)
+		}
+	}
+	return matched
+}
+
+func concurrencyExceeded(l *ConcurrencyLimit) ConcurrencyExceeded {
+	return ConcurrencyExceeded{
+		Error:         "concurrency_limit_exceeded",
+		Message:       fmt.Sprintf("Too many requests in flight for upstream %s and model %s", l.Upstream, l.Model),
+		LimitID:       l.ID,
+		Upstream:      l.Upstream,
+		Model:         l.Model,
+		MaxConcurrent: l.MaxConcurrent,
+	}
+}
+
+func createConcurrencyLimit(w http.ResponseWriter, r *http.Request) {
+	l := ConcurrencyLimit{Upstream: "*", Model: "*"}
+	if err := json.NewDecoder(r.Body).Decode(&l); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request payload", err)
+		return
+	}
+	if l.Upstream == "" || l.Model == "" {
+		respondJSON(w, http.StatusBadRequest, map[string]string{"message": "upstream and model must not be empty, use * to match any"})
+		return
+	}
+	if l.MaxConcurrent <= 0 || l.QueueSeconds < 0 {
+		respondJSON(w, http.StatusBadRequest, map[string]string{"message": "max_concurrent must be positive and queue_seconds must not be negative"})
+		return
+	}
+	err := db.QueryRowContext(r.Context(), "INSERT INTO concurrency_limits (upstream, model, max_concurrent, queue_seconds) VALUES ($1, $2, $3, $4) RETURNING id",
+		l.Upstream, l.Model, l.MaxConcurrent, l.QueueSeconds).Scan(&l.ID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to create concurrency limit", err)
+		return
+	}
+	infof("Limited %s requests to %s to %d in flight\n", l.Model, l.Upstream, l.MaxConcurrent)
+	respondJSON(w, http.StatusCreated, l)
+}
+
+func getConcurrencyLimits(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.QueryContext(r.Context(), "SELECT "+concurrencyLimitColumns+" FROM concurrency_limits ORDER BY id")
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database query error", err)
+		return
+	}
+	defer rows.Close()
+	limits := []ConcurrencyLimit{}
+	for rows.Next() {
+		var l ConcurrencyLimit
+		if err := rows.Scan(&l.ID, &l.Upstream, &l.Model, &l.MaxConcurrent, &l.QueueSeconds); err != nil {
+			respondError(w, http.StatusInternalServerError, "Error scanning row", err)
+			return
+		}
+		l.InFlight = proxySlots.inFlight(l.ID)
+		limits = append(limits, l)
+	}
+	if err = rows.Err(); err != nil {
+		respondError(w, http.StatusInternalServerError, "Error reading data", err)
+		return
+	}
+	respondJSON(w, http.StatusOK, limits)
+}
+
+func deleteConcurrencyLimit(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid concurrency limit id", err)
+		return
+	}
+	res, err := db.ExecContext(r.Context(), "DELETE FROM concurrency_limits WHERE id = $1", id)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to delete concurrency limit", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		respondJSON(w, http.StatusNotFound, map[string]string{"message": "Concurrency limit not found"})
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]string{"message": "Concurrency limit deleted successfully"})
+}
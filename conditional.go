@@ -0,0 +1,59 @@
+// conditional.go
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// pricingStateExpr changes whenever any price that usagePriceJoin can pick does
+const pricingStateExpr = "COALESCE((SELECT md5(string_agg(model || ':' || price_per_million, ',' ORDER BY model)) FROM model_pricing), '') || " +
+	"COALESCE((SELECT md5(string_agg(model || ':' || effective_from || ':' || price_per_million, ',' ORDER BY model, effective_from)) FROM model_price_history), '') || " +
+	"COALESCE((SELECT MAX(updated_at)::TEXT FROM pricing_catalog), '')"
+
+// notModified answers a conditional GET for a slice of token_usage, given as a condition over
+// u with its arguments. The ETag covers the latest updated_at and row count of the slice,
+// so deletes count as changes too, plus anything else that shapes the response: the slice
+// bounds, response format settings, the locale and, for chart responses, the pricing tables and
+// annotations. It sets ETag and Last-Modified, and writes 304 and returns true if the client's
+// copy is current.
+func notModified(w http.ResponseWriter, r *http.Request, chart bool, where string, args ...interface{}) bool {
+	if db == nil {
+		return false
+	}
+	var latest sql.NullTime
+	var count int64
+	var chartState sql.NullString
+	chartExpr := "NULL"
+	if chart {
+		chartExpr = pricingStateExpr + " || (SELECT COUNT(*) || ':' || COALESCE(MAX(id), 0) FROM annotations)"
+	}
+	err := db.QueryRowContext(r.Context(), "SELECT MAX(u.updated_at), COUNT(*), "+chartExpr+" FROM token_usage u WHERE "+where, args...).Scan(&latest, &count, &chartState)
+	if err != nil {
+		// The handler's own query will report the problem
+		return false
+	}
+	cfg := currentConfig.Load()
+	loc, _ := resolveLocale("")
+	h := sha256.New()
+	fmt.Fprintf(h, "%d|%d|%s|%v|%v|%s|%v|%v", latest.Time.UnixMicro(), count, chartState.String, cfg.ResponseEnvelope, cfg.LegacyEmptyResponses, cfg.FieldNaming, loc, args)
+	etag := `W/"` + hex.EncodeToString(h.Sum(nil))[:32] + `"`
+	w.Header().Set("ETag", etag)
+	if latest.Valid {
+		w.Header().Set("Last-Modified", latest.Time.UTC().Format(http.TimeFormat))
+	}
+
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		if inm != etag && inm != "*" {
+			return false
+		}
+	} else if ims, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err != nil || !latest.Valid || latest.Time.Truncate(time.Second).After(ims) {
+		return false
+	}
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
@@ -0,0 +1,462 @@
+// config.go
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Config holds the settings that can be changed at runtime by editing the config file
+// (CONFIG_FILE, default config.json) and reloading. Environment variables provide defaults.
+type Config struct {
+	LogLevel          string                 `json:"log_level"`
+	CORSOrigins       []string               `json:"cors_origins"`
+	Notifications     NotificationConfig     `json:"notifications"`
+	DeprecationAlerts DeprecationAlertConfig `json:"deprecation_alerts"`
+	Sampling          SamplingConfig         `json:"sampling"`
+	Ask               AskConfig              `json:"ask"`
+	Pricing           map[string]float64     `json:"pricing"`
+	PricingCatalog    PricingCatalogConfig   `json:"pricing_catalog"`
+	CostRounding      CostRoundingConfig     `json:"cost_rounding"`
+	// DuplicateWindowMinutes is how long webhook request IDs are remembered to suppress
+	// redeliveries, default a day; 0 turns suppression off
+	DuplicateWindowMinutes *int               `json:"duplicate_window_minutes"`
+	WriteBatching          WriteBatchConfig   `json:"write_batching"`
+	LoadShedding           LoadSheddingConfig `json:"load_shedding"`
+	ColdStorage            ColdStorageConfig  `json:"cold_storage"`
+	Budgets                []ConfigBudget     `json:"budgets"`
+	// Jobs maps scheduled job names to cron expressions, or "off"
+	Jobs map[string]string `json:"jobs"`
+	// LegacyEmptyResponses restores the old responses for zero usage: 404 from the period
+	// endpoint and {status: 0|1} from the date/model endpoint
+	LegacyEmptyResponses bool `json:"legacy_empty_responses"`
+	// ResponseEnvelope wraps every JSON response as {data, meta, error}
+	ResponseEnvelope bool `json:"response_envelope"`
+	// FieldNaming is "snake_case" (the default) or "camelCase"
+	FieldNaming string       `json:"field_naming"`
+	Locale      LocaleConfig `json:"locale"`
+	Auth        AuthConfig   `json:"auth"`
+	// StatusPages maps providers to their status pages, polled for outages
+	StatusPages map[string]string `json:"status_pages"`
+	// IngestTransforms rewrite, drop or split records on ingest (see transforms.go)
+	IngestTransforms []IngestTransform `json:"ingest_transforms"`
+}
+
+// NotificationConfig supplies default targets for thresholds that don't set their own, and
+// named channels (see notify.go)
+type NotificationConfig struct {
+	WebhookURL      string `json:"webhook_url"`
+	SlackWebhookURL string `json:"slack_webhook_url"`
+	// EmailTo is a comma-separated list of addresses
+	EmailTo  string                         `json:"email_to"`
+	Channels map[string]NotificationChannel `json:"channels"`
+}
+
+// ConfigBudget is a budget declared in the config file. Config budgets are matched to
+// stored ones by model, period and window, so reloads keep their alert history.
+type ConfigBudget struct {
+	Model              string            `json:"model"`
+	Period             string            `json:"period"`
+	WindowDays         int               `json:"window_days"`
+	LimitTokens        int64             `json:"limit_tokens"`
+	CarryOverMaxTokens int64             `json:"carry_over_max_tokens"`
+	CooldownMinutes    *int              `json:"cooldown_minutes"`
+	Enforce            bool              `json:"enforce"`
+	Thresholds         []BudgetThreshold `json:"thresholds"`
+}
+
+var currentConfig atomic.Pointer[Config]
+
+// configMu serializes reloads
+var configMu sync.Mutex
+
+func init() {
+	currentConfig.Store(&Config{})
+}
+
+func configPath() string {
+	if p := os.Getenv("CONFIG_FILE"); p != "" {
+		return p
+	}
+	return "config.json"
+}
+
+// loadConfig builds a Config from the environment overlaid with the config file, if present
+func loadConfig(path string) (*Config, error) {
+	cfg := &Config{
+		LogLevel:               os.Getenv("LOG_LEVEL"),
+		LegacyEmptyResponses:   os.Getenv("LEGACY_EMPTY_RESPONSES") == "true",
+		ResponseEnvelope:       os.Getenv("RESPONSE_ENVELOPE") == "true",
+		FieldNaming:            os.Getenv("FIELD_NAMING"),
+		CostRounding:           costRoundingFromEnv(),
+		DuplicateWindowMinutes: duplicateWindowFromEnv(),
+		WriteBatching:          writeBatchingFromEnv(),
+		LoadShedding:           loadSheddingFromEnv(),
+		Locale:                 localeFromEnv(),
+		ColdStorage:            coldStorageFromEnv(),
+		Auth:                   authFromEnv(),
+		PricingCatalog: PricingCatalogConfig{
+			Disabled: os.Getenv("PRICING_CATALOG_DISABLED") == "true",
+			URL:      os.Getenv("PRICING_CATALOG_URL"),
+		},
+		Notifications: NotificationConfig{
+			WebhookURL:      os.Getenv("NOTIFY_WEBHOOK_URL"),
+			SlackWebhookURL: os.Getenv("SLACK_WEBHOOK_URL"),
+			EmailTo:         os.Getenv("NOTIFY_EMAIL_TO"),
+		},
+	}
+	if origins := os.Getenv("CORS_ORIGINS"); origins != "" {
+		for _, o := range strings.Split(origins, ",") {
+			cfg.CORSOrigins = append(cfg.CORSOrigins, strings.TrimSpace(o))
+		}
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return cfg, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	if cfg.LogLevel != "" {
+		if _, ok := logLevelNames[strings.ToLower(cfg.LogLevel)]; !ok {
+			return nil, fmt.Errorf("invalid log_level %q", cfg.LogLevel)
+		}
+	}
+	if cfg.FieldNaming != "" && cfg.FieldNaming != snakeCase && cfg.FieldNaming != camelCase {
+		return nil, fmt.Errorf("invalid field_naming %q, use %q or %q", cfg.FieldNaming, snakeCase, camelCase)
+	}
+	if err := cfg.Notifications.validate(); err != nil {
+		return nil, fmt.Errorf("notifications: %w", err)
+	}
+	for _, channel := range cfg.DeprecationAlerts.Channels {
+		if !cfg.Notifications.hasChannel(channel) {
+			return nil, fmt.Errorf("deprecation_alerts: unknown channel %q", channel)
+		}
+	}
+	if err := cfg.Sampling.compile(); err != nil {
+		return nil, fmt.Errorf("sampling: %w", err)
+	}
+	for name, expr := range cfg.Jobs {
+		if expr == "" || expr == "off" {
+			continue
+		}
+		if _, err := parseCron(expr); err != nil {
+			return nil, fmt.Errorf("schedule for job %s: %w", name, err)
+		}
+	}
+	if cfg.Ask.Upstream != "" && cfg.Ask.Model == "" {
+		return nil, fmt.Errorf("ask: model is required with an upstream")
+	}
+	if u := cfg.PricingCatalog.URL; u != "" && !strings.HasPrefix(u, "https://") && !strings.HasPrefix(u, "http://") {
+		return nil, fmt.Errorf("pricing_catalog: url must be http or https")
+	}
+	if err := cfg.CostRounding.validate(); err != nil {
+		return nil, fmt.Errorf("cost_rounding: %w", err)
+	}
+	if m := cfg.DuplicateWindowMinutes; m != nil && *m < 0 {
+		return nil, fmt.Errorf("duplicate_window_minutes must not be negative")
+	}
+	if err := cfg.WriteBatching.validate(); err != nil {
+		return nil, fmt.Errorf("write_batching: %w", err)
+	}
+	if err := cfg.LoadShedding.validate(); err != nil {
+		return nil, fmt.Errorf("load_shedding: %w", err)
+	}
+	if err := cfg.ColdStorage.validate(); err != nil {
+		return nil, fmt.Errorf("cold_storage: %w", err)
+	}
+	if err := cfg.Locale.validate(); err != nil {
+		return nil, fmt.Errorf("locale: %w", err)
+	}
+	if err := cfg.Auth.validate(); err != nil {
+		return nil, fmt.Errorf("auth: %w", err)
+	}
+	if err := validateStatusPages(cfg.StatusPages); err != nil {
+		return nil, fmt.Errorf("status_pages: %w", err)
+	}
+	for i, t := range cfg.IngestTransforms {
+		if err := t.validate(); err != nil {
+			return nil, fmt.Errorf("ingest_transforms[%d]: %w", i, err)
+		}
+	}
+	for model, price := range cfg.Pricing {
+		if price < 0 {
+			return nil, fmt.Errorf("negative price for %s", model)
+		}
+	}
+	seenBudgets := map[string]bool{}
+	for i := range cfg.Budgets {
+		b := configBudget(cfg.Budgets[i])
+		if err := validateBudget(&b, cfg.Notifications); err != nil {
+			return nil, fmt.Errorf("budget for %s: %w", cfg.Budgets[i].Model, err)
+		}
+		cfg.Budgets[i].Thresholds = b.Thresholds
+		key := fmt.Sprintf("%s/%s/%d", b.Model, b.Period, b.WindowDays)
+		if seenBudgets[key] {
+			return nil, fmt.Errorf("budget for %s: another budget has the same period and window", b.Model)
+		}
+		seenBudgets[key] = true
+	}
+	return cfg, nil
+}
+
+func configBudget(cb ConfigBudget) Budget {
+	b := Budget{
+		Model:              cb.Model,
+		Period:             cb.Period,
+		WindowDays:         cb.WindowDays,
+		LimitTokens:        cb.LimitTokens,
+		CarryOverMaxTokens: cb.CarryOverMaxTokens,
+		CooldownMinutes:    defaultBudgetCooldownMinutes,
+		Enforce:            cb.Enforce,
+		Thresholds:         cb.Thresholds,
+	}
+	if cb.CooldownMinutes != nil {
+		b.CooldownMinutes = *cb.CooldownMinutes
+	}
+	if len(b.Thresholds) == 0 {
+		b.Thresholds = append([]BudgetThreshold(nil), defaultBudgetThresholds...)
+	}
+	return b
+}
+
+// reloadConfig reads the config file and applies it; on error the running config is kept
+func reloadConfig() (*Config, error) {
+	configMu.Lock()
+	defer configMu.Unlock()
+	cfg, err := loadConfig(configPath())
+	if err != nil {
+		return nil, err
+	}
+	if cfg.LogLevel != "" {
+		setLogLevel(cfg.LogLevel)
+	}
+	if err := syncConfigPricing(cfg.Pricing); err != nil {
+		return nil, fmt.Errorf("applying pricing: %w", err)
+	}
+	if err := syncPricingCatalog(cfg.PricingCatalog); err != nil {
+		return nil, fmt.Errorf("applying pricing catalog: %w", err)
+	}
+	if err := syncConfigBudgets(cfg.Budgets); err != nil {
+		return nil, fmt.Errorf("applying budgets: %w", err)
+	}
+	currentConfig.Store(cfg)
+	infof("Configuration loaded from %s\n", configPath())
+	return cfg, nil
+}
+
+// syncConfigPricing applies prices from the config file. A changed price takes effect today,
+// like one set with PUT /pricing/{model}, so reloading does not reprice old usage.
+func syncConfigPricing(pricing map[string]float64) error {
+	today := time.Now().Truncate(24 * time.Hour)
+	for model, price := range pricing {
+		current, priced, err := priceInForce(context.Background(), model, today)
+		if err != nil {
+			return err
+		}
+		if priced && current == price {
+			continue
+		}
+		if err := setModelPrice(context.Background(), model, price, today); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncConfigBudgets makes the config-managed budgets match the file. Budgets created through
+// the API are never touched. Thresholds are only replaced when they actually changed, since
+// replacing them resets their alert history.
+func syncConfigBudgets(budgets []ConfigBudget) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	keep := []int{}
+	for _, cb := range budgets {
+		b := configBudget(cb)
+		var id int
+		err := tx.QueryRow("SELECT id FROM budgets WHERE config_managed AND model = $1 AND period = $2 AND window_days = $3",
+			b.Model, b.Period, b.WindowDays).Scan(&id)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		if err == sql.ErrNoRows {
+			err = tx.QueryRow(`INSERT INTO budgets (model, period, window_days, limit_tokens, carry_over_max_tokens, cooldown_minutes, enforce, config_managed)
+                VALUES ($1, $2, $3, $4, $5, $6, $7, TRUE) RETURNING id`,
+				b.Model, b.Period, b.WindowDays, b.LimitTokens, b.CarryOverMaxTokens, b.CooldownMinutes, b.Enforce).Scan(&id)
+			if err != nil {
+				return err
+			}
+		} else {
+			_, err = tx.Exec(`UPDATE budgets SET limit_tokens = $1, carry_over_max_tokens = $2, cooldown_minutes = $3, enforce = $4
+                WHERE id = $5`, b.LimitTokens, b.CarryOverMaxTokens, b.CooldownMinutes, b.Enforce, id)
+			if err != nil {
+				return err
+			}
+		}
+		keep = append(keep, id)
+
+		rows, err := tx.Query("SELECT percent, channel, target FROM budget_thresholds WHERE budget_id = $1", id)
+		if err != nil {
+			return err
+		}
+		var existing []string
+		for rows.Next() {
+			var t BudgetThreshold
+			if err := rows.Scan(&t.Percent, &t.Channel, &t.Target); err != nil {
+				rows.Close()
+				return err
+			}
+			existing = append(existing, thresholdKey(t))
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		var wanted []string
+		for _, t := range b.Thresholds {
+			wanted = append(wanted, thresholdKey(t))
+		}
+		sort.Strings(existing)
+		sort.Strings(wanted)
+		if strings.Join(existing, ",") == strings.Join(wanted, ",") {
+			continue
+		}
+		if _, err := tx.Exec("DELETE FROM budget_thresholds WHERE budget_id = $1", id); err != nil {
+			return err
+		}
+		for _, t := range b.Thresholds {
+			_, err := tx.Exec("INSERT INTO budget_thresholds (budget_id, percent, channel, target) VALUES ($1, $2, $3, $4)", id, t.Percent, t.Channel, t.Target)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	rows, err := tx.Query("SELECT id FROM budgets WHERE config_managed")
+	if err != nil {
+		return err
+	}
+	var stale []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		if !containsInt(keep, id) {
+			stale = append(stale, id)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, id := range stale {
+		if _, err := tx.Exec("DELETE FROM budgets WHERE id = $1", id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func thresholdKey(t BudgetThreshold) string {
+	return fmt.Sprintf("%d|%s|%s", t.Percent, t.Channel, t.Target)
+}
+
+func containsInt(list []int, v int) bool {
+	for _, x := range list {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+// watchConfig reloads when the config file changes on disk or the process receives SIGHUP
+func watchConfig() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	ticker := time.NewTicker(5 * time.Second)
+	var lastMod time.Time
+	if info, err := os.Stat(configPath()); err == nil {
+		lastMod = info.ModTime()
+	}
+	for {
+		select {
+		case <-hup:
+			log.Println("Received SIGHUP, reloading configuration")
+		case <-ticker.C:
+			info, err := os.Stat(configPath())
+			if err != nil || !info.ModTime().After(lastMod) {
+				continue
+			}
+			lastMod = info.ModTime()
+			log.Printf("%s changed, reloading configuration", configPath())
+		}
+		if _, err := reloadConfig(); err != nil {
+			log.Printf("Failed to reload configuration, keeping previous settings: %v", err)
+		}
+	}
+}
+
+func reloadConfigHandler(w http.ResponseWriter, r *http.Request) {
+	cfg, err := reloadConfig()
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Failed to reload configuration", err)
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"message":      "Configuration reloaded",
+		"log_level":    logLevelName(),
+		"cors_origins": cfg.CORSOrigins,
+		"pricing":      len(cfg.Pricing),
+		"budgets":      len(cfg.Budgets),
+	})
+}
+
+// corsMiddleware applies the configured CORS origins, read on every request so reloads take effect
+func corsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin != "" && originAllowed(currentConfig.Load().CORSOrigins, origin) {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Add("Vary", "Origin")
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, X-Dry-Run, X-Tokencounter-Key, If-None-Match, If-Modified-Since")
+			w.Header().Set("Access-Control-Expose-Headers", "ETag, Last-Modified")
+			if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func originAllowed(allowed []string, origin string) bool {
+	for _, o := range allowed {
+		if o == "*" || o == origin {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,157 @@
+// console.go
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// POST /admin/query runs an ad-hoc SELECT for analyses the canned endpoints don't cover.
+// Queries run in a read-only transaction with a statement timeout, and results are capped.
+const (
+	consoleDefaultRows = 1000
+	consoleMaxRows     = 10000
+	consoleTimeout     = 10 * time.Second
+)
+
+// ConsoleQuery is the body of POST /admin/query
+type ConsoleQuery struct {
+	SQL   string `json:"sql"`
+	Limit int    `json:"limit"`
+	// Format is json (the default) or csv
+	Format string `json:"format"`
+}
+
+var consoleStatementStart = regexp.MustCompile(`(?is)^\s*(select|with)\b`)
+
+// validateConsoleSQL accepts a single SELECT or WITH statement. The read-only transaction is
+// what actually prevents writes; this turns the obvious mistakes into clear errors.
+func validateConsoleSQL(query string) (string, error) {
+	query = strings.TrimSpace(query)
+	query = strings.TrimSpace(strings.TrimSuffix(query, ";"))
+	if query == "" {
+		return "", fmt.Errorf("sql is required")
+	}
+	if !consoleStatementStart.MatchString(query) {
+		return "", fmt.Errorf("only SELECT queries are allowed")
+	}
+	if strings.Contains(query, ";") {
+		return "", fmt.Errorf("only a single statement is allowed")
+	}
+	return query, nil
+}
+
+func runConsoleQuery(w http.ResponseWriter, r *http.Request) {
+	var q ConsoleQuery
+	if err := json.NewDecoder(r.Body).Decode(&q); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request payload", err)
+		return
+	}
+	query, err := validateConsoleSQL(q.SQL)
+	if err != nil {
+		respondJSON(w, http.StatusBadRequest, map[string]string{"message": err.Error()})
+		return
+	}
+	if q.Limit <= 0 {
+		q.Limit = consoleDefaultRows
+	}
+	if q.Limit > consoleMaxRows {
+		q.Limit = consoleMaxRows
+	}
+	if q.Format == "" {
+		q.Format = "json"
+	}
+	if q.Format != "json" && q.Format != "csv" {
+		respondJSON(w, http.StatusBadRequest, map[string]string{"message": "format must be json or csv"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), consoleTimeout+time.Second)
+	defer cancel()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to start transaction", err)
+		return
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf("SET TRANSACTION READ ONLY; SET LOCAL statement_timeout = %d", consoleTimeout.Milliseconds())); err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to start transaction", err)
+		return
+	}
+	// One extra row tells us whether the result was cut off
+	rows, err := tx.QueryContext(ctx, fmt.Sprintf("SELECT * FROM (%s) AS console_query LIMIT %d", query, q.Limit+1))
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Query failed", err)
+		return
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Error reading data", err)
+		return
+	}
+	results := [][]interface{}{}
+	truncated := false
+	for rows.Next() {
+		if len(results) == q.Limit {
+			truncated = true
+			break
+		}
+		values := make([]interface{}, len(columns))
+		ptrs := make([]interface{}, len(columns))
+		for i := range values {
+			ptrs[i] = &values[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			respondError(w, http.StatusInternalServerError, "Error scanning row", err)
+			return
+		}
+		for i, v := range values {
+			// Text and numeric columns arrive as bytes
+			if b, ok := v.([]byte); ok {
+				values[i] = string(b)
+			}
+		}
+		results = append(results, values)
+	}
+	if err = rows.Err(); err != nil {
+		respondError(w, http.StatusBadRequest, "Query failed", err)
+		return
+	}
+	infof("Admin console query returned %d rows\n", len(results))
+
+	if q.Format == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("X-Truncated", fmt.Sprint(truncated))
+		cw := csv.NewWriter(w)
+		cw.Write(columns)
+		for _, row := range results {
+			record := make([]string, len(row))
+			for i, v := range row {
+				if v == nil {
+					continue
+				}
+				if t, ok := v.(time.Time); ok {
+					record[i] = t.Format(time.RFC3339)
+				} else {
+					record[i] = fmt.Sprint(v)
+				}
+			}
+			cw.Write(record)
+		}
+		cw.Flush()
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"columns":   columns,
+		"rows":      results,
+		"row_count": len(results),
+		"truncated": truncated,
+	})
+}
@@ -0,0 +1,134 @@
+// dbhealth.go
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"tokencounter/version"
+)
+
+// dbBreaker tracks whether the database is reachable. A background health check pings it,
+// backing off exponentially while it is down; requests that need the database fail fast
+// with 503 while the breaker is open instead of each waiting on a dead connection.
+// database/sql opens fresh connections on its own, so recovery only needs a successful ping.
+type dbBreaker struct {
+	mu        sync.Mutex
+	open      bool
+	since     time.Time
+	lastError string
+	failures  int
+}
+
+var dbHealth = &dbBreaker{}
+
+const (
+	dbHealthInterval   = 5 * time.Second
+	dbMinBackoff       = time.Second
+	dbMaxBackoff       = 30 * time.Second
+	dbHealthTimeout    = 3 * time.Second
+	dbRetryAfterSecond = 5
+)
+
+// available reports whether requests should try the database
+func (b *dbBreaker) available() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !b.open
+}
+
+// trip opens the breaker after a request found the database unreachable
+func (b *dbBreaker) trip(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	b.lastError = err.Error()
+	if !b.open {
+		b.open = true
+		b.since = time.Now()
+		log.Printf("Database unavailable, failing fast until it recovers: %v", err)
+	}
+}
+
+func (b *dbBreaker) recovered() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.open {
+		log.Printf("Database connection restored after %s", time.Since(b.since).Round(time.Second))
+	}
+	b.open = false
+	b.failures = 0
+	b.lastError = ""
+}
+
+// monitorDatabase pings the database periodically, and more often, with backoff, while it is down
+func monitorDatabase() {
+	backoff := dbMinBackoff
+	for {
+		if dbHealth.available() {
+			backoff = dbMinBackoff
+			time.Sleep(dbHealthInterval)
+		} else {
+			time.Sleep(backoff)
+			backoff = min(backoff*2, dbMaxBackoff)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), dbHealthTimeout)
+		err := db.PingContext(ctx)
+		cancel()
+		if err != nil {
+			dbHealth.trip(err)
+			continue
+		}
+		if !dbHealth.available() {
+			dbHealth.recovered()
+			pendingWrites.notify()
+		}
+	}
+}
+
+// requireDatabase rejects requests with 503 while the breaker is open. Usage ingestion, the
+// proxy and operational endpoints stay up: writes are buffered until the database returns.
+func requireDatabase(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if dbHealth.available() || !needsDatabase(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(dbRetryAfterSecond))
+		respondJSON(w, http.StatusServiceUnavailable, map[string]string{"message": "Database unavailable"})
+	})
+}
+
+func needsDatabase(r *http.Request) bool {
+	switch {
+	case r.Method == http.MethodPost && unversionedPath(r.URL.Path) == "/token_usage",
+		r.URL.Path == "/health",
+		r.URL.Path == "/events",
+		strings.HasPrefix(r.URL.Path, "/proxy/"),
+		strings.HasPrefix(r.URL.Path, "/admin/"),
+		strings.HasPrefix(r.URL.Path, "/debug/"):
+		return false
+	}
+	return true
+}
+
+// getHealth reports database reachability; it returns 503 while the breaker is open
+func getHealth(w http.ResponseWriter, r *http.Request) {
+	dbHealth.mu.Lock()
+	status := map[string]interface{}{"database": "up", "buffered_writes": pendingWrites.size(), "version": version.Version}
+	code := http.StatusOK
+	if dbHealth.open {
+		code = http.StatusServiceUnavailable
+		status["database"] = "down"
+		status["down_since"] = dbHealth.since
+		status["last_error"] = dbHealth.lastError
+		status["failed_checks"] = dbHealth.failures
+	}
+	dbHealth.mu.Unlock()
+	respondJSON(w, code, status)
+}
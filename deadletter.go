@@ -0,0 +1,257 @@
+// deadletter.go
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// DeadLetter is a usage write that failed, kept so it can be replayed once the cause is fixed.
+// Mode is "set" for reported daily totals and "add" for increments observed by the proxy.
+// The write buffer uses the same record for writes waiting out a database outage.
+type DeadLetter struct {
+	ID         string     `json:"id"`
+	ReceivedAt time.Time  `json:"received_at"`
+	Source     string     `json:"source"`
+	Mode       string     `json:"mode"`
+	Error      string     `json:"error"`
+	Attempts   int        `json:"attempts"`
+	Usage      TokenUsage `json:"usage"`
+}
+
+// The dead-letter queue lives in a JSON lines file rather than a table, since the usual
+// reason a write fails is that the database is unavailable.
+var deadLetterMu sync.Mutex
+
+func deadLetterPath() string {
+	if p := os.Getenv("DEAD_LETTER_FILE"); p != "" {
+		return p
+	}
+	return "dead_letter.jsonl"
+}
+
+// deadLetter records a failed write. Failures to record it are logged along with the payload,
+// so the data can still be recovered from the logs.
+func deadLetter(mode, source string, usage TokenUsage, cause error) {
+	entry := DeadLetter{
+		ID:         newUUID(),
+		ReceivedAt: time.Now(),
+		Source:     source,
+		Mode:       mode,
+		Error:      cause.Error(),
+		Usage:      usage,
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("Failed to encode dead letter: %v", err)
+		return
+	}
+	deadLetterMu.Lock()
+	defer deadLetterMu.Unlock()
+	f, err := os.OpenFile(deadLetterPath(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err == nil {
+		_, err = f.Write(append(line, '\n'))
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		log.Printf("Failed to write dead letter, payload was %s: %v", line, err)
+		return
+	}
+	log.Printf("Usage write for %s failed, saved as dead letter %s: %v", usage.Model, entry.ID, cause)
+}
+
+// readDeadLetters loads the queue; the caller must hold deadLetterMu
+func readDeadLetters() ([]DeadLetter, error) {
+	return readWriteLog(deadLetterPath())
+}
+
+// writeDeadLetters replaces the queue; the caller must hold deadLetterMu
+func writeDeadLetters(entries []DeadLetter) error {
+	return writeWriteLog(deadLetterPath(), entries)
+}
+
+// readWriteLog reads a JSON lines file of usage writes
+func readWriteLog(path string) ([]DeadLetter, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return []DeadLetter{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	entries := []DeadLetter{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var entry DeadLetter
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("corrupt entry in %s: %w", path, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// writeWriteLog atomically replaces a JSON lines file of usage writes
+func writeWriteLog(path string, entries []DeadLetter) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".dead_letter-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	enc := json.NewEncoder(tmp)
+	for _, entry := range entries {
+		if err := enc.Encode(entry); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func getDeadLetters(w http.ResponseWriter, r *http.Request) {
+	deadLetterMu.Lock()
+	entries, err := readDeadLetters()
+	deadLetterMu.Unlock()
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to read dead letters", err)
+		return
+	}
+	respondJSON(w, http.StatusOK, entries)
+}
+
+// replayDeadLetters retries every queued write, oldest first, or only the one named by ?id=.
+// Entries that succeed are removed; the rest stay queued with their latest error. A daily
+// total is a conflict, and isn't replayed, if its row was updated after the write was
+// received, since it would overwrite the newer total; ?force=true replays it anyway. Nothing
+// is replayed while the write buffer holds writes, which must be stored first.
+func replayDeadLetters(w http.ResponseWriter, r *http.Request) {
+	only, force := r.URL.Query().Get("id"), r.URL.Query().Get("force") == "true"
+	if pendingWrites.active() {
+		respondJSON(w, http.StatusConflict, map[string]string{"message": "Usage writes are buffered while the database is unavailable; replay once they are stored"})
+		return
+	}
+	deadLetterMu.Lock()
+	defer deadLetterMu.Unlock()
+	entries, err := readDeadLetters()
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to read dead letters", err)
+		return
+	}
+	var updated map[string]time.Time
+	if !force {
+		if updated, err = usageUpdatedSince(r.Context(), entries, only); err != nil {
+			respondError(w, http.StatusInternalServerError, "Database query error", err)
+			return
+		}
+	}
+
+	remaining := []DeadLetter{}
+	conflicts := []string{}
+	replayed, failed, found := 0, 0, false
+	for _, entry := range entries {
+		if only != "" && entry.ID != only {
+			remaining = append(remaining, entry)
+			continue
+		}
+		found = true
+		if at, ok := updated[usageRowKey(entry.Usage)]; ok && entry.Mode == "set" && at.After(entry.ReceivedAt) {
+			entry.Error = fmt.Sprintf("usage was updated at %s, after this write was received; replay with force=true to overwrite it", at.Format(time.RFC3339))
+			remaining = append(remaining, entry)
+			conflicts = append(conflicts, entry.ID)
+			continue
+		}
+		if _, err := applyWrite(r.Context(), entry); err != nil {
+			entry.Attempts++
+			entry.Error = err.Error()
+			remaining = append(remaining, entry)
+			failed++
+			continue
+		}
+		replayed++
+	}
+	if only != "" && !found {
+		respondJSON(w, http.StatusNotFound, map[string]string{"message": "Dead letter not found"})
+		return
+	}
+	if err := writeDeadLetters(remaining); err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to update dead letters", err)
+		return
+	}
+	infof("Replayed %d dead letters, %d failed, %d conflicted\n", replayed, failed, len(conflicts))
+	respondJSON(w, http.StatusOK, map[string]interface{}{"replayed": replayed, "failed": failed, "conflicts": conflicts, "remaining": len(remaining)})
+}
+
+func usageRowKey(u TokenUsage) string {
+	return u.Date.Format("2006-01-02") + "\x00" + u.Model + "\x00" + u.Project
+}
+
+// usageUpdatedSince returns when the rows the daily totals among entries would replace were
+// last updated, for those updated since the oldest of them was received
+func usageUpdatedSince(ctx context.Context, entries []DeadLetter, only string) (map[string]time.Time, error) {
+	var since time.Time
+	for _, entry := range entries {
+		if entry.Mode == "set" && (only == "" || entry.ID == only) && (since.IsZero() || entry.ReceivedAt.Before(since)) {
+			since = entry.ReceivedAt
+		}
+	}
+	updated := map[string]time.Time{}
+	if since.IsZero() {
+		return updated, nil
+	}
+	usages, err := store.ListUsage(ctx, since)
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range usages {
+		if u.UpdatedAt != nil {
+			updated[usageRowKey(u)] = *u.UpdatedAt
+		}
+	}
+	return updated, nil
+}
+
+func deleteDeadLetter(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	deadLetterMu.Lock()
+	defer deadLetterMu.Unlock()
+	entries, err := readDeadLetters()
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to read dead letters", err)
+		return
+	}
+	remaining := []DeadLetter{}
+	for _, entry := range entries {
+		if entry.ID != id {
+			remaining = append(remaining, entry)
+		}
+	}
+	if len(remaining) == len(entries) {
+		respondJSON(w, http.StatusNotFound, map[string]string{"message": "Dead letter not found"})
+		return
+	}
+	if err := writeDeadLetters(remaining); err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to update dead letters", err)
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]string{"message": "Dead letter deleted"})
+}
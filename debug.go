@@ -0,0 +1,23 @@
+// debug.go
+package main
+
+import (
+	"expvar"
+	"net/http/pprof"
+
+	"github.com/gorilla/mux"
+)
+
+var tokensRecordedVar = expvar.NewMap("tokens_recorded")
+
+// registerDebugRoutes mounts pprof and expvar under /debug, behind admin auth
+func registerDebugRoutes(router *mux.Router) {
+	debug := router.PathPrefix("/debug").Subrouter()
+	debug.Use(requireAdmin)
+	debug.Handle("/vars", expvar.Handler())
+	debug.HandleFunc("/pprof/cmdline", pprof.Cmdline)
+	debug.HandleFunc("/pprof/profile", pprof.Profile)
+	debug.HandleFunc("/pprof/symbol", pprof.Symbol)
+	debug.HandleFunc("/pprof/trace", pprof.Trace)
+	debug.PathPrefix("/pprof/").HandlerFunc(pprof.Index)
+}
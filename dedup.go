@@ -0,0 +1,73 @@
+// dedup.go
+package main
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Tools pushing usage per request deliver at least once, so a delivery may arrive again after
+// a timeout or a restart. Events carrying a request ID are suppressed when the same request ID
+// and model were ingested within the duplicate window, by default a day. The IDs seen are
+// kept in seen_requests, shared by every instance, and pruned once they fall out of the window.
+
+const defaultDuplicateWindowMinutes = 24 * 60
+
+// duplicateWindow returns how long request IDs are remembered, 0 when suppression is off
+func duplicateWindow() time.Duration {
+	minutes := defaultDuplicateWindowMinutes
+	if m := currentConfig.Load().DuplicateWindowMinutes; m != nil {
+		minutes = *m
+	}
+	return time.Duration(minutes) * time.Minute
+}
+
+// duplicateWindowFromEnv reads DUPLICATE_WINDOW_MINUTES
+func duplicateWindowFromEnv() *int {
+	if n, err := strconv.Atoi(os.Getenv("DUPLICATE_WINDOW_MINUTES")); err == nil {
+		return &n
+	}
+	return nil
+}
+
+// claimRequest records that the request with id was ingested for model, and reports false if
+// it already was within the window. The claim is released with releaseRequest if the usage
+// then fails to store, so a redelivery is not taken for a duplicate.
+func claimRequest(ctx context.Context, id, model string) (claimed bool, seenAt time.Time, err error) {
+	window := duplicateWindow()
+	if id == "" || window <= 0 || db == nil || !dbHealth.available() {
+		return true, time.Time{}, nil
+	}
+	err = db.QueryRowContext(ctx, `INSERT INTO seen_requests (request_id, model, seen_at) VALUES ($1, $2, NOW())
+        ON CONFLICT (request_id, model) DO UPDATE SET seen_at = EXCLUDED.seen_at
+        WHERE seen_requests.seen_at < NOW() - make_interval(secs => $3)
+        RETURNING seen_at`, id, model, window.Seconds()).Scan(&seenAt)
+	if err == sql.ErrNoRows {
+		return false, time.Time{}, nil
+	}
+	return err == nil, seenAt, err
+}
+
+// releaseRequest undoes a claim made at seenAt
+func releaseRequest(ctx context.Context, id, model string, seenAt time.Time) error {
+	if seenAt.IsZero() {
+		return nil
+	}
+	_, err := db.ExecContext(ctx, "DELETE FROM seen_requests WHERE request_id = $1 AND model = $2 AND seen_at = $3", id, model, seenAt)
+	return err
+}
+
+// pruneSeenRequests is the seen_requests job: it forgets request IDs that fell out of the window
+func pruneSeenRequests(ctx context.Context) error {
+	res, err := db.ExecContext(ctx, "DELETE FROM seen_requests WHERE seen_at < NOW() - make_interval(secs => $1)", duplicateWindow().Seconds())
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		debugf("Forgot %d request IDs older than the duplicate window\n", n)
+	}
+	return nil
+}
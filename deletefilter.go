@@ -0,0 +1,191 @@
+// deletefilter.go
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// POST /admin/token_usage/delete_by_filter removes the records matching a filter, for cleanups
+// like the test project's usage last quarter. It spans every project, so it is an admin
+// endpoint. A request without confirmation_token only previews: it counts what would be
+// deleted and returns a token for exactly those records. Sending the filter again with the
+// token deletes them. The token is derived from the filter and the matching records, so it
+// stops working once any of them changes or another one matches, and the deletion has to be
+// previewed again. Sealed days are never touched.
+
+// UsageFilter selects records; every field set must match. Project is a pointer as "" is the
+// default project. Start and End bound the date, inclusive, and Tag selects the days covered
+// by annotations with that tag, such as those marking a load test.
+type UsageFilter struct {
+	Model    string  `json:"model,omitempty"`
+	Project  *string `json:"project,omitempty"`
+	Provider string  `json:"provider,omitempty"`
+	Start    string  `json:"start,omitempty"`
+	End      string  `json:"end,omitempty"`
+	Tag      string  `json:"tag,omitempty"`
+}
+
+// usageFilterWhere is the filter over token_usage u, with the arguments from UsageFilter.args
+const usageFilterWhere = `($1 = '' OR u.model = $1) AND ($2::TEXT IS NULL OR u.project = $2) AND ($3 = '' OR u.provider = $3)
+        AND ($4::DATE IS NULL OR u.date >= $4) AND ($5::DATE IS NULL OR u.date <= $5)
+        AND ($6 = '' OR EXISTS (SELECT 1 FROM annotations a WHERE $6 = ANY(a.tags)
+            AND u.date >= a.ts::DATE AND u.date <= COALESCE(a.ends_at, a.ts)::DATE))`
+
+// usageFilterSealed holds for records of sealed days
+const usageFilterSealed = "EXISTS (SELECT 1 FROM usage_day_hashes h WHERE h.date = u.date)"
+
+// args validates the filter and returns the arguments of usageFilterWhere
+func (f UsageFilter) args() ([]interface{}, error) {
+	if f.Model == "" && f.Project == nil && f.Provider == "" && f.Start == "" && f.End == "" && f.Tag == "" {
+		return nil, fmt.Errorf("set at least one of model, project, provider, start, end and tag")
+	}
+	var bounds [2]*time.Time
+	for i, v := range []string{f.Start, f.End} {
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse("2006-01-02", v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid date %q, expected YYYY-MM-DD", v)
+		}
+		bounds[i] = &t
+	}
+	if bounds[0] != nil && bounds[1] != nil && bounds[1].Before(*bounds[0]) {
+		return nil, fmt.Errorf("end is before start")
+	}
+	return []interface{}{f.Model, f.Project, f.Provider, bounds[0], bounds[1], f.Tag}, nil
+}
+
+// DeletePreview is what a filter would delete
+type DeletePreview struct {
+	Records     int     `json:"records"`
+	TotalTokens int64   `json:"total_tokens"`
+	Cost        float64 `json:"cost"`
+	// FirstDate and LastDate span the matching records, if there are any
+	FirstDate string `json:"first_date,omitempty"`
+	LastDate  string `json:"last_date,omitempty"`
+	// SkippedSealed counts matching records on sealed days, which are kept
+	SkippedSealed     int    `json:"skipped_sealed"`
+	ConfirmationToken string `json:"confirmation_token,omitempty"`
+}
+
+// filterMatches returns the IDs of the unsealed records matching the filter and the
+// confirmation token for them. With lock set the records are locked for update.
+func filterMatches(ctx context.Context, q interface {
+	QueryContext(context.Context, string, ...interface{}) (*sql.Rows, error)
+}, f UsageFilter, args []interface{}, lock bool) ([]int64, string, error) {
+	query := "SELECT u.id, u.updated_at FROM token_usage u WHERE " + usageFilterWhere + " AND NOT " + usageFilterSealed + " ORDER BY u.id"
+	if lock {
+		query += " FOR UPDATE"
+	}
+	rows, err := q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+	filter, _ := json.Marshal(f)
+	h := sha256.New()
+	h.Write(filter)
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		var updated time.Time
+		if err := rows.Scan(&id, &updated); err != nil {
+			return nil, "", err
+		}
+		fmt.Fprintf(h, "\n%d:%d", id, updated.UnixMicro())
+		ids = append(ids, id)
+	}
+	return ids, hex.EncodeToString(h.Sum(nil))[:32], rows.Err()
+}
+
+// deleteByFilter previews or, given the preview's confirmation token, performs a deletion
+func deleteByFilter(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		UsageFilter
+		ConfirmationToken string `json:"confirmation_token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request payload", err)
+		return
+	}
+	args, err := req.UsageFilter.args()
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid filter", err)
+		return
+	}
+
+	if req.ConfirmationToken == "" {
+		// One snapshot, so the token is for the records counted
+		tx, err := db.BeginTx(r.Context(), &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, "Failed to start transaction", err)
+			return
+		}
+		defer tx.Rollback()
+		var p DeletePreview
+		var first, last sql.NullTime
+		var cost int64
+		err = tx.QueryRowContext(r.Context(), `
+            SELECT COUNT(*) FILTER (WHERE NOT sealed), COALESCE(SUM(u.total_tokens) FILTER (WHERE NOT sealed), 0),
+                COALESCE(SUM(`+usageCostMicrosExpr+`) FILTER (WHERE NOT sealed), 0)::BIGINT,
+                MIN(u.date) FILTER (WHERE NOT sealed), MAX(u.date) FILTER (WHERE NOT sealed), COUNT(*) FILTER (WHERE sealed)
+            FROM (SELECT u.*, `+usageFilterSealed+` AS sealed FROM token_usage u WHERE `+usageFilterWhere+`) u `+usagePriceJoin,
+			args...).Scan(&p.Records, &p.TotalTokens, &cost, &first, &last, &p.SkippedSealed)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, "Database query error", err)
+			return
+		}
+		p.Cost = costFromMicros(cost)
+		if first.Valid {
+			p.FirstDate, p.LastDate = first.Time.Format("2006-01-02"), last.Time.Format("2006-01-02")
+		}
+		if p.Records > 0 {
+			if _, p.ConfirmationToken, err = filterMatches(r.Context(), tx, req.UsageFilter, args, false); err != nil {
+				respondError(w, http.StatusInternalServerError, "Database query error", err)
+				return
+			}
+		}
+		respondJSON(w, http.StatusOK, p)
+		return
+	}
+
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to start transaction", err)
+		return
+	}
+	defer tx.Rollback()
+	ids, token, err := filterMatches(r.Context(), tx, req.UsageFilter, args, true)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database query error", err)
+		return
+	}
+	if token != req.ConfirmationToken {
+		respondJSON(w, http.StatusConflict, map[string]string{"message": "The matching records changed since the preview, or the token is for another filter; preview again"})
+		return
+	}
+	// The request log goes too, or recalculation would bring the records back
+	_, err = tx.ExecContext(r.Context(), `WITH deleted AS (DELETE FROM token_usage WHERE id = ANY($1) RETURNING date, model, project)
+        DELETE FROM usage_requests l USING (SELECT DISTINCT date, model, project FROM deleted) d
+        WHERE l.date = d.date AND l.model = d.model AND l.project = d.project`, pq.Array(ids))
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to delete token usage", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to commit deletion", err)
+		return
+	}
+	infof("Deleted %d token usage records by filter\n", len(ids))
+	respondJSON(w, http.StatusOK, map[string]interface{}{"message": "Token usage deleted successfully", "deleted": len(ids)})
+}
@@ -0,0 +1,105 @@
+// deprecation.go
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	defaultDeprecationAlertDays = 30
+	// deprecationUsageWindowDays is how far back usage counts as recent
+	deprecationUsageWindowDays = 7
+)
+
+// DeprecationAlertConfig controls warnings about models that are still in use but are due
+// to be shut down. Each model is announced once per deprecation date.
+type DeprecationAlertConfig struct {
+	// Days is how far ahead of the deprecation date to warn, default 30
+	Days int `json:"days"`
+	// Channels lists the notification channels to use, default ["log"]
+	Channels []string `json:"channels"`
+}
+
+// checkDeprecations is the deprecation_check job: it alerts on registry models whose
+// deprecation date is near and that were used in the last week
+func checkDeprecations(ctx context.Context) error {
+	cfg := currentConfig.Load().DeprecationAlerts
+	days := cfg.Days
+	if days <= 0 {
+		days = defaultDeprecationAlertDays
+	}
+	channels := cfg.Channels
+	if len(channels) == 0 {
+		channels = []string{"log"}
+	}
+	today := time.Now().Truncate(24 * time.Hour)
+
+	rows, err := db.QueryContext(ctx, `
+        SELECT m.name, m.deprecation_date, SUM(u.total_tokens)
+        FROM models m JOIN token_usage u ON u.model = m.name AND u.date >= $1
+        WHERE m.deprecation_date IS NOT NULL AND m.deprecation_date <= $2
+            AND NOT EXISTS (SELECT 1 FROM deprecation_alerts a WHERE a.model = m.name AND a.deprecation_date = m.deprecation_date)
+        GROUP BY m.name, m.deprecation_date
+        ORDER BY m.deprecation_date, m.name`,
+		today.AddDate(0, 0, -deprecationUsageWindowDays), today.AddDate(0, 0, days))
+	if err != nil {
+		return err
+	}
+	type pending struct {
+		model  string
+		date   time.Time
+		tokens int64
+	}
+	var due []pending
+	for rows.Next() {
+		var p pending
+		if err := rows.Scan(&p.model, &p.date, &p.tokens); err != nil {
+			rows.Close()
+			return err
+		}
+		due = append(due, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, p := range due {
+		daysLeft := int(p.date.Sub(today).Hours() / 24)
+		message := fmt.Sprintf("%s is scheduled for shutdown on %s (in %d days) and used %d tokens in the last %d days",
+			p.model, p.date.Format("2006-01-02"), daysLeft, p.tokens, deprecationUsageWindowDays)
+		if daysLeft < 0 {
+			message = fmt.Sprintf("%s was deprecated on %s but used %d tokens in the last %d days",
+				p.model, p.date.Format("2006-01-02"), p.tokens, deprecationUsageWindowDays)
+		}
+		alert := Alert{
+			Kind:    "model_deprecation",
+			Message: message,
+			Details: map[string]interface{}{
+				"model":            p.model,
+				"deprecation_date": p.date.Format("2006-01-02"),
+				"days_left":        daysLeft,
+				"recent_tokens":    p.tokens,
+			},
+			Time: time.Now(),
+		}
+		sent := false
+		for _, channel := range channels {
+			if err := sendNotification(ctx, channel, "", alert); err != nil {
+				log.Printf("Failed to send deprecation alert for %s via %s: %v", p.model, channel, err)
+				continue
+			}
+			sent = true
+		}
+		if !sent {
+			continue // try again on the next run
+		}
+		if _, err := db.ExecContext(ctx, "INSERT INTO deprecation_alerts (model, deprecation_date) VALUES ($1, $2) ON CONFLICT DO NOTHING", p.model, p.date); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+// diff.go
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// UsageWindow is the usage in one window compared by GET /token_usage/diff. The per-day
+// averages make windows of different lengths comparable.
+type UsageWindow struct {
+	Start        string  `json:"start"`
+	End          string  `json:"end"`
+	Days         int64   `json:"days"`
+	TotalTokens  int64   `json:"total_tokens"`
+	Requests     int64   `json:"requests"`
+	Cost         float64 `json:"cost"`
+	TokensPerDay float64 `json:"tokens_per_day"`
+	CostPerDay   float64 `json:"cost_per_day"`
+	// ExcludedDays lists the outage days left out with ?exclude_outages=; Days and the
+	// totals don't count them
+	ExcludedDays []string `json:"excluded_days,omitempty"`
+
+	costMicros int64
+}
+
+// UsageDelta is window b less window a. The percentages are relative to a, and null when a
+// is zero.
+type UsageDelta struct {
+	TotalTokens         int64    `json:"total_tokens"`
+	Requests            int64    `json:"requests"`
+	Cost                float64  `json:"cost"`
+	TokensPerDay        float64  `json:"tokens_per_day"`
+	CostPerDay          float64  `json:"cost_per_day"`
+	TotalTokensPercent  *float64 `json:"total_tokens_percent"`
+	CostPercent         *float64 `json:"cost_percent"`
+	TokensPerDayPercent *float64 `json:"tokens_per_day_percent"`
+}
+
+// getUsageDiff compares the usage in two date windows, a_start to a_end and b_start to
+// b_end, each end defaulting to today, such as a control window and a rollout window. ?model=
+// and ?project= narrow both windows down, and ?exclude_outages= leaves provider outage days
+// out of both.
+func getUsageDiff(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	model, project := q.Get("model"), q.Get("project")
+	excludeOutages := parseExcludeOutages(q.Get("exclude_outages"))
+	var windows [2]UsageWindow
+	for i, name := range []string{"a", "b"} {
+		start, end, err := parseWindow(q, name)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, "Invalid date range", err)
+			return
+		}
+		excluded := []string{}
+		if excludeOutages != nil {
+			if excluded, err = outageDays(r.Context(), start, end, excludeOutages); err != nil {
+				respondError(w, http.StatusInternalServerError, "Database query error", err)
+				return
+			}
+		}
+		if windows[i], err = usageInWindow(r.Context(), start, end, model, project, excluded); err != nil {
+			respondError(w, http.StatusInternalServerError, "Database query error", err)
+			return
+		}
+	}
+	a, b := windows[0], windows[1]
+	delta := UsageDelta{
+		TotalTokens:         b.TotalTokens - a.TotalTokens,
+		Requests:            b.Requests - a.Requests,
+		Cost:                costFromMicros(b.costMicros - a.costMicros),
+		TokensPerDay:        math.Round((b.TokensPerDay-a.TokensPerDay)*100) / 100,
+		CostPerDay:          roundCost(b.CostPerDay - a.CostPerDay),
+		TotalTokensPercent:  percentChange(float64(a.TotalTokens), float64(b.TotalTokens)),
+		CostPercent:         percentChange(float64(a.costMicros), float64(b.costMicros)),
+		TokensPerDayPercent: percentChange(a.TokensPerDay, b.TokensPerDay),
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{"model": model, "project": project, "a": a, "b": b, "delta": delta})
+}
+
+// parseWindow parses the window given by name_start and name_end
+func parseWindow(q url.Values, name string) (time.Time, time.Time, error) {
+	if q.Get(name+"_start") == "" {
+		return time.Time{}, time.Time{}, fmt.Errorf("%s_start is required", name)
+	}
+	start, end, err := parseDateRange(url.Values{"start": {q.Get(name + "_start")}, "end": {q.Get(name + "_end")}}, "")
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("window %s: %w", name, err)
+	}
+	return start, end, nil
+}
+
+// usageInWindow totals the usage from start to end, inclusive, except on the excluded days
+func usageInWindow(ctx context.Context, start, end time.Time, model, project string, excluded []string) (UsageWindow, error) {
+	window := UsageWindow{Start: start.Format("2006-01-02"), End: end.Format("2006-01-02"), Days: daysBetween(start, end) + 1 - int64(len(excluded)),
+		ExcludedDays: excluded}
+	err := db.QueryRowContext(ctx, `
+        SELECT COALESCE(SUM(u.total_tokens), 0), COALESCE(SUM(u.requests), 0), `+usageCostMicrosSum+`
+        FROM token_usage u `+usagePriceJoin+`
+        WHERE u.date >= $1 AND u.date <= $2 AND ($3 = '' OR u.model = $3) AND ($4 = '' OR u.project = $4)
+            AND NOT u.date = ANY($5::DATE[])`,
+		start, end, model, project, pq.Array(excluded)).Scan(&window.TotalTokens, &window.Requests, &window.costMicros)
+	if err != nil {
+		return window, err
+	}
+	window.Cost = costFromMicros(window.costMicros)
+	// A window made up of outage days has no days left to average over
+	if window.Days == 0 {
+		return window, nil
+	}
+	window.TokensPerDay = math.Round(float64(window.TotalTokens)/float64(window.Days)*100) / 100
+	window.CostPerDay = roundCost(float64(window.costMicros) / float64(window.Days) / microsPerDollar)
+	return window, nil
+}
+
+// percentChange is the change from a to b as a percentage of a, rounded to two places
+func percentChange(a, b float64) *float64 {
+	if a == 0 {
+		return nil
+	}
+	p := math.Round((b-a)/a*10000) / 100
+	return &p
+}
@@ -0,0 +1,90 @@
+// dryrun.go
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// isDryRun reports whether an ingestion request asked, with ?dry_run=true or an X-Dry-Run
+// header, to be validated and priced without being stored
+func isDryRun(r *http.Request) bool {
+	v := r.URL.Query().Get("dry_run")
+	if v == "" {
+		v = r.Header.Get("X-Dry-Run")
+	}
+	v = strings.ToLower(v)
+	return v == "true" || v == "1"
+}
+
+func validateTokenUsage(usage TokenUsage) error {
+	if usage.Model == "" {
+		return fmt.Errorf("model is required")
+	}
+	if usage.Date.IsZero() {
+		return fmt.Errorf("date is required")
+	}
+	if usage.TotalTokens < 0 {
+		return fmt.Errorf("total_tokens must not be negative")
+	}
+	if usage.Cost != nil && *usage.Cost < 0 {
+		return fmt.Errorf("cost must not be negative")
+	}
+	if usage.EndDate == nil && (usage.Distribution != "" || usage.Weights != nil) {
+		return fmt.Errorf("distribution and weights need end_date")
+	}
+	if err := usage.UsageBreakdown.validate(usage.TotalTokens); err != nil {
+		return err
+	}
+	if err := validateJob(usage); err != nil {
+		return err
+	}
+	return usage.UsageMeasures.validate()
+}
+
+// UsagePreview is what POST /token_usage would do with a payload
+type UsagePreview struct {
+	DryRun   bool       `json:"dry_run"`
+	Action   string     `json:"action"`
+	Record   TokenUsage `json:"record"`
+	Previous *int       `json:"previous_total_tokens,omitempty"`
+	Delta    int        `json:"delta_tokens"`
+	// CostSource says where Cost came from: reported, pricing, or none when the model is unpriced
+	CostSource string   `json:"cost_source"`
+	Cost       *float64 `json:"cost"`
+	NewModel   bool     `json:"new_model"`
+}
+
+// previewTokenUsage works out what storing a normalized payload would change, reading only
+func previewTokenUsage(ctx context.Context, usage TokenUsage) (UsagePreview, error) {
+	p := UsagePreview{DryRun: true, Action: "create", Record: usage, Delta: usage.TotalTokens, CostSource: "none"}
+	var existing int
+	err := db.QueryRowContext(ctx, "SELECT total_tokens FROM token_usage WHERE date = $1 AND model = $2 AND project = $3", usage.Date, usage.Model, usage.Project).Scan(&existing)
+	if err != nil && err != sql.ErrNoRows {
+		return p, err
+	}
+	if err == nil {
+		p.Action = "update"
+		p.Previous = &existing
+		p.Delta = usage.TotalTokens - existing
+	} else if err := db.QueryRowContext(ctx, "SELECT NOT EXISTS (SELECT 1 FROM token_usage WHERE model = $1)", usage.Model).Scan(&p.NewModel); err != nil {
+		return p, err
+	}
+
+	if usage.Cost != nil {
+		p.CostSource = "reported"
+		p.Cost = usage.Cost
+		return p, nil
+	}
+	price, priced, err := priceInForce(ctx, usage.Model, usage.Date)
+	if err != nil || !priced {
+		return p, err
+	}
+	cost := roundCost(float64(usage.TotalTokens) / 1e6 * price)
+	p.CostSource = "pricing"
+	p.Cost = &cost
+	return p, nil
+}
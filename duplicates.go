@@ -0,0 +1,162 @@
+// duplicates.go
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// DuplicateGroup is a set of token_usage rows for the same date, model and project. Writes
+// check for an existing row and insert without a lock, so concurrent reports of a new day can
+// each insert one, while every other query expects a single row.
+type DuplicateGroup struct {
+	Date        string   `json:"date"`
+	Model       string   `json:"model"`
+	Project     string   `json:"project"`
+	IDs         []int64  `json:"ids"`
+	TotalTokens int64    `json:"total_tokens"`
+	Cost        *float64 `json:"cost"`
+	UsageMeasures
+	// Sealed days are reported but never merged, as that would break the integrity chain
+	Sealed bool `json:"sealed"`
+}
+
+// usageKeyIndexed is set once token_usage has its unique index on (date, model, project).
+// The index can only be created while there are no duplicates, so on databases that still
+// have some, writes that would upsert fall back to updating, then inserting.
+var usageKeyIndexed atomic.Bool
+
+// ensureUsageKeyIndex creates the unique index on (date, model, project) if token_usage has no
+// duplicates, and records whether it exists
+func ensureUsageKeyIndex(ctx context.Context) error {
+	_, err := db.ExecContext(ctx, `
+        DO $$
+        BEGIN
+            IF to_regclass('token_usage_key_idx') IS NULL AND NOT EXISTS (
+                SELECT 1 FROM token_usage GROUP BY date, model, project HAVING COUNT(*) > 1
+            ) THEN
+                CREATE UNIQUE INDEX token_usage_key_idx ON token_usage (date, model, project);
+            END IF;
+        END
+        $$;`)
+	if err != nil {
+		return err
+	}
+	var indexed bool
+	if err := db.QueryRowContext(ctx, "SELECT to_regclass('token_usage_key_idx') IS NOT NULL").Scan(&indexed); err != nil {
+		return err
+	}
+	usageKeyIndexed.Store(indexed)
+	return nil
+}
+
+// usageIncrementOnConflict turns an insert into token_usage that races with another writer's
+// into an increment of the row the other writer inserted. It needs usageKeyIndexed.
+const usageIncrementOnConflict = `
+        ON CONFLICT (date, model, project) DO UPDATE SET total_tokens = token_usage.total_tokens + EXCLUDED.total_tokens,
+            cost = CASE WHEN EXCLUDED.cost IS NULL THEN token_usage.cost ELSE ROUND(COALESCE(token_usage.cost, 0)::NUMERIC + EXCLUDED.cost::NUMERIC, 6)::DOUBLE PRECISION END,
+            requests = token_usage.requests + EXCLUDED.requests, characters = token_usage.characters + EXCLUDED.characters,
+            credits = token_usage.credits + EXCLUDED.credits, provider = COALESCE(NULLIF(EXCLUDED.provider, ''), token_usage.provider),
+            prompt_tokens = token_usage.prompt_tokens + EXCLUDED.prompt_tokens, completion_tokens = token_usage.completion_tokens + EXCLUDED.completion_tokens`
+
+func findDuplicates(ctx context.Context, start, end time.Time) ([]DuplicateGroup, error) {
+	rows, err := db.QueryContext(ctx, `
+        SELECT u.date, u.model, u.project, ARRAY_AGG(u.id ORDER BY u.id), SUM(u.total_tokens),
+            CASE WHEN COUNT(u.cost) = COUNT(*) THEN SUM(ROUND(u.cost::NUMERIC, 6))::DOUBLE PRECISION END,
+            SUM(u.requests), SUM(u.characters), SUM(u.credits),
+            EXISTS (SELECT 1 FROM usage_day_hashes h WHERE h.date = u.date)
+        FROM token_usage u
+        WHERE u.date >= $1 AND u.date <= $2
+        GROUP BY u.date, u.model, u.project HAVING COUNT(*) > 1
+        ORDER BY u.date, u.model, u.project`, start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	groups := []DuplicateGroup{}
+	for rows.Next() {
+		var g DuplicateGroup
+		var date time.Time
+		if err := rows.Scan(&date, &g.Model, &g.Project, pq.Array(&g.IDs), &g.TotalTokens, &g.Cost, &g.Requests, &g.Characters, &g.Credits, &g.Sealed); err != nil {
+			return nil, err
+		}
+		g.Date = date.Format("2006-01-02")
+		groups = append(groups, g)
+	}
+	return groups, rows.Err()
+}
+
+// getDuplicates reports duplicate rows in a date range, over all time by default
+func getDuplicates(w http.ResponseWriter, r *http.Request) {
+	start, end, err := parseDateRange(r.URL.Query(), "lifetime")
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid date range", err)
+		return
+	}
+	groups, err := findDuplicates(r.Context(), start, end)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database query error", err)
+		return
+	}
+	respondJSON(w, http.StatusOK, groups)
+}
+
+// mergeDuplicates consolidates each unsealed duplicate group into its oldest row, which takes
+// the group's summed tokens and measures. The cost is summed too when every row reported one; otherwise it
+// is cleared so the merged row is priced from the list price like the unreported rows were.
+func mergeDuplicates(w http.ResponseWriter, r *http.Request) {
+	start, end, err := parseDateRange(r.URL.Query(), "lifetime")
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid date range", err)
+		return
+	}
+	groups, err := findDuplicates(r.Context(), start, end)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database query error", err)
+		return
+	}
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to start transaction", err)
+		return
+	}
+	defer tx.Rollback()
+	merged, removed, skipped := 0, 0, 0
+	for _, g := range groups {
+		if g.Sealed {
+			skipped++
+			continue
+		}
+		keep, rest := g.IDs[0], g.IDs[1:]
+		if _, err := tx.ExecContext(r.Context(), "UPDATE token_usage SET total_tokens = $1, cost = $2, requests = $5, characters = $6, credits = $7 WHERE id = $3 AND date = $4",
+			g.TotalTokens, g.Cost, keep, g.Date, g.Requests, g.Characters, g.Credits); err != nil {
+			respondError(w, http.StatusInternalServerError, "Failed to merge duplicates", err)
+			return
+		}
+		if _, err := tx.ExecContext(r.Context(), "DELETE FROM token_usage WHERE id = ANY($1) AND date = $2", pq.Array(rest), g.Date); err != nil {
+			respondError(w, http.StatusInternalServerError, "Failed to merge duplicates", err)
+			return
+		}
+		merged++
+		removed += len(rest)
+	}
+	if err := tx.Commit(); err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to commit merge", err)
+		return
+	}
+	infof("Merged %d duplicate groups, removing %d rows\n", merged, removed)
+	// With the duplicates gone the unique index can be created, unless sealed days still hold some
+	if err := ensureUsageKeyIndex(r.Context()); err != nil {
+		log.Printf("Failed to create the unique index on token_usage: %v", err)
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"merged_groups":  merged,
+		"removed_rows":   removed,
+		"skipped_sealed": skipped,
+	})
+}
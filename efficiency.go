@@ -0,0 +1,130 @@
+// efficiency.go
+package main
+
+import "net/http"
+
+// Efficiency is the unit economics of usage over a date range. Ratios are unset when there is
+// nothing to divide by: records without request counts, proxied requests without a
+// conversation ID (X-Tokencounter-Conversation) or end user (X-Tokencounter-User).
+type Efficiency struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+	// Requests and the sums next to it only cover records with request counts
+	Requests         int64    `json:"requests"`
+	TotalTokens      int64    `json:"total_tokens"`
+	Cost             float64  `json:"cost"`
+	TokensPerRequest *float64 `json:"tokens_per_request"`
+	CostPerRequest   *float64 `json:"cost_per_request"`
+
+	Conversations           int64    `json:"conversations"`
+	ConversationCost        float64  `json:"conversation_cost"`
+	CostPerConversation     *float64 `json:"cost_per_conversation"`
+	TokensPerConversation   *float64 `json:"tokens_per_conversation"`
+	RequestsPerConversation *float64 `json:"requests_per_conversation"`
+	// UserDays counts each end user once per day they were active; the average is over the
+	// days with any end user active
+	UserDays                int64    `json:"user_days"`
+	EndUserCost             float64  `json:"end_user_cost"`
+	CostPerActiveUserPerDay *float64 `json:"cost_per_active_user_per_day"`
+	AverageDailyActiveUsers *float64 `json:"average_daily_active_users"`
+
+	Models []ModelEfficiency `json:"models"`
+}
+
+// ModelEfficiency is a model's share of Efficiency
+type ModelEfficiency struct {
+	Model            string   `json:"model"`
+	Requests         int64    `json:"requests"`
+	TotalTokens      int64    `json:"total_tokens"`
+	Cost             float64  `json:"cost"`
+	TokensPerRequest *float64 `json:"tokens_per_request"`
+	CostPerRequest   *float64 `json:"cost_per_request"`
+}
+
+// ratio is n/d, or nil when d is zero
+func ratio(n float64, d int64) *float64 {
+	if d == 0 {
+		return nil
+	}
+	v := n / float64(d)
+	return &v
+}
+
+// getEfficiency reports unit economics over a date range, this month by default: tokens and
+// cost per request from the usage records, cost per conversation and per active end user per
+// day from proxied usage. ?model= and ?project= narrow it down.
+func getEfficiency(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	start, end, err := parseDateRange(q, "month")
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid date range", err)
+		return
+	}
+	model, project := q.Get("model"), q.Get("project")
+	where := "u.date >= $1 AND u.date <= $2 AND ($3 = '' OR u.model = $3) AND ($4 = '' OR u.project = $4)"
+	out := Efficiency{Start: start.Format("2006-01-02"), End: end.Format("2006-01-02"), Models: []ModelEfficiency{}}
+
+	rows, err := db.QueryContext(r.Context(), `
+        SELECT u.model, SUM(u.requests), SUM(u.total_tokens), `+usageCostMicrosSum+`
+        FROM token_usage u `+usagePriceJoin+`
+        WHERE `+where+` AND u.requests > 0
+        GROUP BY u.model ORDER BY u.model`, start, end, model, project)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database query error", err)
+		return
+	}
+	defer rows.Close()
+	var costMicros int64
+	for rows.Next() {
+		var m ModelEfficiency
+		var cost int64
+		if err := rows.Scan(&m.Model, &m.Requests, &m.TotalTokens, &cost); err != nil {
+			respondError(w, http.StatusInternalServerError, "Error scanning row", err)
+			return
+		}
+		m.Cost = costFromMicros(cost)
+		m.TokensPerRequest = ratio(float64(m.TotalTokens), m.Requests)
+		m.CostPerRequest = ratio(m.Cost, m.Requests)
+		out.Requests += m.Requests
+		out.TotalTokens += m.TotalTokens
+		costMicros += cost
+		out.Models = append(out.Models, m)
+	}
+	if err = rows.Err(); err != nil {
+		respondError(w, http.StatusInternalServerError, "Error reading data", err)
+		return
+	}
+	out.Cost = costFromMicros(costMicros)
+	out.TokensPerRequest = ratio(float64(out.TotalTokens), out.Requests)
+	out.CostPerRequest = ratio(out.Cost, out.Requests)
+
+	// A conversation spanning midnight has a row for each day, so conversations are counted
+	// distinct over the range
+	var conversationTokens, conversationRequests int64
+	err = db.QueryRowContext(r.Context(), `
+        SELECT COUNT(DISTINCT (u.project, u.conversation_id)), COALESCE(SUM(u.requests), 0), COALESCE(SUM(u.total_tokens), 0), `+usageCostMicrosSum+`
+        FROM usage_conversations u `+usagePriceJoin+`
+        WHERE `+where, start, end, model, project).Scan(&out.Conversations, &conversationRequests, &conversationTokens, &costMicros)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database query error", err)
+		return
+	}
+	out.ConversationCost = costFromMicros(costMicros)
+	out.CostPerConversation = ratio(out.ConversationCost, out.Conversations)
+	out.TokensPerConversation = ratio(float64(conversationTokens), out.Conversations)
+	out.RequestsPerConversation = ratio(float64(conversationRequests), out.Conversations)
+
+	var activeDays int64
+	err = db.QueryRowContext(r.Context(), `
+        SELECT COUNT(DISTINCT (u.date, u.project, u.end_user)), COUNT(DISTINCT u.date), `+usageCostMicrosSum+`
+        FROM usage_attribution u `+usagePriceJoin+`
+        WHERE `+where+` AND u.end_user <> ''`, start, end, model, project).Scan(&out.UserDays, &activeDays, &costMicros)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database query error", err)
+		return
+	}
+	out.EndUserCost = costFromMicros(costMicros)
+	out.CostPerActiveUserPerDay = ratio(out.EndUserCost, out.UserDays)
+	out.AverageDailyActiveUsers = ratio(float64(out.UserDays), activeDays)
+	respondJSON(w, http.StatusOK, out)
+}
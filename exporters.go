@@ -0,0 +1,202 @@
+// exporters.go
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+// UsageEvent is a single increment of usage, forwarded to external observability tools
+type UsageEvent struct {
+	Time             time.Time
+	Date             time.Time
+	Model            string
+	Project          string
+	Source           string
+	PromptTokens     int
+	CompletionTokens int
+	TotalTokens      int
+	Cost             *float64
+}
+
+// usageExporter sends events to one external system
+type usageExporter struct {
+	name string
+	send func(UsageEvent) error
+}
+
+const (
+	exportQueueSize   = 1000
+	exportMaxAttempts = 5
+)
+
+var exporters []usageExporter
+var exportQueue = make(chan UsageEvent, exportQueueSize)
+var exportClient = &http.Client{Timeout: 15 * time.Second}
+
+// startUsageExporters enables exporters whose credentials are configured and starts the delivery worker
+func startUsageExporters() {
+	if os.Getenv("LANGFUSE_PUBLIC_KEY") != "" && os.Getenv("LANGFUSE_SECRET_KEY") != "" {
+		exporters = append(exporters, usageExporter{"langfuse", sendLangfuse})
+	}
+	if os.Getenv("HELICONE_API_KEY") != "" {
+		exporters = append(exporters, usageExporter{"helicone", sendHelicone})
+	}
+	if len(exporters) == 0 {
+		return
+	}
+	for _, e := range exporters {
+		log.Printf("Forwarding usage events to %s", e.name)
+	}
+	go runUsageExporters()
+}
+
+// exportUsageEvent queues an event for delivery without blocking the caller
+func exportUsageEvent(event UsageEvent) {
+	if len(exporters) == 0 || event.TotalTokens <= 0 {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+	select {
+	case exportQueue <- event:
+	default:
+		log.Printf("Export queue full, dropping usage event for %s", event.Model)
+	}
+}
+
+func runUsageExporters() {
+	for event := range exportQueue {
+		for _, e := range exporters {
+			delay := time.Second
+			for attempt := 1; ; attempt++ {
+				err := e.send(event)
+				if err == nil {
+					break
+				}
+				if attempt == exportMaxAttempts {
+					log.Printf("Giving up exporting usage event to %s after %d attempts: %v", e.name, attempt, err)
+					break
+				}
+				log.Printf("Failed to export usage event to %s: %v, retrying in %v", e.name, err, delay)
+				time.Sleep(delay)
+				delay *= 2
+			}
+		}
+	}
+}
+
+func newUUID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+func postExport(req *http.Request) error {
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := exportClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s returned %s", req.URL.Host, resp.Status)
+	}
+	return nil
+}
+
+// sendLangfuse records the event as a generation through the Langfuse ingestion API
+func sendLangfuse(event UsageEvent) error {
+	host := os.Getenv("LANGFUSE_HOST")
+	if host == "" {
+		host = "https://cloud.langfuse.com"
+	}
+	generation := map[string]interface{}{
+		"id":        newUUID(),
+		"name":      "tokencounter-" + event.Source,
+		"model":     event.Model,
+		"startTime": event.Time.Format(time.RFC3339Nano),
+		"endTime":   event.Time.Format(time.RFC3339Nano),
+		"usage": map[string]interface{}{
+			"input":  event.PromptTokens,
+			"output": event.CompletionTokens,
+			"total":  event.TotalTokens,
+			"unit":   "TOKENS",
+		},
+		"metadata": map[string]interface{}{
+			"project": event.Project,
+			"date":    event.Date.Format("2006-01-02"),
+			"source":  event.Source,
+		},
+	}
+	if event.Cost != nil {
+		generation["costDetails"] = map[string]float64{"total": *event.Cost}
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"batch": []map[string]interface{}{{
+			"id":        newUUID(),
+			"type":      "generation-create",
+			"timestamp": event.Time.Format(time.RFC3339Nano),
+			"body":      generation,
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, host+"/api/public/ingestion", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(os.Getenv("LANGFUSE_PUBLIC_KEY"), os.Getenv("LANGFUSE_SECRET_KEY"))
+	return postExport(req)
+}
+
+// sendHelicone records the event through Helicone's custom model logging API
+func sendHelicone(event UsageEvent) error {
+	url := os.Getenv("HELICONE_LOG_URL")
+	if url == "" {
+		url = "https://api.worker.helicone.ai/custom/v1/log"
+	}
+	timing := map[string]int64{"seconds": event.Time.Unix(), "milliseconds": int64(event.Time.Nanosecond() / 1e6)}
+	body, err := json.Marshal(map[string]interface{}{
+		"providerRequest": map[string]interface{}{
+			"url":  "tokencounter://" + event.Source,
+			"json": map[string]string{"model": event.Model},
+			"meta": map[string]string{
+				"Helicone-Property-Project": event.Project,
+				"Helicone-Property-Source":  event.Source,
+			},
+		},
+		"providerResponse": map[string]interface{}{
+			"status":  200,
+			"headers": map[string]string{},
+			"json": map[string]interface{}{
+				"model": event.Model,
+				"usage": map[string]int{
+					"prompt_tokens":     event.PromptTokens,
+					"completion_tokens": event.CompletionTokens,
+					"total_tokens":      event.TotalTokens,
+				},
+			},
+		},
+		"timing": map[string]interface{}{"startTime": timing, "endTime": timing},
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+os.Getenv("HELICONE_API_KEY"))
+	return postExport(req)
+}
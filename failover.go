@@ -0,0 +1,235 @@
+// failover.go
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// A pool spreads requests for a model over several upstreams of the same provider type.
+// Clients address it like an upstream, /proxy/{pool}/...; each route says which upstream
+// serves which models (a glob) at what priority and weight. The lowest priority with a
+// healthy upstream is used, its upstreams chosen at random in proportion to weight, and a
+// 429, 5xx or connection failure moves the request on to the next candidate.
+type UpstreamRoute struct {
+	ID       int    `json:"id"`
+	Pool     string `json:"pool"`
+	Model    string `json:"model"`
+	Upstream string `json:"upstream"`
+	Priority int    `json:"priority"`
+	Weight   int    `json:"weight"`
+}
+
+// upstreamCooldown is how long an upstream that just failed is tried only as a last resort
+const upstreamCooldown = 30 * time.Second
+
+type upstreamHealthTracker struct {
+	mu       sync.Mutex
+	failedAt map[string]time.Time
+}
+
+var upstreamHealth = &upstreamHealthTracker{failedAt: map[string]time.Time{}}
+
+func (h *upstreamHealthTracker) failed(name string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.failedAt[name] = time.Now()
+}
+
+func (h *upstreamHealthTracker) succeeded(name string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.failedAt, name)
+}
+
+func (h *upstreamHealthTracker) healthy(name string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return time.Since(h.failedAt[name]) > upstreamCooldown
+}
+
+// proxyTargets returns the upstreams to try for a request, in order, and the model it addresses
+func proxyTargets(ctx context.Context, name, path string, body []byte) ([]proxyTarget, string, error) {
+	if dbHealth.available() {
+		routes, targets, err := loadPool(ctx, name)
+		if err != nil && !isUnavailable(err) {
+			return nil, "", err
+		}
+		if len(routes) > 0 {
+			// Pool members share a provider type, so any of them can parse the request
+			model := targets[0].provider.requestModel(path, body)
+			ordered := orderPool(routes, targets, model)
+			if len(ordered) == 0 {
+				return nil, model, fmt.Errorf("no upstream in pool %s serves model %q", name, model)
+			}
+			return ordered, model, nil
+		}
+	}
+	upstream, err := resolveUpstream(ctx, name)
+	if err != nil {
+		return nil, "", err
+	}
+	return []proxyTarget{upstream}, upstream.provider.requestModel(path, body), nil
+}
+
+func loadPool(ctx context.Context, pool string) ([]UpstreamRoute, []proxyTarget, error) {
+	rows, err := db.QueryContext(ctx, `
+        SELECT r.id, r.pool, r.model, r.upstream, r.priority, r.weight, u.provider, u.base_url, u.api_key, u.timeout_seconds
+        FROM upstream_routes r JOIN upstreams u ON u.name = r.upstream
+        WHERE r.pool = $1 ORDER BY r.priority, r.id`, pool)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	var routes []UpstreamRoute
+	var targets []proxyTarget
+	for rows.Next() {
+		var route UpstreamRoute
+		u := Upstream{}
+		if err := rows.Scan(&route.ID, &route.Pool, &route.Model, &route.Upstream, &route.Priority, &route.Weight,
+			&u.Provider, &u.BaseURL, &u.APIKey, &u.TimeoutSeconds); err != nil {
+			return nil, nil, err
+		}
+		u.Name = route.Upstream
+		target, err := upstreamTarget(u)
+		if err != nil {
+			return nil, nil, err
+		}
+		routes = append(routes, route)
+		targets = append(targets, target)
+	}
+	return routes, targets, rows.Err()
+}
+
+// orderPool picks the routes serving model and orders them: by priority, then by a weighted
+// random draw within each priority. Upstreams in their failure cooldown go last.
+func orderPool(routes []UpstreamRoute, targets []proxyTarget, model string) []proxyTarget {
+	type candidate struct {
+		target  proxyTarget
+		healthy bool
+		rank    int
+		key     float64
+	}
+	var candidates []candidate
+	seen := map[string]bool{}
+	for i, route := range routes {
+		if seen[route.Upstream] || !matchModelPattern(route.Model, model) {
+			continue
+		}
+		seen[route.Upstream] = true
+		// Weighted sampling without replacement: sort by u^(1/weight), largest first
+		candidates = append(candidates, candidate{
+			target:  targets[i],
+			healthy: upstreamHealth.healthy(route.Upstream),
+			rank:    route.Priority,
+			key:     math.Pow(rand.Float64(), 1/float64(route.Weight)),
+		})
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if a.healthy != b.healthy {
+			return a.healthy
+		}
+		if a.rank != b.rank {
+			return a.rank < b.rank
+		}
+		return a.key > b.key
+	})
+	ordered := make([]proxyTarget, len(candidates))
+	for i, c := range candidates {
+		ordered[i] = c.target
+	}
+	return ordered
+}
+
+func createUpstreamRoute(w http.ResponseWriter, r *http.Request) {
+	route := UpstreamRoute{Model: "*", Weight: 1}
+	if err := json.NewDecoder(r.Body).Decode(&route); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request payload", err)
+		return
+	}
+	if route.Pool == "" || route.Upstream == "" {
+		respondJSON(w, http.StatusBadRequest, map[string]string{"message": "pool and upstream are required"})
+		return
+	}
+	if route.Weight <= 0 {
+		respondJSON(w, http.StatusBadRequest, map[string]string{"message": "weight must be positive"})
+		return
+	}
+	// Failing over only works between upstreams that speak the same API
+	var provider, poolProvider string
+	err := db.QueryRowContext(r.Context(), `SELECT provider,
+            COALESCE((SELECT u.provider FROM upstream_routes r JOIN upstreams u ON u.name = r.upstream WHERE r.pool = $2 LIMIT 1), '')
+        FROM upstreams WHERE name = $1`, route.Upstream, route.Pool).Scan(&provider, &poolProvider)
+	if err == sql.ErrNoRows {
+		respondJSON(w, http.StatusBadRequest, map[string]string{"message": "Upstream not found"})
+		return
+	} else if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database query error", err)
+		return
+	}
+	if poolProvider != "" && poolProvider != provider {
+		respondJSON(w, http.StatusBadRequest, map[string]string{"message": fmt.Sprintf("Pool %s uses %s upstreams, %s is %s", route.Pool, poolProvider, route.Upstream, provider)})
+		return
+	}
+	err = db.QueryRowContext(r.Context(), "INSERT INTO upstream_routes (pool, model, upstream, priority, weight) VALUES ($1, $2, $3, $4, $5) RETURNING id",
+		route.Pool, route.Model, route.Upstream, route.Priority, route.Weight).Scan(&route.ID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to create route", err)
+		return
+	}
+	infof("Routed %s in pool %s to upstream %s\n", route.Model, route.Pool, route.Upstream)
+	respondJSON(w, http.StatusCreated, route)
+}
+
+func getUpstreamRoutes(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.QueryContext(r.Context(), "SELECT id, pool, model, upstream, priority, weight FROM upstream_routes ORDER BY pool, priority, id")
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database query error", err)
+		return
+	}
+	defer rows.Close()
+	routes := []UpstreamRoute{}
+	for rows.Next() {
+		var route UpstreamRoute
+		if err := rows.Scan(&route.ID, &route.Pool, &route.Model, &route.Upstream, &route.Priority, &route.Weight); err != nil {
+			respondError(w, http.StatusInternalServerError, "Error scanning row", err)
+			return
+		}
+		routes = append(routes, route)
+	}
+	if err = rows.Err(); err != nil {
+		respondError(w, http.StatusInternalServerError, "Error reading data", err)
+		return
+	}
+	respondJSON(w, http.StatusOK, routes)
+}
+
+func deleteUpstreamRoute(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid route id", err)
+		return
+	}
+	res, err := db.ExecContext(r.Context(), "DELETE FROM upstream_routes WHERE id = $1", id)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to delete route", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		respondJSON(w, http.StatusNotFound, map[string]string{"message": "Route not found"})
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]string{"message": "Route deleted successfully"})
+}
@@ -0,0 +1,208 @@
+// fallback.go
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// A FallbackPolicy downgrades proxied requests to a cheaper model as a budget runs out, e.g.
+// "when project X has spent 80% of its monthly budget, send gpt-4o requests to gpt-4o-mini".
+// With a project, the policy watches that project's monthly USD budget; without one, it
+// watches the token budgets of the requested model and applies to every project. Model is a
+// glob. The first matching policy whose budget is at or past ThresholdPercent applies, and
+// only once: the fallback model is not itself downgraded further.
+type FallbackPolicy struct {
+	ID               int     `json:"id"`
+	Project          string  `json:"project"`
+	Model            string  `json:"model"`
+	FallbackModel    string  `json:"fallback_model"`
+	ThresholdPercent float64 `json:"threshold_percent"`
+}
+
+// ModelDowngrade counts the requests a policy downgraded on a day
+type ModelDowngrade struct {
+	Date          string `json:"date"`
+	PolicyID      int    `json:"policy_id"`
+	Project       string `json:"project"`
+	Model         string `json:"model"`
+	FallbackModel string `json:"fallback_model"`
+	Requests      int64  `json:"requests"`
+}
+
+const fallbackPolicyColumns = "id, project, model, fallback_model, threshold_percent"
+
+// fallbackFor returns the policy that downgrades a request for model from project, if any.
+// Like budgets, policies fail open while the database is down.
+func fallbackFor(ctx context.Context, project, model string) (*FallbackPolicy, error) {
+	if model == "" || !dbHealth.available() {
+		return nil, nil
+	}
+	rows, err := db.QueryContext(ctx, "SELECT "+fallbackPolicyColumns+" FROM fallback_policies WHERE project = '' OR project = $1 ORDER BY id", project)
+	if err != nil {
+		return nil, err
+	}
+	var policies []FallbackPolicy
+	for rows.Next() {
+		var p FallbackPolicy
+		if err := rows.Scan(&p.ID, &p.Project, &p.Model, &p.FallbackModel, &p.ThresholdPercent); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if matchModelPattern(p.Model, model) && p.FallbackModel != model {
+			policies = append(policies, p)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for i, p := range policies {
+		percent, err := policyBudgetPercent(ctx, p, model)
+		if err != nil {
+			return nil, err
+		}
+		if percent >= p.ThresholdPercent {
+			return &policies[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// policyBudgetPercent is how much of the budget a policy watches has been used: the project's
+// monthly USD budget, or the most used token budget of the model. No budget reads as 0%.
+func policyBudgetPercent(ctx context.Context, p FallbackPolicy, model string) (float64, error) {
+	today := time.Now().Truncate(24 * time.Hour)
+	monthStart, _ := periodStart("month", today)
+	var percent sql.NullFloat64
+	if p.Project != "" {
+		err := db.QueryRowContext(ctx, `
+            SELECT (SELECT `+usageCostMicrosSum+`
+                FROM token_usage u `+usagePriceJoin+`
+                WHERE u.project = pr.name AND u.date >= $2) / 1e6 / NULLIF(pr.monthly_budget_usd, 0) * 100
+            FROM projects pr WHERE pr.name = $1`, p.Project, monthStart).Scan(&percent)
+		if err == sql.ErrNoRows {
+			return 0, nil
+		}
+		return percent.Float64, err
+	}
+	weekStart, _ := periodStart("week", today)
+	err := db.QueryRowContext(ctx, `
+        SELECT MAX(COALESCE((SELECT SUM(u.total_tokens) FROM token_usage u
+            WHERE u.model = b.model AND u.date >= CASE b.period WHEN 'week' THEN $2 ELSE $3 END), 0)::DOUBLE PRECISION
+            / NULLIF(b.limit_tokens, 0) * 100)
+        FROM budgets b WHERE b.model = $1`, model, weekStart, monthStart).Scan(&percent)
+	return percent.Float64, err
+}
+
+// recordDowngrade counts a downgraded request for GET /fallback_policies/downgrades
+func recordDowngrade(ctx context.Context, p *FallbackPolicy, project, model string) error {
+	_, err := db.ExecContext(ctx, `INSERT INTO model_downgrades (date, policy_id, project, model, fallback_model, requests) VALUES ($1, $2, $3, $4, $5, 1)
+        ON CONFLICT (date, policy_id, project, model) DO UPDATE SET requests = model_downgrades.requests + 1`,
+		time.Now().Truncate(24*time.Hour), p.ID, project, model, p.FallbackModel)
+	return err
+}
+
+func createFallbackPolicy(w http.ResponseWriter, r *http.Request) {
+	var p FallbackPolicy
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request payload", err)
+		return
+	}
+	if p.Model == "" || p.FallbackModel == "" {
+		respondJSON(w, http.StatusBadRequest, map[string]string{"message": "model and fallback_model are required"})
+		return
+	}
+	if p.ThresholdPercent <= 0 {
+		respondJSON(w, http.StatusBadRequest, map[string]string{"message": "threshold_percent must be positive"})
+		return
+	}
+	err := db.QueryRowContext(r.Context(), "INSERT INTO fallback_policies (project, model, fallback_model, threshold_percent) VALUES ($1, $2, $3, $4) RETURNING id",
+		p.Project, p.Model, p.FallbackModel, p.ThresholdPercent).Scan(&p.ID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to create fallback policy", err)
+		return
+	}
+	infof("Created fallback policy from %s to %s at %.0f%%\n", p.Model, p.FallbackModel, p.ThresholdPercent)
+	respondJSON(w, http.StatusCreated, p)
+}
+
+func getFallbackPolicies(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.QueryContext(r.Context(), "SELECT "+fallbackPolicyColumns+" FROM fallback_policies ORDER BY id")
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database query error", err)
+		return
+	}
+	defer rows.Close()
+	policies := []FallbackPolicy{}
+	for rows.Next() {
+		var p FallbackPolicy
+		if err := rows.Scan(&p.ID, &p.Project, &p.Model, &p.FallbackModel, &p.ThresholdPercent); err != nil {
+			respondError(w, http.StatusInternalServerError, "Error scanning row", err)
+			return
+		}
+		policies = append(policies, p)
+	}
+	if err = rows.Err(); err != nil {
+		respondError(w, http.StatusInternalServerError, "Error reading data", err)
+		return
+	}
+	respondJSON(w, http.StatusOK, policies)
+}
+
+func deleteFallbackPolicy(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid fallback policy id", err)
+		return
+	}
+	res, err := db.ExecContext(r.Context(), "DELETE FROM fallback_policies WHERE id = $1", id)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to delete fallback policy", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		respondJSON(w, http.StatusNotFound, map[string]string{"message": "Fallback policy not found"})
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]string{"message": "Fallback policy deleted successfully"})
+}
+
+// getModelDowngrades lists the downgrades made in a date range
+func getModelDowngrades(w http.ResponseWriter, r *http.Request) {
+	start, end, err := parseDateRange(r.URL.Query(), "month")
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid date range", err)
+		return
+	}
+	rows, err := db.QueryContext(r.Context(), `
+        SELECT date, policy_id, project, model, fallback_model, requests FROM model_downgrades
+        WHERE date >= $1 AND date <= $2 ORDER BY date, policy_id, project, model`, start, end)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database query error", err)
+		return
+	}
+	defer rows.Close()
+	downgrades := []ModelDowngrade{}
+	for rows.Next() {
+		var d ModelDowngrade
+		var date time.Time
+		if err := rows.Scan(&date, &d.PolicyID, &d.Project, &d.Model, &d.FallbackModel, &d.Requests); err != nil {
+			respondError(w, http.StatusInternalServerError, "Error scanning row", err)
+			return
+		}
+		d.Date = date.Format("2006-01-02")
+		downgrades = append(downgrades, d)
+	}
+	if err = rows.Err(); err != nil {
+		respondError(w, http.StatusInternalServerError, "Error reading data", err)
+		return
+	}
+	respondJSON(w, http.StatusOK, downgrades)
+}
@@ -0,0 +1,51 @@
+// faults.go
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Fault injection lets operators rehearse how reporters and dashboards cope when TokenCounter
+// degrades. It is only compiled into builds made with -tags chaos (see faults_chaos.go),
+// which set these hooks; in regular builds they stay nil and cost a nil check.
+var (
+	// dbFault runs before each database statement, write or not; an error fails the statement
+	dbFault func(ctx context.Context, write bool) error
+	// responseFault runs before each request is handled
+	responseFault func(r *http.Request)
+	// faultRoutes registers the admin endpoints controlling the faults
+	faultRoutes func(admin *mux.Router)
+)
+
+// injectDBFault applies dbFault, if compiled in
+func injectDBFault(ctx context.Context, write bool) error {
+	if dbFault == nil {
+		return nil
+	}
+	return dbFault(ctx, write)
+}
+
+// isWriteStatement reports whether query changes data. Data-modifying CTEs are not detected.
+func isWriteStatement(query string) bool {
+	verb, _, _ := strings.Cut(strings.TrimSpace(query), " ")
+	switch strings.ToUpper(verb) {
+	case "INSERT", "UPDATE", "DELETE":
+		return true
+	}
+	return false
+}
+
+// injectResponseFaults applies responseFault to requests, if compiled in
+func injectResponseFaults(next http.Handler) http.Handler {
+	if responseFault == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		responseFault(r)
+		next.ServeHTTP(w, r)
+	})
+}
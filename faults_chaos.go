@@ -0,0 +1,108 @@
+//go:build chaos
+
+// faults_chaos.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// FaultConfig is the set of faults injected, as read and replaced at /admin/faults. All are
+// off at startup. DBLatencyMs delays every database statement, WriteFailureRate fails that
+// fraction of writes (INSERT, UPDATE and DELETE statements) and ResponseDelayMs delays every
+// request except admin and debug ones, which stay usable to turn the faults off again.
+type FaultConfig struct {
+	DBLatencyMs      int     `json:"db_latency_ms"`
+	WriteFailureRate float64 `json:"write_failure_rate"`
+	ResponseDelayMs  int     `json:"response_delay_ms"`
+}
+
+var (
+	faultsMu sync.RWMutex
+	faults   FaultConfig
+)
+
+// errInjectedFault fails writes picked by WriteFailureRate
+var errInjectedFault = errors.New("injected fault: write failed")
+
+func init() {
+	dbFault = injectedDBFault
+	responseFault = injectedResponseDelay
+	faultRoutes = func(admin *mux.Router) {
+		admin.HandleFunc("/faults", getFaults).Methods("GET")
+		admin.HandleFunc("/faults", putFaults).Methods("PUT")
+		admin.HandleFunc("/faults", deleteFaults).Methods("DELETE")
+	}
+	log.Println("Fault injection is compiled in; configure it at /admin/faults")
+}
+
+func currentFaults() FaultConfig {
+	faultsMu.RLock()
+	defer faultsMu.RUnlock()
+	return faults
+}
+
+func injectedDBFault(ctx context.Context, write bool) error {
+	f := currentFaults()
+	if f.DBLatencyMs > 0 {
+		select {
+		case <-time.After(time.Duration(f.DBLatencyMs) * time.Millisecond):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if write && f.WriteFailureRate > 0 && rand.Float64() < f.WriteFailureRate {
+		return errInjectedFault
+	}
+	return nil
+}
+
+func injectedResponseDelay(r *http.Request) {
+	f := currentFaults()
+	if f.ResponseDelayMs <= 0 || strings.HasPrefix(r.URL.Path, "/admin/") || strings.HasPrefix(r.URL.Path, "/debug/") {
+		return
+	}
+	select {
+	case <-time.After(time.Duration(f.ResponseDelayMs) * time.Millisecond):
+	case <-r.Context().Done():
+	}
+}
+
+func getFaults(w http.ResponseWriter, r *http.Request) {
+	respondJSON(w, http.StatusOK, currentFaults())
+}
+
+func putFaults(w http.ResponseWriter, r *http.Request) {
+	var f FaultConfig
+	if err := json.NewDecoder(r.Body).Decode(&f); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request payload", err)
+		return
+	}
+	if f.DBLatencyMs < 0 || f.ResponseDelayMs < 0 || f.WriteFailureRate < 0 || f.WriteFailureRate > 1 {
+		respondJSON(w, http.StatusBadRequest, map[string]string{"message": "Delays must not be negative and write_failure_rate must be between 0 and 1"})
+		return
+	}
+	faultsMu.Lock()
+	faults = f
+	faultsMu.Unlock()
+	log.Printf("Injecting faults: %+v", f)
+	respondJSON(w, http.StatusOK, f)
+}
+
+func deleteFaults(w http.ResponseWriter, r *http.Request) {
+	faultsMu.Lock()
+	faults = FaultConfig{}
+	faultsMu.Unlock()
+	log.Println("Fault injection turned off")
+	respondJSON(w, http.StatusOK, map[string]string{"message": "Faults cleared"})
+}
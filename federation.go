@@ -0,0 +1,415 @@
+// federation.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Federation rolls usage up from other TokenCounter instances, such as per-team deployments,
+// into this one. Each member is a federation source: the federation job pulls the usage rows of
+// members with a URL through their GET /sync, and members without one push the same rows to
+// POST /federation/push with the source's token (see the federation_push job). Rows are kept
+// per source in federated_usage and GET /federation/usage reports them next to local usage.
+// As with /sync, rows a member deletes are not removed here. Members must use the default
+// snake_case field naming.
+type FederationSource struct {
+	Name string `json:"name"`
+	// URL is the member's base URL to pull from; empty for members that push
+	URL string `json:"url,omitempty"`
+	// Token is write-only: the bearer token sent when pulling and expected with pushes
+	Token        string     `json:"token,omitempty"`
+	HasToken     bool       `json:"has_token"`
+	LastSyncedAt *time.Time `json:"last_synced_at,omitempty"`
+	LastError    string     `json:"last_error,omitempty"`
+}
+
+// federationPull is a page of a member's GET /sync
+type federationPull struct {
+	Records    []TokenUsage `json:"records"`
+	NextCursor string       `json:"next_cursor"`
+	HasMore    bool         `json:"has_more"`
+}
+
+// localSourceName labels this instance's own usage in federated reports
+func localSourceName() string {
+	if name := os.Getenv("FEDERATION_SOURCE_NAME"); name != "" {
+		return name
+	}
+	return "local"
+}
+
+// storeFederatedUsage upserts a source's rows by their id on the member
+func storeFederatedUsage(ctx context.Context, tx *sql.Tx, source string, records []TokenUsage) error {
+	for _, u := range records {
+		_, err := tx.ExecContext(ctx, `INSERT INTO federated_usage (source, remote_id, date, model, project, total_tokens, cost, requests, characters, credits, synced_at)
+            VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, NOW())
+            ON CONFLICT (source, remote_id) DO UPDATE SET date = EXCLUDED.date, model = EXCLUDED.model, project = EXCLUDED.project,
+                total_tokens = EXCLUDED.total_tokens, cost = EXCLUDED.cost, requests = EXCLUDED.requests,
+                characters = EXCLUDED.characters, credits = EXCLUDED.credits, synced_at = NOW()`,
+			source, u.ID, u.Date, u.Model, u.Project, u.TotalTokens, u.Cost, u.Requests, u.Characters, u.Credits)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pullFederationSource fetches everything new from a member, a page per transaction so
+// progress survives a failure part way
+func pullFederationSource(ctx context.Context, name, baseURL, token, cursor string) error {
+	for {
+		endpoint := strings.TrimSuffix(baseURL, "/") + "/sync?limit=" + fmt.Sprint(syncMaxLimit)
+		if cursor != "" {
+			endpoint += "&cursor=" + url.QueryEscape(cursor)
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+		if err != nil {
+			return err
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := exportClient.Do(req)
+		if err != nil {
+			return err
+		}
+		var body json.RawMessage
+		err = json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("%s returned %s", req.URL.Host, resp.Status)
+		}
+		if err != nil {
+			return fmt.Errorf("reading %s: %w", req.URL.Host, err)
+		}
+		// Members with response_envelope set wrap the page in data
+		var envelope struct {
+			Data json.RawMessage `json:"data"`
+		}
+		if json.Unmarshal(body, &envelope) == nil && len(envelope.Data) > 0 {
+			body = envelope.Data
+		}
+		var page federationPull
+		if err := json.Unmarshal(body, &page); err != nil {
+			return fmt.Errorf("reading %s: %w", req.URL.Host, err)
+		}
+
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		if err := storeFederatedUsage(ctx, tx, name, page.Records); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE federation_sources SET cursor = $2, last_synced_at = NOW(), last_error = '' WHERE name = $1", name, page.NextCursor); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		cursor = page.NextCursor
+		if !page.HasMore {
+			return nil
+		}
+	}
+}
+
+// pullFederation is the federation job: it pulls from every member with a URL
+func pullFederation(ctx context.Context) error {
+	rows, err := db.QueryContext(ctx, "SELECT name, url, token, cursor FROM federation_sources WHERE url <> '' ORDER BY name")
+	if err != nil {
+		return err
+	}
+	type source struct{ name, url, token, cursor string }
+	var sources []source
+	for rows.Next() {
+		var s source
+		if err := rows.Scan(&s.name, &s.url, &s.token, &s.cursor); err != nil {
+			rows.Close()
+			return err
+		}
+		sources = append(sources, s)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	var failed []error
+	for _, s := range sources {
+		if err := pullFederationSource(ctx, s.name, s.url, s.token, s.cursor); err != nil {
+			log.Printf("Failed to pull usage from federation source %s: %v", s.name, err)
+			if _, dbErr := db.ExecContext(ctx, "UPDATE federation_sources SET last_error = $2 WHERE name = $1", s.name, err.Error()); dbErr != nil {
+				return dbErr
+			}
+			failed = append(failed, fmt.Errorf("%s: %w", s.name, err))
+		}
+	}
+	return errors.Join(failed...)
+}
+
+// receiveFederationPush stores rows pushed by a member: {"source": ..., "records": [...]},
+// authenticated with the source's token
+func receiveFederationPush(w http.ResponseWriter, r *http.Request) {
+	var push struct {
+		Source  string       `json:"source"`
+		Records []TokenUsage `json:"records"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&push); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request payload", err)
+		return
+	}
+	var token string
+	err := db.QueryRowContext(r.Context(), "SELECT token FROM federation_sources WHERE name = $1", push.Source).Scan(&token)
+	if err != nil && err != sql.ErrNoRows {
+		respondError(w, http.StatusInternalServerError, "Database query error", err)
+		return
+	}
+	given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if err == sql.ErrNoRows || token == "" || !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+		respondJSON(w, http.StatusUnauthorized, map[string]string{"message": "Unknown federation source or wrong token"})
+		return
+	}
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to start transaction", err)
+		return
+	}
+	defer tx.Rollback()
+	if err := storeFederatedUsage(r.Context(), tx, push.Source, push.Records); err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to store federated usage", err)
+		return
+	}
+	if _, err := tx.ExecContext(r.Context(), "UPDATE federation_sources SET last_synced_at = NOW(), last_error = '' WHERE name = $1", push.Source); err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to store federated usage", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to commit federated usage", err)
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{"received": len(push.Records)})
+}
+
+// pushFederation is the federation_push job, for members that push: it sends usage rows
+// changed since the last push to FEDERATION_PUSH_URL as FEDERATION_SOURCE_NAME, with
+// FEDERATION_PUSH_TOKEN
+func pushFederation(ctx context.Context) error {
+	central := os.Getenv("FEDERATION_PUSH_URL")
+	if central == "" {
+		return nil
+	}
+	var cursor string
+	err := db.QueryRowContext(ctx, "SELECT cursor FROM federation_push_state WHERE id = 1").Scan(&cursor)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	pushed := 0
+	for {
+		var since time.Time
+		sinceID := 0
+		if cursor != "" {
+			if since, sinceID, err = decodeSyncCursor(cursor); err != nil {
+				return err
+			}
+		}
+		records, hasMore, err := syncPage(ctx, since, sinceID, syncMaxLimit)
+		if err != nil || len(records) == 0 {
+			return err
+		}
+		body, err := json.Marshal(map[string]interface{}{"source": localSourceName(), "records": records})
+		if err != nil {
+			return err
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(central, "/")+"/federation/push", bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+os.Getenv("FEDERATION_PUSH_TOKEN"))
+		if err := postExport(req); err != nil {
+			return err
+		}
+		last := records[len(records)-1]
+		cursor = encodeSyncCursor(*last.UpdatedAt, last.ID)
+		if _, err := db.ExecContext(ctx, `INSERT INTO federation_push_state (id, cursor) VALUES (1, $1)
+            ON CONFLICT (id) DO UPDATE SET cursor = EXCLUDED.cursor`, cursor); err != nil {
+			return err
+		}
+		pushed += len(records)
+		if !hasMore {
+			debugf("Pushed %d usage rows to %s\n", pushed, central)
+			return nil
+		}
+	}
+}
+
+// federationGroups maps ?group_by= values of GET /federation/usage to columns
+var federationGroups = map[string]string{
+	"source":  "u.source",
+	"model":   "u.model",
+	"project": "u.project",
+}
+
+// getFederatedUsage is the org-wide rollup: local and federated usage over a date range,
+// grouped by any of ?group_by=source,model,project (source and model by default)
+func getFederatedUsage(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	start, end, err := parseDateRange(q, "month")
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid date range", err)
+		return
+	}
+	groupBy := []string{"source", "model"}
+	if v := q.Get("group_by"); v != "" {
+		groupBy = strings.Split(v, ",")
+	}
+	// Group columns come from federationGroups, never from the request
+	var columns []string
+	for _, dim := range groupBy {
+		column, ok := federationGroups[dim]
+		if !ok {
+			respondJSON(w, http.StatusBadRequest, map[string]string{"message": "Unknown group_by " + dim + ", use source, model or project"})
+			return
+		}
+		columns = append(columns, column)
+	}
+	cols := strings.Join(columns, ", ")
+	rows, err := db.QueryContext(r.Context(), `
+        SELECT `+cols+`, SUM(u.total_tokens), `+usageCostMicrosSum+`
+        FROM (
+            SELECT $3::TEXT AS source, date, model, project, total_tokens, cost FROM token_usage WHERE date >= $1 AND date <= $2
+            UNION ALL
+            SELECT source, date, model, project, total_tokens, cost FROM federated_usage WHERE date >= $1 AND date <= $2
+        ) u `+usagePriceJoin+`
+        GROUP BY `+cols+` ORDER BY `+cols, start, end, localSourceName())
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database query error", err)
+		return
+	}
+	defer rows.Close()
+	out := []map[string]interface{}{}
+	for rows.Next() {
+		keys := make([]string, len(groupBy))
+		var tokens, cost int64
+		dest := make([]interface{}, 0, len(keys)+2)
+		for i := range keys {
+			dest = append(dest, &keys[i])
+		}
+		dest = append(dest, &tokens, &cost)
+		if err := rows.Scan(dest...); err != nil {
+			respondError(w, http.StatusInternalServerError, "Error scanning row", err)
+			return
+		}
+		row := map[string]interface{}{"total_tokens": tokens, "cost": costFromMicros(cost)}
+		for i, dim := range groupBy {
+			row[dim] = keys[i]
+		}
+		out = append(out, row)
+	}
+	if err = rows.Err(); err != nil {
+		respondError(w, http.StatusInternalServerError, "Error reading data", err)
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{"start": start.Format("2006-01-02"), "end": end.Format("2006-01-02"), "usage": out})
+}
+
+func putFederationSource(w http.ResponseWriter, r *http.Request) {
+	var s FederationSource
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request payload", err)
+		return
+	}
+	s.Name = mux.Vars(r)["name"]
+	if s.Name == localSourceName() {
+		respondJSON(w, http.StatusBadRequest, map[string]string{"message": "name is used for this instance's own usage"})
+		return
+	}
+	if s.URL != "" {
+		if u, err := url.Parse(s.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			respondJSON(w, http.StatusBadRequest, map[string]string{"message": "url must be an http or https URL"})
+			return
+		}
+	} else if s.Token == "" {
+		respondJSON(w, http.StatusBadRequest, map[string]string{"message": "a source without a url pushes, and needs a token"})
+		return
+	}
+	// An omitted token keeps the current one
+	_, err := db.ExecContext(r.Context(), `INSERT INTO federation_sources (name, url, token) VALUES ($1, $2, $3)
+        ON CONFLICT (name) DO UPDATE SET url = EXCLUDED.url, token = CASE WHEN EXCLUDED.token = '' THEN federation_sources.token ELSE EXCLUDED.token END`,
+		s.Name, s.URL, s.Token)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to save federation source", err)
+		return
+	}
+	s.HasToken = s.Token != ""
+	s.Token = ""
+	infof("Saved federation source %s\n", s.Name)
+	respondJSON(w, http.StatusOK, s)
+}
+
+func getFederationSources(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.QueryContext(r.Context(), "SELECT name, url, token <> '', last_synced_at, last_error FROM federation_sources ORDER BY name")
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database query error", err)
+		return
+	}
+	defer rows.Close()
+	sources := []FederationSource{}
+	for rows.Next() {
+		var s FederationSource
+		if err := rows.Scan(&s.Name, &s.URL, &s.HasToken, &s.LastSyncedAt, &s.LastError); err != nil {
+			respondError(w, http.StatusInternalServerError, "Error scanning row", err)
+			return
+		}
+		sources = append(sources, s)
+	}
+	if err = rows.Err(); err != nil {
+		respondError(w, http.StatusInternalServerError, "Error reading data", err)
+		return
+	}
+	respondJSON(w, http.StatusOK, sources)
+}
+
+// deleteFederationSource removes a member along with the usage federated from it
+func deleteFederationSource(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to start transaction", err)
+		return
+	}
+	defer tx.Rollback()
+	res, err := tx.ExecContext(r.Context(), "DELETE FROM federation_sources WHERE name = $1", name)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to delete federation source", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		respondJSON(w, http.StatusNotFound, map[string]string{"message": "Federation source not found"})
+		return
+	}
+	if _, err := tx.ExecContext(r.Context(), "DELETE FROM federated_usage WHERE source = $1", name); err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to delete federation source", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to delete federation source", err)
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]string{"message": "Federation source deleted successfully"})
+}
@@ -0,0 +1,83 @@
+// gemini.go
+package main
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+)
+
+// geminiModelPath matches ".../models/{model}:generateContent" style paths used by Gemini and Vertex AI
+var geminiModelPath = regexp.MustCompile(`models/([^/:]+):`)
+
+func geminiRequestModel(path string, body []byte) string {
+	return geminiModelFromPath(path)
+}
+
+func geminiModelFromPath(path string) string {
+	if m := geminiModelPath.FindStringSubmatch(path); m != nil {
+		return m[1]
+	}
+	return ""
+}
+
+// extractGeminiUsage reads usageMetadata from generateContent or streamGenerateContent responses.
+// Streamed chunks report cumulative counts, so the last chunk carrying usage wins.
+func extractGeminiUsage(path string, body []byte) (proxyUsage, bool) {
+	usage := proxyUsage{Model: geminiModelFromPath(path)}
+	found := false
+	for _, payload := range jsonPayloads(body) {
+		var resp struct {
+			ModelVersion  string `json:"modelVersion"`
+			UsageMetadata *struct {
+				PromptTokenCount     int `json:"promptTokenCount"`
+				CandidatesTokenCount int `json:"candidatesTokenCount"`
+				ThoughtsTokenCount   int `json:"thoughtsTokenCount"`
+			} `json:"usageMetadata"`
+		}
+		if err := json.Unmarshal(payload, &resp); err != nil || resp.UsageMetadata == nil {
+			continue
+		}
+		if usage.Model == "" {
+			usage.Model = resp.ModelVersion
+		}
+		usage.PromptTokens = resp.UsageMetadata.PromptTokenCount
+		usage.CompletionTokens = resp.UsageMetadata.CandidatesTokenCount + resp.UsageMetadata.ThoughtsTokenCount
+		found = true
+	}
+	return usage, found
+}
+
+// geminiStreamText concatenates the text parts of streamed candidates
+func geminiStreamText(body []byte) string {
+	var text strings.Builder
+	for _, payload := range jsonPayloads(body) {
+		var chunk struct {
+			Candidates []struct {
+				Content struct {
+					Parts []struct {
+						Text string `json:"text"`
+					} `json:"parts"`
+				} `json:"content"`
+			} `json:"candidates"`
+		}
+		if err := json.Unmarshal(payload, &chunk); err != nil {
+			continue
+		}
+		for _, c := range chunk.Candidates {
+			for _, p := range c.Content.Parts {
+				text.WriteString(p.Text)
+			}
+		}
+	}
+	return text.String()
+}
+
+// geminiRewriteModel swaps the model in a generateContent path
+func geminiRewriteModel(path string, body []byte, model string) (string, []byte) {
+	loc := geminiModelPath.FindStringSubmatchIndex(path)
+	if loc == nil {
+		return path, body
+	}
+	return path[:loc[2]] + model + path[loc[3]:], body
+}
@@ -0,0 +1,302 @@
+// hierarchy.go
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// Usage is organised as organizations -> projects -> keys. Projects are the project names
+// recorded with usage; keys are client credentials or labels that report usage on behalf of
+// a project, resolved to it on ingest. Projects without an organization roll up under
+// organization 0, "unassigned".
+
+// Organization is the top level of the project hierarchy
+type Organization struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+// Project places a project name in an organization and lists the keys reporting for it
+type Project struct {
+	Name             string   `json:"name"`
+	OrganizationID   *int     `json:"organization_id"`
+	MonthlyBudgetUSD *float64 `json:"monthly_budget_usd"`
+	Keys             []string `json:"keys"`
+}
+
+// resolveProjectKey returns the project a key reports for; ok is false if the key is unknown
+func resolveProjectKey(key string) (string, bool, error) {
+	var project string
+	err := db.QueryRow("SELECT project FROM project_keys WHERE key = $1", key).Scan(&project)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return project, true, nil
+}
+
+func isForeignKeyViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23503"
+}
+
+func createOrganization(w http.ResponseWriter, r *http.Request) {
+	var org Organization
+	if err := json.NewDecoder(r.Body).Decode(&org); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request payload", err)
+		return
+	}
+	if org.Name == "" {
+		respondJSON(w, http.StatusBadRequest, map[string]string{"message": "name is required"})
+		return
+	}
+	err := db.QueryRowContext(r.Context(), "INSERT INTO organizations (name) VALUES ($1) ON CONFLICT (name) DO NOTHING RETURNING id", org.Name).Scan(&org.ID)
+	if err == sql.ErrNoRows {
+		respondJSON(w, http.StatusConflict, map[string]string{"message": "An organization with this name already exists"})
+		return
+	} else if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to create organization", err)
+		return
+	}
+	infof("Created organization %d %s\n", org.ID, org.Name)
+	respondJSON(w, http.StatusCreated, org)
+}
+
+func getOrganizations(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.QueryContext(r.Context(), "SELECT id, name FROM organizations ORDER BY name")
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database query error", err)
+		return
+	}
+	defer rows.Close()
+	orgs := []Organization{}
+	for rows.Next() {
+		var o Organization
+		if err := rows.Scan(&o.ID, &o.Name); err != nil {
+			respondError(w, http.StatusInternalServerError, "Error scanning row", err)
+			return
+		}
+		orgs = append(orgs, o)
+	}
+	if err = rows.Err(); err != nil {
+		respondError(w, http.StatusInternalServerError, "Error reading data", err)
+		return
+	}
+	respondJSON(w, http.StatusOK, orgs)
+}
+
+// deleteOrganization removes an organization; its projects become unassigned
+func deleteOrganization(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid organization id", err)
+		return
+	}
+	res, err := db.ExecContext(r.Context(), "DELETE FROM organizations WHERE id = $1", id)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to delete organization", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		respondJSON(w, http.StatusNotFound, map[string]string{"message": "Organization not found"})
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]string{"message": "Organization deleted successfully"})
+}
+
+func getProjects(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.QueryContext(r.Context(), `
+        SELECT p.name, p.organization_id, p.monthly_budget_usd, COALESCE(array_agg(k.key ORDER BY k.key) FILTER (WHERE k.key IS NOT NULL), '{}')
+        FROM projects p LEFT JOIN project_keys k ON k.project = p.name
+        GROUP BY p.name, p.organization_id, p.monthly_budget_usd ORDER BY p.name`)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database query error", err)
+		return
+	}
+	defer rows.Close()
+	projects := []Project{}
+	for rows.Next() {
+		var p Project
+		if err := rows.Scan(&p.Name, &p.OrganizationID, &p.MonthlyBudgetUSD, pq.Array(&p.Keys)); err != nil {
+			respondError(w, http.StatusInternalServerError, "Error scanning row", err)
+			return
+		}
+		projects = append(projects, p)
+	}
+	if err = rows.Err(); err != nil {
+		respondError(w, http.StatusInternalServerError, "Error reading data", err)
+		return
+	}
+	respondJSON(w, http.StatusOK, projects)
+}
+
+// putProject registers a project and sets its organization and monthly budget
+func putProject(w http.ResponseWriter, r *http.Request) {
+	var p Project
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request payload", err)
+		return
+	}
+	p.Name = mux.Vars(r)["name"]
+	if p.MonthlyBudgetUSD != nil && *p.MonthlyBudgetUSD <= 0 {
+		respondJSON(w, http.StatusBadRequest, map[string]string{"message": "monthly_budget_usd must be positive"})
+		return
+	}
+	_, err := db.ExecContext(r.Context(), `INSERT INTO projects (name, organization_id, monthly_budget_usd) VALUES ($1, $2, $3)
+        ON CONFLICT (name) DO UPDATE SET organization_id = EXCLUDED.organization_id, monthly_budget_usd = EXCLUDED.monthly_budget_usd`,
+		p.Name, p.OrganizationID, p.MonthlyBudgetUSD)
+	if isForeignKeyViolation(err) {
+		respondJSON(w, http.StatusBadRequest, map[string]string{"message": "Organization not found"})
+		return
+	} else if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to save project", err)
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{"name": p.Name, "organization_id": p.OrganizationID, "monthly_budget_usd": p.MonthlyBudgetUSD})
+}
+
+// deleteProject removes a project from the hierarchy along with its keys; usage is kept
+func deleteProject(w http.ResponseWriter, r *http.Request) {
+	res, err := db.ExecContext(r.Context(), "DELETE FROM projects WHERE name = $1", mux.Vars(r)["name"])
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to delete project", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		respondJSON(w, http.StatusNotFound, map[string]string{"message": "Project not found"})
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]string{"message": "Project deleted successfully"})
+}
+
+// putProjectKey assigns a key to a project, moving it if it belonged to another
+func putProjectKey(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	_, err := db.ExecContext(r.Context(), `INSERT INTO project_keys (key, project) VALUES ($1, $2)
+        ON CONFLICT (key) DO UPDATE SET project = EXCLUDED.project`, vars["key"], vars["name"])
+	if isForeignKeyViolation(err) {
+		respondJSON(w, http.StatusNotFound, map[string]string{"message": "Project not found"})
+		return
+	} else if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to save key", err)
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]string{"key": vars["key"], "project": vars["name"]})
+}
+
+func deleteProjectKey(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	res, err := db.ExecContext(r.Context(), "DELETE FROM project_keys WHERE key = $1 AND project = $2", vars["key"], vars["name"])
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to delete key", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		respondJSON(w, http.StatusNotFound, map[string]string{"message": "Key not found"})
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]string{"message": "Key deleted successfully"})
+}
+
+// Rollup nodes carry the totals of everything below them
+type ModelRollup struct {
+	Model       string  `json:"model"`
+	TotalTokens int64   `json:"total_tokens"`
+	Cost        float64 `json:"cost"`
+}
+
+type ProjectRollup struct {
+	Project     string        `json:"project"`
+	TotalTokens int64         `json:"total_tokens"`
+	Cost        float64       `json:"cost"`
+	Models      []ModelRollup `json:"models"`
+	costMicros  int64
+}
+
+type OrganizationRollup struct {
+	ID          int             `json:"id"`
+	Name        string          `json:"name"`
+	TotalTokens int64           `json:"total_tokens"`
+	Cost        float64         `json:"cost"`
+	Projects    []ProjectRollup `json:"projects"`
+	costMicros  int64
+}
+
+// getRollup aggregates usage and cost up the hierarchy for a date range, optionally for a
+// single organization with ?organization_id= (0 selects unassigned projects)
+func getRollup(w http.ResponseWriter, r *http.Request) {
+	start, end, err := parseDateRange(r.URL.Query(), "month")
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid date range", err)
+		return
+	}
+	orgFilter := -1
+	if v := r.URL.Query().Get("organization_id"); v != "" {
+		if orgFilter, err = strconv.Atoi(v); err != nil || orgFilter < 0 {
+			respondJSON(w, http.StatusBadRequest, map[string]string{"message": "Invalid organization_id"})
+			return
+		}
+	}
+	rows, err := db.QueryContext(r.Context(), `
+        SELECT COALESCE(o.id, 0), COALESCE(o.name, 'unassigned'), u.project, u.model,
+            SUM(u.total_tokens), `+usageCostMicrosSum+`
+        FROM token_usage u
+        `+usagePriceJoin+`
+        LEFT JOIN projects pr ON pr.name = u.project
+        LEFT JOIN organizations o ON o.id = pr.organization_id
+        WHERE u.date >= $1 AND u.date <= $2 AND ($3 < 0 OR COALESCE(o.id, 0) = $3)
+        GROUP BY 1, 2, 3, 4
+        ORDER BY 2, 1, 3, 4`, start, end, orgFilter)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database query error", err)
+		return
+	}
+	defer rows.Close()
+
+	orgs := []OrganizationRollup{}
+	for rows.Next() {
+		var orgID int
+		var orgName, project string
+		var m ModelRollup
+		var cost int64
+		if err := rows.Scan(&orgID, &orgName, &project, &m.Model, &m.TotalTokens, &cost); err != nil {
+			respondError(w, http.StatusInternalServerError, "Error scanning row", err)
+			return
+		}
+		// Rows arrive ordered by organization then project, so new nodes start at the end
+		if len(orgs) == 0 || orgs[len(orgs)-1].ID != orgID {
+			orgs = append(orgs, OrganizationRollup{ID: orgID, Name: orgName, Projects: []ProjectRollup{}})
+		}
+		org := &orgs[len(orgs)-1]
+		if len(org.Projects) == 0 || org.Projects[len(org.Projects)-1].Project != project {
+			org.Projects = append(org.Projects, ProjectRollup{Project: project, Models: []ModelRollup{}})
+		}
+		p := &org.Projects[len(org.Projects)-1]
+		m.Cost = costFromMicros(cost)
+		p.Models = append(p.Models, m)
+		p.TotalTokens += m.TotalTokens
+		p.costMicros += cost
+		p.Cost = costFromMicros(p.costMicros)
+		org.TotalTokens += m.TotalTokens
+		org.costMicros += cost
+		org.Cost = costFromMicros(org.costMicros)
+	}
+	if err = rows.Err(); err != nil {
+		respondError(w, http.StatusInternalServerError, "Error reading data", err)
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"start":         start.Format("2006-01-02"),
+		"end":           end.Format("2006-01-02"),
+		"organizations": orgs,
+	})
+}
@@ -0,0 +1,239 @@
+// integrity.go
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// SnapshotRecord is one token_usage row in a snapshot. Row ids are left out so a snapshot of
+// restored data hashes the same as the original.
+// Measures are omitted when zero, so days sealed before they existed still verify.
+type SnapshotRecord struct {
+	Model       string   `json:"model"`
+	Project     string   `json:"project"`
+	TotalTokens int      `json:"total_tokens"`
+	Cost        *float64 `json:"cost"`
+	UsageMeasures
+}
+
+// daySnapshot returns a day's records in a fixed order and the SHA-256 of their canonical
+// encoding: one JSON object per line, in that order
+func daySnapshot(ctx context.Context, date time.Time) ([]SnapshotRecord, string, error) {
+	rows, err := db.QueryContext(ctx, "SELECT model, project, total_tokens, cost, requests, characters, credits FROM token_usage WHERE date = $1 ORDER BY model, project, id", date)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+	records := []SnapshotRecord{}
+	h := sha256.New()
+	for rows.Next() {
+		var rec SnapshotRecord
+		if err := rows.Scan(&rec.Model, &rec.Project, &rec.TotalTokens, &rec.Cost, &rec.Requests, &rec.Characters, &rec.Credits); err != nil {
+			return nil, "", err
+		}
+		line, err := json.Marshal(rec)
+		if err != nil {
+			return nil, "", err
+		}
+		h.Write(append(line, '\n'))
+		records = append(records, rec)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+	return records, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// getSnapshot returns a complete, deterministic dump of one day's records with its content
+// hash, which is also sent as the ETag so backup tools can skip unchanged days
+func getSnapshot(w http.ResponseWriter, r *http.Request) {
+	date, err := time.Parse("2006-01-02", r.URL.Query().Get("date"))
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid date, expected ?date=YYYY-MM-DD", err)
+		return
+	}
+	records, hash, err := daySnapshot(r.Context(), date)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database query error", err)
+		return
+	}
+	etag := `"` + hash + `"`
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"date":    date.Format("2006-01-02"),
+		"count":   len(records),
+		"sha256":  hash,
+		"records": records,
+	})
+}
+
+// Sealed days form a hash chain: each day's chain hash covers the previous day's chain hash,
+// the date and the day's content hash, so altering, adding or removing any record of a sealed
+// day breaks verification from that day on. Days are sealed once they are sealGraceDays old,
+// leaving reporters time to finish sending running totals.
+const sealGraceDays = 2
+
+// DayHash is a sealed day's entry in the chain
+type DayHash struct {
+	Date        string    `json:"date"`
+	ContentHash string    `json:"content_hash"`
+	ChainHash   string    `json:"chain_hash"`
+	SealedAt    time.Time `json:"sealed_at"`
+}
+
+func chainHash(prev, date, content string) string {
+	sum := sha256.Sum256([]byte(prev + "|" + date + "|" + content))
+	return hex.EncodeToString(sum[:])
+}
+
+// sealDays is the seal job: it extends the chain with every unsealed day up to the grace period,
+// including days without usage so the chain has no gaps
+func sealDays(ctx context.Context) error {
+	var last sql.NullTime
+	var prev string
+	err := db.QueryRowContext(ctx, "SELECT date, chain_hash FROM usage_day_hashes ORDER BY date DESC LIMIT 1").Scan(&last, &prev)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	var day time.Time
+	if last.Valid {
+		day = last.Time.AddDate(0, 0, 1)
+	} else {
+		var first sql.NullTime
+		if err := db.QueryRowContext(ctx, "SELECT MIN(date) FROM token_usage").Scan(&first); err != nil {
+			return err
+		}
+		if !first.Valid {
+			return nil // nothing recorded yet
+		}
+		day = first.Time
+	}
+	until := time.Now().Truncate(24*time.Hour).AddDate(0, 0, -sealGraceDays)
+	sealed := 0
+	for ; !day.After(until); day = day.AddDate(0, 0, 1) {
+		_, content, err := daySnapshot(ctx, day)
+		if err != nil {
+			return err
+		}
+		date := day.Format("2006-01-02")
+		chain := chainHash(prev, date, content)
+		if _, err := db.ExecContext(ctx, "INSERT INTO usage_day_hashes (date, content_hash, chain_hash) VALUES ($1, $2, $3)", day, content, chain); err != nil {
+			return err
+		}
+		prev = chain
+		sealed++
+	}
+	if sealed > 0 {
+		infof("Sealed %d days of usage, chain head %s\n", sealed, prev)
+	}
+	return nil
+}
+
+func loadDayHashes(ctx context.Context, start, end time.Time) ([]DayHash, error) {
+	rows, err := db.QueryContext(ctx, "SELECT date, content_hash, chain_hash, sealed_at FROM usage_day_hashes WHERE date >= $1 AND date <= $2 ORDER BY date", start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	hashes := []DayHash{}
+	for rows.Next() {
+		var h DayHash
+		var date time.Time
+		if err := rows.Scan(&date, &h.ContentHash, &h.ChainHash, &h.SealedAt); err != nil {
+			return nil, err
+		}
+		h.Date = date.Format("2006-01-02")
+		hashes = append(hashes, h)
+	}
+	return hashes, rows.Err()
+}
+
+// getDayHashes lists the chain for a date range (default: lifetime), e.g. to publish the
+// chain head alongside an invoice
+func getDayHashes(w http.ResponseWriter, r *http.Request) {
+	start, end, err := parseDateRange(r.URL.Query(), "lifetime")
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid date range", err)
+		return
+	}
+	hashes, err := loadDayHashes(r.Context(), start, end)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database query error", err)
+		return
+	}
+	respondJSON(w, http.StatusOK, hashes)
+}
+
+// IntegrityProblem is a sealed day that no longer matches the chain
+type IntegrityProblem struct {
+	Date     string `json:"date"`
+	Problem  string `json:"problem"`
+	Expected string `json:"expected"`
+	Actual   string `json:"actual"`
+}
+
+// verifyIntegrity recomputes the content hash of every sealed day in the range, except days in
+// cold storage, and checks each chain link against the day before it
+func verifyIntegrity(w http.ResponseWriter, r *http.Request) {
+	start, end, err := parseDateRange(r.URL.Query(), "lifetime")
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid date range", err)
+		return
+	}
+	hashes, err := loadDayHashes(r.Context(), start, end)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database query error", err)
+		return
+	}
+	// Archived days' records are in cold storage, so only their chain links can be checked
+	archived, err := archivedMonths(r.Context())
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database query error", err)
+		return
+	}
+	problems := []IntegrityProblem{}
+	prev := ""
+	if len(hashes) > 0 {
+		err := db.QueryRowContext(r.Context(), "SELECT chain_hash FROM usage_day_hashes WHERE date < $1 ORDER BY date DESC LIMIT 1", hashes[0].Date).Scan(&prev)
+		if err != nil && err != sql.ErrNoRows {
+			respondError(w, http.StatusInternalServerError, "Database query error", err)
+			return
+		}
+	}
+	for _, h := range hashes {
+		day, _ := time.Parse("2006-01-02", h.Date)
+		content := h.ContentHash
+		if !archived[day.Format("2006-01")] {
+			if _, content, err = daySnapshot(r.Context(), day); err != nil {
+				respondError(w, http.StatusInternalServerError, "Database query error", err)
+				return
+			}
+		}
+		if content != h.ContentHash {
+			problems = append(problems, IntegrityProblem{Date: h.Date, Problem: "records changed after sealing", Expected: h.ContentHash, Actual: content})
+		}
+		if expected := chainHash(prev, h.Date, h.ContentHash); expected != h.ChainHash {
+			problems = append(problems, IntegrityProblem{Date: h.Date, Problem: "chain link broken", Expected: expected, Actual: h.ChainHash})
+		}
+		prev = h.ChainHash
+	}
+	resp := map[string]interface{}{
+		"verified_days": len(hashes),
+		"valid":         len(problems) == 0,
+		"problems":      problems,
+	}
+	if len(hashes) > 0 {
+		resp["chain_head"] = hashes[len(hashes)-1].ChainHash
+	}
+	respondJSON(w, http.StatusOK, resp)
+}
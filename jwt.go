@@ -0,0 +1,419 @@
+// jwt.go
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// JWTAuthConfig configures the jwt provider. Tokens must be signed with RS256, RS384, RS512,
+// ES256 or ES384 by a key published at JWKSURL, and must not have expired. Without JWKSURL the
+// keys are found through the issuer's OpenID configuration, as Auth0 and Keycloak publish it.
+// Claims are named as in the token, such as Auth0's "https://example.com/project", or by a
+// dotted path into it, such as Keycloak's "realm_access.roles".
+type JWTAuthConfig struct {
+	JWKSURL string `json:"jwks_url"`
+	// Issuer and Audience, if set, must match the token's iss and one of its aud
+	Issuer   string `json:"issuer"`
+	Audience string `json:"audience"`
+	// ProjectClaim scopes the caller to the project it holds, "project" by default
+	ProjectClaim string `json:"project_claim"`
+	// ProjectMap, if set, maps the values of ProjectClaim to projects, such as the client IDs
+	// in azp of services granted client credentials; a token whose value is not listed grants
+	// no project
+	ProjectMap map[string]string `json:"project_map"`
+	// RequireProject rejects tokens that grant no project, unless they are an admin's, so a
+	// token can't see every project's usage by leaving the claim out
+	RequireProject bool `json:"require_project"`
+	// RolesClaim holds the caller's roles, "roles" by default; holders of AdminRole are admins
+	RolesClaim string `json:"roles_claim"`
+	AdminRole  string `json:"admin_role"`
+}
+
+func (c JWTAuthConfig) validate() error {
+	isURL := func(u string) bool {
+		return strings.HasPrefix(u, "https://") || strings.HasPrefix(u, "http://")
+	}
+	switch {
+	case c.JWKSURL == "" && c.Issuer == "":
+		return fmt.Errorf("jwks_url or issuer is required")
+	case c.JWKSURL != "" && !isURL(c.JWKSURL):
+		return fmt.Errorf("jwks_url must be http or https")
+	case c.JWKSURL == "" && !isURL(c.Issuer):
+		return fmt.Errorf("issuer must be http or https to discover its keys without jwks_url")
+	}
+	return nil
+}
+
+// jwtLeeway allows for clock skew between the issuer and the service
+const jwtLeeway = time.Minute
+
+var jwtAlgorithms = map[string]crypto.Hash{
+	"RS256": crypto.SHA256, "RS384": crypto.SHA384, "RS512": crypto.SHA512,
+	"ES256": crypto.SHA256, "ES384": crypto.SHA384,
+}
+
+// jwtBearer authenticates bearer JWTs
+type jwtBearer JWTAuthConfig
+
+func (j jwtBearer) Authenticate(r *http.Request) (*Principal, error) {
+	token, ok := bearerToken(r)
+	// Anything that isn't shaped like a JWT is left to the other providers
+	if !ok || strings.Count(token, ".") != 2 {
+		return nil, nil
+	}
+	claims, err := verifyJWT(r.Context(), JWTAuthConfig(j), token)
+	if err != nil {
+		return nil, err
+	}
+	p := &Principal{header: "Authorization"}
+	p.Subject, _ = claims["sub"].(string)
+	if values := claimStrings(claims, j.claim(j.ProjectClaim, "project")); len(values) > 0 {
+		p.Project = values[0]
+		if j.ProjectMap != nil {
+			p.Project = ""
+			// The first value mapped wins, so a token may carry groups besides the mapped one
+			for _, v := range values {
+				if project, ok := j.ProjectMap[v]; ok {
+					p.Project = project
+					break
+				}
+			}
+		}
+	}
+	if j.AdminRole != "" {
+		for _, role := range claimStrings(claims, j.claim(j.RolesClaim, "roles")) {
+			if role == j.AdminRole {
+				p.Admin = true
+			}
+		}
+	}
+	if j.RequireProject && p.Project == "" && !p.Admin {
+		return nil, credentialError("Token grants no project")
+	}
+	return p, nil
+}
+
+func (j jwtBearer) GrantsAdmin() bool {
+	return j.AdminRole != ""
+}
+
+func (j jwtBearer) claim(name, fallback string) string {
+	if name == "" {
+		return fallback
+	}
+	return name
+}
+
+// verifyJWT checks a token's signature and validity and returns its claims. A token that fails
+// gives a credentialError; failing to fetch the signing keys does not.
+func verifyJWT(ctx context.Context, cfg JWTAuthConfig, token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, credentialError("Invalid token: malformed header")
+	}
+	hash, ok := jwtAlgorithms[header.Alg]
+	if !ok {
+		return nil, credentialError(fmt.Sprintf("Invalid token: unsupported algorithm %q", header.Alg))
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, credentialError("Invalid token: malformed signature")
+	}
+	url := cfg.JWKSURL
+	if url == "" {
+		if url, err = discoverJWKS(ctx, cfg.Issuer); err != nil {
+			return nil, err
+		}
+	}
+	key, err := jwks.key(ctx, url, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	h := hash.New()
+	h.Write([]byte(parts[0] + "." + parts[1]))
+	digest := h.Sum(nil)
+	valid := false
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		valid = strings.HasPrefix(header.Alg, "RS") && rsa.VerifyPKCS1v15(pub, hash, digest, sig) == nil
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if strings.HasPrefix(header.Alg, "ES") && len(sig) == 2*size {
+			r, s := new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])
+			valid = ecdsa.Verify(pub, digest, r, s)
+		}
+	}
+	if !valid {
+		return nil, credentialError("Invalid token: bad signature")
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, credentialError("Invalid token: malformed claims")
+	}
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return nil, credentialError("Invalid token: no expiry")
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(jwtLeeway)) {
+		return nil, credentialError("Token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(jwtLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, credentialError("Token not valid yet")
+	}
+	if cfg.Issuer != "" && claims["iss"] != cfg.Issuer {
+		return nil, credentialError("Invalid token: wrong issuer")
+	}
+	if cfg.Audience != "" {
+		found := false
+		for _, aud := range claimStrings(claims, "aud") {
+			found = found || aud == cfg.Audience
+		}
+		if !found {
+			return nil, credentialError("Invalid token: wrong audience")
+		}
+	}
+	return claims, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// claimStrings returns the claim named path, or else at path taken as a dotted path, as a
+// list: a string claim as the only element, a list claim's strings, and nothing for anything
+// else
+func claimStrings(claims map[string]interface{}, path string) []string {
+	v, ok := claims[path]
+	if !ok {
+		v = interface{}(claims)
+		for _, name := range strings.Split(path, ".") {
+			m, ok := v.(map[string]interface{})
+			if !ok {
+				return nil
+			}
+			v = m[name]
+		}
+	}
+	switch v := v.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		var out []string
+		for _, e := range v {
+			if s, ok := e.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+// jwksCache holds the keys published at a JWKS URL. They are fetched again after jwksMaxAge,
+// or when a token names a key not among them, which is how issuers roll keys over, though not
+// more often than jwksMinRefresh so tokens with made-up key IDs can't make it fetch each time.
+type jwksCache struct {
+	mu      sync.Mutex
+	url     string
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+}
+
+const (
+	jwksMaxAge     = time.Hour
+	jwksMinRefresh = 30 * time.Second
+)
+
+var jwks = &jwksCache{}
+
+var jwksClient = &http.Client{Timeout: 10 * time.Second}
+
+// key returns the key with ID kid; a token without kid takes the only key published
+func (c *jwksCache) key(ctx context.Context, url, kid string) (crypto.PublicKey, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.url != url {
+		c.url, c.keys, c.fetched = url, nil, time.Time{}
+	}
+	key, ok := c.lookup(kid)
+	if (!ok || time.Since(c.fetched) > jwksMaxAge) && time.Since(c.fetched) > jwksMinRefresh {
+		keys, err := fetchJWKS(ctx, url)
+		if err != nil && !ok {
+			return nil, err
+		}
+		// Should a refresh fail, the cached key is still good
+		if err == nil {
+			c.keys, c.fetched = keys, time.Now()
+			key, ok = c.lookup(kid)
+		}
+	}
+	if !ok {
+		return nil, credentialError(fmt.Sprintf("Invalid token: unknown signing key %q", kid))
+	}
+	return key, nil
+}
+
+func (c *jwksCache) lookup(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(c.keys) == 1 {
+		for _, key := range c.keys {
+			return key, true
+		}
+	}
+	key, ok := c.keys[kid]
+	return key, ok
+}
+
+// oidcDiscovery caches the JWKS URL of an issuer's OpenID configuration, looked up again
+// after jwksMaxAge in case the issuer moves its keys
+var oidcDiscovery struct {
+	sync.Mutex
+	issuer  string
+	jwksURL string
+	fetched time.Time
+}
+
+// discoverJWKS returns the jwks_uri of issuer's OpenID configuration
+func discoverJWKS(ctx context.Context, issuer string) (string, error) {
+	d := &oidcDiscovery
+	d.Lock()
+	defer d.Unlock()
+	if d.issuer == issuer && time.Since(d.fetched) < jwksMaxAge {
+		return d.jwksURL, nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimRight(issuer, "/")+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := jwksClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("fetching OpenID configuration: %s", resp.Status)
+	}
+	var config struct {
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&config); err != nil {
+		return "", fmt.Errorf("reading OpenID configuration: %w", err)
+	}
+	if config.JWKSURI == "" {
+		return "", fmt.Errorf("OpenID configuration of %s has no jwks_uri", issuer)
+	}
+	d.issuer, d.jwksURL, d.fetched = issuer, config.JWKSURI, time.Now()
+	return d.jwksURL, nil
+}
+
+// jsonWebKey is the part of a JWK the service uses
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// fetchJWKS fetches the signing keys at url, skipping encryption keys and those it can't use
+func fetchJWKS(ctx context.Context, url string) (map[string]crypto.PublicKey, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := jwksClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching JWKS: %s", resp.Status)
+	}
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, fmt.Errorf("reading JWKS: %w", err)
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Use == "enc" {
+			continue
+		}
+		if key, err := k.publicKey(); err == nil {
+			keys[k.Kid] = key
+		}
+	}
+	return keys, nil
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	decode := func(s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil || len(b) == 0 {
+			return nil, fmt.Errorf("invalid key parameter")
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil || !e.IsInt64() {
+			return nil, fmt.Errorf("invalid exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("point not on curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
@@ -0,0 +1,209 @@
+// keys.go
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// keyActivity counts requests made with each project key, whether sent in X-Tokencounter-Key
+// or in an ingested record, and flushes the counts to key_activity every keyFlushInterval. A
+// request counts as an error when its response status is 400 or above. Counts not yet flushed
+// are lost if the process dies, which is acceptable for telemetry.
+type keyActivityCounter struct {
+	mu     sync.Mutex
+	counts map[string]*keyCounts
+}
+
+type keyCounts struct {
+	requests int64
+	errors   int64
+	lastUsed time.Time
+}
+
+const keyFlushInterval = 30 * time.Second
+
+var keyActivity = &keyActivityCounter{counts: map[string]*keyCounts{}}
+
+func (a *keyActivityCounter) record(key string, failed bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	c, ok := a.counts[key]
+	if !ok {
+		c = &keyCounts{}
+		a.counts[key] = c
+	}
+	c.requests++
+	if failed {
+		c.errors++
+	}
+	c.lastUsed = time.Now()
+}
+
+// flush writes the counts to the database, keeping them for the next flush if that fails
+func (a *keyActivityCounter) flush(ctx context.Context) error {
+	a.mu.Lock()
+	counts := a.counts
+	a.counts = map[string]*keyCounts{}
+	a.mu.Unlock()
+	for key, c := range counts {
+		_, err := db.ExecContext(ctx, `INSERT INTO key_activity (key, date, requests, errors, last_used_at) VALUES ($1, $2, $3, $4, $5)
+            ON CONFLICT (key, date) DO UPDATE SET requests = key_activity.requests + EXCLUDED.requests,
+                errors = key_activity.errors + EXCLUDED.errors, last_used_at = GREATEST(key_activity.last_used_at, EXCLUDED.last_used_at)`,
+			key, c.lastUsed.Truncate(24*time.Hour), c.requests, c.errors, c.lastUsed)
+		if err != nil {
+			a.mu.Lock()
+			for k, c := range counts {
+				a.merge(k, c)
+			}
+			a.mu.Unlock()
+			return err
+		}
+		delete(counts, key)
+	}
+	return nil
+}
+
+// merge adds c to the counts for key; the caller holds a.mu
+func (a *keyActivityCounter) merge(key string, c *keyCounts) {
+	existing, ok := a.counts[key]
+	if !ok {
+		a.counts[key] = c
+		return
+	}
+	existing.requests += c.requests
+	existing.errors += c.errors
+	if c.lastUsed.After(existing.lastUsed) {
+		existing.lastUsed = c.lastUsed
+	}
+}
+
+// run flushes the counts periodically; every instance flushes its own
+func (a *keyActivityCounter) run() {
+	for range time.Tick(keyFlushInterval) {
+		if !dbHealth.available() {
+			continue
+		}
+		if err := a.flush(context.Background()); err != nil {
+			log.Printf("Failed to save key activity: %v", err)
+		}
+	}
+}
+
+// keyUse lets a handler name the key a request used when it is not in the header
+type keyUse struct {
+	key string
+}
+
+type keyUseKey struct{}
+
+// noteKeyUse attributes the request with ctx to key for key activity
+func noteKeyUse(ctx context.Context, key string) {
+	if use, ok := ctx.Value(keyUseKey{}).(*keyUse); ok {
+		use.key = key
+	}
+}
+
+// statusWriter remembers the status of a response
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// trackKeyUse records key activity for the request, if it used a key
+func trackKeyUse(w http.ResponseWriter, r *http.Request, next http.Handler, key string) {
+	use := &keyUse{key: key}
+	sw := &statusWriter{ResponseWriter: w}
+	next.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), keyUseKey{}, use)))
+	if use.key != "" {
+		keyActivity.record(use.key, sw.status >= http.StatusBadRequest)
+	}
+}
+
+// KeyStats is a project key's activity as listed by GET /admin/keys
+type KeyStats struct {
+	Key        string     `json:"key"`
+	Project    string     `json:"project"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	Requests   int64      `json:"requests"`
+	Errors     int64      `json:"errors"`
+	// RequestsToday and ErrorsToday compare with DailyAverage, the mean over the 30 days
+	// before today, to spot a key being used unusually
+	RequestsToday int64   `json:"requests_today"`
+	ErrorsToday   int64   `json:"errors_today"`
+	DailyAverage  float64 `json:"daily_average"`
+}
+
+// getKeys lists project keys with their activity, least recently used first. ?unused_days=N
+// lists only keys not used in the last N days, including keys never used.
+func getKeys(w http.ResponseWriter, r *http.Request) {
+	unusedDays := -1
+	if v := r.URL.Query().Get("unused_days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			respondJSON(w, http.StatusBadRequest, map[string]string{"message": "Invalid unused_days"})
+			return
+		}
+		unusedDays = n
+	}
+	// Include this instance's unflushed counts
+	if err := keyActivity.flush(r.Context()); err != nil {
+		log.Printf("Failed to save key activity: %v", err)
+	}
+	today := time.Now().Truncate(24 * time.Hour)
+	rows, err := db.QueryContext(r.Context(), `
+        SELECT k.key, k.project, MAX(a.last_used_at), COALESCE(SUM(a.requests), 0), COALESCE(SUM(a.errors), 0),
+            COALESCE(SUM(a.requests) FILTER (WHERE a.date = $1), 0), COALESCE(SUM(a.errors) FILTER (WHERE a.date = $1), 0),
+            COALESCE(SUM(a.requests) FILTER (WHERE a.date >= $1::DATE - 30 AND a.date < $1), 0) / 30.0
+        FROM project_keys k LEFT JOIN key_activity a ON a.key = k.key
+        GROUP BY k.key, k.project
+        HAVING $2 < 0 OR COALESCE(MAX(a.last_used_at), '-infinity') < NOW() - make_interval(days => $2)
+        ORDER BY MAX(a.last_used_at) NULLS FIRST, k.key`, today, unusedDays)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database query error", err)
+		return
+	}
+	defer rows.Close()
+	keys := []KeyStats{}
+	for rows.Next() {
+		var k KeyStats
+		if err := rows.Scan(&k.Key, &k.Project, &k.LastUsedAt, &k.Requests, &k.Errors, &k.RequestsToday, &k.ErrorsToday, &k.DailyAverage); err != nil {
+			respondError(w, http.StatusInternalServerError, "Error scanning row", err)
+			return
+		}
+		keys = append(keys, k)
+	}
+	if err = rows.Err(); err != nil {
+		respondError(w, http.StatusInternalServerError, "Error reading data", err)
+		return
+	}
+	respondJSON(w, http.StatusOK, keys)
+}
@@ -0,0 +1,72 @@
+// leader.go
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"sync"
+	"time"
+)
+
+// When several instances share a database only one of them, the leader, runs scheduled jobs.
+// Leadership is a session-level Postgres advisory lock held on a dedicated connection, so it
+// is released automatically if the leader dies or loses its connection.
+const leaderLockKey int64 = 0x746f6b656e6a6f62 // "tokenjob"
+
+type leaderElection struct {
+	mu     sync.Mutex
+	conn   *sql.Conn
+	leader bool
+}
+
+var jobLeader = &leaderElection{}
+
+// isLeader checks that a held lock is still alive, or tries to take it
+func (l *leaderElection) isLeader(ctx context.Context) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	if l.conn != nil {
+		if err := l.conn.PingContext(ctx); err == nil {
+			return true
+		}
+		l.conn.Close()
+		l.conn = nil
+	}
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		l.setLeader(false)
+		return false
+	}
+	var acquired bool
+	if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", leaderLockKey).Scan(&acquired); err != nil || !acquired {
+		conn.Close()
+		l.setLeader(false)
+		return false
+	}
+	l.conn = conn
+	l.setLeader(true)
+	return true
+}
+
+// setLeader records the current state, logging transitions; the caller must hold l.mu
+func (l *leaderElection) setLeader(leader bool) {
+	if leader != l.leader {
+		if leader {
+			log.Println("Acquired job leadership, this instance runs scheduled jobs")
+		} else {
+			log.Println("Lost job leadership, scheduled jobs run on another instance")
+		}
+	}
+	l.leader = leader
+}
+
+// current reports the last known state without touching the database
+func (l *leaderElection) current() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.leader
+}
@@ -0,0 +1,147 @@
+// live.go
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+type liveKey struct {
+	date    string
+	model   string
+	project string
+}
+
+// liveAccumulator holds accepted writes that have not reached the database yet, so
+// live totals can include them. pending values are per-day totals, matching POST semantics;
+// increments are increments waiting for their write batch, added to the stored totals.
+type liveAccumulator struct {
+	mu         sync.Mutex
+	pending    map[liveKey]int
+	increments map[liveKey]int
+}
+
+var liveUsage = &liveAccumulator{pending: make(map[liveKey]int), increments: make(map[liveKey]int)}
+
+func keyFor(usage TokenUsage) liveKey {
+	return liveKey{usage.Date.Format("2006-01-02"), usage.Model, usage.Project}
+}
+
+// add marks a write as accepted but not yet flushed
+func (a *liveAccumulator) add(usage TokenUsage) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.pending[keyFor(usage)] = usage.TotalTokens
+}
+
+// flushed clears a pending write once it is stored (or has failed), unless a newer value replaced it
+func (a *liveAccumulator) flushed(usage TokenUsage) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	k := keyFor(usage)
+	if v, ok := a.pending[k]; ok && v == usage.TotalTokens {
+		delete(a.pending, k)
+	}
+}
+
+// addIncrement marks an increment as waiting for its batch
+func (a *liveAccumulator) addIncrement(usage TokenUsage) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.increments[keyFor(usage)] += usage.TotalTokens
+}
+
+// incrementFlushed clears an increment once its batch is written (or has failed)
+func (a *liveAccumulator) incrementFlushed(usage TokenUsage) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	k := keyFor(usage)
+	if a.increments[k] -= usage.TotalTokens; a.increments[k] == 0 {
+		delete(a.increments, k)
+	}
+}
+
+// pendingFor returns unflushed per-project totals for a model on a date
+func (a *liveAccumulator) pendingFor(model string, date time.Time) map[string]int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return forModelOn(a.pending, model, date)
+}
+
+// incrementsFor returns unwritten per-project increments for a model on a date
+func (a *liveAccumulator) incrementsFor(model string, date time.Time) map[string]int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return forModelOn(a.increments, model, date)
+}
+
+func forModelOn(values map[liveKey]int, model string, date time.Time) map[string]int {
+	day := date.Format("2006-01-02")
+	out := map[string]int{}
+	for k, v := range values {
+		if k.model == model && k.date == day {
+			out[k.project] = v
+		}
+	}
+	return out
+}
+
+// getLiveUsage returns today's running total for a model, overlaying writes still in flight
+func getLiveUsage(w http.ResponseWriter, r *http.Request) {
+	model := mux.Vars(r)["model"]
+	today := time.Now().Truncate(24 * time.Hour)
+
+	rows, err := db.QueryContext(r.Context(), "SELECT project, total_tokens FROM token_usage WHERE model = $1 AND date = $2", model, today)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database query error", err)
+		return
+	}
+	defer rows.Close()
+	projects := map[string]int{}
+	for rows.Next() {
+		var project string
+		var tokens int
+		if err := rows.Scan(&project, &tokens); err != nil {
+			respondError(w, http.StatusInternalServerError, "Error scanning row", err)
+			return
+		}
+		projects[project] += tokens
+	}
+	if err = rows.Err(); err != nil {
+		respondError(w, http.StatusInternalServerError, "Error reading data", err)
+		return
+	}
+
+	pending, increments := liveUsage.pendingFor(model, today), liveUsage.incrementsFor(model, today)
+	if scope, ok := projectScope(r.Context()); ok {
+		for project := range pending {
+			if project != scope {
+				delete(pending, project)
+			}
+		}
+		for project := range increments {
+			if project != scope {
+				delete(increments, project)
+			}
+		}
+	}
+	for project, tokens := range pending {
+		projects[project] = tokens
+	}
+	for project, tokens := range increments {
+		projects[project] += tokens
+	}
+	total := 0
+	for _, tokens := range projects {
+		total += tokens
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"model":          model,
+		"date":           today.Format("2006-01-02"),
+		"total_tokens":   total,
+		"pending_writes": len(pending) + len(increments),
+	})
+}
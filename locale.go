@@ -0,0 +1,218 @@
+// locale.go
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Output meant for people follows a locale's conventions for dates and numbers: report
+// digests, reports exported as CSV and the labels of chart series. The locale is locale.name
+// in the config file (LOCALE), which a report can override with its own and a request with
+// ?locale=; the configured date format and separators override the locale's. JSON fields keep
+// ISO 8601 dates and plain numbers whatever the locale, as programs read them, and so does the
+// admin console's CSV.
+
+// LocaleConfig picks the locale. Without a name dates stay YYYY-MM-DD and numbers are written
+// without thousands separators, as before locales were supported.
+type LocaleConfig struct {
+	Name string `json:"name"`
+	// DateFormat is written with YYYY, MM and DD, e.g. "DD/MM/YYYY"
+	DateFormat       string `json:"date_format"`
+	DecimalSeparator string `json:"decimal_separator"`
+	// ThousandsSeparator may be "" to group no digits
+	ThousandsSeparator *string `json:"thousands_separator"`
+}
+
+// locale holds the conventions output is formatted with
+type locale struct {
+	dateFormat string
+	decimal    string
+	thousands  string
+	// currencyAfter writes amounts as "1,50 $" rather than "$1.50"
+	currencyAfter bool
+}
+
+var isoLocale = locale{dateFormat: "YYYY-MM-DD", decimal: "."}
+
+// locales lists the locales that can be named
+var locales = map[string]locale{
+	"en-US": {dateFormat: "MM/DD/YYYY", decimal: ".", thousands: ","},
+	"en-GB": {dateFormat: "DD/MM/YYYY", decimal: ".", thousands: ","},
+	"en-IN": {dateFormat: "DD/MM/YYYY", decimal: ".", thousands: ","},
+	"de-DE": {dateFormat: "DD.MM.YYYY", decimal: ",", thousands: ".", currencyAfter: true},
+	"de-CH": {dateFormat: "DD.MM.YYYY", decimal: ".", thousands: "'"},
+	"fr-FR": {dateFormat: "DD/MM/YYYY", decimal: ",", thousands: " ", currencyAfter: true},
+	"es-ES": {dateFormat: "DD/MM/YYYY", decimal: ",", thousands: ".", currencyAfter: true},
+	"it-IT": {dateFormat: "DD/MM/YYYY", decimal: ",", thousands: ".", currencyAfter: true},
+	"nl-NL": {dateFormat: "DD-MM-YYYY", decimal: ",", thousands: "."},
+	"pt-BR": {dateFormat: "DD/MM/YYYY", decimal: ",", thousands: "."},
+	"pl-PL": {dateFormat: "DD.MM.YYYY", decimal: ",", thousands: " ", currencyAfter: true},
+	"sv-SE": {dateFormat: "YYYY-MM-DD", decimal: ",", thousands: " ", currencyAfter: true},
+	"ja-JP": {dateFormat: "YYYY/MM/DD", decimal: ".", thousands: ","},
+	"zh-CN": {dateFormat: "YYYY/MM/DD", decimal: ".", thousands: ","},
+}
+
+// localeFromEnv reads LOCALE
+func localeFromEnv() LocaleConfig {
+	return LocaleConfig{Name: os.Getenv("LOCALE")}
+}
+
+func (c LocaleConfig) validate() error {
+	if c.Name != "" {
+		if _, ok := locales[c.Name]; !ok {
+			return fmt.Errorf("unknown locale %q", c.Name)
+		}
+	}
+	if c.DateFormat != "" {
+		if err := validateDateFormat(c.DateFormat); err != nil {
+			return err
+		}
+	}
+	if n := len([]rune(c.DecimalSeparator)); n > 1 {
+		return fmt.Errorf("decimal_separator must be a single character")
+	}
+	if t := c.ThousandsSeparator; t != nil && *t != "" && *t == c.DecimalSeparator {
+		return fmt.Errorf("thousands_separator must differ from decimal_separator")
+	}
+	return nil
+}
+
+// validateDateFormat accepts a format with YYYY, MM and DD once each
+func validateDateFormat(format string) error {
+	for _, part := range []string{"YYYY", "MM", "DD"} {
+		if strings.Count(format, part) != 1 {
+			return fmt.Errorf("date_format %q must contain YYYY, MM and DD once each", format)
+		}
+	}
+	return nil
+}
+
+// resolveLocale returns the conventions of the named locale, or of the configured one when
+// name is empty
+func resolveLocale(name string) (locale, error) {
+	cfg := currentConfig.Load().Locale
+	if name != "" && name != cfg.Name {
+		l, ok := locales[name]
+		if !ok {
+			return locale{}, fmt.Errorf("unknown locale %q", name)
+		}
+		return l, nil
+	}
+	l := isoLocale
+	if cfg.Name != "" {
+		l = locales[cfg.Name]
+	}
+	if cfg.DateFormat != "" {
+		l.dateFormat = cfg.DateFormat
+	}
+	if cfg.DecimalSeparator != "" {
+		l.decimal = cfg.DecimalSeparator
+	}
+	if cfg.ThousandsSeparator != nil {
+		l.thousands = *cfg.ThousandsSeparator
+	}
+	return l, nil
+}
+
+var dateFormatLayout = strings.NewReplacer("YYYY", "2006", "MM", "01", "DD", "02")
+
+func (l locale) date(t time.Time) string {
+	return t.Format(dateFormatLayout.Replace(l.dateFormat))
+}
+
+// month writes the date format without the day and a separator next to it
+func (l locale) month(t time.Time) string {
+	format := l.dateFormat
+	if i := strings.Index(format, "DD"); i >= 0 {
+		if i+3 <= len(format) {
+			format = format[:i] + format[i+3:]
+		} else {
+			format = format[:max(0, i-1)]
+		}
+	}
+	return t.Format(dateFormatLayout.Replace(format))
+}
+
+// label localizes a report group value: day and week values are dates and month values
+// months; the others are returned as they are
+func (l locale) label(group, value string) string {
+	switch group {
+	case "day", "week":
+		if t, err := time.Parse("2006-01-02", value); err == nil {
+			return l.date(t)
+		}
+	case "month":
+		if t, err := time.Parse("2006-01", value); err == nil {
+			return l.month(t)
+		}
+	}
+	return value
+}
+
+// integer writes n with its digits grouped in thousands
+func (l locale) integer(n int64) string {
+	digits := strconv.FormatInt(n, 10)
+	sign := ""
+	if n < 0 {
+		sign, digits = "-", digits[1:]
+	}
+	return sign + l.group(digits)
+}
+
+func (l locale) group(digits string) string {
+	if l.thousands == "" || len(digits) <= 3 {
+		return digits
+	}
+	var b strings.Builder
+	for i, d := range digits {
+		if i > 0 && (len(digits)-i)%3 == 0 {
+			b.WriteString(l.thousands)
+		}
+		b.WriteRune(d)
+	}
+	return b.String()
+}
+
+// number writes f with the given decimal places, or as many as needed when places is -1. With
+// grouped unset the integer part is not grouped, as spreadsheets would read a grouped number
+// in a CSV cell as text under some locales.
+func (l locale) number(f float64, places int, grouped bool) string {
+	s := strconv.FormatFloat(f, 'f', places, 64)
+	sign := ""
+	if strings.HasPrefix(s, "-") {
+		sign, s = "-", s[1:]
+	}
+	whole, frac, hasFrac := strings.Cut(s, ".")
+	if grouped {
+		whole = l.group(whole)
+	}
+	if hasFrac {
+		return sign + whole + l.decimal + frac
+	}
+	return sign + whole
+}
+
+// money writes a USD amount in cents
+func (l locale) money(f float64) string {
+	amount := l.number(f, 2, true)
+	if l.currencyAfter {
+		return amount + " $"
+	}
+	if rest, negative := strings.CutPrefix(amount, "-"); negative {
+		return "-$" + rest
+	}
+	return "$" + amount
+}
+
+// csvComma is the CSV field separator: a semicolon where the comma is the decimal separator,
+// as spreadsheets in those locales expect
+func (l locale) csvComma() rune {
+	if l.decimal == "," {
+		return ';'
+	}
+	return ','
+}
@@ -0,0 +1,81 @@
+// logging.go
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// Log levels, from most to least verbose. Errors and warnings go through the log
+// package and are always printed; debugf and infof are filtered by the current level.
+const (
+	levelDebug int32 = iota
+	levelInfo
+	levelWarn
+)
+
+var logLevelNames = map[string]int32{"debug": levelDebug, "info": levelInfo, "warn": levelWarn}
+
+var currentLogLevel atomic.Int32
+
+func init() {
+	currentLogLevel.Store(levelInfo)
+}
+
+// setLogLevel switches the level by name and reports whether the name was valid
+func setLogLevel(name string) bool {
+	level, ok := logLevelNames[strings.ToLower(name)]
+	if ok {
+		currentLogLevel.Store(level)
+	}
+	return ok
+}
+
+func logLevelName() string {
+	level := currentLogLevel.Load()
+	for name, l := range logLevelNames {
+		if l == level {
+			return name
+		}
+	}
+	return "info"
+}
+
+func debugf(format string, args ...interface{}) {
+	if currentLogLevel.Load() <= levelDebug {
+		fmt.Printf(format, args...)
+	}
+}
+
+func infof(format string, args ...interface{}) {
+	if currentLogLevel.Load() <= levelInfo {
+		fmt.Printf(format, args...)
+	}
+}
+
+func getLogLevel(w http.ResponseWriter, r *http.Request) {
+	respondJSON(w, http.StatusOK, map[string]string{"level": logLevelName()})
+}
+
+// putLogLevel switches the log level at runtime; it lasts until the next restart or a config
+// reload that sets log_level
+func putLogLevel(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Level string `json:"level"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request payload", err)
+		return
+	}
+	previous := logLevelName()
+	if !setLogLevel(req.Level) {
+		respondJSON(w, http.StatusBadRequest, map[string]string{"message": "Invalid level. Use 'debug', 'info' or 'warn'"})
+		return
+	}
+	log.Printf("Log level changed from %s to %s", previous, logLevelName())
+	respondJSON(w, http.StatusOK, map[string]string{"level": logLevelName(), "previous": previous})
+}
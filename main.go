@@ -2,14 +2,22 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
 	"time"
 
+	"tokencounter/version"
+
+	"github.com/XSAM/otelsql"
 	"github.com/gorilla/mux"
 	"github.com/joho/godotenv"
 	_ "github.com/lib/pq"
@@ -20,13 +28,89 @@ type TokenUsage struct {
 	ID          int       `json:"id"`
 	Date        time.Time `json:"date"`
 	Model       string    `json:"model"`
+	Project     string    `json:"project"`
 	TotalTokens int       `json:"total_tokens"`
+	UsageBreakdown
+	UsageMeasures
+	// Cost is the provider-reported cost in USD; when absent cost is derived from model pricing
+	Cost *float64 `json:"cost,omitempty"`
+	// Deployment is an Azure OpenAI deployment name, resolved to Model on ingest
+	Deployment string `json:"deployment,omitempty"`
+	// Key identifies the client reporting for a project, resolved to Project on ingest
+	Key string `json:"key,omitempty"`
+	// EndDate spreads the record over Date to EndDate on ingest, split as Distribution says:
+	// "even", the default, or "weighted" by Weights, one per day
+	EndDate      *time.Time `json:"end_date,omitempty"`
+	Distribution string     `json:"distribution,omitempty"`
+	Weights      []float64  `json:"weights,omitempty"`
+	// CreatedAt and UpdatedAt are maintained by storage and ignored on ingest
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+	// JobID reports the record as a batch job's running total, of the kind JobType says
+	JobID   string `json:"job_id,omitempty"`
+	JobType string `json:"job_type,omitempty"`
 }
 
 var db *sql.DB
 
 func main() {
+	// Subcommands run instead of the server
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "version":
+			fmt.Println(version.String())
+			return
+		case "update":
+			check := len(os.Args) > 2 && os.Args[2] == "--check"
+			if err := runSelfUpdate(check); err != nil {
+				log.Fatal("Update failed: ", err)
+			}
+			return
+		case "restore-archive":
+			if err := runRestoreArchive(os.Args[2:]); err != nil {
+				log.Fatal("Restore failed: ", err)
+			}
+			return
+		case "selfcheck":
+			if err := runSelfCheck(); err != nil {
+				log.Fatal("Self-check failed: ", err)
+			}
+			return
+		}
+	}
+
 	godotenv.Load() // Load .env file
+	shutdownTelemetry, err := setupTelemetry(context.Background())
+	if err != nil {
+		log.Printf("Failed to set up OpenTelemetry, continuing without it: %v", err)
+	}
+	defer shutdownTelemetry(context.Background())
+
+	log.Println(version.String())
+	defaultStorage := os.Getenv("STORAGE")
+	if defaultStorage == "" {
+		defaultStorage = "postgres"
+	}
+	storage := flag.String("storage", defaultStorage, "usage storage: postgres, embedded for a single-file database, or memory for an ephemeral instance")
+	dataFile := flag.String("data", "tokencounter.db", "data file for embedded storage")
+	flag.Parse()
+	switch *storage {
+	case "postgres":
+	case "memory":
+		serveStandalone("memory", newMemoryStore())
+		return
+	case "embedded":
+		s, err := openBoltStore(*dataFile)
+		if err != nil {
+			log.Fatalf("Failed to open %s: %v", *dataFile, err)
+		}
+		defer s.db.Close()
+		serveStandalone("embedded", s)
+		return
+	default:
+		log.Fatalf("Unknown storage %q, use postgres, embedded or memory", *storage)
+	}
+
 	// Database connection
 	dbUrl := os.Getenv("DATABASE_URL")
 	if dbUrl == "" {
@@ -37,9 +121,8 @@ func main() {
 	//Retry connection logic
 	maxRetries := 5
 	retryDelay := 2 * time.Second
-	var err error
 	for i := 0; i < maxRetries; i++ {
-		db, err = sql.Open("postgres", dbUrl)
+		db, err = openScopedDB(dbUrl)
 		if err != nil {
 			log.Printf("Failed to connect to the database: %v, retrying in %v", err, retryDelay)
 			time.Sleep(retryDelay)
@@ -62,30 +145,143 @@ func main() {
 		return
 	}
 	defer db.Close()
+	otelsql.RegisterDBStatsMetrics(db)
 
-	// Ensure the table exists (using raw SQL)
-	_, err = db.Exec(`
-        CREATE TABLE IF NOT EXISTS token_usage (
-            id SERIAL PRIMARY KEY,
-            date DATE NOT NULL,
-            model VARCHAR(255) NOT NULL,
-            total_tokens INTEGER NOT NULL
-        );
-    `)
-	if err != nil {
-		log.Fatal("Error creating table:", err)
+	// Ensure the tables exist (using raw SQL)
+	for _, stmt := range schemaStatements {
+		if _, err = db.Exec(stmt); err != nil {
+			log.Fatal("Error creating table:", err)
+			return
+		}
+	}
+	infof("Tables created if not present\n")
+	if err := ensureUsageKeyIndex(context.Background()); err != nil {
+		log.Printf("Failed to create the unique index on token_usage: %v", err)
+	} else if !usageKeyIndexed.Load() {
+		log.Printf("token_usage has duplicate rows, so concurrent writes may add more; merge them with POST /admin/duplicates/merge")
+	}
+	if err := ensureUpcomingPartitions(context.Background()); err != nil {
+		log.Printf("Failed to create upcoming partitions: %v", err)
+	}
+
+	if _, err := reloadConfig(); err != nil {
+		log.Fatal("Error loading configuration:", err)
 		return
 	}
-	fmt.Println("Table created if not present")
+	if err := pendingWrites.load(); err != nil {
+		log.Fatalf("Failed to restore buffered writes: %v", err)
+	}
+	go monitorDatabase()
+	go listenForUsageChanges(dbUrl)
+	go pendingWrites.run()
+	go keyActivity.run()
+	go watchConfig()
+	go runScheduler()
+
+	router := newRouter()
+
+	startUsageExporters()
+
+	log.Println("Server listening on port 5001")
+	http.ListenAndServe(":5001", corsMiddleware(instrumentHandler(router)))
+}
 
+// newRouter mounts every endpoint of the Postgres-backed service
+func newRouter() *mux.Router {
 	router := mux.NewRouter()
+	router.HandleFunc("/health", getHealth).Methods("GET")
 	router.HandleFunc("/token_usage", recordTokenUsage).Methods("POST")
 	router.HandleFunc("/token_usage", getTokenUsageAll).Methods("GET")
-	router.HandleFunc("/token_usage/{date}/{model}", getTokenUsageByDateAndModel).Methods("GET")
-	router.HandleFunc("/token_usage/{model}/{period}", getTokenUsageByPeriod).Methods("GET")
-
-	log.Println("Server listening on port 5001")
-	http.ListenAndServe(":5001", router)
+	router.HandleFunc("/token_usage/matrix", getTokenUsageMatrix).Methods("GET")
+	router.HandleFunc("/token_usage/series", getUsageSeries).Methods("GET")
+	router.HandleFunc("/token_usage/calendar", getUsageCalendar).Methods("GET")
+	router.HandleFunc("/token_usage/monthly", getMonthlyUsage).Methods("GET")
+	router.HandleFunc("/token_usage/diff", getUsageDiff).Methods("GET")
+	router.HandleFunc("/token_usage/recent", getRecentIngestions).Methods("GET")
+	router.HandleFunc("/token_usage/requests", getUsageRequests).Methods("GET")
+	router.HandleFunc("/token_usage/query", queryTokenUsage).Methods("POST")
+	router.HandleFunc(datedUsagePath, getTokenUsageByDateAndModel).Methods("GET")
+	router.HandleFunc(periodUsagePath, getTokenUsageByPeriod).Methods("GET")
+	router.HandleFunc("/measures/{measure}", getMeasureTotals).Methods("GET")
+	router.HandleFunc("/attribution", getAttribution).Methods("GET")
+	router.HandleFunc("/efficiency", getEfficiency).Methods("GET")
+	router.HandleFunc("/context_utilization", getContextUtilization).Methods("GET")
+	router.HandleFunc("/ask", ask).Methods("POST")
+	router.HandleFunc("/federation/usage", getFederatedUsage).Methods("GET")
+	router.HandleFunc("/federation/push", receiveFederationPush).Methods("POST")
+	router.HandleFunc("/ingest/{provider}", ingestWebhook).Methods("POST")
+	router.HandleFunc("/annotations", unscopedOnly(createAnnotation)).Methods("POST")
+	router.HandleFunc("/annotations", getAnnotations).Methods("GET")
+	router.HandleFunc("/annotations/{id}", unscopedOnly(deleteAnnotation)).Methods("DELETE")
+	router.HandleFunc("/batch_jobs", getBatchJobs).Methods("GET")
+	router.HandleFunc("/batch_jobs/summary", getBatchJobSummary).Methods("GET")
+	router.HandleFunc("/batch_jobs/{id}", getBatchJob).Methods("GET")
+	router.HandleFunc("/outages", unscopedOnly(createOutage)).Methods("POST")
+	router.HandleFunc("/outages", getOutages).Methods("GET")
+	router.HandleFunc("/outages/{id}", unscopedOnly(deleteOutage)).Methods("DELETE")
+	router.HandleFunc("/sync", syncUsage).Methods("GET")
+	router.HandleFunc("/budgets", unscopedOnly(createBudget)).Methods("POST")
+	router.HandleFunc("/budgets", getBudgets).Methods("GET")
+	router.HandleFunc("/budgets/{id}", getBudget).Methods("GET")
+	router.HandleFunc("/budgets/{id}", unscopedOnly(deleteBudget)).Methods("DELETE")
+	router.HandleFunc("/budgets/{id}/alerts", getBudgetAlerts).Methods("GET")
+	router.HandleFunc("/rules", unscopedOnly(createRule)).Methods("POST")
+	router.HandleFunc("/rules", getRules).Methods("GET")
+	router.HandleFunc("/rules/{id}", getRule).Methods("GET")
+	router.HandleFunc("/rules/{id}", unscopedOnly(updateRule)).Methods("PUT")
+	router.HandleFunc("/rules/{id}", unscopedOnly(deleteRule)).Methods("DELETE")
+	router.HandleFunc("/rules/{id}/firings", unscopedOnly(getRuleFirings)).Methods("GET")
+	router.HandleFunc("/reports", unscopedOnly(createReport)).Methods("POST")
+	router.HandleFunc("/reports", getReports).Methods("GET")
+	router.HandleFunc("/reports/{name}", getReport).Methods("GET")
+	router.HandleFunc("/reports/{name}", unscopedOnly(deleteReport)).Methods("DELETE")
+	router.HandleFunc("/reports/{name}/run", runReport).Methods("GET")
+	router.HandleFunc("/quota/check", checkQuota).Methods("POST")
+	router.HandleFunc("/quota/remaining", getQuotaRemaining).Methods("GET")
+	router.HandleFunc("/fallback_policies", unscopedOnly(createFallbackPolicy)).Methods("POST")
+	router.HandleFunc("/fallback_policies", getFallbackPolicies).Methods("GET")
+	router.HandleFunc("/fallback_policies/downgrades", getModelDowngrades).Methods("GET")
+	router.HandleFunc("/fallback_policies/{id}", unscopedOnly(deleteFallbackPolicy)).Methods("DELETE")
+	router.HandleFunc("/pricing", getPricingAll).Methods("GET")
+	router.HandleFunc("/pricing/catalog", getPricingCatalog).Methods("GET")
+	router.HandleFunc("/pricing/{model:.+}/history", getPriceHistory).Methods("GET")
+	router.HandleFunc("/pricing/{model:.+}", getPricing).Methods("GET")
+	router.HandleFunc("/pricing/{model:.+}", unscopedOnly(putPricing)).Methods("PUT")
+	router.HandleFunc("/pricing/{model:.+}", unscopedOnly(deletePricing)).Methods("DELETE")
+	router.HandleFunc("/organizations", unscopedOnly(createOrganization)).Methods("POST")
+	router.HandleFunc("/organizations", getOrganizations).Methods("GET")
+	router.HandleFunc("/organizations/{id}", unscopedOnly(deleteOrganization)).Methods("DELETE")
+	router.HandleFunc("/projects", getProjects).Methods("GET")
+	router.HandleFunc("/projects/{name}", unscopedOnly(putProject)).Methods("PUT")
+	router.HandleFunc("/projects/{name}", unscopedOnly(deleteProject)).Methods("DELETE")
+	router.HandleFunc("/projects/{name}/budget_status", getProjectBudgetStatus).Methods("GET")
+	router.HandleFunc("/projects/{name}/keys/{key}", unscopedOnly(putProjectKey)).Methods("PUT")
+	router.HandleFunc("/projects/{name}/keys/{key}", unscopedOnly(deleteProjectKey)).Methods("DELETE")
+	router.HandleFunc("/rollup", getRollup).Methods("GET")
+	router.HandleFunc("/models", getModels).Methods("GET")
+	router.HandleFunc("/models/{name:.+}", getModel).Methods("GET")
+	router.HandleFunc("/models/{name:.+}", unscopedOnly(putModel)).Methods("PUT")
+	router.HandleFunc("/models/{name:.+}", unscopedOnly(deleteModel)).Methods("DELETE")
+	router.HandleFunc("/model_templates", unscopedOnly(createModelTemplate)).Methods("POST")
+	router.HandleFunc("/model_templates", getModelTemplates).Methods("GET")
+	router.HandleFunc("/model_templates/{id}", unscopedOnly(deleteModelTemplate)).Methods("DELETE")
+	router.HandleFunc("/reconciliation/import", unscopedOnly(importInvoice)).Methods("POST")
+	router.HandleFunc("/reconciliation", unscopedOnly(getReconciliation)).Methods("GET")
+	router.HandleFunc("/live/{model:.+}", getLiveUsage).Methods("GET")
+	router.HandleFunc("/events", streamUsageEvents).Methods("GET")
+	router.HandleFunc("/azure_deployments", getAzureDeployments).Methods("GET")
+	router.HandleFunc("/azure_deployments/{deployment}", unscopedOnly(putAzureDeployment)).Methods("PUT")
+	router.HandleFunc("/azure_deployments/{deployment}", unscopedOnly(deleteAzureDeployment)).Methods("DELETE")
+	router.PathPrefix("/proxy/{upstream}/").HandlerFunc(proxyRequest)
+	registerDebugRoutes(router)
+	registerAPIRoutes(router)
+	registerAdminRoutes(router)
+	router.Use(shedLoad)
+	router.Use(requireDatabase)
+	router.Use(noteRejectedIngestions)
+	router.Use(scopeByKey)
+	router.Use(injectResponseFaults)
+	return router
 }
 
 func recordTokenUsage(w http.ResponseWriter, r *http.Request) {
@@ -94,53 +290,135 @@ func recordTokenUsage(w http.ResponseWriter, r *http.Request) {
 		respondError(w, http.StatusBadRequest, "Invalid request payload", err)
 		return
 	}
-	fmt.Printf("Received token usage on %s for %s with %d\n", usage.Date.Format("2006-01-02"), usage.Model, usage.TotalTokens)
+	if usage.TotalTokens == 0 {
+		usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+	}
+	recordUsage(w, r, usage)
+}
 
-	// Check if there's a record for the date and model
-	var existingID int
-	err := db.QueryRow("SELECT id FROM token_usage WHERE date = $1 AND model = $2", usage.Date, usage.Model).Scan(&existingID)
-	if err != nil && err != sql.ErrNoRows {
-		respondError(w, http.StatusInternalServerError, "Database query error", err)
+// recordUsage stores a record decoded by recordTokenUsage or translated from an older API version
+func recordUsage(w http.ResponseWriter, r *http.Request, usage TokenUsage) {
+	if db == nil && (usage.Deployment != "" || usage.Key != "" || usage.JobID != "" || isDryRun(r)) {
+		respondJSON(w, http.StatusBadRequest, map[string]string{"message": "Deployments, project keys, batch jobs and dry runs need database storage"})
 		return
 	}
-	if err == sql.ErrNoRows { // No record exists for this date and model
-		_, err = db.Exec("INSERT INTO token_usage (date, model, total_tokens) VALUES ($1, $2, $3)", usage.Date, usage.Model, usage.TotalTokens)
+	if usage.JobID != "" && isDryRun(r) {
+		respondJSON(w, http.StatusBadRequest, map[string]string{"message": "Dry runs don't support batch jobs"})
+		return
+	}
+	if usage.Deployment != "" {
+		model, ok, err := resolveAzureDeployment(usage.Deployment)
 		if err != nil {
-			respondError(w, http.StatusInternalServerError, "Failed to insert token usage", err)
+			respondError(w, http.StatusInternalServerError, "Database query error", err)
 			return
 		}
-		fmt.Printf("Recorded token usage on %s for %s with %d\n", usage.Date.Format("2006-01-02"), usage.Model, usage.TotalTokens)
-		respondJSON(w, http.StatusCreated, map[string]string{"message": "Token usage recorded successfully"})
-	} else { // Record exists, update
-		_, err = db.Exec("UPDATE token_usage SET total_tokens = $1 WHERE id = $2", usage.TotalTokens, existingID)
+		if !ok {
+			respondJSON(w, http.StatusBadRequest, map[string]string{"message": "Unknown Azure deployment: " + usage.Deployment})
+			return
+		}
+		usage.Model = model
+		usage.Deployment = ""
+	}
+	if usage.Key != "" {
+		project, ok, err := resolveProjectKey(usage.Key)
 		if err != nil {
-			respondError(w, http.StatusInternalServerError, "Failed to update token usage", err)
+			respondError(w, http.StatusInternalServerError, "Database query error", err)
 			return
 		}
-		fmt.Printf("Updated token usage on %s for %s with %d\n", usage.Date.Format("2006-01-02"), usage.Model, usage.TotalTokens)
-		respondJSON(w, http.StatusOK, map[string]string{"message": "Token usage updated successfully"})
+		if !ok {
+			respondJSON(w, http.StatusBadRequest, map[string]string{"message": "Unknown project key: " + usage.Key})
+			return
+		}
+		noteKeyUse(r.Context(), usage.Key)
+		usage.Project = project
+		usage.Key = ""
 	}
-}
+	if scope, ok := projectScope(r.Context()); ok {
+		if usage.Project != "" && usage.Project != scope {
+			respondJSON(w, http.StatusForbidden, map[string]string{"message": "This key can only record usage for project " + scope})
+			return
+		}
+		usage.Project = scope
+	}
+	usage.CreatedAt, usage.UpdatedAt = nil, nil
+	if err := validateTokenUsage(usage); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid token usage", err)
+		return
+	}
+	records, err := transformUsage(r.Context(), usage, "api")
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Rejected by an ingest transform", err)
+		return
+	}
+	for _, record := range records {
+		if err := validateTokenUsage(record); err != nil {
+			respondError(w, http.StatusBadRequest, "Invalid token usage after ingest transforms", err)
+			return
+		}
+	}
+	if len(records) == 0 {
+		respondJSON(w, http.StatusOK, map[string]string{"message": "Token usage dropped by an ingest transform"})
+		return
+	}
+	if len(records) > 1 || records[0].EndDate != nil {
+		recordTokenUsages(w, r, records)
+		return
+	}
+	usage = records[0]
+	if isDryRun(r) {
+		preview, err := previewTokenUsage(r.Context(), usage)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, "Database query error", err)
+			return
+		}
+		respondJSON(w, http.StatusOK, preview)
+		return
+	}
+	debugf("Received token usage on %s for %s with %d\n", usage.Date.Format("2006-01-02"), usage.Model, usage.TotalTokens)
+	liveUsage.add(usage)
 
-func getTokenUsageAll(w http.ResponseWriter, r *http.Request) {
-	rows, err := db.Query("SELECT id, date, model, total_tokens FROM token_usage")
+	// Buffered writes stay pending in the live totals until the buffer flushes them
+	created, buffered, err := storeOrBuffer(r.Context(), DeadLetter{Mode: "set", Source: "api", Usage: usage})
+	if !buffered {
+		liveUsage.flushed(usage)
+	}
 	if err != nil {
-		respondError(w, http.StatusInternalServerError, "Database query error", err)
+		deadLetter("set", "api", usage, err)
+		status := http.StatusInternalServerError
+		if errors.Is(err, errBufferFull) {
+			status = http.StatusServiceUnavailable
+		}
+		respondError(w, status, "Failed to record token usage", err)
 		return
 	}
-	defer rows.Close()
+	if !buffered && db != nil {
+		noteIngestion(r, usage, "api")
+	}
+	if buffered {
+		respondJSON(w, http.StatusAccepted, map[string]string{"message": "Database unavailable, token usage buffered"})
+	} else if created {
+		respondJSON(w, http.StatusCreated, map[string]string{"message": "Token usage recorded successfully"})
+	} else {
+		respondJSON(w, http.StatusOK, map[string]string{"message": "Token usage updated successfully"})
+	}
+}
 
-	var usages []TokenUsage
-	for rows.Next() {
-		var usage TokenUsage
-		if err := rows.Scan(&usage.ID, &usage.Date, &usage.Model, &usage.TotalTokens); err != nil {
-			respondError(w, http.StatusInternalServerError, "Error scanning row", err)
+// getTokenUsageAll lists usage records, only those changed after ?updated_since= (RFC 3339) if given
+func getTokenUsageAll(w http.ResponseWriter, r *http.Request) {
+	var since time.Time
+	if v := r.URL.Query().Get("updated_since"); v != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339, v); err != nil {
+			respondError(w, http.StatusBadRequest, "Invalid updated_since, expected RFC 3339", err)
 			return
 		}
-		usages = append(usages, usage)
 	}
-	if err = rows.Err(); err != nil {
-		respondError(w, http.StatusInternalServerError, "Error reading data", err)
+	if notModified(w, r, false, "u.updated_at > $1", since) {
+		return
+	}
+	usages, err := store.ListUsage(r.Context(), since)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database query error", err)
 		return
 	}
 	respondJSON(w, http.StatusOK, usages)
@@ -155,62 +433,113 @@ func getTokenUsageByDateAndModel(w http.ResponseWriter, r *http.Request) {
 		respondError(w, http.StatusBadRequest, "Invalid date format", err)
 		return
 	}
-	var totalTokens int
-	err = db.QueryRow("SELECT total_tokens FROM token_usage WHERE date = $1 AND model = $2", date, model).Scan(&totalTokens)
-	if err == sql.ErrNoRows {
-		respondJSON(w, http.StatusOK, map[string]interface{}{"message": "No token usage data found for this date and model", "status": 0})
+	if notModified(w, r, false, "u.date = $1 AND u.model = $2", date, model) {
 		return
-	} else if err != nil {
+	}
+	// Sum across projects
+	totalTokens, found, err := store.SumUsage(r.Context(), model, date, date)
+	if err != nil {
 		respondError(w, http.StatusInternalServerError, "Database query error", err)
 		return
 	}
-
-	respondJSON(w, http.StatusOK, map[string]interface{}{"total_tokens": totalTokens, "status": 1})
-
+	if currentConfig.Load().LegacyEmptyResponses {
+		if !found {
+			respondJSON(w, http.StatusOK, map[string]interface{}{"message": "No token usage data found for this date and model", "status": 0})
+			return
+		}
+		respondJSON(w, http.StatusOK, map[string]interface{}{"total_tokens": totalTokens, "status": 1})
+		return
+	}
+	// Zero usage is a valid answer, not a missing resource
+	respondJSON(w, http.StatusOK, map[string]interface{}{"model": model, "date": dateStr, "total_tokens": totalTokens})
 }
 
 func getTokenUsageByPeriod(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	model := vars["model"]
 	period := vars["period"]
-	var startDate time.Time
-	today := time.Now().Truncate(24 * time.Hour)
-	switch period {
-	case "week":
-		startDate = today.AddDate(0, 0, -int(today.Weekday()))
-	case "month":
-		startDate = today.AddDate(0, 0, -today.Day()+1)
-	case "lifetime":
-		startDate = time.Time{}
-	default:
+	startDate, ok := periodStart(period, time.Now().Truncate(24*time.Hour))
+	if !ok {
 		respondJSON(w, http.StatusBadRequest, map[string]string{"message": "Invalid period. Use 'week', 'month' or 'lifetime'"})
 		return
 	}
-	var totalTokens int
-	var err error
-	if !startDate.IsZero() {
-		err = db.QueryRow("SELECT COALESCE(SUM(total_tokens), 0) FROM token_usage WHERE model = $1 AND date >= $2", model, startDate).Scan(&totalTokens)
-	} else {
-		err = db.QueryRow("SELECT COALESCE(SUM(total_tokens), 0) FROM token_usage WHERE model = $1", model).Scan(&totalTokens)
+	// Lifetime uses the zero date as its lower bound
+	today := time.Now().Truncate(24 * time.Hour)
+	if notModified(w, r, false, "u.model = $1 AND u.date >= $2 AND u.date <= $3", model, startDate, today) {
+		return
 	}
+	totalTokens, _, err := store.SumUsage(r.Context(), model, startDate, today)
 	if err != nil {
 		respondError(w, http.StatusInternalServerError, "Database query error", err)
 		return
 	}
-	if totalTokens == 0 {
+	if totalTokens == 0 && currentConfig.Load().LegacyEmptyResponses {
 		respondJSON(w, http.StatusNotFound, map[string]string{"message": "No token usage data found for this model"})
 		return
 	}
-	respondJSON(w, http.StatusOK, map[string]int{"total_tokens": totalTokens})
+	respondJSON(w, http.StatusOK, map[string]interface{}{"model": model, "period": period, "total_tokens": totalTokens})
 }
+
+// periodStart returns the first day of the named period containing today; lifetime yields the zero time
+func periodStart(period string, today time.Time) (time.Time, bool) {
+	switch period {
+	case "week":
+		return today.AddDate(0, 0, -int(today.Weekday())), true
+	case "month":
+		return today.AddDate(0, 0, -today.Day()+1), true
+	case "lifetime":
+		return time.Time{}, true
+	}
+	return time.Time{}, false
+}
+
+// parseDateRange reads an inclusive range from ?start=&end= (YYYY-MM-DD) or, failing that,
+// from ?period= (week, month or lifetime, defaulting to defaultPeriod). A zero start means unbounded.
+func parseDateRange(q url.Values, defaultPeriod string) (time.Time, time.Time, error) {
+	today := time.Now().Truncate(24 * time.Hour)
+	if q.Get("start") != "" || q.Get("end") != "" {
+		start, err := time.Parse("2006-01-02", q.Get("start"))
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid start date: %w", err)
+		}
+		end := today
+		if q.Get("end") != "" {
+			if end, err = time.Parse("2006-01-02", q.Get("end")); err != nil {
+				return time.Time{}, time.Time{}, fmt.Errorf("invalid end date: %w", err)
+			}
+		}
+		if end.Before(start) {
+			return time.Time{}, time.Time{}, fmt.Errorf("end date is before start date")
+		}
+		return start, end, nil
+	}
+	period := q.Get("period")
+	if period == "" {
+		period = defaultPeriod
+	}
+	start, ok := periodStart(period, today)
+	if !ok {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid period %q, use 'week', 'month' or 'lifetime'", period)
+	}
+	return start, today, nil
+}
+
 func respondJSON(w http.ResponseWriter, status int, data interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
+	if _, raw := w.(rawJSONWriter); !raw {
+		data = shapeResponse(status, data)
+	}
 	if err := json.NewEncoder(w).Encode(data); err != nil {
 		log.Printf("Failed to encode JSON response: %v", err)
 	}
 }
 func respondError(w http.ResponseWriter, status int, message string, err error) {
 	log.Printf("%s : %v", message, err)
+	if isUnavailable(err) {
+		dbHealth.trip(err)
+		w.Header().Set("Retry-After", strconv.Itoa(dbRetryAfterSecond))
+		status = http.StatusServiceUnavailable
+	}
 	respondJSON(w, status, map[string]string{"message": message, "error": err.Error()})
 }
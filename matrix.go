@@ -0,0 +1,97 @@
+// matrix.go
+package main
+
+import (
+	"net/http"
+	"sort"
+)
+
+// getTokenUsageMatrix returns a model x project pivot of tokens and cost for a date range.
+// Tokens[i][j] and Cost[i][j] are for Models[i] in Projects[j].
+func getTokenUsageMatrix(w http.ResponseWriter, r *http.Request) {
+	start, end, err := parseDateRange(r.URL.Query(), "month")
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid date range", err)
+		return
+	}
+	if notModified(w, r, true, "u.date >= $1 AND u.date <= $2", start, end) {
+		return
+	}
+	rows, err := db.QueryContext(r.Context(), `
+        SELECT u.model, u.project, SUM(u.total_tokens), `+usageCostMicrosSum+`
+        FROM token_usage u `+usagePriceJoin+`
+        WHERE u.date >= $1 AND u.date <= $2
+        GROUP BY u.model, u.project`, start, end)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database query error", err)
+		return
+	}
+	defer rows.Close()
+
+	type cell struct {
+		tokens int64
+		cost   int64
+	}
+	cells := map[[2]string]cell{}
+	modelSet := map[string]bool{}
+	projectSet := map[string]bool{}
+	for rows.Next() {
+		var model, project string
+		var tokens, cost int64
+		if err := rows.Scan(&model, &project, &tokens, &cost); err != nil {
+			respondError(w, http.StatusInternalServerError, "Error scanning row", err)
+			return
+		}
+		cells[[2]string{model, project}] = cell{tokens, cost}
+		modelSet[model] = true
+		projectSet[project] = true
+	}
+	if err = rows.Err(); err != nil {
+		respondError(w, http.StatusInternalServerError, "Error reading data", err)
+		return
+	}
+
+	annotations, err := annotationsBetween(r.Context(), start, end, "")
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database query error", err)
+		return
+	}
+
+	models := sortedKeys(modelSet)
+	projects := sortedKeys(projectSet)
+	tokens := make([][]int64, len(models))
+	cost := make([][]float64, len(models))
+	modelTotals := make([]int64, len(models))
+	projectTotals := make([]int64, len(projects))
+	for i, m := range models {
+		tokens[i] = make([]int64, len(projects))
+		cost[i] = make([]float64, len(projects))
+		for j, p := range projects {
+			c := cells[[2]string{m, p}]
+			tokens[i][j] = c.tokens
+			cost[i][j] = costFromMicros(c.cost)
+			modelTotals[i] += c.tokens
+			projectTotals[j] += c.tokens
+		}
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"start":          start.Format("2006-01-02"),
+		"end":            end.Format("2006-01-02"),
+		"models":         models,
+		"projects":       projects,
+		"tokens":         tokens,
+		"cost":           cost,
+		"model_totals":   modelTotals,
+		"project_totals": projectTotals,
+		"annotations":    annotations,
+	})
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
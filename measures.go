@@ -0,0 +1,100 @@
+// measures.go
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// UsageMeasures are what a usage record counts besides tokens, for providers that bill by
+// request, by character (e.g. TTS and some embeddings) or in their own credits. They follow
+// the record's write mode: reporters send running daily totals, the proxy increments.
+type UsageMeasures struct {
+	Requests   int64   `json:"requests,omitempty"`
+	Characters int64   `json:"characters,omitempty"`
+	Credits    float64 `json:"credits,omitempty"`
+}
+
+// usageMeasureColumns maps measure names, as used by /measures/{measure}, to token_usage columns
+var usageMeasureColumns = map[string]string{
+	"tokens":     "total_tokens",
+	"requests":   "requests",
+	"characters": "characters",
+	"credits":    "credits",
+}
+
+func (m *UsageMeasures) add(o UsageMeasures) {
+	m.Requests += o.Requests
+	m.Characters += o.Characters
+	m.Credits += o.Credits
+}
+
+func (m UsageMeasures) validate() error {
+	if m.Requests < 0 || m.Characters < 0 || m.Credits < 0 {
+		return fmt.Errorf("requests, characters and credits must not be negative")
+	}
+	return nil
+}
+
+// MeasureTotal is one model's total of a measure
+type MeasureTotal struct {
+	Model string  `json:"model"`
+	Total float64 `json:"total"`
+}
+
+// getMeasureTotals aggregates one measure over a date range, in total and per model.
+// ?model= and ?project= narrow it down.
+func getMeasureTotals(w http.ResponseWriter, r *http.Request) {
+	measure := mux.Vars(r)["measure"]
+	column, ok := usageMeasureColumns[measure]
+	if !ok {
+		respondJSON(w, http.StatusBadRequest, map[string]string{"message": "Unknown measure " + measure + ", use tokens, requests, characters or credits"})
+		return
+	}
+	q := r.URL.Query()
+	start, end, err := parseDateRange(q, "month")
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid date range", err)
+		return
+	}
+	// column comes from usageMeasureColumns, never from the request
+	rows, err := db.QueryContext(r.Context(), `
+        SELECT model, SUM(`+column+`)::DOUBLE PRECISION FROM token_usage
+        WHERE date >= $1 AND date <= $2 AND ($3 = '' OR model = $3) AND ($4 = '' OR project = $4)
+        GROUP BY model HAVING SUM(`+column+`) <> 0 ORDER BY model`, start, end, q.Get("model"), q.Get("project"))
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database query error", err)
+		return
+	}
+	defer rows.Close()
+	byModel := []MeasureTotal{}
+	var total float64
+	for rows.Next() {
+		var m MeasureTotal
+		if err := rows.Scan(&m.Model, &m.Total); err != nil {
+			respondError(w, http.StatusInternalServerError, "Error scanning row", err)
+			return
+		}
+		total += m.Total
+		byModel = append(byModel, m)
+	}
+	if err = rows.Err(); err != nil {
+		respondError(w, http.StatusInternalServerError, "Error reading data", err)
+		return
+	}
+	annotations, err := annotationsBetween(r.Context(), start, end, "")
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database query error", err)
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"measure":     measure,
+		"start":       start.Format("2006-01-02"),
+		"end":         end.Format("2006-01-02"),
+		"total":       total,
+		"by_model":    byModel,
+		"annotations": annotations,
+	})
+}
@@ -0,0 +1,110 @@
+// memstore.go
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// memoryStore keeps usage in process memory and loses it on exit. It backs --storage=memory,
+// meant for demos, quick evaluations and integration tests of clients.
+type memoryStore struct {
+	mu     sync.Mutex
+	nextID int
+	rows   map[memoryKey]*TokenUsage
+}
+
+type memoryKey struct {
+	date           string
+	model, project string
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{rows: map[memoryKey]*TokenUsage{}}
+}
+
+func keyOf(u TokenUsage) memoryKey {
+	return memoryKey{u.Date.Format("2006-01-02"), u.Model, u.Project}
+}
+
+// insert adds a new row; the caller must hold s.mu
+func (s *memoryStore) insert(usage TokenUsage, now time.Time) {
+	s.nextID++
+	usage.ID = s.nextID
+	usage.CreatedAt, usage.UpdatedAt = &now, &now
+	s.rows[keyOf(usage)] = &usage
+}
+
+func sameCost(a, b *float64) bool {
+	return (a == nil && b == nil) || (a != nil && b != nil && *a == *b)
+}
+
+func (s *memoryStore) SetUsage(ctx context.Context, usage TokenUsage, source string) (bool, error) {
+	now := time.Now()
+	s.mu.Lock()
+	row, ok := s.rows[keyOf(usage)]
+	previous := 0
+	if ok {
+		previous = row.TotalTokens
+		if row.TotalTokens != usage.TotalTokens || !sameCost(row.Cost, usage.Cost) || row.UsageMeasures != usage.UsageMeasures || row.UsageBreakdown != usage.UsageBreakdown {
+			row.TotalTokens, row.Cost, row.UsageMeasures, row.UsageBreakdown, row.UpdatedAt = usage.TotalTokens, usage.Cost, usage.UsageMeasures, usage.UsageBreakdown, &now
+		}
+	} else {
+		s.insert(usage, now)
+	}
+	s.mu.Unlock()
+	usageRecorded(UsageEvent{Date: usage.Date, Model: usage.Model, Project: usage.Project, Source: source, TotalTokens: usage.TotalTokens - previous, Cost: usage.Cost})
+	return !ok, nil
+}
+
+func (s *memoryStore) AddUsage(ctx context.Context, usage TokenUsage, source string) error {
+	now := time.Now()
+	s.mu.Lock()
+	if row, ok := s.rows[keyOf(usage)]; ok {
+		row.UpdatedAt = &now
+		row.TotalTokens += usage.TotalTokens
+		row.UsageMeasures.add(usage.UsageMeasures)
+		row.UsageBreakdown.add(usage.UsageBreakdown)
+		if usage.Cost != nil {
+			cost := *usage.Cost
+			if row.Cost != nil {
+				cost = float64(toMicros(cost)+toMicros(*row.Cost)) / microsPerDollar
+			}
+			row.Cost = &cost
+		}
+	} else {
+		s.insert(usage, now)
+	}
+	s.mu.Unlock()
+	usageRecorded(UsageEvent{Date: usage.Date, Model: usage.Model, Project: usage.Project, Source: source, TotalTokens: usage.TotalTokens, Cost: usage.Cost})
+	return nil
+}
+
+func (s *memoryStore) ListUsage(ctx context.Context, since time.Time) ([]TokenUsage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	usages := make([]TokenUsage, 0, len(s.rows))
+	for _, row := range s.rows {
+		if row.UpdatedAt.After(since) {
+			usages = append(usages, *row)
+		}
+	}
+	sort.Slice(usages, func(i, j int) bool { return usages[i].ID < usages[j].ID })
+	return usages, nil
+}
+
+func (s *memoryStore) SumUsage(ctx context.Context, model string, start, end time.Time) (int64, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var total int64
+	found := false
+	for _, row := range s.rows {
+		if row.Model == model && !row.Date.Before(start) && !row.Date.After(end) {
+			total += int64(row.TotalTokens)
+			found = true
+		}
+	}
+	return total, found, nil
+}
@@ -0,0 +1,169 @@
+// models.go
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Model is a registry entry describing a model's capabilities. PricingModel links the model
+// to another model_pricing entry (e.g. a dated snapshot priced like its alias); without it the
+// model's own pricing applies. PricePerMillion is the resolved price and is read-only.
+type Model struct {
+	Name            string   `json:"name"`
+	Provider        string   `json:"provider"`
+	ContextWindow   *int     `json:"context_window,omitempty"`
+	MaxOutputTokens *int     `json:"max_output_tokens,omitempty"`
+	DeprecationDate *string  `json:"deprecation_date,omitempty"`
+	PricingModel    string   `json:"pricing_model,omitempty"`
+	PricePerMillion *float64 `json:"price_per_million,omitempty"`
+	AutoRegistered  bool     `json:"auto_registered"`
+}
+
+const modelColumns = `m.name, m.provider, m.context_window, m.max_output_tokens, m.deprecation_date,
+        COALESCE(m.pricing_model, ''), COALESCE(p.price_per_million, c.price_per_million), m.auto_registered
+        FROM models m LEFT JOIN model_pricing p ON p.model = COALESCE(NULLIF(m.pricing_model, ''), m.name)
+        LEFT JOIN pricing_catalog c ON c.model = COALESCE(NULLIF(m.pricing_model, ''), m.name)`
+
+// modelProviders guesses the provider of an auto-registered model from its name
+var modelProviders = []struct{ prefix, provider string }{
+	{"gpt-", "openai"}, {"o1", "openai"}, {"o3", "openai"}, {"o4", "openai"}, {"text-embedding-", "openai"},
+	{"claude", "anthropic"},
+	{"gemini", "google"},
+	{"mistral", "mistral"}, {"mixtral", "mistral"},
+	{"llama", "meta"},
+	{"command", "cohere"},
+}
+
+func guessProvider(model string) string {
+	if i := strings.Index(model, "/"); i > 0 {
+		return model[:i] // OpenRouter style "provider/model"
+	}
+	for _, p := range modelProviders {
+		if strings.HasPrefix(model, p.prefix) {
+			return p.provider
+		}
+	}
+	return ""
+}
+
+// registerModel adds an unseen model to the registry so it can be described later
+func registerModel(model string) {
+	res, err := db.Exec("INSERT INTO models (name, provider, auto_registered) VALUES ($1, $2, TRUE) ON CONFLICT (name) DO NOTHING", model, guessProvider(model))
+	if err != nil {
+		log.Printf("Failed to register model %s: %v", model, err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return
+	}
+	infof("Registered new model %s\n", model)
+}
+
+func scanModel(row interface{ Scan(...interface{}) error }) (Model, error) {
+	var m Model
+	var deprecation sql.NullTime
+	err := row.Scan(&m.Name, &m.Provider, &m.ContextWindow, &m.MaxOutputTokens, &deprecation, &m.PricingModel, &m.PricePerMillion, &m.AutoRegistered)
+	if deprecation.Valid {
+		d := deprecation.Time.Format("2006-01-02")
+		m.DeprecationDate = &d
+	}
+	return m, err
+}
+
+func getModels(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.QueryContext(r.Context(), "SELECT "+modelColumns+" ORDER BY m.name")
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database query error", err)
+		return
+	}
+	defer rows.Close()
+	models := []Model{}
+	for rows.Next() {
+		m, err := scanModel(rows)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, "Error scanning row", err)
+			return
+		}
+		models = append(models, m)
+	}
+	if err = rows.Err(); err != nil {
+		respondError(w, http.StatusInternalServerError, "Error reading data", err)
+		return
+	}
+	respondJSON(w, http.StatusOK, models)
+}
+
+func getModel(w http.ResponseWriter, r *http.Request) {
+	m, err := scanModel(db.QueryRowContext(r.Context(), "SELECT "+modelColumns+" WHERE m.name = $1", mux.Vars(r)["name"]))
+	if err == sql.ErrNoRows {
+		respondJSON(w, http.StatusNotFound, map[string]string{"message": "Model not found"})
+		return
+	} else if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database query error", err)
+		return
+	}
+	respondJSON(w, http.StatusOK, m)
+}
+
+// putModel creates or replaces a registry entry; saving it clears the auto_registered flag
+func putModel(w http.ResponseWriter, r *http.Request) {
+	var m Model
+	if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request payload", err)
+		return
+	}
+	m.Name = mux.Vars(r)["name"]
+	var deprecation *time.Time
+	if m.DeprecationDate != nil {
+		d, err := time.Parse("2006-01-02", *m.DeprecationDate)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, "Invalid deprecation_date, expected YYYY-MM-DD", err)
+			return
+		}
+		deprecation = &d
+	}
+	if (m.ContextWindow != nil && *m.ContextWindow <= 0) || (m.MaxOutputTokens != nil && *m.MaxOutputTokens <= 0) {
+		respondJSON(w, http.StatusBadRequest, map[string]string{"message": "context_window and max_output_tokens must be positive"})
+		return
+	}
+	var pricingModel *string
+	if m.PricingModel != "" {
+		pricingModel = &m.PricingModel
+	}
+	_, err := db.ExecContext(r.Context(), `INSERT INTO models (name, provider, context_window, max_output_tokens, deprecation_date, pricing_model, auto_registered)
+        VALUES ($1, $2, $3, $4, $5, $6, FALSE)
+        ON CONFLICT (name) DO UPDATE SET provider = EXCLUDED.provider, context_window = EXCLUDED.context_window,
+            max_output_tokens = EXCLUDED.max_output_tokens, deprecation_date = EXCLUDED.deprecation_date,
+            pricing_model = EXCLUDED.pricing_model, auto_registered = FALSE`,
+		m.Name, m.Provider, m.ContextWindow, m.MaxOutputTokens, deprecation, pricingModel)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to save model", err)
+		return
+	}
+	m, err = scanModel(db.QueryRowContext(r.Context(), "SELECT "+modelColumns+" WHERE m.name = $1", m.Name))
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database query error", err)
+		return
+	}
+	respondJSON(w, http.StatusOK, m)
+}
+
+func deleteModel(w http.ResponseWriter, r *http.Request) {
+	res, err := db.ExecContext(r.Context(), "DELETE FROM models WHERE name = $1", mux.Vars(r)["name"])
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to delete model", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		respondJSON(w, http.StatusNotFound, map[string]string{"message": "Model not found"})
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]string{"message": "Model deleted successfully"})
+}
@@ -0,0 +1,108 @@
+// money.go
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+)
+
+// Costs are summed as integer micro-dollars so totals match provider invoices: each row's cost
+// is rounded to the micro-dollar once, and sums of many rows accumulate no float error. Costs
+// are only turned back into dollars, rounded as configured by cost_rounding, for responses.
+
+// microsPerDollar is the number of micro-dollars in a dollar
+const microsPerDollar = 1_000_000
+
+// usageCostMicrosExpr is usageCostExpr rounded to integer micro-dollars
+const usageCostMicrosExpr = "ROUND(" + usageCostExpr + " * 1000000)::BIGINT"
+
+// usageCostMicrosSum sums usageCostMicrosExpr over a group, 0 for no rows
+const usageCostMicrosSum = "COALESCE(SUM(" + usageCostMicrosExpr + "), 0)::BIGINT"
+
+// Rounding modes for cost_rounding.mode
+const (
+	roundHalfUp   = "half_up"
+	roundHalfEven = "half_even"
+	roundDown     = "down"
+	roundUp       = "up"
+)
+
+// CostRoundingConfig sets how costs are rounded for display. Decimals is 0 to 6, by default 6,
+// and Mode one of half_up (the default), half_even, down (toward zero) or up (away from zero).
+type CostRoundingConfig struct {
+	Decimals *int   `json:"decimals"`
+	Mode     string `json:"mode"`
+}
+
+func (c CostRoundingConfig) validate() error {
+	if c.Decimals != nil && (*c.Decimals < 0 || *c.Decimals > 6) {
+		return fmt.Errorf("decimals must be between 0 and 6")
+	}
+	switch c.Mode {
+	case "", roundHalfUp, roundHalfEven, roundDown, roundUp:
+		return nil
+	}
+	return fmt.Errorf("unknown mode %q, use %s, %s, %s or %s", c.Mode, roundHalfUp, roundHalfEven, roundDown, roundUp)
+}
+
+// costRoundingFromEnv reads COST_DECIMALS and COST_ROUNDING_MODE
+func costRoundingFromEnv() CostRoundingConfig {
+	c := CostRoundingConfig{Mode: os.Getenv("COST_ROUNDING_MODE")}
+	if n, err := strconv.Atoi(os.Getenv("COST_DECIMALS")); err == nil {
+		c.Decimals = &n
+	}
+	return c
+}
+
+// toMicros converts a cost in dollars to micro-dollars
+func toMicros(dollars float64) int64 {
+	return int64(math.Round(dollars * microsPerDollar))
+}
+
+// costFromMicros converts micro-dollars to dollars for display, rounded as configured
+func costFromMicros(micros int64) float64 {
+	cfg := currentConfig.Load().CostRounding
+	decimals := 6
+	if cfg.Decimals != nil {
+		decimals = *cfg.Decimals
+	}
+	return float64(roundMicros(micros, decimals, cfg.Mode)) / microsPerDollar
+}
+
+// roundMicros rounds micros to a multiple of 10^(6-decimals)
+func roundMicros(micros int64, decimals int, mode string) int64 {
+	unit := int64(math.Pow10(6 - decimals))
+	if unit == 1 {
+		return micros
+	}
+	q, r := micros/unit, micros%unit
+	if r == 0 {
+		return micros
+	}
+	sign := int64(1)
+	if r < 0 {
+		sign, r = -1, -r
+	}
+	// q is truncated toward zero; away moves it one unit further from zero
+	away := false
+	switch mode {
+	case roundDown:
+	case roundUp:
+		away = true
+	case roundHalfEven:
+		away = 2*r > unit || (2*r == unit && q%2 != 0)
+	default:
+		away = 2*r >= unit
+	}
+	if away {
+		q += sign
+	}
+	return q * unit
+}
+
+// roundCost rounds a cost in dollars as configured
+func roundCost(dollars float64) float64 {
+	return costFromMicros(toMicros(dollars))
+}
@@ -0,0 +1,235 @@
+// monthly.go
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Reports ask for the same completed months over and over, so the monthly_summary job keeps
+// their totals in monthly_usage. A month is computed again when its usage or the prices have
+// changed since; until then GET /token_usage/monthly computes it live, as it does the current
+// month.
+
+// Cache lifetimes for GET /token_usage/monthly: a year whose months are all complete and
+// summarized is not expected to change, any other year is still filling in
+const (
+	monthlyClosedMaxAge = 30 * 24 * time.Hour
+	monthlyOpenMaxAge   = 5 * time.Minute
+)
+
+// MonthlyModelUsage is one model's share of a month
+type MonthlyModelUsage struct {
+	Model       string  `json:"model"`
+	TotalTokens int64   `json:"total_tokens"`
+	Cost        float64 `json:"cost"`
+}
+
+// MonthlyUsage is a month's totals as returned by GET /token_usage/monthly. Complete is false
+// for the current month and months still to come.
+type MonthlyUsage struct {
+	Month       string              `json:"month"`
+	Complete    bool                `json:"complete"`
+	TotalTokens int64               `json:"total_tokens"`
+	Cost        float64             `json:"cost"`
+	Models      []MonthlyModelUsage `json:"models"`
+}
+
+// refreshMonthlySummaries is the monthly_summary job: it computes every completed month that
+// has no summary yet or whose usage or prices changed since its summary
+func refreshMonthlySummaries(ctx context.Context) error {
+	thisMonth := startOfMonth(time.Now())
+	var pricing string
+	if err := db.QueryRowContext(ctx, "SELECT "+pricingStateExpr).Scan(&pricing); err != nil {
+		return err
+	}
+	// Months whose usage has all been deleted, rather than moved to cold storage
+	_, err := db.ExecContext(ctx, `WITH gone AS (
+            DELETE FROM monthly_summaries s WHERE NOT EXISTS (
+                SELECT 1 FROM token_usage u WHERE u.date >= s.month AND u.date < s.month + INTERVAL '1 month')
+                AND NOT EXISTS (SELECT 1 FROM usage_archives a WHERE a.month = s.month AND a.restored_at IS NULL)
+            RETURNING month)
+        DELETE FROM monthly_usage WHERE month IN (SELECT month FROM gone)`)
+	if err != nil {
+		return err
+	}
+	rows, err := db.QueryContext(ctx, `
+        SELECT m.month FROM (
+            SELECT date_trunc('month', date)::DATE AS month, MAX(updated_at) AS updated, COUNT(*) AS n
+            FROM token_usage WHERE date < $1 GROUP BY 1) m
+        LEFT JOIN monthly_summaries s ON s.month = m.month
+        WHERE s.month IS NULL OR s.source_updated_at IS DISTINCT FROM m.updated OR s.source_rows <> m.n OR s.pricing_state <> $2
+        ORDER BY m.month`, thisMonth, pricing)
+	if err != nil {
+		return err
+	}
+	var stale []time.Time
+	for rows.Next() {
+		var month time.Time
+		if err := rows.Scan(&month); err != nil {
+			rows.Close()
+			return err
+		}
+		stale = append(stale, month)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, month := range stale {
+		if err := summarizeMonth(ctx, month); err != nil {
+			return fmt.Errorf("%s: %w", month.Format("2006-01"), err)
+		}
+	}
+	if len(stale) > 0 {
+		infof("Summarized %d months of usage\n", len(stale))
+	}
+	return nil
+}
+
+// summarizeMonth replaces a month's summary. It reads the usage and prices in one snapshot so
+// the state it records is the state the totals were computed from.
+func summarizeMonth(ctx context.Context, month time.Time) error {
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, "DELETE FROM monthly_usage WHERE month = $1", month); err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `INSERT INTO monthly_usage (month, model, project, total_tokens, cost_micros)
+        SELECT $1, u.model, u.project, SUM(u.total_tokens), `+usageCostMicrosSum+`
+        FROM token_usage u `+usagePriceJoin+`
+        WHERE u.date >= $1 AND u.date < $1::DATE + INTERVAL '1 month'
+        GROUP BY u.model, u.project`, month)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `INSERT INTO monthly_summaries (month, source_updated_at, source_rows, pricing_state)
+        SELECT $1, MAX(updated_at), COUNT(*), `+pricingStateExpr+` FROM token_usage WHERE date >= $1 AND date < $1::DATE + INTERVAL '1 month'
+        ON CONFLICT (month) DO UPDATE SET source_updated_at = EXCLUDED.source_updated_at, source_rows = EXCLUDED.source_rows,
+            pricing_state = EXCLUDED.pricing_state, computed_at = NOW()`, month)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// startOfMonth returns the first day of t's month, in UTC
+func startOfMonth(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// getMonthlyUsage returns the twelve month totals of ?year=, this year by default, per model.
+// Completed months come from their summaries where those are current with the prices.
+func getMonthlyUsage(w http.ResponseWriter, r *http.Request) {
+	year := time.Now().UTC().Year()
+	if v := r.URL.Query().Get("year"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 9999 {
+			respondJSON(w, http.StatusBadRequest, map[string]string{"message": "Invalid year"})
+			return
+		}
+		year = n
+	}
+	yearStart := time.Date(year, 1, 1, 0, 0, 0, 0, time.UTC)
+	yearEnd := yearStart.AddDate(1, 0, 0)
+	thisMonth := startOfMonth(time.Now())
+
+	summarized := map[string]bool{}
+	rows, err := db.QueryContext(r.Context(), "SELECT month FROM monthly_summaries WHERE month >= $1 AND month < $2 AND pricing_state = "+pricingStateExpr,
+		yearStart, yearEnd)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database query error", err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var month time.Time
+		if err := rows.Scan(&month); err != nil {
+			respondError(w, http.StatusInternalServerError, "Error scanning row", err)
+			return
+		}
+		summarized[month.Format("2006-01-02")] = true
+	}
+	if err = rows.Err(); err != nil {
+		respondError(w, http.StatusInternalServerError, "Error reading data", err)
+		return
+	}
+	months := make([]string, 0, len(summarized))
+	for month := range summarized {
+		months = append(months, month)
+	}
+
+	// Summarized months from monthly_usage, the rest live from token_usage
+	rows, err = db.QueryContext(r.Context(), `
+        SELECT month, model, SUM(total_tokens)::BIGINT, SUM(cost_micros)::BIGINT FROM monthly_usage
+        WHERE month = ANY($1::DATE[]) GROUP BY month, model
+        UNION ALL
+        SELECT date_trunc('month', u.date)::DATE, u.model, SUM(u.total_tokens)::BIGINT, `+usageCostMicrosSum+`
+        FROM token_usage u `+usagePriceJoin+`
+        WHERE u.date >= $2 AND u.date < $3 AND date_trunc('month', u.date)::DATE <> ALL($1::DATE[])
+        GROUP BY 1, u.model
+        ORDER BY 1, 2`, pq.Array(months), yearStart, yearEnd)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database query error", err)
+		return
+	}
+	defer rows.Close()
+	type modelMicros struct {
+		model  string
+		tokens int64
+		micros int64
+	}
+	byMonth := map[string][]modelMicros{}
+	for rows.Next() {
+		var month time.Time
+		var m modelMicros
+		if err := rows.Scan(&month, &m.model, &m.tokens, &m.micros); err != nil {
+			respondError(w, http.StatusInternalServerError, "Error scanning row", err)
+			return
+		}
+		key := month.Format("2006-01-02")
+		byMonth[key] = append(byMonth[key], m)
+	}
+	if err = rows.Err(); err != nil {
+		respondError(w, http.StatusInternalServerError, "Error reading data", err)
+		return
+	}
+
+	closed := true
+	out := make([]MonthlyUsage, 12)
+	for i := range out {
+		month := yearStart.AddDate(0, i, 0)
+		key := month.Format("2006-01-02")
+		usage := MonthlyUsage{Month: month.Format("2006-01"), Complete: month.Before(thisMonth), Models: []MonthlyModelUsage{}}
+		var micros int64
+		for _, m := range byMonth[key] {
+			usage.Models = append(usage.Models, MonthlyModelUsage{Model: m.model, TotalTokens: m.tokens, Cost: costFromMicros(m.micros)})
+			usage.TotalTokens += m.tokens
+			micros += m.micros
+		}
+		usage.Cost = costFromMicros(micros)
+		// A completed month without usage has no summary, and nothing to change
+		closed = closed && usage.Complete && (summarized[key] || len(usage.Models) == 0)
+		out[i] = usage
+	}
+
+	maxAge, visibility := monthlyOpenMaxAge, "public"
+	if closed {
+		maxAge = monthlyClosedMaxAge
+	}
+	if requestPrincipal(r.Context()) != nil {
+		visibility = "private"
+	}
+	w.Header().Set("Cache-Control", fmt.Sprintf("%s, max-age=%d", visibility, int(maxAge.Seconds())))
+	respondJSON(w, http.StatusOK, map[string]interface{}{"year": year, "months": out})
+}
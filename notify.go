@@ -0,0 +1,170 @@
+// notify.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Alerts are delivered through notification channels. A channel is one of the registered
+// notifier types (log, webhook, slack, email, telegram, ntfy, gotify), each in a file of its
+// own that registers it, or a channel named in the config's notifications.channels, which
+// sends through a type with a target and options of its own:
+//
+//	"channels": {"oncall": {"type": "webhook", "target": "https://...", "options": {"Authorization": "..."}}}
+//
+// Budgets, rules, reports and deprecation alerts name the channel they send to, so a new
+// transport only needs to register itself.
+
+// Alert is the payload delivered to notification channels
+type Alert struct {
+	Kind    string                 `json:"kind"`
+	Message string                 `json:"message"`
+	Details map[string]interface{} `json:"details,omitempty"`
+	Time    time.Time              `json:"time"`
+}
+
+// Notifier delivers alerts to one target of a channel
+type Notifier interface {
+	Send(ctx context.Context, alert Alert) error
+}
+
+// notifierType is a registered kind of channel
+type notifierType struct {
+	// needsTarget is set for types that can't send without a target
+	needsTarget bool
+	// defaultTarget returns the target used when a channel sets none, if there is one
+	defaultTarget func(n NotificationConfig) string
+	// new returns a Notifier for target, with the options of a named channel
+	new func(target string, options map[string]string) (Notifier, error)
+}
+
+var notifierTypes = map[string]notifierType{}
+
+// registerNotifier makes a notifier type available as a channel; types register in init
+func registerNotifier(name string, t notifierType) {
+	if _, ok := notifierTypes[name]; ok {
+		panic("notifier type registered twice: " + name)
+	}
+	notifierTypes[name] = t
+}
+
+var notifyClient = &http.Client{Timeout: 10 * time.Second}
+
+// NotificationChannel is a channel named in the config
+type NotificationChannel struct {
+	Type    string            `json:"type"`
+	Target  string            `json:"target"`
+	Options map[string]string `json:"options"`
+}
+
+// validate checks the named channels
+func (n NotificationConfig) validate() error {
+	names := make([]string, 0, len(n.Channels))
+	for name := range n.Channels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		c := n.Channels[name]
+		if _, ok := notifierTypes[name]; ok {
+			return fmt.Errorf("channel %q has the name of a channel type", name)
+		}
+		if _, ok := notifierTypes[c.Type]; !ok {
+			return fmt.Errorf("channel %q has unknown type %q", name, c.Type)
+		}
+	}
+	return nil
+}
+
+// hasChannel reports whether channel is a registered type or a named channel
+func (n NotificationConfig) hasChannel(channel string) bool {
+	if _, ok := n.Channels[channel]; ok {
+		return true
+	}
+	_, ok := notifierTypes[channel]
+	return ok
+}
+
+// notifier returns the Notifier sending through channel to target. An empty target falls
+// back to the named channel's target, then to the type's configured default.
+func (n NotificationConfig) notifier(channel, target string) (Notifier, error) {
+	typ, options := channel, map[string]string(nil)
+	if c, ok := n.Channels[channel]; ok {
+		typ, options = c.Type, c.Options
+		if target == "" {
+			target = c.Target
+		}
+	}
+	t, ok := notifierTypes[typ]
+	if !ok {
+		return nil, fmt.Errorf("unknown notification channel %q", channel)
+	}
+	if target == "" && t.defaultTarget != nil {
+		target = t.defaultTarget(n)
+	}
+	if t.needsTarget && target == "" {
+		return nil, fmt.Errorf("channel %q needs a target or a configured default", channel)
+	}
+	return t.new(target, options)
+}
+
+// checkChannel checks that alerts can be sent through channel to target
+func (n NotificationConfig) checkChannel(channel, target string) error {
+	_, err := n.notifier(channel, target)
+	return err
+}
+
+// sendNotification delivers an alert through a single channel
+func sendNotification(ctx context.Context, channel, target string, alert Alert) error {
+	notifier, err := currentConfig.Load().Notifications.notifier(channel, target)
+	if err != nil {
+		return err
+	}
+	return notifier.Send(ctx, alert)
+}
+
+func init() {
+	registerNotifier("log", notifierType{
+		new: func(string, map[string]string) (Notifier, error) { return logNotifier{}, nil },
+	})
+}
+
+// logNotifier writes alerts to the log
+type logNotifier struct{}
+
+func (logNotifier) Send(_ context.Context, alert Alert) error {
+	log.Printf("ALERT [%s] %s", alert.Kind, alert.Message)
+	return nil
+}
+
+// postJSON posts payload to url with the extra headers given, for HTTP-based notifiers
+func postJSON(ctx context.Context, url string, payload interface{}, headers map[string]string) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := notifyClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("notification target returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+// notify_email.go
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+)
+
+// The email channel mails alerts to a comma-separated list of addresses, by default the
+// notifications config's email_to (NOTIFY_EMAIL_TO), through the SMTP server configured by
+// SMTP_HOST, SMTP_PORT (default 587), SMTP_USERNAME, SMTP_PASSWORD and SMTP_FROM
+
+func init() {
+	registerNotifier("email", notifierType{
+		needsTarget:   true,
+		defaultTarget: func(n NotificationConfig) string { return n.EmailTo },
+		new: func(target string, _ map[string]string) (Notifier, error) {
+			return emailNotifier{to: target}, nil
+		},
+	})
+}
+
+type emailNotifier struct {
+	to string
+}
+
+func (n emailNotifier) Send(_ context.Context, alert Alert) error {
+	host := os.Getenv("SMTP_HOST")
+	if host == "" {
+		return fmt.Errorf("SMTP_HOST is not configured")
+	}
+	port := os.Getenv("SMTP_PORT")
+	if port == "" {
+		port = "587"
+	}
+	from := os.Getenv("SMTP_FROM")
+	if from == "" {
+		from = os.Getenv("SMTP_USERNAME")
+	}
+	var auth smtp.Auth
+	if user := os.Getenv("SMTP_USERNAME"); user != "" {
+		auth = smtp.PlainAuth("", user, os.Getenv("SMTP_PASSWORD"), host)
+	}
+	recipients := strings.Split(n.to, ",")
+	for i := range recipients {
+		recipients[i] = strings.TrimSpace(recipients[i])
+	}
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: [tokencounter] %s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n",
+		from, strings.Join(recipients, ", "), alert.Kind, alert.Message)
+	return smtp.SendMail(net.JoinHostPort(host, port), auth, from, recipients, []byte(msg))
+}
@@ -0,0 +1,55 @@
+// notify_gotify.go
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// The gotify channel pushes alerts to a Gotify server. The target is the server's URL, by
+// default GOTIFY_URL; the application token is a named channel's token option or
+// GOTIFY_TOKEN, and its priority option sets the message priority, default 5.
+
+const defaultGotifyPriority = 5
+
+func init() {
+	registerNotifier("gotify", notifierType{
+		needsTarget:   true,
+		defaultTarget: func(NotificationConfig) string { return os.Getenv("GOTIFY_URL") },
+		new: func(target string, options map[string]string) (Notifier, error) {
+			token := options["token"]
+			if token == "" {
+				token = os.Getenv("GOTIFY_TOKEN")
+			}
+			if token == "" {
+				return nil, fmt.Errorf("gotify needs a token option or GOTIFY_TOKEN")
+			}
+			priority := defaultGotifyPriority
+			if v := options["priority"]; v != "" {
+				p, err := strconv.Atoi(v)
+				if err != nil {
+					return nil, fmt.Errorf("gotify priority must be a number")
+				}
+				priority = p
+			}
+			return gotifyNotifier{url: strings.TrimRight(target, "/"), token: token, priority: priority}, nil
+		},
+	})
+}
+
+type gotifyNotifier struct {
+	url      string
+	token    string
+	priority int
+}
+
+func (n gotifyNotifier) Send(ctx context.Context, alert Alert) error {
+	return postJSON(ctx, n.url+"/message", map[string]interface{}{
+		"title":    "[tokencounter] " + alert.Kind,
+		"message":  alert.Message,
+		"priority": n.priority,
+	}, map[string]string{"X-Gotify-Key": n.token})
+}
@@ -0,0 +1,59 @@
+// notify_ntfy.go
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// The ntfy channel publishes alerts to an ntfy topic (https://ntfy.sh or a self-hosted server)
+// as push notifications. The target is the topic URL, e.g. https://ntfy.example.com/tokencounter,
+// by default NTFY_URL. A named channel's token option, or NTFY_TOKEN, is sent as the access
+// token, and its priority option (1 to 5, or min to max) sets the notification priority.
+
+func init() {
+	registerNotifier("ntfy", notifierType{
+		needsTarget:   true,
+		defaultTarget: func(NotificationConfig) string { return os.Getenv("NTFY_URL") },
+		new: func(target string, options map[string]string) (Notifier, error) {
+			token := options["token"]
+			if token == "" {
+				token = os.Getenv("NTFY_TOKEN")
+			}
+			return ntfyNotifier{url: target, token: token, priority: options["priority"]}, nil
+		},
+	})
+}
+
+type ntfyNotifier struct {
+	url      string
+	token    string
+	priority string
+}
+
+func (n ntfyNotifier) Send(ctx context.Context, alert Alert) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, strings.NewReader(alert.Message))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Title", "[tokencounter] "+alert.Kind)
+	req.Header.Set("Tags", alert.Kind)
+	if n.priority != "" {
+		req.Header.Set("Priority", n.priority)
+	}
+	if n.token != "" {
+		req.Header.Set("Authorization", "Bearer "+n.token)
+	}
+	resp, err := notifyClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("ntfy returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,25 @@
+// notify_slack.go
+package main
+
+import "context"
+
+// The slack channel posts alert messages to a Slack incoming webhook, by default the
+// notifications config's slack_webhook_url (SLACK_WEBHOOK_URL)
+
+func init() {
+	registerNotifier("slack", notifierType{
+		needsTarget:   true,
+		defaultTarget: func(n NotificationConfig) string { return n.SlackWebhookURL },
+		new: func(target string, _ map[string]string) (Notifier, error) {
+			return slackNotifier{url: target}, nil
+		},
+	})
+}
+
+type slackNotifier struct {
+	url string
+}
+
+func (n slackNotifier) Send(ctx context.Context, alert Alert) error {
+	return postJSON(ctx, n.url, map[string]string{"text": alert.Message}, nil)
+}
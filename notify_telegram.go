@@ -0,0 +1,41 @@
+// notify_telegram.go
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+)
+
+// The telegram channel sends alert messages to a Telegram chat through a bot. The target is the
+// chat ID, by default TELEGRAM_CHAT_ID; the bot token is a named channel's bot_token option or
+// TELEGRAM_BOT_TOKEN.
+
+var telegramAPI = "https://api.telegram.org"
+
+func init() {
+	registerNotifier("telegram", notifierType{
+		needsTarget:   true,
+		defaultTarget: func(NotificationConfig) string { return os.Getenv("TELEGRAM_CHAT_ID") },
+		new: func(target string, options map[string]string) (Notifier, error) {
+			token := options["bot_token"]
+			if token == "" {
+				token = os.Getenv("TELEGRAM_BOT_TOKEN")
+			}
+			if token == "" {
+				return nil, fmt.Errorf("telegram needs a bot_token option or TELEGRAM_BOT_TOKEN")
+			}
+			return telegramNotifier{token: token, chatID: target}, nil
+		},
+	})
+}
+
+type telegramNotifier struct {
+	token  string
+	chatID string
+}
+
+func (n telegramNotifier) Send(ctx context.Context, alert Alert) error {
+	return postJSON(ctx, telegramAPI+"/bot"+n.token+"/sendMessage",
+		map[string]string{"chat_id": n.chatID, "text": alert.Message}, nil)
+}
@@ -0,0 +1,26 @@
+// notify_webhook.go
+package main
+
+import "context"
+
+// The webhook channel posts alerts as JSON to a URL, by default the notifications config's
+// webhook_url (NOTIFY_WEBHOOK_URL). A named channel's options are sent as request headers.
+
+func init() {
+	registerNotifier("webhook", notifierType{
+		needsTarget:   true,
+		defaultTarget: func(n NotificationConfig) string { return n.WebhookURL },
+		new: func(target string, options map[string]string) (Notifier, error) {
+			return webhookNotifier{url: target, headers: options}, nil
+		},
+	})
+}
+
+type webhookNotifier struct {
+	url     string
+	headers map[string]string
+}
+
+func (n webhookNotifier) Send(ctx context.Context, alert Alert) error {
+	return postJSON(ctx, n.url, alert, n.headers)
+}
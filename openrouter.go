@@ -0,0 +1,61 @@
+// openrouter.go
+package main
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// extractOpenRouterUsage reads the OpenAI-style usage block OpenRouter returns, including its
+// cost field (present when the request enables usage accounting). Streams carry usage in the final chunk.
+func extractOpenRouterUsage(path string, body []byte) (proxyUsage, bool) {
+	var usage proxyUsage
+	found := false
+	for _, payload := range jsonPayloads(body) {
+		var resp struct {
+			Model string `json:"model"`
+			Usage *struct {
+				PromptTokens     int      `json:"prompt_tokens"`
+				CompletionTokens int      `json:"completion_tokens"`
+				Cost             *float64 `json:"cost"`
+			} `json:"usage"`
+		}
+		if err := json.Unmarshal(payload, &resp); err != nil {
+			continue
+		}
+		if resp.Model != "" {
+			usage.Model = resp.Model
+		}
+		if resp.Usage == nil {
+			continue
+		}
+		usage.PromptTokens = resp.Usage.PromptTokens
+		usage.CompletionTokens = resp.Usage.CompletionTokens
+		usage.Cost = resp.Usage.Cost
+		found = true
+	}
+	return usage, found
+}
+
+// openRouterStreamText concatenates the content and reasoning deltas of a streamed completion
+func openRouterStreamText(body []byte) string {
+	var text strings.Builder
+	for _, payload := range jsonPayloads(body) {
+		var chunk struct {
+			Choices []struct {
+				Delta struct {
+					Content   string `json:"content"`
+					Reasoning string `json:"reasoning"`
+				} `json:"delta"`
+			} `json:"choices"`
+		}
+		if err := json.Unmarshal(payload, &chunk); err != nil {
+			continue
+		}
+		for _, c := range chunk.Choices {
+			text.WriteString(c.Delta.Reasoning)
+			text.WriteString(c.Delta.Content)
+		}
+	}
+	return text.String()
+}
@@ -0,0 +1,260 @@
+// outages.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// A provider outage is a window in which a provider was down or degraded, so usage through it
+// fell short of the usual. Outages are recorded by hand with POST /outages or imported from
+// the providers' status pages by the outages job. Comparisons and projections take
+// ?exclude_outages= to leave the days an outage touched out of their per-day figures, so a day
+// OpenAI was down doesn't make the next week look like growth: "true" excludes the outages of
+// every provider, a comma-separated list only those of the providers named.
+
+// ProviderOutage is an outage of a provider. EndsAt is unset while it is ongoing. Source is
+// "manual" or the status page an outage was imported from, with ExternalID its incident ID.
+type ProviderOutage struct {
+	ID          int        `json:"id"`
+	Provider    string     `json:"provider"`
+	StartsAt    time.Time  `json:"starts_at"`
+	EndsAt      *time.Time `json:"ends_at,omitempty"`
+	Description string     `json:"description"`
+	Source      string     `json:"source"`
+	ExternalID  *string    `json:"external_id,omitempty"`
+}
+
+const outageColumns = "id, provider, starts_at, ends_at, description, source, external_id"
+
+const manualOutageSource = "manual"
+
+var statusPageClient = &http.Client{Timeout: 30 * time.Second}
+
+// validateStatusPages checks the status_pages config, which maps providers to the base URLs
+// of their Statuspage-hosted status pages, e.g. "openai": "https://status.openai.com"
+func validateStatusPages(pages map[string]string) error {
+	for provider, u := range pages {
+		if provider == "" {
+			return fmt.Errorf("provider name is empty")
+		}
+		if !strings.HasPrefix(u, "https://") && !strings.HasPrefix(u, "http://") {
+			return fmt.Errorf("url for %s must be http or https", provider)
+		}
+	}
+	return nil
+}
+
+// outagesBetween returns the outages overlapping the days start to end, oldest first, only
+// those of provider if it is not empty
+func outagesBetween(ctx context.Context, start, end time.Time, provider string) ([]ProviderOutage, error) {
+	rows, err := db.QueryContext(ctx, "SELECT "+outageColumns+` FROM provider_outages
+        WHERE starts_at < $2 AND (ends_at IS NULL OR ends_at >= $1) AND ($3 = '' OR provider = $3)
+        ORDER BY starts_at, id`, start, end.AddDate(0, 0, 1), provider)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	outages := []ProviderOutage{}
+	for rows.Next() {
+		var o ProviderOutage
+		if err := rows.Scan(&o.ID, &o.Provider, &o.StartsAt, &o.EndsAt, &o.Description, &o.Source, &o.ExternalID); err != nil {
+			return nil, err
+		}
+		outages = append(outages, o)
+	}
+	return outages, rows.Err()
+}
+
+// parseExcludeOutages reads ?exclude_outages=: nil when outages are kept, an empty list for
+// every provider's, otherwise the providers whose outages are excluded
+func parseExcludeOutages(v string) []string {
+	switch v {
+	case "", "false":
+		return nil
+	case "true":
+		return []string{}
+	}
+	providers := []string{}
+	for _, p := range strings.Split(v, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			providers = append(providers, p)
+		}
+	}
+	return providers
+}
+
+// outageDays returns the days from start to end, in order, that an outage of one of providers
+// touched, or of any provider when providers is empty. An ongoing outage runs to now.
+func outageDays(ctx context.Context, start, end time.Time, providers []string) ([]string, error) {
+	rows, err := db.QueryContext(ctx, `
+        SELECT DISTINCT d::DATE FROM provider_outages o,
+            generate_series(GREATEST(o.starts_at::DATE, $1::DATE), LEAST(COALESCE(o.ends_at, NOW())::DATE, $2::DATE), INTERVAL '1 day') d
+        WHERE o.starts_at < $2::DATE + 1 AND (o.ends_at IS NULL OR o.ends_at >= $1)
+            AND (cardinality($3::TEXT[]) = 0 OR o.provider = ANY($3))
+        ORDER BY 1`, start, end, pq.Array(providers))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	days := []string{}
+	for rows.Next() {
+		var day time.Time
+		if err := rows.Scan(&day); err != nil {
+			return nil, err
+		}
+		days = append(days, day.Format("2006-01-02"))
+	}
+	return days, rows.Err()
+}
+
+func createOutage(w http.ResponseWriter, r *http.Request) {
+	var o ProviderOutage
+	if err := json.NewDecoder(r.Body).Decode(&o); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request payload", err)
+		return
+	}
+	if o.Provider == "" || o.StartsAt.IsZero() {
+		respondJSON(w, http.StatusBadRequest, map[string]string{"message": "provider and starts_at are required"})
+		return
+	}
+	if o.EndsAt != nil && o.EndsAt.Before(o.StartsAt) {
+		respondJSON(w, http.StatusBadRequest, map[string]string{"message": "ends_at must not be before starts_at"})
+		return
+	}
+	o.Source, o.ExternalID = manualOutageSource, nil
+	err := db.QueryRowContext(r.Context(), `INSERT INTO provider_outages (provider, starts_at, ends_at, description, source)
+        VALUES ($1, $2, $3, $4, $5) RETURNING id`, o.Provider, o.StartsAt, o.EndsAt, o.Description, o.Source).Scan(&o.ID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to create outage", err)
+		return
+	}
+	respondJSON(w, http.StatusCreated, o)
+}
+
+// getOutages lists outages overlapping a date range, this month by default. ?provider=
+// narrows it to one provider.
+func getOutages(w http.ResponseWriter, r *http.Request) {
+	start, end, err := parseDateRange(r.URL.Query(), "month")
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid date range", err)
+		return
+	}
+	outages, err := outagesBetween(r.Context(), start, end, r.URL.Query().Get("provider"))
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database query error", err)
+		return
+	}
+	respondJSON(w, http.StatusOK, outages)
+}
+
+// deleteOutage removes an outage. An imported one is imported again on the next poll while
+// its incident is still listed on the status page.
+func deleteOutage(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid outage id", err)
+		return
+	}
+	res, err := db.ExecContext(r.Context(), "DELETE FROM provider_outages WHERE id = $1", id)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to delete outage", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		respondJSON(w, http.StatusNotFound, map[string]string{"message": "Outage not found"})
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]string{"message": "Outage deleted successfully"})
+}
+
+// statusPageIncident is the part of a Statuspage incident the import uses
+type statusPageIncident struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Impact     string     `json:"impact"`
+	CreatedAt  time.Time  `json:"created_at"`
+	StartedAt  *time.Time `json:"started_at"`
+	ResolvedAt *time.Time `json:"resolved_at"`
+}
+
+// importedImpacts are the incident impacts recorded as outages; minor incidents, such as
+// elevated errors on one endpoint, hardly move usage
+var importedImpacts = map[string]bool{"major": true, "critical": true}
+
+// pollStatusPages is the outages job: it imports the major and critical incidents listed on
+// the configured status pages, updating those imported before as they are resolved
+func pollStatusPages(ctx context.Context) error {
+	pages := currentConfig.Load().StatusPages
+	providers := make([]string, 0, len(pages))
+	for provider := range pages {
+		providers = append(providers, provider)
+	}
+	sort.Strings(providers)
+	var failed []string
+	for _, provider := range providers {
+		n, err := importStatusPage(ctx, provider, pages[provider])
+		if err != nil {
+			log.Printf("Failed to poll the status page of %s: %v", provider, err)
+			failed = append(failed, provider)
+			continue
+		}
+		debugf("Imported %d incidents from the status page of %s\n", n, provider)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("polling status pages failed for %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// importStatusPage upserts the incidents of one status page and returns how many it imported
+func importStatusPage(ctx context.Context, provider, base string) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimRight(base, "/")+"/api/v2/incidents.json", nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := statusPageClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("fetching incidents: %s", resp.Status)
+	}
+	var body struct {
+		Incidents []statusPageIncident `json:"incidents"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return 0, fmt.Errorf("reading incidents: %w", err)
+	}
+	n := 0
+	for _, inc := range body.Incidents {
+		if !importedImpacts[inc.Impact] || inc.ID == "" {
+			continue
+		}
+		starts := inc.CreatedAt
+		if inc.StartedAt != nil {
+			starts = *inc.StartedAt
+		}
+		_, err := db.ExecContext(ctx, `INSERT INTO provider_outages (provider, starts_at, ends_at, description, source, external_id)
+            VALUES ($1, $2, $3, $4, $5, $6)
+            ON CONFLICT (provider, external_id) DO UPDATE SET starts_at = EXCLUDED.starts_at, ends_at = EXCLUDED.ends_at,
+                description = EXCLUDED.description, source = EXCLUDED.source`,
+			provider, starts, inc.ResolvedAt, inc.Name, base, inc.ID)
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
@@ -0,0 +1,112 @@
+// partitions.go
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// partitionsAhead is how many future months the partitions job prepares
+const partitionsAhead = 2
+
+// knownPartitions caches months whose token_usage partition is known to exist
+var knownPartitions sync.Map
+
+// ensurePartition creates the monthly partition holding date, if needed. Writes still succeed
+// without it, since they fall into the default partition, so callers may ignore the error.
+func ensurePartition(ctx context.Context, date time.Time) error {
+	month := date.Format("2006-01")
+	if _, ok := knownPartitions.Load(month); ok {
+		return nil
+	}
+	if _, err := db.ExecContext(ctx, "SELECT token_usage_ensure_partition($1)", date); err != nil {
+		return err
+	}
+	knownPartitions.Store(month, true)
+	return nil
+}
+
+// ensureUpcomingPartitions is the partitions job: it creates partitions ahead of time so the
+// first write of a month doesn't pay for the DDL
+func ensureUpcomingPartitions(ctx context.Context) error {
+	now := time.Now()
+	start := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i <= partitionsAhead; i++ {
+		if err := ensurePartition(ctx, start.AddDate(0, i, 0)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Partition describes one token_usage partition as listed by GET /admin/partitions
+type Partition struct {
+	Name         string `json:"name"`
+	Bounds       string `json:"bounds"`
+	RowsEstimate int64  `json:"rows_estimate"`
+	SizeBytes    int64  `json:"size_bytes"`
+}
+
+func getPartitions(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.QueryContext(r.Context(), `
+        SELECT c.relname, pg_get_expr(c.relpartbound, c.oid), GREATEST(c.reltuples, 0)::BIGINT, pg_total_relation_size(c.oid)
+        FROM pg_inherits i JOIN pg_class c ON c.oid = i.inhrelid
+        WHERE i.inhparent = 'token_usage'::REGCLASS
+        ORDER BY c.relname`)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database query error", err)
+		return
+	}
+	defer rows.Close()
+	partitions := []Partition{}
+	for rows.Next() {
+		var p Partition
+		if err := rows.Scan(&p.Name, &p.Bounds, &p.RowsEstimate, &p.SizeBytes); err != nil {
+			respondError(w, http.StatusInternalServerError, "Error scanning row", err)
+			return
+		}
+		partitions = append(partitions, p)
+	}
+	if err = rows.Err(); err != nil {
+		respondError(w, http.StatusInternalServerError, "Error reading data", err)
+		return
+	}
+	respondJSON(w, http.StatusOK, partitions)
+}
+
+// dropPartition deletes a whole month of usage (YYYY-MM) by dropping its partition, which is
+// far cheaper than a DELETE. The current and future months are refused.
+func dropPartition(w http.ResponseWriter, r *http.Request) {
+	month, err := time.Parse("2006-01", mux.Vars(r)["month"])
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid month, expected YYYY-MM", err)
+		return
+	}
+	now := time.Now()
+	if !month.Before(time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)) {
+		respondJSON(w, http.StatusBadRequest, map[string]string{"message": "Only partitions for past months can be dropped"})
+		return
+	}
+	name := "token_usage_" + month.Format("2006_01")
+	var exists bool
+	if err := db.QueryRowContext(r.Context(), "SELECT to_regclass($1) IS NOT NULL", name).Scan(&exists); err != nil {
+		respondError(w, http.StatusInternalServerError, "Database query error", err)
+		return
+	}
+	if !exists {
+		respondJSON(w, http.StatusNotFound, map[string]string{"message": "Partition not found"})
+		return
+	}
+	// name is built from a parsed date, so it is safe to interpolate
+	if _, err := db.ExecContext(r.Context(), "DROP TABLE "+name); err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to drop partition", err)
+		return
+	}
+	knownPartitions.Delete(month.Format("2006-01"))
+	infof("Dropped partition %s\n", name)
+	respondJSON(w, http.StatusOK, map[string]string{"message": "Partition " + name + " dropped"})
+}
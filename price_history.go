@@ -0,0 +1,195 @@
+// price_history.go
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// PriceChange is a model's list price from a date on, until the next change. model_pricing
+// keeps the price in force today, so everything that only needs the current price reads it
+// as before; usage is priced by date through usagePriceJoin.
+type PriceChange struct {
+	Model           string  `json:"model"`
+	EffectiveFrom   string  `json:"effective_from"`
+	PricePerMillion float64 `json:"price_per_million"`
+}
+
+// setModelPrice records that model costs price from effective on. The first change of a
+// model keeps the flat price it replaces for the days before it, so setting a new price no
+// longer reprices old usage. A model with no earlier price takes this one for all of history.
+func setModelPrice(ctx context.Context, model string, price float64, effective time.Time) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.ExecContext(ctx, `INSERT INTO model_price_history (model, effective_from, price_per_million)
+        SELECT model, '0001-01-01', price_per_million FROM model_pricing
+        WHERE model = $1 AND NOT EXISTS (SELECT 1 FROM model_price_history WHERE model = $1)`, model)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `INSERT INTO model_price_history (model, effective_from, price_per_million) VALUES ($1, $2, $3)
+        ON CONFLICT (model, effective_from) DO UPDATE SET price_per_million = EXCLUDED.price_per_million`, model, effective, price)
+	if err != nil {
+		return err
+	}
+	if _, err := applyPricesInForce(ctx, tx, model); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// applyPricesInForce brings model_pricing up to the price in force today for one model, or
+// every model with a price history when model is empty, and returns how many it changed.
+// Prices set ahead of time take effect this way.
+func applyPricesInForce(ctx context.Context, tx *sql.Tx, model string) (int64, error) {
+	res, err := tx.ExecContext(ctx, `INSERT INTO model_pricing (model, price_per_million)
+        SELECT DISTINCT ON (model) model, price_per_million FROM model_price_history
+        WHERE effective_from <= $1 AND ($2 = '' OR model = $2)
+        ORDER BY model, effective_from DESC
+        ON CONFLICT (model) DO UPDATE SET price_per_million = EXCLUDED.price_per_million
+        WHERE model_pricing.price_per_million <> EXCLUDED.price_per_million`, time.Now().Truncate(24*time.Hour), model)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// applyScheduledPrices is the price_changes job
+func applyScheduledPrices(ctx context.Context) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	n, err := applyPricesInForce(ctx, tx, "")
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if n > 0 {
+		infof("Applied %d scheduled price changes\n", n)
+	}
+	return nil
+}
+
+// priceInForce is the price of model on date, as usagePriceJoin finds it, and false when the
+// model is unpriced
+func priceInForce(ctx context.Context, model string, date time.Time) (float64, bool, error) {
+	var price sql.NullFloat64
+	err := db.QueryRowContext(ctx, `SELECT COALESCE(
+            (SELECT price_per_million FROM model_price_history WHERE model = $1 AND effective_from <= $2 ORDER BY effective_from DESC LIMIT 1),
+            (SELECT price_per_million FROM model_pricing WHERE model = $1),
+            (SELECT price_per_million FROM pricing_catalog WHERE model = $1))`, model, date).Scan(&price)
+	return price.Float64, price.Valid, err
+}
+
+// getPriceHistory lists the price changes of a model, oldest first
+func getPriceHistory(w http.ResponseWriter, r *http.Request) {
+	model := mux.Vars(r)["model"]
+	rows, err := db.QueryContext(r.Context(), "SELECT effective_from, price_per_million FROM model_price_history WHERE model = $1 ORDER BY effective_from", model)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database query error", err)
+		return
+	}
+	defer rows.Close()
+	changes := []PriceChange{}
+	for rows.Next() {
+		c := PriceChange{Model: model}
+		var from time.Time
+		if err := rows.Scan(&from, &c.PricePerMillion); err != nil {
+			respondError(w, http.StatusInternalServerError, "Error scanning row", err)
+			return
+		}
+		c.EffectiveFrom = from.Format("2006-01-02")
+		changes = append(changes, c)
+	}
+	if err = rows.Err(); err != nil {
+		respondError(w, http.StatusInternalServerError, "Error reading data", err)
+		return
+	}
+	respondJSON(w, http.StatusOK, changes)
+}
+
+// PriceRecompute is a model's cost over a range at the prices in force on each day, next to
+// what it came to when every day was priced at today's price
+type PriceRecompute struct {
+	Model       string  `json:"model"`
+	TotalTokens int64   `json:"total_tokens"`
+	FlatCost    float64 `json:"flat_cost"`
+	DatedCost   float64 `json:"dated_cost"`
+	Difference  float64 `json:"difference"`
+}
+
+// recomputePricing is the backfill after entering past price changes. Costs are derived when
+// queried, so there is nothing stored to rewrite: it applies any price changes now in force to
+// model_pricing, unless dry_run, and reports how dated pricing changes each model's cost over
+// ?start=&end= (all time by default) compared with pricing every day at the current price.
+func recomputePricing(w http.ResponseWriter, r *http.Request) {
+	start, end, err := parseDateRange(r.URL.Query(), "lifetime")
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid date range", err)
+		return
+	}
+	var applied int64
+	if !isDryRun(r) {
+		tx, err := db.BeginTx(r.Context(), nil)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, "Failed to start transaction", err)
+			return
+		}
+		defer tx.Rollback()
+		if applied, err = applyPricesInForce(r.Context(), tx, ""); err != nil {
+			respondError(w, http.StatusInternalServerError, "Failed to apply price changes", err)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			respondError(w, http.StatusInternalServerError, "Failed to commit price changes", err)
+			return
+		}
+	}
+	rows, err := db.QueryContext(r.Context(), `
+        SELECT u.model, SUM(u.total_tokens),
+            COALESCE(SUM(ROUND(COALESCE(u.cost, u.total_tokens / 1e6 * COALESCE(mp.price_per_million, 0)) * 1000000)::BIGINT), 0)::BIGINT,
+            `+usageCostMicrosSum+`
+        FROM token_usage u
+        `+usagePriceJoin+`
+        LEFT JOIN model_pricing mp ON mp.model = u.model
+        WHERE u.date >= $1 AND u.date <= $2 AND u.model IN (SELECT model FROM model_price_history)
+        GROUP BY u.model ORDER BY u.model`, start, end)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database query error", err)
+		return
+	}
+	defer rows.Close()
+	models := []PriceRecompute{}
+	for rows.Next() {
+		var m PriceRecompute
+		var flat, dated int64
+		if err := rows.Scan(&m.Model, &m.TotalTokens, &flat, &dated); err != nil {
+			respondError(w, http.StatusInternalServerError, "Error scanning row", err)
+			return
+		}
+		m.FlatCost, m.DatedCost, m.Difference = costFromMicros(flat), costFromMicros(dated), costFromMicros(dated-flat)
+		models = append(models, m)
+	}
+	if err = rows.Err(); err != nil {
+		respondError(w, http.StatusInternalServerError, "Error reading data", err)
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"dry_run":         isDryRun(r),
+		"start":           start.Format("2006-01-02"),
+		"end":             end.Format("2006-01-02"),
+		"applied_changes": applied,
+		"models":          models,
+	})
+}
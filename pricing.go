@@ -0,0 +1,132 @@
+// pricing.go
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ModelPricing is the list price of a model in USD per million tokens
+type ModelPricing struct {
+	Model           string  `json:"model"`
+	PricePerMillion float64 `json:"price_per_million"`
+	// EffectiveFrom (YYYY-MM-DD) dates a price change when setting a price, today by default
+	EffectiveFrom string     `json:"effective_from,omitempty"`
+	CreatedAt     *time.Time `json:"created_at,omitempty"`
+	UpdatedAt     *time.Time `json:"updated_at,omitempty"`
+}
+
+// getPricingAll lists prices, only those changed after ?updated_since= (RFC 3339) if given
+func getPricingAll(w http.ResponseWriter, r *http.Request) {
+	var since time.Time
+	if v := r.URL.Query().Get("updated_since"); v != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339, v); err != nil {
+			respondError(w, http.StatusBadRequest, "Invalid updated_since, expected RFC 3339", err)
+			return
+		}
+	}
+	rows, err := db.QueryContext(r.Context(), "SELECT model, price_per_million, created_at, updated_at FROM model_pricing WHERE updated_at > $1 ORDER BY model", since)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database query error", err)
+		return
+	}
+	defer rows.Close()
+	prices := []ModelPricing{}
+	for rows.Next() {
+		var p ModelPricing
+		if err := rows.Scan(&p.Model, &p.PricePerMillion, &p.CreatedAt, &p.UpdatedAt); err != nil {
+			respondError(w, http.StatusInternalServerError, "Error scanning row", err)
+			return
+		}
+		prices = append(prices, p)
+	}
+	if err = rows.Err(); err != nil {
+		respondError(w, http.StatusInternalServerError, "Error reading data", err)
+		return
+	}
+	respondJSON(w, http.StatusOK, prices)
+}
+
+func getPricing(w http.ResponseWriter, r *http.Request) {
+	model := mux.Vars(r)["model"]
+	p := ModelPricing{Model: model}
+	err := db.QueryRowContext(r.Context(), "SELECT price_per_million, created_at, updated_at FROM model_pricing WHERE model = $1", model).Scan(&p.PricePerMillion, &p.CreatedAt, &p.UpdatedAt)
+	if err == sql.ErrNoRows {
+		respondJSON(w, http.StatusNotFound, map[string]string{"message": "No pricing configured for this model"})
+		return
+	} else if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database query error", err)
+		return
+	}
+	respondJSON(w, http.StatusOK, p)
+}
+
+func putPricing(w http.ResponseWriter, r *http.Request) {
+	var p ModelPricing
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request payload", err)
+		return
+	}
+	p.Model = mux.Vars(r)["model"]
+	if p.PricePerMillion < 0 {
+		respondJSON(w, http.StatusBadRequest, map[string]string{"message": "price_per_million must not be negative"})
+		return
+	}
+	effective := time.Now().Truncate(24 * time.Hour)
+	if p.EffectiveFrom != "" {
+		var err error
+		if effective, err = time.Parse("2006-01-02", p.EffectiveFrom); err != nil {
+			respondError(w, http.StatusBadRequest, "Invalid effective_from, expected YYYY-MM-DD", err)
+			return
+		}
+	}
+	p.EffectiveFrom = effective.Format("2006-01-02")
+	if err := setModelPrice(r.Context(), p.Model, p.PricePerMillion, effective); err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to save pricing", err)
+		return
+	}
+	// A price set ahead of time leaves model_pricing as it is until it takes effect
+	err := db.QueryRowContext(r.Context(), "SELECT created_at, updated_at FROM model_pricing WHERE model = $1", p.Model).Scan(&p.CreatedAt, &p.UpdatedAt)
+	if err != nil && err != sql.ErrNoRows {
+		respondError(w, http.StatusInternalServerError, "Database query error", err)
+		return
+	}
+	infof("Set price for %s to %.4f per million tokens from %s\n", p.Model, p.PricePerMillion, p.EffectiveFrom)
+	respondJSON(w, http.StatusOK, p)
+}
+
+// deletePricing removes a model's price along with its price history
+func deletePricing(w http.ResponseWriter, r *http.Request) {
+	model := mux.Vars(r)["model"]
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to start transaction", err)
+		return
+	}
+	defer tx.Rollback()
+	res, err := tx.ExecContext(r.Context(), "DELETE FROM model_pricing WHERE model = $1", model)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to delete pricing", err)
+		return
+	}
+	history, err := tx.ExecContext(r.Context(), "DELETE FROM model_price_history WHERE model = $1", model)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to delete pricing", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to delete pricing", err)
+		return
+	}
+	n, _ := res.RowsAffected()
+	if h, _ := history.RowsAffected(); n+h == 0 {
+		respondJSON(w, http.StatusNotFound, map[string]string{"message": "No pricing configured for this model"})
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]string{"message": "Pricing deleted successfully"})
+}
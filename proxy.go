@@ -0,0 +1,464 @@
+// proxy.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// proxyUsage is the token usage extracted from one proxied response
+type proxyUsage struct {
+	Model            string
+	PromptTokens     int
+	CompletionTokens int
+	// Cost is set when the provider reports the request's cost itself
+	Cost *float64
+}
+
+func (u proxyUsage) total() int {
+	return u.PromptTokens + u.CompletionTokens
+}
+
+// proxyProvider describes an upstream API that requests can be passed through to
+type proxyProvider struct {
+	// baseURLEnv names the environment variable overriding defaultBaseURL
+	baseURLEnv     string
+	defaultBaseURL string
+	// requestModel returns the model a request addresses, from its path or JSON body
+	requestModel func(path string, body []byte) string
+	// rewriteModel points a request at another model
+	rewriteModel func(path string, body []byte, model string) (string, []byte)
+	// extractUsage parses a complete response body (JSON or SSE) into usage
+	extractUsage func(path string, body []byte) (proxyUsage, bool)
+	// streamText concatenates the generated text of a streamed response, for estimating
+	// completion tokens when the stream carries no usage
+	streamText func(body []byte) string
+	// setAPIKey authenticates a request with an upstream's configured key
+	setAPIKey func(h http.Header, key string)
+}
+
+func setGoogleAPIKey(h http.Header, key string) {
+	h.Del("Authorization")
+	h.Set("X-Goog-Api-Key", key)
+}
+
+func setBearerToken(h http.Header, key string) {
+	h.Set("Authorization", "Bearer "+key)
+}
+
+var proxyProviders = map[string]proxyProvider{
+	"gemini": {
+		baseURLEnv:     "GEMINI_BASE_URL",
+		defaultBaseURL: "https://generativelanguage.googleapis.com",
+		requestModel:   geminiRequestModel,
+		rewriteModel:   geminiRewriteModel,
+		extractUsage:   extractGeminiUsage,
+		streamText:     geminiStreamText,
+		setAPIKey:      setGoogleAPIKey,
+	},
+	"openrouter": {
+		baseURLEnv:     "OPENROUTER_BASE_URL",
+		defaultBaseURL: "https://openrouter.ai",
+		requestModel:   bodyRequestModel,
+		rewriteModel:   bodyRewriteModel,
+		extractUsage:   extractOpenRouterUsage,
+		streamText:     openRouterStreamText,
+		setAPIKey:      setBearerToken,
+	},
+	// Vertex AI is regional, so VERTEX_BASE_URL must be set, e.g. https://us-central1-aiplatform.googleapis.com
+	"vertex": {
+		baseURLEnv:   "VERTEX_BASE_URL",
+		requestModel: geminiRequestModel,
+		rewriteModel: geminiRewriteModel,
+		extractUsage: extractGeminiUsage,
+		streamText:   geminiStreamText,
+		setAPIKey:    setBearerToken,
+	},
+}
+
+// proxyHeaderPrefix marks headers meant for TokenCounter; they are not forwarded upstream
+const proxyHeaderPrefix = "X-Tokencounter-"
+
+// maxCapturedBody bounds how much of a response is buffered for usage extraction
+const maxCapturedBody = 8 << 20
+
+// proxyRequest forwards /proxy/{upstream}/... to the upstream, or to the members of the pool
+// of that name, and records the usage in its response
+func proxyRequest(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["upstream"]
+	upstreamPath := "/" + strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/proxy/"+name), "/")
+	caller := proxyCaller{
+		project:      r.Header.Get(proxyHeaderPrefix + "Project"),
+		feature:      r.Header.Get(proxyHeaderPrefix + "Feature"),
+		user:         r.Header.Get(proxyHeaderPrefix + "User"),
+		conversation: r.Header.Get(proxyHeaderPrefix + "Conversation"),
+	}
+	if key := r.Header.Get(proxyHeaderPrefix + "Key"); key != "" {
+		var ok bool
+		var err error
+		if caller.project, ok, err = resolveProjectKey(key); err != nil {
+			respondError(w, http.StatusInternalServerError, "Database query error", err)
+			return
+		} else if !ok {
+			respondJSON(w, http.StatusBadRequest, map[string]string{"message": "Unknown project key: " + key})
+			return
+		}
+	}
+	if scope, ok := projectScope(r.Context()); ok {
+		if caller.project != "" && caller.project != scope {
+			respondJSON(w, http.StatusForbidden, map[string]string{"message": "This key can only record usage for project " + scope})
+			return
+		}
+		caller.project = scope
+	}
+
+	reqBody, err := io.ReadAll(io.LimitReader(r.Body, maxCapturedBody))
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Failed to read request body", err)
+		return
+	}
+	rest := r.Body
+	// Only a fully buffered body can be sent again to another upstream
+	replayable := len(reqBody) < maxCapturedBody
+
+	targets, model, err := proxyTargets(r.Context(), name, upstreamPath, reqBody)
+	if errors.Is(err, errUnknownUpstream) {
+		respondJSON(w, http.StatusNotFound, map[string]string{"message": "Unknown proxy upstream: " + name})
+		return
+	} else if err != nil {
+		respondJSON(w, http.StatusBadGateway, map[string]string{"message": err.Error()})
+		return
+	}
+
+	// A truncated body cannot be rewritten, so only fully buffered requests are downgraded
+	if replayable {
+		policy, err := fallbackFor(r.Context(), caller.project, model)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, "Database query error", err)
+			return
+		}
+		if policy != nil {
+			upstreamPath, reqBody = targets[0].provider.rewriteModel(upstreamPath, reqBody, policy.FallbackModel)
+			r.ContentLength = int64(len(reqBody))
+			r.Header.Del("Content-Length")
+			if targets, _, err = proxyTargets(r.Context(), name, upstreamPath, reqBody); err != nil {
+				respondJSON(w, http.StatusBadGateway, map[string]string{"message": err.Error()})
+				return
+			}
+			debugf("Fallback policy %d downgraded %s to %s for project %q\n", policy.ID, model, policy.FallbackModel, caller.project)
+			w.Header().Set(proxyHeaderPrefix+"Downgraded-From", model)
+			if err := recordDowngrade(r.Context(), policy, caller.project, model); err != nil {
+				log.Printf("Failed to record downgrade by fallback policy %d: %v", policy.ID, err)
+			}
+			model = policy.FallbackModel
+		}
+	}
+
+	// Budgets cannot be checked while the database is down; the proxy fails open rather than
+	// taking every client down with it
+	if model != "" && dbHealth.available() {
+		exceeded, err := enforceBudgets(model, 1)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, "Database query error", err)
+			return
+		}
+		if exceeded != nil {
+			if _, ok := projectScope(r.Context()); ok {
+				respondJSON(w, http.StatusTooManyRequests, exceeded.scopedView())
+				return
+			}
+			respondJSON(w, http.StatusTooManyRequests, exceeded)
+			return
+		}
+	}
+
+	sample := shouldSample()
+	limits, err := loadConcurrencyLimits(r.Context())
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database query error", err)
+		return
+	}
+
+	for i, upstream := range targets {
+		last := i == len(targets)-1
+		release, full := proxySlots.acquire(r.Context(), matchingLimits(limits, upstream.name, model), last)
+		if full != nil {
+			if last {
+				w.Header().Set("Retry-After", "1")
+				respondJSON(w, http.StatusTooManyRequests, concurrencyExceeded(full))
+				return
+			}
+			debugf("Upstream %s is at its concurrency limit for %s, trying %s\n", upstream.name, name, targets[i+1].name)
+			continue
+		}
+		r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(reqBody), rest))
+		retry := proxyTo(w, r, reqBody, upstream, upstreamPath, model, caller, replayable && !last, sample)
+		release()
+		if !retry {
+			return
+		}
+		log.Printf("Upstream %s failed for %s, failing over to %s", upstream.name, name, targets[i+1].name)
+	}
+}
+
+// errRetryUpstream aborts a proxied response so the next upstream can be tried
+var errRetryUpstream = errors.New("retryable upstream response")
+
+// proxyTo passes a request to one upstream. If canRetry, a rate-limited or failed attempt
+// writes nothing and proxyTo returns true so the caller can try another upstream.
+// If sample, a successful exchange is stored as a payload sample.
+func proxyTo(w http.ResponseWriter, r *http.Request, reqBody []byte, upstream proxyTarget, upstreamPath, model string, caller proxyCaller, canRetry, sample bool) (retry bool) {
+	provider := upstream.provider
+	rp := &httputil.ReverseProxy{
+		Transport: upstream.transport(),
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.Out.URL.Path = upstreamPath
+			pr.Out.URL.RawPath = ""
+			pr.SetURL(upstream.baseURL)
+			// Let the transport negotiate compression so the captured body is always plain text
+			pr.Out.Header.Del("Accept-Encoding")
+			for h := range pr.Out.Header {
+				if strings.HasPrefix(http.CanonicalHeaderKey(h), proxyHeaderPrefix) {
+					pr.Out.Header.Del(h)
+				}
+			}
+			if upstream.apiKey != "" {
+				provider.setAPIKey(pr.Out.Header, upstream.apiKey)
+			}
+		},
+		ModifyResponse: func(resp *http.Response) error {
+			if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+				upstreamHealth.failed(upstream.name)
+				if canRetry {
+					return errRetryUpstream
+				}
+			} else {
+				upstreamHealth.succeeded(upstream.name)
+			}
+			resp.Header.Set(proxyHeaderPrefix+"Upstream", upstream.name)
+			if resp.StatusCode >= 300 {
+				return nil
+			}
+			streamed := strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream")
+			resp.Body = &capturingBody{ReadCloser: resp.Body, onDone: func(body []byte) {
+				usage, ok := provider.extractUsage(upstreamPath, body)
+				if !ok && streamed {
+					usage, ok = estimateStreamUsage(provider, usage, model, body)
+				}
+				// The response is done by now, but the writes keep the request's project scope
+				ctx := context.WithoutCancel(r.Context())
+				if sample {
+					recordSample(ctx, upstream.name, upstreamPath, caller.project, usage, reqBody, body)
+				}
+				if !ok {
+					log.Printf("No usage found in %s response for %s", upstream.name, upstreamPath)
+					return
+				}
+				recordProxyUsage(ctx, upstream.name, usage, caller)
+			}}
+			return nil
+		},
+		// Flush immediately so streamed responses reach the client as they arrive
+		FlushInterval: -1,
+		// Not respondError: upstream network errors say nothing about the database
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			if errors.Is(err, errRetryUpstream) {
+				retry = true
+				return
+			}
+			upstreamHealth.failed(upstream.name)
+			if canRetry && r.Context().Err() == nil {
+				retry = true
+				return
+			}
+			log.Printf("Upstream request to %s failed: %v", upstream.name, err)
+			respondJSON(w, http.StatusBadGateway, map[string]string{"message": "Upstream request failed", "error": err.Error()})
+		},
+	}
+	rp.ServeHTTP(w, r)
+	return retry
+}
+
+// estimateStreamUsage counts the completion tokens of a stream that reported no usage from
+// its deltas. Prompt tokens are left at zero rather than guessed from the request.
+func estimateStreamUsage(provider proxyProvider, usage proxyUsage, model string, body []byte) (proxyUsage, bool) {
+	if usage.Model == "" {
+		usage.Model = model
+	}
+	usage.CompletionTokens = estimateTokens(provider.streamText(body))
+	if usage.CompletionTokens == 0 {
+		return usage, false
+	}
+	debugf("Estimated %d completion tokens for a %s stream without usage\n", usage.CompletionTokens, usage.Model)
+	return usage, true
+}
+
+// recordProxyUsage records usage served by the named upstream, with the project scope of ctx
+func recordProxyUsage(ctx context.Context, provider string, usage proxyUsage, caller proxyCaller) {
+	if usage.Model == "" || usage.total() == 0 {
+		return
+	}
+	today := time.Now().Truncate(24 * time.Hour)
+	record := TokenUsage{Date: today, Model: usage.Model, Project: caller.project, TotalTokens: usage.total(), UsageMeasures: UsageMeasures{Requests: 1}, Cost: usage.Cost,
+		UsageBreakdown: UsageBreakdown{Provider: provider, PromptTokens: usage.PromptTokens, CompletionTokens: usage.CompletionTokens}}
+	source := "proxy-" + provider
+	records, err := transformUsage(ctx, record, source)
+	if err != nil {
+		log.Printf("Failed to transform %s proxy usage for %s, recording it as measured: %v", provider, usage.Model, err)
+		records = []TokenUsage{record}
+	}
+	if len(records) == 0 {
+		return
+	}
+	stored := false
+	for _, record := range records {
+		stored = storeProxyUsage(ctx, source, record) || stored
+	}
+	// The upstream, attribution and conversation tables keep what the upstream served
+	if stored {
+		if err := recordUpstreamUsage(provider, today, usage.Model, usage.total()); err != nil {
+			log.Printf("Failed to record usage for upstream %s: %v", provider, err)
+		}
+		if caller.feature != "" || caller.user != "" {
+			if err := recordAttribution(ctx, caller, today, usage); err != nil {
+				log.Printf("Failed to record usage for feature %q and user %q: %v", caller.feature, caller.user, err)
+			}
+		}
+		if caller.conversation != "" {
+			if err := recordConversation(ctx, caller, today, usage); err != nil {
+				log.Printf("Failed to record usage for conversation %q: %v", caller.conversation, err)
+			}
+		}
+	}
+}
+
+// storeProxyUsage adds a proxied record, buffering it while the database is unavailable, and
+// reports whether it was stored directly, which is when the side tables are written too
+func storeProxyUsage(ctx context.Context, source string, record TokenUsage) bool {
+	if dbHealth.available() && !pendingWrites.active() {
+		err := addTokenUsage(ctx, record)
+		if err == nil {
+			usageRecorded(UsageEvent{
+				Date:             record.Date,
+				Model:            record.Model,
+				Project:          record.Project,
+				Source:           source,
+				PromptTokens:     record.PromptTokens,
+				CompletionTokens: record.CompletionTokens,
+				TotalTokens:      record.TotalTokens,
+				Cost:             record.Cost,
+			})
+			return true
+		}
+		log.Printf("Failed to record %s usage for %s: %v", source, record.Model, err)
+		if !isUnavailable(err) {
+			deadLetter("add", source, record, err)
+			return false
+		}
+		dbHealth.trip(err)
+	}
+	// Only the usage record is buffered: the upstream, attribution and conversation totals are
+	// side tables, best effort like payload samples, and are skipped for usage served while the
+	// database is down
+	if err := pendingWrites.enqueue(DeadLetter{Mode: "add", Source: source, Usage: record}); err != nil {
+		deadLetter("add", source, record, err)
+	}
+	return false
+}
+
+// capturingBody copies what the client reads and hands the full body to onDone once
+type capturingBody struct {
+	io.ReadCloser
+	buf    bytes.Buffer
+	once   sync.Once
+	onDone func([]byte)
+}
+
+func (c *capturingBody) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	if n > 0 && c.buf.Len() < maxCapturedBody {
+		c.buf.Write(p[:n])
+	}
+	if err == io.EOF {
+		c.finish()
+	}
+	return n, err
+}
+
+func (c *capturingBody) Close() error {
+	c.finish()
+	return c.ReadCloser.Close()
+}
+
+func (c *capturingBody) finish() {
+	c.once.Do(func() { go c.onDone(c.buf.Bytes()) })
+}
+
+// bodyRequestModel reads the "model" field of an OpenAI-style JSON request body
+func bodyRequestModel(path string, body []byte) string {
+	var req struct {
+		Model string `json:"model"`
+	}
+	json.Unmarshal(body, &req)
+	return req.Model
+}
+
+// bodyRewriteModel replaces the "model" field of an OpenAI-style JSON request body
+func bodyRewriteModel(path string, body []byte, model string) (string, []byte) {
+	var req map[string]json.RawMessage
+	if err := json.Unmarshal(body, &req); err != nil {
+		return path, body
+	}
+	req["model"], _ = json.Marshal(model)
+	rewritten, err := json.Marshal(req)
+	if err != nil {
+		return path, body
+	}
+	return path, rewritten
+}
+
+// jsonPayloads splits a response body into its JSON documents: a single object,
+// the elements of a JSON array, or the data lines of a server-sent event stream.
+func jsonPayloads(body []byte) [][]byte {
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) == 0 {
+		return nil
+	}
+	switch trimmed[0] {
+	case '{':
+		return [][]byte{trimmed}
+	case '[':
+		var items []json.RawMessage
+		if err := json.Unmarshal(trimmed, &items); err != nil {
+			return nil
+		}
+		out := make([][]byte, len(items))
+		for i, item := range items {
+			out[i] = item
+		}
+		return out
+	}
+	var out [][]byte
+	for _, line := range bytes.Split(trimmed, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if !bytes.HasPrefix(line, []byte("data:")) {
+			continue
+		}
+		data := bytes.TrimSpace(line[len("data:"):])
+		if len(data) > 0 && data[0] == '{' {
+			out = append(out, data)
+		}
+	}
+	return out
+}
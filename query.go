@@ -0,0 +1,99 @@
+// query.go
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/lib/pq"
+)
+
+// maxBulkQueries caps how many (model, range) pairs one POST /token_usage/query may ask for
+const maxBulkQueries = 500
+
+// UsageQuery is one cell of a bulk query. The range is given as start/end (YYYY-MM-DD) or a
+// period, as for GET /token_usage/matrix; Project optionally narrows it to one project.
+type UsageQuery struct {
+	Model   string `json:"model"`
+	Project string `json:"project,omitempty"`
+	Start   string `json:"start,omitempty"`
+	End     string `json:"end,omitempty"`
+	Period  string `json:"period,omitempty"`
+}
+
+// UsageQueryResult answers one UsageQuery, in request order
+type UsageQueryResult struct {
+	Model       string  `json:"model"`
+	Project     string  `json:"project,omitempty"`
+	Start       string  `json:"start"`
+	End         string  `json:"end"`
+	TotalTokens int64   `json:"total_tokens"`
+	Cost        float64 `json:"cost"`
+}
+
+// queryTokenUsage answers many (model, date range) totals with a single database round trip
+func queryTokenUsage(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Queries []UsageQuery `json:"queries"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request payload", err)
+		return
+	}
+	if len(req.Queries) == 0 || len(req.Queries) > maxBulkQueries {
+		respondJSON(w, http.StatusBadRequest, map[string]string{"message": fmt.Sprintf("Send between 1 and %d queries", maxBulkQueries)})
+		return
+	}
+
+	results := make([]UsageQueryResult, len(req.Queries))
+	models := make([]string, len(req.Queries))
+	projects := make([]string, len(req.Queries))
+	starts := make([]string, len(req.Queries))
+	ends := make([]string, len(req.Queries))
+	for i, q := range req.Queries {
+		if q.Model == "" {
+			respondJSON(w, http.StatusBadRequest, map[string]string{"message": fmt.Sprintf("Query %d has no model", i)})
+			return
+		}
+		start, end, err := parseDateRange(url.Values{"start": {q.Start}, "end": {q.End}, "period": {q.Period}}, "month")
+		if err != nil {
+			respondError(w, http.StatusBadRequest, fmt.Sprintf("Invalid date range in query %d", i), err)
+			return
+		}
+		models[i], projects[i] = q.Model, q.Project
+		starts[i], ends[i] = start.Format("2006-01-02"), end.Format("2006-01-02")
+		results[i] = UsageQueryResult{Model: q.Model, Project: q.Project, Start: starts[i], End: ends[i]}
+	}
+
+	rows, err := db.QueryContext(r.Context(), `
+        SELECT q.i, COALESCE(SUM(u.total_tokens), 0), `+usageCostMicrosSum+`
+        FROM unnest($1::TEXT[], $2::TEXT[], $3::DATE[], $4::DATE[]) WITH ORDINALITY AS q(model, project, start_date, end_date, i)
+        LEFT JOIN token_usage u ON u.model = q.model AND u.date >= q.start_date AND u.date <= q.end_date
+            AND (q.project = '' OR u.project = q.project)
+        `+usagePriceJoin+`
+        GROUP BY q.i`,
+		pq.Array(models), pq.Array(projects), pq.Array(starts), pq.Array(ends))
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database query error", err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var i int
+		var tokens, cost int64
+		if err := rows.Scan(&i, &tokens, &cost); err != nil {
+			respondError(w, http.StatusInternalServerError, "Error scanning row", err)
+			return
+		}
+		// WITH ORDINALITY counts from 1
+		results[i-1].TotalTokens = tokens
+		results[i-1].Cost = costFromMicros(cost)
+	}
+	if err = rows.Err(); err != nil {
+		respondError(w, http.StatusInternalServerError, "Error reading data", err)
+		return
+	}
+	respondJSON(w, http.StatusOK, results)
+}
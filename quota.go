@@ -0,0 +1,229 @@
+// quota.go
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// BudgetExceeded describes the enforced budget that would be overrun by a request
+type BudgetExceeded struct {
+	Error    string `json:"error"`
+	Message  string `json:"message"`
+	BudgetID int    `json:"budget_id"`
+	Model    string `json:"model"`
+	Period   string `json:"period"`
+	// LimitTokens includes CarriedOverTokens
+	LimitTokens       int64 `json:"limit_tokens"`
+	CarriedOverTokens int64 `json:"carried_over_tokens"`
+	UsedTokens        int64 `json:"used_tokens"`
+	RequestedTokens   int64 `json:"requested_tokens"`
+}
+
+// scopedView is what a caller scoped to a project is told of an exceeded budget: the budget
+// counts every project's usage, which the caller must not see
+func (e *BudgetExceeded) scopedView() map[string]interface{} {
+	return map[string]interface{}{"error": e.Error, "message": e.Message, "budget_id": e.BudgetID, "model": e.Model,
+		"period": e.Period, "requested_tokens": e.RequestedTokens}
+}
+
+// enforceBudgets returns the first enforced budget for the model that would be exceeded
+// by spending the requested tokens, or nil if the request may proceed. Budgets cap the model
+// across projects, so it counts every project's usage whatever the caller's scope.
+func enforceBudgets(model string, tokens int64) (*BudgetExceeded, error) {
+	ctx := context.Background()
+	budgets, err := loadBudgets(ctx, "SELECT "+budgetColumns+" FROM budgets WHERE model = $1 AND enforce ORDER BY id", model)
+	if err != nil {
+		return nil, err
+	}
+	today := time.Now().Truncate(24 * time.Hour)
+	for _, b := range budgets {
+		cycle, used, err := budgetUsage(ctx, b, today)
+		if err != nil {
+			return nil, err
+		}
+		if used+tokens > cycle.Limit {
+			return &BudgetExceeded{
+				Error:             "budget_exceeded",
+				Message:           fmt.Sprintf("Request would exceed the %s budget for %s", b.Period, b.Model),
+				BudgetID:          b.ID,
+				Model:             b.Model,
+				Period:            b.Period,
+				LimitTokens:       cycle.Limit,
+				CarriedOverTokens: cycle.CarriedOver,
+				UsedTokens:        used,
+				RequestedTokens:   tokens,
+			}, nil
+		}
+	}
+	return nil, nil
+}
+
+// checkQuota lets callers ask whether spending tokens on a model is allowed before doing so
+func checkQuota(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Model  string `json:"model"`
+		Tokens int64  `json:"tokens"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request payload", err)
+		return
+	}
+	if req.Model == "" || req.Tokens < 0 {
+		respondJSON(w, http.StatusBadRequest, map[string]string{"message": "model is required and tokens must not be negative"})
+		return
+	}
+	exceeded, err := enforceBudgets(req.Model, req.Tokens)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database query error", err)
+		return
+	}
+	if exceeded != nil {
+		if _, ok := projectScope(r.Context()); ok {
+			respondJSON(w, http.StatusTooManyRequests, exceeded.scopedView())
+			return
+		}
+		respondJSON(w, http.StatusTooManyRequests, exceeded)
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{"allowed": true})
+}
+
+// quotaMaxAge is how long clients may cache GET /quota/remaining. Budgets are soft limits
+// here, so a slightly stale answer is worth saving a round trip per request.
+const quotaMaxAge = 15 * time.Second
+
+// BudgetRemaining is what is left of a model's token budget in its current cycle. LimitTokens
+// includes CarriedOverTokens; rolling budgets have a WindowDays and no ResetsOn.
+type BudgetRemaining struct {
+	BudgetID          int     `json:"budget_id"`
+	Period            string  `json:"period"`
+	WindowDays        int     `json:"window_days,omitempty"`
+	Enforced          bool    `json:"enforced"`
+	CycleStart        string  `json:"cycle_start"`
+	LimitTokens       int64   `json:"limit_tokens"`
+	CarriedOverTokens int64   `json:"carried_over_tokens"`
+	UsedTokens        int64   `json:"used_tokens"`
+	RemainingTokens   int64   `json:"remaining_tokens"`
+	PercentUsed       float64 `json:"percent_used"`
+	ResetsOn          string  `json:"resets_on,omitempty"`
+}
+
+// scopedView is what a caller scoped to a project is told of a budget: how much of it is left,
+// without the usage of every project it counts
+func (b BudgetRemaining) scopedView() map[string]interface{} {
+	view := map[string]interface{}{"budget_id": b.BudgetID, "period": b.Period, "enforced": b.Enforced,
+		"remaining_tokens": b.RemainingTokens, "percent_used": b.PercentUsed}
+	if b.WindowDays > 0 {
+		view["window_days"] = b.WindowDays
+	}
+	if b.ResetsOn != "" {
+		view["resets_on"] = b.ResetsOn
+	}
+	return view
+}
+
+// ProjectRemaining is what is left of a project's monthly spend budget
+type ProjectRemaining struct {
+	BudgetUSD    float64 `json:"budget_usd"`
+	SpendUSD     float64 `json:"spend_usd"`
+	RemainingUSD float64 `json:"remaining_usd"`
+	PercentUsed  float64 `json:"percent_used"`
+	ResetsOn     string  `json:"resets_on"`
+}
+
+// getQuotaRemaining reports the headroom left under the budgets of ?model= and the monthly
+// budget of ?project=, so clients can degrade gracefully, e.g. switch to a smaller model, as
+// limits approach. remaining_tokens is the tightest of the model's budgets. It takes a query
+// per budget and one for the project, and may be cached for quotaMaxAge. The model's budgets
+// count every project's usage, as enforceBudgets does, so callers scoped to a project only see
+// what is left of them.
+func getQuotaRemaining(w http.ResponseWriter, r *http.Request) {
+	model, project := r.URL.Query().Get("model"), r.URL.Query().Get("project")
+	if model == "" && project == "" {
+		respondJSON(w, http.StatusBadRequest, map[string]string{"message": "model or project is required"})
+		return
+	}
+	today := time.Now().Truncate(24 * time.Hour)
+	monthStart, _ := periodStart("month", today)
+	out := map[string]interface{}{"model": model, "project": project}
+
+	if model != "" {
+		ctx := context.Background()
+		stored, err := loadBudgets(ctx, "SELECT "+budgetColumns+" FROM budgets WHERE model = $1 ORDER BY id", model)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, "Database query error", err)
+			return
+		}
+		_, scoped := projectScope(r.Context())
+		budgets := []interface{}{}
+		var tightest *int64
+		for _, sb := range stored {
+			cycle, used, err := budgetUsage(ctx, sb, today)
+			if err != nil {
+				respondError(w, http.StatusInternalServerError, "Database query error", err)
+				return
+			}
+			b := BudgetRemaining{
+				BudgetID:          sb.ID,
+				Period:            sb.Period,
+				WindowDays:        sb.WindowDays,
+				Enforced:          sb.Enforce,
+				CycleStart:        cycle.Start.Format("2006-01-02"),
+				LimitTokens:       cycle.Limit,
+				CarriedOverTokens: cycle.CarriedOver,
+				UsedTokens:        used,
+				RemainingTokens:   max(cycle.Limit-used, 0),
+				PercentUsed:       float64(used) / float64(cycle.Limit) * 100,
+			}
+			if cycle.ResetsOn != nil {
+				b.ResetsOn = cycle.ResetsOn.Format("2006-01-02")
+			}
+			if tightest == nil || b.RemainingTokens < *tightest {
+				tightest = &b.RemainingTokens
+			}
+			if scoped {
+				budgets = append(budgets, b.scopedView())
+			} else {
+				budgets = append(budgets, b)
+			}
+		}
+		out["budgets"] = budgets
+		out["remaining_tokens"] = tightest
+	}
+
+	if project != "" {
+		var budget sql.NullFloat64
+		var spend int64
+		err := db.QueryRowContext(r.Context(), `
+            SELECT pr.monthly_budget_usd, (SELECT `+usageCostMicrosSum+`
+                FROM token_usage u `+usagePriceJoin+`
+                WHERE u.project = pr.name AND u.date >= $2)
+            FROM projects pr WHERE pr.name = $1`, project, monthStart).Scan(&budget, &spend)
+		if err != nil && err != sql.ErrNoRows {
+			respondError(w, http.StatusInternalServerError, "Database query error", err)
+			return
+		}
+		// Unknown projects and projects without a budget have no limit to report
+		var remaining *ProjectRemaining
+		if budget.Valid {
+			remaining = &ProjectRemaining{
+				BudgetUSD:    budget.Float64,
+				SpendUSD:     costFromMicros(spend),
+				RemainingUSD: costFromMicros(max(toMicros(budget.Float64)-spend, 0)),
+				ResetsOn:     monthStart.AddDate(0, 1, 0).Format("2006-01-02"),
+			}
+			if budget.Float64 > 0 {
+				remaining.PercentUsed = float64(spend) / float64(toMicros(budget.Float64)) * 100
+			}
+		}
+		out["project_budget"] = remaining
+	}
+
+	w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int(quotaMaxAge.Seconds())))
+	respondJSON(w, http.StatusOK, out)
+}
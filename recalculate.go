@@ -0,0 +1,145 @@
+// recalculate.go
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// UsageRecalculation is a daily total that differs from the sum of its logged requests
+type UsageRecalculation struct {
+	Date                string   `json:"date"`
+	Model               string   `json:"model"`
+	Project             string   `json:"project"`
+	PreviousTotalTokens *int64   `json:"previous_total_tokens"`
+	TotalTokens         int64    `json:"total_tokens"`
+	PreviousCost        *float64 `json:"previous_cost"`
+	Cost                *float64 `json:"cost"`
+	PreviousRequests    *int64   `json:"previous_requests"`
+	Requests            int64    `json:"requests"`
+}
+
+// findDrift compares the daily totals in a range with the request log. Only days and keys the
+// log fully covers are considered: keys with no logged requests come from reporters, which send
+// totals rather than requests, and the day the log started holds requests it never saw.
+// Sealed days are left alone. Requests are counted from the log too, unless it holds increments
+// logged before it counted them; the other measures aren't logged and are kept as stored.
+func findDrift(ctx context.Context, start, end time.Time, model string) ([]UsageRecalculation, error) {
+	rows, err := db.QueryContext(ctx, `
+        WITH logged AS (
+            SELECT date, model, project, SUM(total_tokens) AS total_tokens,
+                CASE WHEN COUNT(cost) = COUNT(*) THEN SUM(ROUND(cost::NUMERIC, 6))::DOUBLE PRECISION END AS cost,
+                CASE WHEN COUNT(requests) = COUNT(*) THEN SUM(requests) END AS requests
+            FROM usage_requests
+            WHERE date >= $1 AND date <= $2 AND ($3 = '' OR model = $3)
+                AND date > (SELECT MIN(logged_at)::date FROM usage_requests)
+                AND date NOT IN (SELECT date FROM usage_day_hashes)
+            GROUP BY date, model, project
+        ), stored AS (
+            SELECT date, model, project, SUM(total_tokens) AS total_tokens,
+                CASE WHEN COUNT(cost) = COUNT(*) THEN SUM(ROUND(cost::NUMERIC, 6))::DOUBLE PRECISION END AS cost,
+                SUM(requests) AS requests, COUNT(*) AS n
+            FROM token_usage
+            WHERE date >= $1 AND date <= $2 AND ($3 = '' OR model = $3)
+            GROUP BY date, model, project
+        )
+        SELECT l.date, l.model, l.project, s.total_tokens, l.total_tokens, s.cost, l.cost, s.requests, COALESCE(l.requests, s.requests, 0)
+        FROM logged l LEFT JOIN stored s USING (date, model, project)
+        WHERE s.total_tokens IS DISTINCT FROM l.total_tokens OR s.cost IS DISTINCT FROM l.cost
+            OR s.requests IS DISTINCT FROM COALESCE(l.requests, s.requests) OR s.n > 1
+        ORDER BY l.date, l.model, l.project`, start, end, model)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	drift := []UsageRecalculation{}
+	for rows.Next() {
+		var d UsageRecalculation
+		var date time.Time
+		if err := rows.Scan(&date, &d.Model, &d.Project, &d.PreviousTotalTokens, &d.TotalTokens, &d.PreviousCost, &d.Cost, &d.PreviousRequests, &d.Requests); err != nil {
+			return nil, err
+		}
+		d.Date = date.Format("2006-01-02")
+		drift = append(drift, d)
+	}
+	return drift, rows.Err()
+}
+
+// recalculateUsage rebuilds the daily totals in ?start=&end= from the request log, fixing
+// drift left by imports, replays or manual edits. ?model= narrows it to one model, and dry_run
+// reports the changes without making them. The range is required, as rebuilding is not
+// something to do to all of history by accident.
+func recalculateUsage(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("start") == "" {
+		respondJSON(w, http.StatusBadRequest, map[string]string{"message": "start is required"})
+		return
+	}
+	start, end, err := parseDateRange(r.URL.Query(), "month")
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid date range", err)
+		return
+	}
+	drift, err := findDrift(r.Context(), start, end, r.URL.Query().Get("model"))
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database query error", err)
+		return
+	}
+	if isDryRun(r) {
+		respondJSON(w, http.StatusOK, map[string]interface{}{"dry_run": true, "changes": drift})
+		return
+	}
+	for _, d := range drift {
+		date, _ := time.Parse("2006-01-02", d.Date)
+		if err := ensurePartition(r.Context(), date); err != nil {
+			respondError(w, http.StatusInternalServerError, "Failed to create partition", err)
+			return
+		}
+	}
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to start transaction", err)
+		return
+	}
+	defer tx.Rollback()
+	for _, d := range drift {
+		if err := rebuildTotal(r.Context(), tx, d); err != nil {
+			respondError(w, http.StatusInternalServerError, "Failed to recalculate usage", err)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to commit recalculation", err)
+		return
+	}
+	infof("Recalculated %d daily totals from %s to %s\n", len(drift), start.Format("2006-01-02"), end.Format("2006-01-02"))
+	respondJSON(w, http.StatusOK, map[string]interface{}{"dry_run": false, "changes": drift})
+}
+
+// rebuildTotal writes a recalculated total into the oldest row for its key, removing any
+// duplicates, or inserts the row if the key has none. The measures the log doesn't hold are
+// summed over the duplicates into the row kept.
+func rebuildTotal(ctx context.Context, tx *sql.Tx, d UsageRecalculation) error {
+	var id int64
+	err := tx.QueryRowContext(ctx, "SELECT id FROM token_usage WHERE date = $1 AND model = $2 AND project = $3 ORDER BY id LIMIT 1", d.Date, d.Model, d.Project).Scan(&id)
+	if err == sql.ErrNoRows {
+		_, err = tx.ExecContext(ctx, "INSERT INTO token_usage (date, model, project, total_tokens, cost, requests) VALUES ($1, $2, $3, $4, $5, $6)",
+			d.Date, d.Model, d.Project, d.TotalTokens, d.Cost, d.Requests)
+		return err
+	} else if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE token_usage u SET total_tokens = $1, cost = $2, requests = $5,
+            characters = m.characters, credits = m.credits, prompt_tokens = m.prompt_tokens, completion_tokens = m.completion_tokens
+        FROM (SELECT SUM(characters) AS characters, SUM(credits) AS credits, SUM(prompt_tokens) AS prompt_tokens, SUM(completion_tokens) AS completion_tokens
+            FROM token_usage WHERE date = $4 AND model = $6 AND project = $7) m
+        WHERE u.id = $3 AND u.date = $4`, d.TotalTokens, d.Cost, id, d.Date, d.Requests, d.Model, d.Project); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM token_usage WHERE date = $1 AND model = $2 AND project = $3 AND id <> $4", d.Date, d.Model, d.Project, id); err != nil {
+		return fmt.Errorf("removing duplicates of %s %s: %w", d.Date, d.Model, err)
+	}
+	return nil
+}
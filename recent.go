@@ -0,0 +1,141 @@
+// recent.go
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Every record ingested through the API or a webhook is noted in recent_ingestions with who
+// sent it, so an operator setting up a reporter can see its records arrive with GET
+// /token_usage/recent. Proxied requests are left out, as they would drown the reporters. Notes
+// are kept for a day; records buffered while the database was down are not noted.
+
+// RecentIngestion is a record as it was received
+type RecentIngestion struct {
+	ID          int64     `json:"id"`
+	ReceivedAt  time.Time `json:"received_at"`
+	Date        string    `json:"date"`
+	Model       string    `json:"model"`
+	Project     string    `json:"project"`
+	TotalTokens int64     `json:"total_tokens"`
+	Source      string    `json:"source"`
+	// Key ends with the last characters of the project key the record came with, if any
+	Key string `json:"key,omitempty"`
+	// Caller is who another authentication provider identified the sender as
+	Caller    string `json:"caller,omitempty"`
+	IP        string `json:"ip"`
+	UserAgent string `json:"user_agent,omitempty"`
+}
+
+const (
+	recentIngestionRetention = 24 * time.Hour
+	defaultRecentLimit       = 100
+	maxRecentLimit           = 1000
+)
+
+// noteIngestion notes a record received with r and stored. A failure is only logged, as the
+// record itself is stored.
+func noteIngestion(r *http.Request, usage TokenUsage, source string) {
+	var key, caller string
+	if use, ok := r.Context().Value(keyUseKey{}).(*keyUse); ok && use.key != "" {
+		key = keyHint(use.key)
+	} else if p := requestPrincipal(r.Context()); p != nil {
+		caller = p.Subject
+	}
+	_, err := db.ExecContext(r.Context(), `INSERT INTO recent_ingestions (date, model, project, total_tokens, source, key_hint, caller, ip, user_agent)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+		usage.Date, usage.Model, usage.Project, usage.TotalTokens, source, key, caller, clientIP(r), r.UserAgent())
+	if err != nil {
+		log.Printf("Failed to note ingestion of %s usage: %v", usage.Model, err)
+	}
+}
+
+// keyHint keeps the last four characters of a key, enough to tell keys apart
+func keyHint(key string) string {
+	if len(key) <= 8 {
+		return "…"
+	}
+	return "…" + key[len(key)-4:]
+}
+
+// clientIP is the address r came from. Behind the gateways listed as trusted proxies it is the
+// last address in X-Forwarded-For that isn't one of them; addresses before it could have been
+// made up by the client.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	nets, _ := parseTrustedProxies(currentConfig.Load().Auth.TrustedHeader.TrustedProxies)
+	proxies := trustedHeaders{proxies: nets}
+	forwarded := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(forwarded) - 1; i >= 0 && proxies.trustedIP(host); i-- {
+		if hop := strings.TrimSpace(forwarded[i]); hop != "" {
+			host = hop
+		}
+	}
+	return host
+}
+
+// getRecentIngestions lists the latest records received, newest first, ?limit= of them (100
+// by default, at most 1000). ?model=, ?project= and ?source= narrow them down.
+func getRecentIngestions(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	limit := defaultRecentLimit
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxRecentLimit {
+			respondJSON(w, http.StatusBadRequest, map[string]string{"message": "limit must be between 1 and " + strconv.Itoa(maxRecentLimit)})
+			return
+		}
+		limit = n
+	}
+	rows, err := db.QueryContext(r.Context(), `
+        SELECT id, received_at, date, model, project, total_tokens, source, key_hint, caller, ip, user_agent
+        FROM recent_ingestions
+        WHERE ($1 = '' OR model = $1) AND ($2 = '' OR project = $2) AND ($3 = '' OR source = $3)
+        ORDER BY id DESC LIMIT $4`, q.Get("model"), q.Get("project"), q.Get("source"), limit)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database query error", err)
+		return
+	}
+	defer rows.Close()
+	out := []RecentIngestion{}
+	for rows.Next() {
+		var e RecentIngestion
+		var date time.Time
+		if err := rows.Scan(&e.ID, &e.ReceivedAt, &date, &e.Model, &e.Project, &e.TotalTokens, &e.Source, &e.Key, &e.Caller, &e.IP, &e.UserAgent); err != nil {
+			respondError(w, http.StatusInternalServerError, "Error scanning row", err)
+			return
+		}
+		e.Date = date.Format("2006-01-02")
+		out = append(out, e)
+	}
+	if err = rows.Err(); err != nil {
+		respondError(w, http.StatusInternalServerError, "Error reading data", err)
+		return
+	}
+	respondJSON(w, http.StatusOK, out)
+}
+
+// pruneRecentIngestions is the recent_ingestions job: it forgets notes older than a day, of
+// records stored and of rejected ingestion requests (see sources.go) alike
+func pruneRecentIngestions(ctx context.Context) error {
+	cutoff := time.Now().Add(-recentIngestionRetention)
+	for _, table := range []string{"recent_ingestions", "ingestion_errors"} {
+		res, err := db.ExecContext(ctx, "DELETE FROM "+table+" WHERE received_at < $1", cutoff)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			debugf("Forgot %d %s older than a day\n", n, table)
+		}
+	}
+	return nil
+}
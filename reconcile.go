@@ -0,0 +1,307 @@
+// reconcile.go
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// invoiceColumns lists the accepted CSV header names for each field, per provider.
+// Input and output token columns are summed when no total column is present.
+var invoiceColumns = map[string]map[string][]string{
+	"openai": {
+		"date":   {"date", "usage_date", "start_time", "day"},
+		"model":  {"model", "snapshot_id", "model_id", "line_item"},
+		"tokens": {"total_tokens", "tokens", "n_tokens"},
+		"input":  {"input_tokens", "n_context_tokens_total", "prompt_tokens"},
+		"output": {"output_tokens", "n_generated_tokens_total", "completion_tokens"},
+		"cost":   {"cost", "cost_usd", "amount", "amount_value"},
+	},
+	"anthropic": {
+		"date":   {"date", "usage_date", "day", "starting_at"},
+		"model":  {"model", "model_name", "model_id"},
+		"tokens": {"total_tokens", "tokens"},
+		"input":  {"input_tokens", "uncached_input_tokens", "prompt_tokens"},
+		"output": {"output_tokens", "completion_tokens"},
+		"cost":   {"cost", "cost_usd", "amount", "total_cost"},
+	},
+	// Azure bills per deployment; the model column is resolved through azure_deployments
+	"azure": {
+		"date":   {"date", "usagedate", "usage_date"},
+		"model":  {"deployment", "deployment_name", "deploymentname", "model"},
+		"tokens": {"total_tokens", "tokens", "quantity"},
+		"input":  {"input_tokens", "prompt_tokens"},
+		"output": {"output_tokens", "completion_tokens"},
+		"cost":   {"cost", "costinbillingcurrency", "cost_usd", "pretaxcost"},
+	},
+}
+
+// InvoiceLine is one provider-billed (date, model) aggregate
+type InvoiceLine struct {
+	Provider string    `json:"provider"`
+	Date     time.Time `json:"date"`
+	Model    string    `json:"model"`
+	Tokens   int64     `json:"tokens"`
+	Cost     float64   `json:"cost"`
+}
+
+// ReconciliationRow compares provider-billed usage against recorded usage for one model
+type ReconciliationRow struct {
+	Model          string  `json:"model"`
+	BilledTokens   int64   `json:"billed_tokens"`
+	RecordedTokens int64   `json:"recorded_tokens"`
+	GapTokens      int64   `json:"gap_tokens"`
+	GapPercent     float64 `json:"gap_percent"`
+	BilledCost     float64 `json:"billed_cost"`
+	RecordedCost   float64 `json:"recorded_cost"`
+	GapCost        float64 `json:"gap_cost"`
+	Flagged        bool    `json:"flagged"`
+}
+
+func parseInvoiceDate(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	for _, layout := range []string{"2006-01-02", time.RFC3339, "2006-01-02 15:04:05", "2006-01-02T15:04:05", "01/02/2006"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.Truncate(24 * time.Hour), nil
+		}
+	}
+	if secs, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(secs, 0).UTC().Truncate(24 * time.Hour), nil
+	}
+	return time.Time{}, fmt.Errorf("unrecognized date %q", s)
+}
+
+func parseInvoiceNumber(s string) (float64, error) {
+	s = strings.TrimSpace(strings.NewReplacer("$", "", ",", "").Replace(s))
+	if s == "" {
+		return 0, nil
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+// parseInvoiceCSV reads a billing export and aggregates it into one line per date and model.
+// mapModel, if set, translates the billed name into a model before aggregation.
+func parseInvoiceCSV(provider string, r io.Reader, mapModel func(string) (string, error)) ([]InvoiceLine, error) {
+	aliases, ok := invoiceColumns[provider]
+	if !ok {
+		return nil, fmt.Errorf("unsupported provider %q", provider)
+	}
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("reading header: %w", err)
+	}
+	index := map[string]int{}
+	for field, names := range aliases {
+		index[field] = -1
+		for i, h := range header {
+			h = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(h, "\ufeff")))
+			for _, name := range names {
+				if h == name && index[field] < 0 {
+					index[field] = i
+				}
+			}
+		}
+	}
+	if index["date"] < 0 || index["model"] < 0 {
+		return nil, fmt.Errorf("CSV needs a date and a model column")
+	}
+	if index["tokens"] < 0 && index["input"] < 0 && index["output"] < 0 {
+		return nil, fmt.Errorf("CSV needs a token count column")
+	}
+
+	cell := func(record []string, field string) string {
+		if i := index[field]; i >= 0 && i < len(record) {
+			return record[i]
+		}
+		return ""
+	}
+	type key struct {
+		date  time.Time
+		model string
+	}
+	totals := map[key]*InvoiceLine{}
+	line := 1
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		line++
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		date, err := parseInvoiceDate(cell(record, "date"))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		model := strings.TrimSpace(cell(record, "model"))
+		if model == "" {
+			continue
+		}
+		if mapModel != nil {
+			if model, err = mapModel(model); err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+		}
+		var tokens float64
+		if index["tokens"] >= 0 {
+			if tokens, err = parseInvoiceNumber(cell(record, "tokens")); err != nil {
+				return nil, fmt.Errorf("line %d: invalid token count: %w", line, err)
+			}
+		} else {
+			for _, field := range []string{"input", "output"} {
+				n, err := parseInvoiceNumber(cell(record, field))
+				if err != nil {
+					return nil, fmt.Errorf("line %d: invalid token count: %w", line, err)
+				}
+				tokens += n
+			}
+		}
+		cost, err := parseInvoiceNumber(cell(record, "cost"))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid cost: %w", line, err)
+		}
+		k := key{date, model}
+		if totals[k] == nil {
+			totals[k] = &InvoiceLine{Provider: provider, Date: date, Model: model}
+		}
+		totals[k].Tokens += int64(tokens)
+		// Summed in micro-dollars so the total matches the invoice's
+		totals[k].Cost = float64(toMicros(totals[k].Cost)+toMicros(cost)) / microsPerDollar
+	}
+
+	lines := make([]InvoiceLine, 0, len(totals))
+	for _, l := range totals {
+		lines = append(lines, *l)
+	}
+	sort.Slice(lines, func(i, j int) bool {
+		if !lines[i].Date.Equal(lines[j].Date) {
+			return lines[i].Date.Before(lines[j].Date)
+		}
+		return lines[i].Model < lines[j].Model
+	})
+	return lines, nil
+}
+
+// importInvoice stores a provider billing CSV, replacing previously imported lines for the same days and models
+func importInvoice(w http.ResponseWriter, r *http.Request) {
+	provider := strings.ToLower(r.URL.Query().Get("provider"))
+	var mapModel func(string) (string, error)
+	if provider == "azure" {
+		mapModel = func(deployment string) (string, error) {
+			model, ok, err := resolveAzureDeployment(deployment)
+			if err != nil || ok {
+				return model, err
+			}
+			// Leave unmapped deployments visible in the report rather than dropping their usage
+			log.Printf("No model mapped for Azure deployment %s", deployment)
+			return deployment, nil
+		}
+	}
+	lines, err := parseInvoiceCSV(provider, r.Body, mapModel)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid invoice CSV", err)
+		return
+	}
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to start transaction", err)
+		return
+	}
+	defer tx.Rollback()
+	for _, l := range lines {
+		_, err := tx.ExecContext(r.Context(), `INSERT INTO provider_invoice_lines (provider, date, model, tokens, cost) VALUES ($1, $2, $3, $4, $5)
+            ON CONFLICT (provider, date, model) DO UPDATE SET tokens = EXCLUDED.tokens, cost = EXCLUDED.cost, imported_at = NOW()`,
+			l.Provider, l.Date, l.Model, l.Tokens, l.Cost)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, "Failed to store invoice line", err)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to commit invoice", err)
+		return
+	}
+	infof("Imported %d %s invoice lines\n", len(lines), provider)
+	respondJSON(w, http.StatusOK, map[string]interface{}{"message": "Invoice imported successfully", "lines": len(lines)})
+}
+
+// getReconciliation compares a month of provider-billed usage to what was recorded.
+// Models whose recorded tokens fall short of billed tokens by more than the tolerance are flagged.
+func getReconciliation(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	provider := strings.ToLower(q.Get("provider"))
+	if _, ok := invoiceColumns[provider]; !ok {
+		respondJSON(w, http.StatusBadRequest, map[string]string{"message": "Invalid provider. Use 'openai', 'anthropic' or 'azure'"})
+		return
+	}
+	month, err := time.Parse("2006-01", q.Get("month"))
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid month format, use YYYY-MM", err)
+		return
+	}
+	tolerance := 0.05
+	if t := q.Get("tolerance"); t != "" {
+		if tolerance, err = strconv.ParseFloat(t, 64); err != nil || tolerance < 0 {
+			respondJSON(w, http.StatusBadRequest, map[string]string{"message": "Invalid tolerance"})
+			return
+		}
+	}
+	end := month.AddDate(0, 1, 0)
+
+	rows, err := db.QueryContext(r.Context(), `
+        SELECT i.model, i.tokens, i.cost, COALESCE(r.tokens, 0), COALESCE(r.cost, 0)
+        FROM (SELECT model, SUM(tokens) AS tokens, SUM(ROUND(cost * 1000000)::BIGINT)::BIGINT AS cost FROM provider_invoice_lines
+              WHERE provider = $1 AND date >= $2 AND date < $3 GROUP BY model) i
+        LEFT JOIN (SELECT u.model, SUM(u.total_tokens) AS tokens, `+usageCostMicrosSum+` AS cost
+              FROM token_usage u `+usagePriceJoin+`
+              WHERE u.date >= $2 AND u.date < $3 GROUP BY u.model) r ON r.model = i.model
+        ORDER BY i.model`, provider, month, end)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database query error", err)
+		return
+	}
+	defer rows.Close()
+
+	report := []ReconciliationRow{}
+	var billedTotal, recordedTotal int64
+	for rows.Next() {
+		var row ReconciliationRow
+		var billedCost, recordedCost int64
+		if err := rows.Scan(&row.Model, &row.BilledTokens, &billedCost, &row.RecordedTokens, &recordedCost); err != nil {
+			respondError(w, http.StatusInternalServerError, "Error scanning row", err)
+			return
+		}
+		row.GapTokens = row.BilledTokens - row.RecordedTokens
+		if row.BilledTokens > 0 {
+			row.GapPercent = float64(row.GapTokens) / float64(row.BilledTokens) * 100
+		}
+		row.BilledCost, row.RecordedCost = costFromMicros(billedCost), costFromMicros(recordedCost)
+		row.GapCost = costFromMicros(billedCost - recordedCost)
+		row.Flagged = row.GapPercent > tolerance*100
+		billedTotal += row.BilledTokens
+		recordedTotal += row.RecordedTokens
+		report = append(report, row)
+	}
+	if err = rows.Err(); err != nil {
+		respondError(w, http.StatusInternalServerError, "Error reading data", err)
+		return
+	}
+	sort.SliceStable(report, func(i, j int) bool { return report[i].GapTokens > report[j].GapTokens })
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"provider":        provider,
+		"month":           month.Format("2006-01"),
+		"billed_tokens":   billedTotal,
+		"recorded_tokens": recordedTotal,
+		"models":          report,
+	})
+}
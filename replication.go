@@ -0,0 +1,265 @@
+// replication.go
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/XSAM/otelsql"
+)
+
+// Replication copies usage records to a secondary database as a warm standby, without setting
+// up Postgres replication. REPLICA_DATABASE_URL is either another Postgres, which gets the full
+// schema so it can be promoted by pointing DATABASE_URL at it, or "file:" and the path of an
+// embedded data file, which `-storage embedded -data <path>` can serve. The replication job
+// tails token_usage in the order GET /sync pages it, so each run sends what changed since the
+// last. Only usage records are replicated, and rows deleted on the primary stay on the replica
+// until a catch-up with reset=true recopies everything.
+type replicaTarget interface {
+	apply(ctx context.Context, records []TokenUsage) error
+}
+
+// replica is the open replica target; opened on first use and kept for the process
+var replica struct {
+	sync.Mutex
+	target replicaTarget
+	url    string
+}
+
+// ReplicationStatus is replication progress as reported by GET /admin/replication
+type ReplicationStatus struct {
+	Target string `json:"target"`
+	// ReplicatedThrough is the updated_at of the last record copied
+	ReplicatedThrough *time.Time `json:"replicated_through,omitempty"`
+	PendingRecords    int64      `json:"pending_records"`
+	// LagSeconds is how long the oldest record not yet copied has been waiting
+	LagSeconds float64    `json:"lag_seconds"`
+	LastRun    *time.Time `json:"last_run,omitempty"`
+	LastError  string     `json:"last_error,omitempty"`
+}
+
+// replicaDescription shows the target without credentials
+func replicaDescription(url string) string {
+	if path, ok := strings.CutPrefix(url, "file:"); ok {
+		return "embedded file " + path
+	}
+	if i := strings.LastIndex(url, "@"); i >= 0 {
+		return "postgres " + url[i+1:]
+	}
+	return "postgres"
+}
+
+// openReplica connects to the configured replica, creating its schema
+func openReplica() (replicaTarget, error) {
+	url := os.Getenv("REPLICA_DATABASE_URL")
+	replica.Lock()
+	defer replica.Unlock()
+	if replica.target != nil && replica.url == url {
+		return replica.target, nil
+	}
+	if path, ok := strings.CutPrefix(url, "file:"); ok {
+		s, err := openBoltStore(path)
+		if err != nil {
+			return nil, err
+		}
+		replica.target, replica.url = boltReplica{s}, url
+		return replica.target, nil
+	}
+	rdb, err := otelsql.Open("postgres", url)
+	if err != nil {
+		return nil, err
+	}
+	for _, stmt := range schemaStatements {
+		if _, err := rdb.Exec(stmt); err != nil {
+			rdb.Close()
+			return nil, fmt.Errorf("creating replica schema: %w", err)
+		}
+	}
+	replica.target, replica.url = postgresReplica{rdb}, url
+	return replica.target, nil
+}
+
+type postgresReplica struct {
+	db *sql.DB
+}
+
+// apply writes records as they are on the primary, keeping their ids, and moves the id
+// sequence past them so the replica can take writes once promoted
+func (p postgresReplica) apply(ctx context.Context, records []TokenUsage) error {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, u := range records {
+		_, err := tx.ExecContext(ctx, `INSERT INTO token_usage (id, date, model, project, total_tokens, cost, requests, characters, credits, created_at, updated_at)
+            VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+            ON CONFLICT (id, date) DO UPDATE SET model = EXCLUDED.model, project = EXCLUDED.project, total_tokens = EXCLUDED.total_tokens,
+                cost = EXCLUDED.cost, requests = EXCLUDED.requests, characters = EXCLUDED.characters, credits = EXCLUDED.credits,
+                updated_at = EXCLUDED.updated_at`,
+			u.ID, u.Date, u.Model, u.Project, u.TotalTokens, u.Cost, u.Requests, u.Characters, u.Credits, u.CreatedAt, u.UpdatedAt)
+		if err != nil {
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, "SELECT setval(pg_get_serial_sequence('token_usage', 'id'), GREATEST(MAX(id), 1)) FROM token_usage"); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+type boltReplica struct {
+	s *boltStore
+}
+
+// apply replaces each record's row in the file. Unlike SetUsage it raises no usage events:
+// the primary has already reported the usage.
+func (b boltReplica) apply(ctx context.Context, records []TokenUsage) error {
+	for _, u := range records {
+		_, _, err := b.s.update(u, func(row *TokenUsage) (TokenUsage, int, bool) {
+			if row == nil {
+				return u, 0, true
+			}
+			row.TotalTokens, row.Cost, row.UsageMeasures = u.TotalTokens, u.Cost, u.UsageMeasures
+			return *row, 0, true
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replicate copies everything changed since the last run to the replica and returns how many
+// records it sent
+func replicate(ctx context.Context) (int, error) {
+	target, err := openReplica()
+	if err != nil {
+		return 0, err
+	}
+	var cursor string
+	err = db.QueryRowContext(ctx, "SELECT cursor FROM replication_state WHERE id = 1").Scan(&cursor)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, err
+	}
+	copied := 0
+	for {
+		var since time.Time
+		sinceID := 0
+		if cursor != "" {
+			if since, sinceID, err = decodeSyncCursor(cursor); err != nil {
+				return copied, err
+			}
+		}
+		records, hasMore, err := syncPage(ctx, since, sinceID, syncMaxLimit)
+		if err != nil || len(records) == 0 {
+			return copied, err
+		}
+		if err := target.apply(ctx, records); err != nil {
+			return copied, fmt.Errorf("writing to replica: %w", err)
+		}
+		last := records[len(records)-1]
+		cursor = encodeSyncCursor(*last.UpdatedAt, last.ID)
+		_, err = db.ExecContext(ctx, `INSERT INTO replication_state (id, cursor, replicated_through) VALUES (1, $1, $2)
+            ON CONFLICT (id) DO UPDATE SET cursor = EXCLUDED.cursor, replicated_through = EXCLUDED.replicated_through`, cursor, last.UpdatedAt)
+		if err != nil {
+			return copied, err
+		}
+		copied += len(records)
+		if !hasMore {
+			return copied, nil
+		}
+	}
+}
+
+// recordReplicationRun notes the outcome of a run for GET /admin/replication
+func recordReplicationRun(ctx context.Context, runErr error) error {
+	message := ""
+	if runErr != nil {
+		message = runErr.Error()
+	}
+	_, err := db.ExecContext(ctx, `INSERT INTO replication_state (id, cursor, last_run, last_error) VALUES (1, '', NOW(), $1)
+        ON CONFLICT (id) DO UPDATE SET last_run = NOW(), last_error = EXCLUDED.last_error`, message)
+	return err
+}
+
+// replicationJob is the replication job
+func replicationJob(ctx context.Context) error {
+	if os.Getenv("REPLICA_DATABASE_URL") == "" {
+		return nil
+	}
+	n, err := replicate(ctx)
+	if dbErr := recordReplicationRun(ctx, err); dbErr != nil && err == nil {
+		err = dbErr
+	}
+	if n > 0 {
+		debugf("Replicated %d usage records\n", n)
+	}
+	return err
+}
+
+func getReplicationStatus(w http.ResponseWriter, r *http.Request) {
+	url := os.Getenv("REPLICA_DATABASE_URL")
+	if url == "" {
+		respondJSON(w, http.StatusNotFound, map[string]string{"message": "Replication is not configured; set REPLICA_DATABASE_URL"})
+		return
+	}
+	status := ReplicationStatus{Target: replicaDescription(url)}
+	var cursor string
+	err := db.QueryRowContext(r.Context(), "SELECT cursor, replicated_through, last_run, last_error FROM replication_state WHERE id = 1").
+		Scan(&cursor, &status.ReplicatedThrough, &status.LastRun, &status.LastError)
+	if err != nil && err != sql.ErrNoRows {
+		respondError(w, http.StatusInternalServerError, "Database query error", err)
+		return
+	}
+	var since time.Time
+	sinceID := 0
+	if cursor != "" {
+		if since, sinceID, err = decodeSyncCursor(cursor); err != nil {
+			respondError(w, http.StatusInternalServerError, "Invalid replication cursor", err)
+			return
+		}
+	}
+	var oldest sql.NullTime
+	err = db.QueryRowContext(r.Context(), "SELECT COUNT(*), MIN(updated_at) FROM token_usage WHERE (updated_at, id) > ($1, $2)", since, sinceID).
+		Scan(&status.PendingRecords, &oldest)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database query error", err)
+		return
+	}
+	if oldest.Valid {
+		status.LagSeconds = time.Since(oldest.Time).Seconds()
+	}
+	respondJSON(w, http.StatusOK, status)
+}
+
+// catchUpReplication replicates everything pending now rather than on the next run. With
+// ?reset=true it starts over and recopies every record, e.g. for a new or rebuilt replica.
+func catchUpReplication(w http.ResponseWriter, r *http.Request) {
+	if os.Getenv("REPLICA_DATABASE_URL") == "" {
+		respondJSON(w, http.StatusNotFound, map[string]string{"message": "Replication is not configured; set REPLICA_DATABASE_URL"})
+		return
+	}
+	if r.URL.Query().Get("reset") == "true" {
+		if _, err := db.ExecContext(r.Context(), "UPDATE replication_state SET cursor = '', replicated_through = NULL WHERE id = 1"); err != nil {
+			respondError(w, http.StatusInternalServerError, "Failed to reset replication", err)
+			return
+		}
+	}
+	n, err := replicate(r.Context())
+	if dbErr := recordReplicationRun(r.Context(), err); dbErr != nil && err == nil {
+		err = dbErr
+	}
+	if err != nil {
+		respondError(w, http.StatusBadGateway, "Replication failed", err)
+		return
+	}
+	infof("Caught up replication with %d records\n", n)
+	respondJSON(w, http.StatusOK, map[string]interface{}{"replicated": n})
+}
@@ -0,0 +1,369 @@
+// reports.go
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// A saved report is a named usage query: model and project filters, a grouping and a default
+// period. GET /reports/{name}/run executes it; a report with a schedule is also sent as a
+// digest to its notification channel by the report_digests job.
+type Report struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	// Models are globs, as in model templates; empty means every model
+	Models   []string `json:"models"`
+	Projects []string `json:"projects"`
+	// GroupBy lists dimensions from reportGroups; empty gives a single total
+	GroupBy []string `json:"group_by"`
+	Period  string   `json:"period"`
+	// Schedule is a cron expression for digests; empty means the report is only run on demand
+	Schedule string `json:"schedule,omitempty"`
+	Channel  string `json:"channel,omitempty"`
+	Target   string `json:"target,omitempty"`
+	// Locale formats the report's digests and CSV exports; empty uses the configured locale
+	Locale string `json:"locale,omitempty"`
+}
+
+// reportGroups maps each group-by dimension to its SQL expression over token_usage u
+var reportGroups = map[string]string{
+	"model":   "u.model",
+	"project": "u.project",
+	"day":     "to_char(u.date, 'YYYY-MM-DD')",
+	"week":    "to_char(date_trunc('week', u.date), 'YYYY-MM-DD')",
+	"month":   "to_char(u.date, 'YYYY-MM')",
+}
+
+const reportColumns = "name, description, models, projects, group_by, period, schedule, channel, target, locale"
+
+func validateReport(report *Report) error {
+	if report.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if report.Period == "" {
+		report.Period = "month"
+	}
+	// Nil slices would be stored as NULL
+	for _, list := range []*[]string{&report.Models, &report.Projects, &report.GroupBy} {
+		if *list == nil {
+			*list = []string{}
+		}
+	}
+	if _, ok := periodStart(report.Period, time.Now()); !ok {
+		return fmt.Errorf("invalid period %q, use 'week', 'month' or 'lifetime'", report.Period)
+	}
+	seen := map[string]bool{}
+	for _, g := range report.GroupBy {
+		if _, ok := reportGroups[g]; !ok {
+			return fmt.Errorf("unknown group_by %q, use model, project, day, week or month", g)
+		}
+		if seen[g] {
+			return fmt.Errorf("group_by %q is repeated", g)
+		}
+		seen[g] = true
+	}
+	if report.Locale != "" {
+		if _, ok := locales[report.Locale]; !ok {
+			return fmt.Errorf("unknown locale %q", report.Locale)
+		}
+	}
+	if report.Schedule == "" {
+		return nil
+	}
+	if _, err := parseCron(report.Schedule); err != nil {
+		return fmt.Errorf("schedule: %w", err)
+	}
+	if err := currentConfig.Load().Notifications.checkChannel(report.Channel, report.Target); err != nil {
+		return err
+	}
+	return nil
+}
+
+func createReport(w http.ResponseWriter, r *http.Request) {
+	var report Report
+	if err := json.NewDecoder(r.Body).Decode(&report); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request payload", err)
+		return
+	}
+	if err := validateReport(&report); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid report", err)
+		return
+	}
+	res, err := db.ExecContext(r.Context(), "INSERT INTO reports ("+reportColumns+") VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) ON CONFLICT (name) DO NOTHING",
+		report.Name, report.Description, pq.Array(report.Models), pq.Array(report.Projects), pq.Array(report.GroupBy),
+		report.Period, report.Schedule, report.Channel, report.Target, report.Locale)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to create report", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		respondJSON(w, http.StatusConflict, map[string]string{"message": "A report with this name already exists"})
+		return
+	}
+	infof("Created report %s\n", report.Name)
+	respondJSON(w, http.StatusCreated, report)
+}
+
+func loadReports(ctx context.Context, query string, args ...interface{}) ([]Report, error) {
+	rows, err := db.QueryContext(ctx, "SELECT "+reportColumns+" FROM reports "+query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	reports := []Report{}
+	for rows.Next() {
+		var rep Report
+		if err := rows.Scan(&rep.Name, &rep.Description, pq.Array(&rep.Models), pq.Array(&rep.Projects), pq.Array(&rep.GroupBy),
+			&rep.Period, &rep.Schedule, &rep.Channel, &rep.Target, &rep.Locale); err != nil {
+			return nil, err
+		}
+		reports = append(reports, rep)
+	}
+	return reports, rows.Err()
+}
+
+func getReports(w http.ResponseWriter, r *http.Request) {
+	reports, err := loadReports(r.Context(), "ORDER BY name")
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database query error", err)
+		return
+	}
+	respondJSON(w, http.StatusOK, reports)
+}
+
+// findReport loads the report named in the route, answering 404 itself if there is none
+func findReport(w http.ResponseWriter, r *http.Request) (Report, bool) {
+	reports, err := loadReports(r.Context(), "WHERE name = $1", mux.Vars(r)["name"])
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database query error", err)
+		return Report{}, false
+	}
+	if len(reports) == 0 {
+		respondJSON(w, http.StatusNotFound, map[string]string{"message": "Report not found"})
+		return Report{}, false
+	}
+	return reports[0], true
+}
+
+func getReport(w http.ResponseWriter, r *http.Request) {
+	if report, ok := findReport(w, r); ok {
+		respondJSON(w, http.StatusOK, report)
+	}
+}
+
+func deleteReport(w http.ResponseWriter, r *http.Request) {
+	res, err := db.ExecContext(r.Context(), "DELETE FROM reports WHERE name = $1", mux.Vars(r)["name"])
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to delete report", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		respondJSON(w, http.StatusNotFound, map[string]string{"message": "Report not found"})
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]string{"message": "Report deleted successfully"})
+}
+
+// ReportResult is one execution of a report; each row holds its group values plus
+// total_tokens and cost
+type ReportResult struct {
+	Report      string                   `json:"report"`
+	Start       string                   `json:"start"`
+	End         string                   `json:"end"`
+	Rows        []map[string]interface{} `json:"rows"`
+	Annotations []Annotation             `json:"annotations"`
+}
+
+// globToLike turns a model glob into a LIKE pattern
+func globToLike(glob string) string {
+	escaped := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(glob)
+	return strings.ReplaceAll(escaped, "*", "%")
+}
+
+// executeReport runs a report over [start, end]
+func executeReport(ctx context.Context, report Report, start, end time.Time) (ReportResult, error) {
+	result := ReportResult{Report: report.Name, Start: start.Format("2006-01-02"), End: end.Format("2006-01-02"), Rows: []map[string]interface{}{}}
+	likes := make([]string, len(report.Models))
+	for i, m := range report.Models {
+		likes[i] = globToLike(m)
+	}
+	// Group expressions come from reportGroups, never from the request
+	selects := make([]string, 0, len(report.GroupBy)+2)
+	positions := make([]string, 0, len(report.GroupBy))
+	for i, g := range report.GroupBy {
+		selects = append(selects, reportGroups[g])
+		positions = append(positions, fmt.Sprint(i+1))
+	}
+	selects = append(selects, "SUM(u.total_tokens)", usageCostMicrosSum)
+	query := "SELECT " + strings.Join(selects, ", ") + `
+        FROM token_usage u ` + usagePriceJoin + `
+        WHERE u.date >= $1 AND u.date <= $2
+            AND (cardinality($3::TEXT[]) = 0 OR u.model LIKE ANY($3))
+            AND (cardinality($4::TEXT[]) = 0 OR u.project = ANY($4))`
+	if len(positions) > 0 {
+		query += " GROUP BY " + strings.Join(positions, ", ") + " ORDER BY " + strings.Join(positions, ", ")
+	}
+	rows, err := db.QueryContext(ctx, query, start, end, pq.Array(likes), pq.Array(report.Projects))
+	if err != nil {
+		return result, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		groups := make([]string, len(report.GroupBy))
+		var tokens sql.NullInt64
+		var cost int64
+		dest := make([]interface{}, 0, len(groups)+2)
+		for i := range groups {
+			dest = append(dest, &groups[i])
+		}
+		dest = append(dest, &tokens, &cost)
+		if err := rows.Scan(dest...); err != nil {
+			return result, err
+		}
+		row := map[string]interface{}{"total_tokens": tokens.Int64, "cost": costFromMicros(cost)}
+		for i, g := range report.GroupBy {
+			row[g] = groups[i]
+		}
+		result.Rows = append(result.Rows, row)
+	}
+	if err := rows.Err(); err != nil {
+		return result, err
+	}
+	result.Annotations, err = annotationsBetween(ctx, start, end, "")
+	return result, err
+}
+
+// runReport executes a saved report over its period, or over ?start=&end=/?period= if given.
+// ?format=csv exports the rows as CSV in the report's locale, or in ?locale= if given.
+func runReport(w http.ResponseWriter, r *http.Request) {
+	report, ok := findReport(w, r)
+	if !ok {
+		return
+	}
+	q := r.URL.Query()
+	format := q.Get("format")
+	if format != "" && format != "json" && format != "csv" {
+		respondJSON(w, http.StatusBadRequest, map[string]string{"message": "format must be json or csv"})
+		return
+	}
+	localeName := report.Locale
+	if v := q.Get("locale"); v != "" {
+		localeName = v
+	}
+	loc, err := resolveLocale(localeName)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid locale", err)
+		return
+	}
+	start, end, err := parseDateRange(q, report.Period)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid date range", err)
+		return
+	}
+	result, err := executeReport(r.Context(), report, start, end)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database query error", err)
+		return
+	}
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", report.Name+".csv"))
+		writeReportCSV(w, report, result, loc)
+		return
+	}
+	respondJSON(w, http.StatusOK, result)
+}
+
+// writeReportCSV writes a report's rows, one column per group followed by total_tokens and cost
+func writeReportCSV(w io.Writer, report Report, result ReportResult, loc locale) {
+	cw := csv.NewWriter(w)
+	cw.Comma = loc.csvComma()
+	cw.Write(append(append([]string{}, report.GroupBy...), "total_tokens", "cost"))
+	for _, row := range result.Rows {
+		record := make([]string, 0, len(report.GroupBy)+2)
+		for _, g := range report.GroupBy {
+			record = append(record, loc.label(g, fmt.Sprint(row[g])))
+		}
+		record = append(record, fmt.Sprint(row["total_tokens"]), loc.number(row["cost"].(float64), -1, false))
+		cw.Write(record)
+	}
+	cw.Flush()
+}
+
+// maxDigestRows caps how many rows a digest message lists
+const maxDigestRows = 20
+
+// sendReportDigests is the report_digests job: it runs every scheduled report that is due
+// this minute and sends the result to the report's channel
+func sendReportDigests(ctx context.Context) error {
+	reports, err := loadReports(ctx, "WHERE schedule <> '' ORDER BY name")
+	if err != nil {
+		return err
+	}
+	tick := time.Now().Truncate(time.Minute)
+	var failed []string
+	for _, report := range reports {
+		schedule, err := parseCron(report.Schedule)
+		if err != nil || !schedule.matches(tick) {
+			continue
+		}
+		start, end, _ := parseDateRange(url.Values{}, report.Period)
+		loc, err := resolveLocale(report.Locale)
+		var result ReportResult
+		if err == nil {
+			result, err = executeReport(ctx, report, start, end)
+		}
+		if err == nil {
+			err = sendNotification(ctx, report.Channel, report.Target, reportDigest(result, loc))
+		}
+		if err != nil {
+			log.Printf("Failed to send digest for report %s: %v", report.Name, err)
+			failed = append(failed, report.Name)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("digests failed for %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// reportDigest writes a report's result as a message, with dates and numbers as loc writes them
+func reportDigest(result ReportResult, loc locale) Alert {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Report %q, %s to %s", result.Report, loc.label("day", result.Start), loc.label("day", result.End))
+	for i, row := range result.Rows {
+		if i == maxDigestRows {
+			fmt.Fprintf(&b, "\n... and %d more rows", len(result.Rows)-maxDigestRows)
+			break
+		}
+		var labels []string
+		for _, g := range []string{"month", "week", "day", "project", "model"} {
+			if v, ok := row[g]; ok {
+				labels = append(labels, loc.label(g, fmt.Sprint(v)))
+			}
+		}
+		if len(labels) == 0 {
+			labels = []string{"total"}
+		}
+		fmt.Fprintf(&b, "\n%s: %s tokens, %s", strings.Join(labels, " / "), loc.integer(row["total_tokens"].(int64)), loc.money(row["cost"].(float64)))
+	}
+	return Alert{
+		Kind:    "report",
+		Message: b.String(),
+		Details: map[string]interface{}{"report": result.Report, "start": result.Start, "end": result.End, "rows": result.Rows},
+		Time:    time.Now(),
+	}
+}
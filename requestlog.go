@@ -0,0 +1,164 @@
+// requestlog.go
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/apache/arrow-go/v18/arrow"
+	"github.com/apache/arrow-go/v18/arrow/array"
+)
+
+// GET /token_usage/requests reads usage_requests, the log of every increment recorded, for
+// analytics consumers pulling large slices of it. Rows are streamed as they are read rather
+// than collected first: as a JSON array by default, or as an Arrow IPC stream (see arrow.go) of
+// columnar batches to clients sending Accept: application/vnd.apache.arrow.stream, which
+// pyarrow, polars and DuckDB load far faster than JSON.
+
+// UsageRequest is an increment logged to usage_requests. Cost and Requests are unset on
+// increments logged before they were tracked.
+type UsageRequest struct {
+	ID          int64     `json:"id"`
+	LoggedAt    time.Time `json:"logged_at"`
+	Date        string    `json:"date"`
+	Model       string    `json:"model"`
+	Project     string    `json:"project"`
+	TotalTokens int64     `json:"total_tokens"`
+	Cost        *float64  `json:"cost"`
+	Requests    *int64    `json:"requests"`
+}
+
+var usageRequestSchema = arrow.NewSchema([]arrow.Field{
+	{Name: "id", Type: arrow.PrimitiveTypes.Int64},
+	{Name: "logged_at", Type: &arrow.TimestampType{Unit: arrow.Microsecond, TimeZone: "UTC"}},
+	{Name: "date", Type: arrow.FixedWidthTypes.Date32},
+	{Name: "model", Type: arrow.BinaryTypes.String},
+	{Name: "project", Type: arrow.BinaryTypes.String},
+	{Name: "total_tokens", Type: arrow.PrimitiveTypes.Int64},
+	{Name: "cost", Type: arrow.PrimitiveTypes.Float64, Nullable: true},
+	{Name: "requests", Type: arrow.PrimitiveTypes.Int64, Nullable: true},
+}, nil)
+
+// getUsageRequests streams the increments logged in a date range, this month by default, in
+// the order they were logged. ?model= and ?project= narrow them down.
+func getUsageRequests(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	start, end, err := parseDateRange(q, "month")
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid date range", err)
+		return
+	}
+	rows, err := db.QueryContext(r.Context(), `
+        SELECT id, logged_at, date, model, project, total_tokens, cost, requests
+        FROM usage_requests
+        WHERE date >= $1 AND date <= $2 AND ($3 = '' OR model = $3) AND ($4 = '' OR project = $4)
+        ORDER BY id`, start, end, q.Get("model"), q.Get("project"))
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database query error", err)
+		return
+	}
+	defer rows.Close()
+	w.Header().Add("Vary", "Accept")
+	if strings.Contains(r.Header.Get("Accept"), arrowStreamType) {
+		err = streamUsageRequestsArrow(w, rows)
+	} else {
+		err = streamUsageRequestsJSON(w, rows)
+	}
+	// The status went out with the first rows, so a failure can only cut the stream short
+	if err != nil {
+		log.Printf("Failed to stream usage requests: %v", err)
+	}
+}
+
+func scanUsageRequest(rows *sql.Rows) (UsageRequest, time.Time, error) {
+	var u UsageRequest
+	var date time.Time
+	var cost sql.NullFloat64
+	var requests sql.NullInt64
+	if err := rows.Scan(&u.ID, &u.LoggedAt, &date, &u.Model, &u.Project, &u.TotalTokens, &cost, &requests); err != nil {
+		return u, date, err
+	}
+	u.Date = date.Format("2006-01-02")
+	if cost.Valid {
+		u.Cost = &cost.Float64
+	}
+	if requests.Valid {
+		u.Requests = &requests.Int64
+	}
+	return u, date, nil
+}
+
+func streamUsageRequestsJSON(w http.ResponseWriter, rows *sql.Rows) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	sep := "["
+	for rows.Next() {
+		u, _, err := scanUsageRequest(rows)
+		if err != nil {
+			return err
+		}
+		b, err := json.Marshal(u)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(append([]byte(sep), b...)); err != nil {
+			return err
+		}
+		sep = ","
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if sep == "[" {
+		_, err := w.Write([]byte("[]"))
+		return err
+	}
+	_, err := w.Write([]byte("]"))
+	return err
+}
+
+func streamUsageRequestsArrow(w http.ResponseWriter, rows *sql.Rows) error {
+	w.Header().Set("Content-Type", arrowStreamType)
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	aw := newArrowStreamWriter(w, usageRequestSchema)
+	defer aw.release()
+	b := aw.builder
+	for rows.Next() {
+		u, date, err := scanUsageRequest(rows)
+		if err != nil {
+			return err
+		}
+		b.Field(0).(*array.Int64Builder).Append(u.ID)
+		b.Field(1).(*array.TimestampBuilder).Append(arrow.Timestamp(u.LoggedAt.UnixMicro()))
+		b.Field(2).(*array.Date32Builder).Append(arrow.Date32FromTime(date))
+		b.Field(3).(*array.StringBuilder).Append(u.Model)
+		b.Field(4).(*array.StringBuilder).Append(u.Project)
+		b.Field(5).(*array.Int64Builder).Append(u.TotalTokens)
+		if u.Cost != nil {
+			b.Field(6).(*array.Float64Builder).Append(*u.Cost)
+		} else {
+			b.Field(6).AppendNull()
+		}
+		if u.Requests != nil {
+			b.Field(7).(*array.Int64Builder).Append(*u.Requests)
+		} else {
+			b.Field(7).AppendNull()
+		}
+		wrote, err := aw.endRow()
+		if err != nil {
+			return err
+		}
+		if wrote && flusher != nil {
+			flusher.Flush()
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return aw.close()
+}
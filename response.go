@@ -0,0 +1,86 @@
+// response.go
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+)
+
+// Field naming styles for JSON responses
+const (
+	snakeCase = "snake_case"
+	camelCase = "camelCase"
+)
+
+// shapeResponse applies the configured response options to a payload. With response_envelope
+// set, successes become {data, meta, error: null} and failures {data: null, meta, error}.
+// With field_naming camelCase, object keys are converted from snake_case; this applies to
+// every key, including map keys that come from data such as model names.
+func shapeResponse(status int, data interface{}) interface{} {
+	cfg := currentConfig.Load()
+	if !cfg.ResponseEnvelope && cfg.FieldNaming != camelCase {
+		return data
+	}
+	if cfg.FieldNaming == camelCase {
+		raw, err := json.Marshal(data)
+		if err != nil {
+			return data
+		}
+		var generic interface{}
+		dec := json.NewDecoder(bytes.NewReader(raw))
+		dec.UseNumber()
+		if err := dec.Decode(&generic); err != nil {
+			return data
+		}
+		data = camelKeys(generic)
+	}
+	if !cfg.ResponseEnvelope {
+		return data
+	}
+	envelope := map[string]interface{}{"data": data, "meta": map[string]int{"status": status}, "error": nil}
+	if status >= 400 {
+		envelope["data"] = nil
+		envelope["error"] = data
+	}
+	return envelope
+}
+
+func camelKeys(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for k, val := range v {
+			out[toCamel(k)] = camelKeys(val)
+		}
+		return out
+	case []interface{}:
+		for i := range v {
+			v[i] = camelKeys(v[i])
+		}
+		return v
+	}
+	return v
+}
+
+// toCamel converts snake_case to camelCase, e.g. total_tokens to totalTokens
+func toCamel(s string) string {
+	if !strings.Contains(s, "_") {
+		return s
+	}
+	var b strings.Builder
+	upper := false
+	for _, r := range s {
+		if r == '_' {
+			upper = b.Len() > 0
+			continue
+		}
+		if upper {
+			b.WriteString(strings.ToUpper(string(r)))
+			upper = false
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
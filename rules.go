@@ -0,0 +1,416 @@
+// rules.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// A notification rule fires an action when a usage metric crosses a threshold within a
+// window. Conditions are written in a small DSL:
+//
+//	<metric> > <threshold> per <window> [where <field> = <value> [and ...]]
+//
+// metric is tokens or cost (USD), the comparison is > or >=, window is day, week, month or
+// a rolling Nd (e.g. 7d), and fields are model (a glob, as in model templates) and project.
+// For example: cost > 50 per day where model = gpt-4o and project = X
+//
+// A rule fires at most once per window; rolling windows fire at most once per day.
+type NotificationRule struct {
+	ID        int    `json:"id"`
+	Name      string `json:"name"`
+	Condition string `json:"condition"`
+	Channel   string `json:"channel"`
+	Target    string `json:"target,omitempty"`
+	Enabled   bool   `json:"enabled"`
+}
+
+// ruleCondition is a parsed rule condition
+type ruleCondition struct {
+	metric    string
+	inclusive bool
+	threshold float64
+	window    string
+	days      int // for rolling windows
+	model     string
+	project   string
+}
+
+var rulesMu sync.Mutex
+
+func parseRuleCondition(text string) (ruleCondition, error) {
+	var c ruleCondition
+	tokens, err := splitRuleTokens(text)
+	if err != nil {
+		return c, err
+	}
+	next := func() string {
+		if len(tokens) == 0 {
+			return ""
+		}
+		t := tokens[0]
+		tokens = tokens[1:]
+		return t
+	}
+
+	c.metric = strings.ToLower(next())
+	if c.metric != "tokens" && c.metric != "cost" {
+		return c, fmt.Errorf("metric must be tokens or cost, got %q", c.metric)
+	}
+	switch op := next(); op {
+	case ">":
+	case ">=":
+		c.inclusive = true
+	default:
+		return c, fmt.Errorf("expected > or >= after the metric, got %q", op)
+	}
+	threshold := strings.TrimPrefix(next(), "$")
+	if c.threshold, err = strconv.ParseFloat(threshold, 64); err != nil || c.threshold < 0 {
+		return c, fmt.Errorf("invalid threshold %q", threshold)
+	}
+	if kw := strings.ToLower(next()); kw != "per" {
+		return c, fmt.Errorf("expected per <window>, got %q", kw)
+	}
+	c.window = strings.ToLower(next())
+	switch {
+	case c.window == "day" || c.window == "week" || c.window == "month":
+	case strings.HasSuffix(c.window, "d"):
+		if c.days, err = strconv.Atoi(strings.TrimSuffix(c.window, "d")); err != nil || c.days <= 0 || c.days > 366 {
+			return c, fmt.Errorf("invalid rolling window %q", c.window)
+		}
+	default:
+		return c, fmt.Errorf("window must be day, week, month or Nd, got %q", c.window)
+	}
+
+	if len(tokens) == 0 {
+		return c, nil
+	}
+	if kw := strings.ToLower(next()); kw != "where" {
+		return c, fmt.Errorf("expected where, got %q", kw)
+	}
+	for {
+		field, eq, value := strings.ToLower(next()), next(), next()
+		if eq != "=" || value == "" {
+			return c, fmt.Errorf("expected <field> = <value> in where clause")
+		}
+		switch field {
+		case "model":
+			c.model = value
+		case "project":
+			c.project = value
+		default:
+			return c, fmt.Errorf("unknown field %q, use model or project", field)
+		}
+		if len(tokens) == 0 {
+			return c, nil
+		}
+		if kw := strings.ToLower(next()); kw != "and" {
+			return c, fmt.Errorf("expected and, got %q", kw)
+		}
+	}
+}
+
+// splitRuleTokens splits on whitespace, keeping operators separate and quoted values whole
+func splitRuleTokens(text string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(text); {
+		switch c := text[i]; {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case c == '"' || c == '\'':
+			end := strings.IndexByte(text[i+1:], c)
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated quote")
+			}
+			tokens = append(tokens, text[i+1:i+1+end])
+			i += end + 2
+		case c == '>' || c == '=':
+			if c == '>' && i+1 < len(text) && text[i+1] == '=' {
+				tokens = append(tokens, ">=")
+				i += 2
+			} else {
+				tokens = append(tokens, string(c))
+				i++
+			}
+		default:
+			j := i
+			for j < len(text) && !strings.ContainsRune(" \t\n>=\"'", rune(text[j])) {
+				j++
+			}
+			tokens = append(tokens, text[i:j])
+			i = j
+		}
+	}
+	return tokens, nil
+}
+
+// windowStart returns where the condition's window begins and the key used to fire at most
+// once per window
+func (c ruleCondition) windowStart(today time.Time) (time.Time, time.Time) {
+	switch c.window {
+	case "day":
+		return today, today
+	case "week", "month":
+		start, _ := periodStart(c.window, today)
+		return start, start
+	}
+	return today.AddDate(0, 0, -(c.days - 1)), today
+}
+
+func validateRule(rule *NotificationRule) error {
+	if rule.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if _, err := parseRuleCondition(rule.Condition); err != nil {
+		return fmt.Errorf("condition: %w", err)
+	}
+	if err := currentConfig.Load().Notifications.checkChannel(rule.Channel, rule.Target); err != nil {
+		return err
+	}
+	return nil
+}
+
+func createRule(w http.ResponseWriter, r *http.Request) {
+	rule := NotificationRule{Enabled: true}
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request payload", err)
+		return
+	}
+	if err := validateRule(&rule); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid rule", err)
+		return
+	}
+	err := db.QueryRowContext(r.Context(), "INSERT INTO notification_rules (name, condition, channel, target, enabled) VALUES ($1, $2, $3, $4, $5) RETURNING id",
+		rule.Name, rule.Condition, rule.Channel, rule.Target, rule.Enabled).Scan(&rule.ID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to create rule", err)
+		return
+	}
+	infof("Created notification rule %d: %s\n", rule.ID, rule.Condition)
+	respondJSON(w, http.StatusCreated, rule)
+}
+
+func updateRule(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid rule id", err)
+		return
+	}
+	rule := NotificationRule{Enabled: true}
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request payload", err)
+		return
+	}
+	rule.ID = id
+	if err := validateRule(&rule); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid rule", err)
+		return
+	}
+	res, err := db.ExecContext(r.Context(), "UPDATE notification_rules SET name = $1, condition = $2, channel = $3, target = $4, enabled = $5 WHERE id = $6",
+		rule.Name, rule.Condition, rule.Channel, rule.Target, rule.Enabled, id)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to update rule", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		respondJSON(w, http.StatusNotFound, map[string]string{"message": "Rule not found"})
+		return
+	}
+	respondJSON(w, http.StatusOK, rule)
+}
+
+func loadRules(ctx context.Context, query string, args ...interface{}) ([]NotificationRule, error) {
+	rows, err := db.QueryContext(ctx, "SELECT id, name, condition, channel, target, enabled FROM notification_rules "+query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	rules := []NotificationRule{}
+	for rows.Next() {
+		var rule NotificationRule
+		if err := rows.Scan(&rule.ID, &rule.Name, &rule.Condition, &rule.Channel, &rule.Target, &rule.Enabled); err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, rows.Err()
+}
+
+func getRules(w http.ResponseWriter, r *http.Request) {
+	rules, err := loadRules(r.Context(), "ORDER BY id")
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database query error", err)
+		return
+	}
+	respondJSON(w, http.StatusOK, rules)
+}
+
+func getRule(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid rule id", err)
+		return
+	}
+	rules, err := loadRules(r.Context(), "WHERE id = $1", id)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database query error", err)
+		return
+	}
+	if len(rules) == 0 {
+		respondJSON(w, http.StatusNotFound, map[string]string{"message": "Rule not found"})
+		return
+	}
+	respondJSON(w, http.StatusOK, rules[0])
+}
+
+func deleteRule(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid rule id", err)
+		return
+	}
+	res, err := db.ExecContext(r.Context(), "DELETE FROM notification_rules WHERE id = $1", id)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to delete rule", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		respondJSON(w, http.StatusNotFound, map[string]string{"message": "Rule not found"})
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]string{"message": "Rule deleted successfully"})
+}
+
+// evaluateRules is the rules job: it checks every enabled rule and fires those whose
+// condition holds and that have not fired in the current window
+func evaluateRules(ctx context.Context) error {
+	rulesMu.Lock()
+	defer rulesMu.Unlock()
+	rules, err := loadRules(ctx, "WHERE enabled ORDER BY id")
+	if err != nil {
+		return err
+	}
+	today := time.Now().Truncate(24 * time.Hour)
+	for _, rule := range rules {
+		if err := evaluateRule(ctx, rule, today); err != nil {
+			log.Printf("Failed to evaluate rule %d: %v", rule.ID, err)
+		}
+	}
+	return nil
+}
+
+func evaluateRule(ctx context.Context, rule NotificationRule, today time.Time) error {
+	c, err := parseRuleCondition(rule.Condition)
+	if err != nil {
+		return err
+	}
+	start, windowKey := c.windowStart(today)
+	var fired bool
+	if err := db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM rule_firings WHERE rule_id = $1 AND window_start = $2)", rule.ID, windowKey).Scan(&fired); err != nil {
+		return err
+	}
+	if fired {
+		return nil
+	}
+
+	rows, err := db.QueryContext(ctx, `
+        SELECT u.model, SUM(u.total_tokens), `+usageCostMicrosSum+`
+        FROM token_usage u `+usagePriceJoin+`
+        WHERE u.date >= $1 AND u.date <= $2 AND ($3 = '' OR u.project = $3)
+        GROUP BY u.model`, start, today, c.project)
+	if err != nil {
+		return err
+	}
+	var value float64
+	var costMicros int64
+	for rows.Next() {
+		var model string
+		var tokens, cost int64
+		if err := rows.Scan(&model, &tokens, &cost); err != nil {
+			rows.Close()
+			return err
+		}
+		if c.model != "" && !matchModelPattern(c.model, model) {
+			continue
+		}
+		if c.metric == "tokens" {
+			value += float64(tokens)
+		} else {
+			costMicros += cost
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if c.metric != "tokens" {
+		value = costFromMicros(costMicros)
+	}
+	if value < c.threshold || (value == c.threshold && !c.inclusive) {
+		return nil
+	}
+
+	alert := Alert{
+		Kind:    "rule",
+		Message: fmt.Sprintf("Rule %q triggered: %s (current %s %.2f since %s)", rule.Name, rule.Condition, c.metric, value, start.Format("2006-01-02")),
+		Details: map[string]interface{}{
+			"rule_id":      rule.ID,
+			"rule":         rule.Name,
+			"condition":    rule.Condition,
+			"value":        value,
+			"window_start": start.Format("2006-01-02"),
+		},
+		Time: time.Now(),
+	}
+	if err := sendNotification(ctx, rule.Channel, rule.Target, alert); err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, "INSERT INTO rule_firings (rule_id, window_start, value) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING", rule.ID, windowKey, value)
+	return err
+}
+
+// getRuleFirings lists when a rule fired, most recent first. The values it fired at count every
+// project, so scoped callers can't list them.
+func getRuleFirings(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid rule id", err)
+		return
+	}
+	rows, err := db.QueryContext(r.Context(), "SELECT window_start, value, fired_at FROM rule_firings WHERE rule_id = $1 ORDER BY fired_at DESC", id)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database query error", err)
+		return
+	}
+	defer rows.Close()
+	type firing struct {
+		WindowStart string    `json:"window_start"`
+		Value       float64   `json:"value"`
+		FiredAt     time.Time `json:"fired_at"`
+	}
+	firings := []firing{}
+	for rows.Next() {
+		var f firing
+		var start time.Time
+		if err := rows.Scan(&start, &f.Value, &f.FiredAt); err != nil {
+			respondError(w, http.StatusInternalServerError, "Error scanning row", err)
+			return
+		}
+		f.WindowStart = start.Format("2006-01-02")
+		firings = append(firings, f)
+	}
+	if err = rows.Err(); err != nil {
+		respondError(w, http.StatusInternalServerError, "Error reading data", err)
+		return
+	}
+	respondJSON(w, http.StatusOK, firings)
+}
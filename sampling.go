@@ -0,0 +1,201 @@
+// sampling.go
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// SamplingConfig turns on payload capture in proxy mode: a percentage of successful proxied
+// requests is stored with its request and response bodies and usage, to help explain
+// unexpectedly expensive requests. Bodies pass through the redaction pipeline before they
+// are stored, and samples are only readable through the admin API.
+type SamplingConfig struct {
+	// Percent of proxied requests to capture, 0 (the default) to disable
+	Percent float64 `json:"percent"`
+	// RetentionDays is how long samples are kept, default 7
+	RetentionDays int `json:"retention_days"`
+	// MaxPayloadBytes truncates each stored body, default 65536
+	MaxPayloadBytes int `json:"max_payload_bytes"`
+	// RedactBuiltins picks the built-in redactions (email, phone, api_key); omitted means all
+	RedactBuiltins []string `json:"redact_builtins"`
+	// Redact lists further regular expressions whose matches are replaced before storing
+	Redact []string `json:"redact"`
+
+	pipeline redactionPipeline
+}
+
+const (
+	defaultSampleRetentionDays   = 7
+	defaultSampleMaxPayloadBytes = 64 << 10
+)
+
+// PayloadSample is a captured proxied request. Listings leave out the bodies.
+type PayloadSample struct {
+	ID               int64     `json:"id"`
+	CapturedAt       time.Time `json:"captured_at"`
+	Upstream         string    `json:"upstream"`
+	Path             string    `json:"path"`
+	Model            string    `json:"model"`
+	Project          string    `json:"project"`
+	PromptTokens     int       `json:"prompt_tokens"`
+	CompletionTokens int       `json:"completion_tokens"`
+	TotalTokens      int       `json:"total_tokens"`
+	RequestBody      string    `json:"request_body,omitempty"`
+	ResponseBody     string    `json:"response_body,omitempty"`
+}
+
+// compile validates the settings and builds the redaction pipeline
+func (c *SamplingConfig) compile() error {
+	if c.Percent < 0 || c.Percent > 100 {
+		return fmt.Errorf("percent must be between 0 and 100")
+	}
+	pipeline, err := newRedactionPipeline(c.RedactBuiltins, c.Redact)
+	if err != nil {
+		return err
+	}
+	c.pipeline = pipeline
+	return nil
+}
+
+// shouldSample decides whether to capture the request about to be proxied
+func shouldSample() bool {
+	p := currentConfig.Load().Sampling.Percent
+	return p > 0 && rand.Float64()*100 < p
+}
+
+// redactPayload applies the redaction pipeline, then truncates to the configured size
+func redactPayload(cfg SamplingConfig, body []byte) string {
+	body = cfg.pipeline.apply(body)
+	limit := cfg.MaxPayloadBytes
+	if limit <= 0 {
+		limit = defaultSampleMaxPayloadBytes
+	}
+	if len(body) > limit {
+		body = body[:limit]
+	}
+	return string(body)
+}
+
+// recordSample stores a captured request. Samples are best effort: nothing is buffered for them
+// while the database is down.
+func recordSample(ctx context.Context, upstream, path, project string, usage proxyUsage, reqBody, respBody []byte) {
+	if !dbHealth.available() {
+		return
+	}
+	cfg := currentConfig.Load().Sampling
+	_, err := db.ExecContext(ctx, `INSERT INTO payload_samples (upstream, path, model, project, prompt_tokens, completion_tokens, total_tokens, request_body, response_body)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+		upstream, path, usage.Model, project, usage.PromptTokens, usage.CompletionTokens, usage.total(),
+		redactPayload(cfg, reqBody), redactPayload(cfg, respBody))
+	if err != nil {
+		log.Printf("Failed to store payload sample from %s: %v", upstream, err)
+	}
+}
+
+// pruneSamples is the sample_retention job: it deletes samples past the retention period
+func pruneSamples(ctx context.Context) error {
+	days := currentConfig.Load().Sampling.RetentionDays
+	if days <= 0 {
+		days = defaultSampleRetentionDays
+	}
+	res, err := db.ExecContext(ctx, "DELETE FROM payload_samples WHERE captured_at < NOW() - make_interval(days => $1)", days)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		infof("Pruned %d payload samples older than %d days\n", n, days)
+	}
+	return nil
+}
+
+// getSamples lists samples, most expensive first, optionally filtered by model and date range
+func getSamples(w http.ResponseWriter, r *http.Request) {
+	start, end, err := parseDateRange(r.URL.Query(), "month")
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid date range", err)
+		return
+	}
+	limit := 100
+	if l := r.URL.Query().Get("limit"); l != "" {
+		if limit, err = strconv.Atoi(l); err != nil || limit <= 0 {
+			respondJSON(w, http.StatusBadRequest, map[string]string{"message": "limit must be a positive integer"})
+			return
+		}
+	}
+	rows, err := db.QueryContext(r.Context(), `
+        SELECT id, captured_at, upstream, path, model, project, prompt_tokens, completion_tokens, total_tokens
+        FROM payload_samples
+        WHERE captured_at >= $1 AND captured_at < $2 + INTERVAL '1 day' AND ($3 = '' OR model = $3)
+        ORDER BY total_tokens DESC, id DESC LIMIT $4`, start, end, r.URL.Query().Get("model"), limit)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database query error", err)
+		return
+	}
+	defer rows.Close()
+	samples := []PayloadSample{}
+	for rows.Next() {
+		var s PayloadSample
+		if err := rows.Scan(&s.ID, &s.CapturedAt, &s.Upstream, &s.Path, &s.Model, &s.Project,
+			&s.PromptTokens, &s.CompletionTokens, &s.TotalTokens); err != nil {
+			respondError(w, http.StatusInternalServerError, "Error scanning row", err)
+			return
+		}
+		samples = append(samples, s)
+	}
+	if err = rows.Err(); err != nil {
+		respondError(w, http.StatusInternalServerError, "Error reading data", err)
+		return
+	}
+	respondJSON(w, http.StatusOK, samples)
+}
+
+// getSample returns one sample with its bodies. Every read is logged, as the bodies may hold
+// whatever the redaction rules missed.
+func getSample(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid sample id", err)
+		return
+	}
+	var s PayloadSample
+	err = db.QueryRowContext(r.Context(), `
+        SELECT id, captured_at, upstream, path, model, project, prompt_tokens, completion_tokens, total_tokens, request_body, response_body
+        FROM payload_samples WHERE id = $1`, id).Scan(&s.ID, &s.CapturedAt, &s.Upstream, &s.Path, &s.Model, &s.Project,
+		&s.PromptTokens, &s.CompletionTokens, &s.TotalTokens, &s.RequestBody, &s.ResponseBody)
+	if err == sql.ErrNoRows {
+		respondJSON(w, http.StatusNotFound, map[string]string{"message": "Sample not found"})
+		return
+	} else if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database query error", err)
+		return
+	}
+	log.Printf("Payload sample %d read by %s", id, r.RemoteAddr)
+	respondJSON(w, http.StatusOK, s)
+}
+
+func deleteSample(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid sample id", err)
+		return
+	}
+	res, err := db.ExecContext(r.Context(), "DELETE FROM payload_samples WHERE id = $1", id)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to delete sample", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		respondJSON(w, http.StatusNotFound, map[string]string{"message": "Sample not found"})
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]string{"message": "Sample deleted successfully"})
+}
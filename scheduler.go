@@ -0,0 +1,175 @@
+// scheduler.go
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// scheduledJob is a recurring background task. Its cron schedule comes from the "jobs"
+// section of the config file, falling back to defaultSchedule; "off" disables it.
+type scheduledJob struct {
+	name            string
+	defaultSchedule string
+	run             func(ctx context.Context) error
+}
+
+// JobStatus is the run history of a job as reported by GET /admin/jobs
+type JobStatus struct {
+	Name         string     `json:"name"`
+	Schedule     string     `json:"schedule"`
+	Enabled      bool       `json:"enabled"`
+	Running      bool       `json:"running"`
+	LastRun      *time.Time `json:"last_run,omitempty"`
+	LastDuration string     `json:"last_duration,omitempty"`
+	LastError    string     `json:"last_error,omitempty"`
+	NextRun      *time.Time `json:"next_run,omitempty"`
+	Runs         int        `json:"runs"`
+	Failures     int        `json:"failures"`
+}
+
+var jobs = []scheduledJob{
+	{name: "budget_check", defaultSchedule: "*/15 * * * *", run: checkAllBudgets},
+	{name: "export", defaultSchedule: "off", run: exportArchiveJob},
+	{name: "partitions", defaultSchedule: "@daily", run: ensureUpcomingPartitions},
+	{name: "deprecation_check", defaultSchedule: "0 9 * * *", run: checkDeprecations},
+	{name: "rules", defaultSchedule: "*/5 * * * *", run: evaluateRules},
+	{name: "seal", defaultSchedule: "30 0 * * *", run: sealDays},
+	{name: "report_digests", defaultSchedule: "* * * * *", run: sendReportDigests},
+	{name: "sample_retention", defaultSchedule: "@hourly", run: pruneSamples},
+	{name: "price_changes", defaultSchedule: "5 0 * * *", run: applyScheduledPrices},
+	{name: "pricing_catalog", defaultSchedule: "@daily", run: refreshPricingCatalog},
+	{name: "sheets_export", defaultSchedule: "15 0 * * *", run: exportToSheets},
+	{name: "federation", defaultSchedule: "*/5 * * * *", run: pullFederation},
+	{name: "federation_push", defaultSchedule: "*/5 * * * *", run: pushFederation},
+	{name: "replication", defaultSchedule: "* * * * *", run: replicationJob},
+	{name: "monthly_summary", defaultSchedule: "20 0 * * *", run: refreshMonthlySummaries},
+	{name: "seen_requests", defaultSchedule: "@hourly", run: pruneSeenRequests},
+	{name: "cold_storage", defaultSchedule: "50 0 * * *", run: archiveColdUsage},
+	{name: "outages", defaultSchedule: "*/15 * * * *", run: pollStatusPages},
+	{name: "recent_ingestions", defaultSchedule: "@hourly", run: pruneRecentIngestions},
+}
+
+var jobStatusMu sync.Mutex
+var jobStatuses = map[string]*JobStatus{}
+
+// jobSchedule returns the configured schedule for a job, or nil if it is disabled
+func jobSchedule(job scheduledJob) (string, *cronSchedule) {
+	expr := job.defaultSchedule
+	if configured, ok := currentConfig.Load().Jobs[job.name]; ok {
+		expr = configured
+	}
+	if expr == "" || expr == "off" {
+		return expr, nil
+	}
+	schedule, err := parseCron(expr)
+	if err != nil {
+		log.Printf("Invalid schedule %q for job %s: %v", expr, job.name, err)
+		return expr, nil
+	}
+	return expr, schedule
+}
+
+// runScheduler checks every job at the start of each minute and starts those that are due.
+// Only the leader instance runs scheduled jobs; the others keep trying to take over.
+func runScheduler() {
+	for {
+		now := time.Now()
+		time.Sleep(now.Truncate(time.Minute).Add(time.Minute).Sub(now))
+		tick := time.Now().Truncate(time.Minute)
+		if !jobLeader.isLeader(context.Background()) {
+			continue
+		}
+		for _, job := range jobs {
+			if _, schedule := jobSchedule(job); schedule != nil && schedule.matches(tick) {
+				go runJob(job)
+			}
+		}
+	}
+}
+
+// runJob runs a job unless a previous run is still in progress and records the outcome
+func runJob(job scheduledJob) bool {
+	jobStatusMu.Lock()
+	status := jobStatuses[job.name]
+	if status == nil {
+		status = &JobStatus{Name: job.name}
+		jobStatuses[job.name] = status
+	}
+	if status.Running {
+		jobStatusMu.Unlock()
+		log.Printf("Job %s is still running, skipping this run", job.name)
+		return false
+	}
+	status.Running = true
+	jobStatusMu.Unlock()
+
+	start := time.Now()
+	debugf("Running job %s\n", job.name)
+	err := job.run(context.Background())
+
+	jobStatusMu.Lock()
+	defer jobStatusMu.Unlock()
+	status.Running = false
+	status.LastRun = &start
+	status.LastDuration = time.Since(start).Round(time.Millisecond).String()
+	status.Runs++
+	status.LastError = ""
+	if err != nil {
+		status.Failures++
+		status.LastError = err.Error()
+		log.Printf("Job %s failed: %v", job.name, err)
+	}
+	return true
+}
+
+func getJobs(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	out := []JobStatus{}
+	jobStatusMu.Lock()
+	for _, job := range jobs {
+		s := JobStatus{Name: job.name}
+		if status := jobStatuses[job.name]; status != nil {
+			s = *status
+		}
+		expr, schedule := jobSchedule(job)
+		s.Schedule = expr
+		s.Enabled = schedule != nil
+		if schedule != nil {
+			next := schedule.next(now)
+			s.NextRun = &next
+		}
+		out = append(out, s)
+	}
+	jobStatusMu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	w.Header().Set("X-Job-Leader", strconv.FormatBool(jobLeader.current()))
+	respondJSON(w, http.StatusOK, out)
+}
+
+// runJobNow triggers a job immediately on this instance, regardless of its schedule or leadership
+func runJobNow(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	for _, job := range jobs {
+		if job.name != name {
+			continue
+		}
+		if !runJob(job) {
+			respondJSON(w, http.StatusConflict, map[string]string{"message": "Job is already running"})
+			return
+		}
+		jobStatusMu.Lock()
+		status := *jobStatuses[name]
+		jobStatusMu.Unlock()
+		respondJSON(w, http.StatusOK, status)
+		return
+	}
+	respondJSON(w, http.StatusNotFound, map[string]string{"message": "Unknown job: " + name})
+}
@@ -0,0 +1,688 @@
+// schema.go
+package main
+
+// schemaStatements are executed in order at startup; each must be idempotent
+var schemaStatements = []string{
+	`
+        CREATE TABLE IF NOT EXISTS token_usage (
+            id SERIAL PRIMARY KEY,
+            date DATE NOT NULL,
+            model VARCHAR(255) NOT NULL,
+            total_tokens INTEGER NOT NULL
+        );
+    `,
+	`
+        CREATE TABLE IF NOT EXISTS budgets (
+            id SERIAL PRIMARY KEY,
+            model VARCHAR(255) NOT NULL,
+            period VARCHAR(16) NOT NULL,
+            limit_tokens BIGINT NOT NULL,
+            cooldown_minutes INTEGER NOT NULL DEFAULT 60
+        );
+    `,
+	`
+        CREATE TABLE IF NOT EXISTS budget_thresholds (
+            id SERIAL PRIMARY KEY,
+            budget_id INTEGER NOT NULL REFERENCES budgets(id) ON DELETE CASCADE,
+            percent INTEGER NOT NULL,
+            channel VARCHAR(32) NOT NULL,
+            target TEXT NOT NULL DEFAULT ''
+        );
+    `,
+	`
+        CREATE TABLE IF NOT EXISTS budget_alerts (
+            id SERIAL PRIMARY KEY,
+            budget_id INTEGER NOT NULL REFERENCES budgets(id) ON DELETE CASCADE,
+            threshold_id INTEGER NOT NULL REFERENCES budget_thresholds(id) ON DELETE CASCADE,
+            period_start DATE NOT NULL,
+            total_tokens BIGINT NOT NULL,
+            sent_at TIMESTAMP NOT NULL DEFAULT NOW(),
+            UNIQUE (threshold_id, period_start)
+        );
+    `,
+	`ALTER TABLE budgets ADD COLUMN IF NOT EXISTS enforce BOOLEAN NOT NULL DEFAULT FALSE;`,
+	`ALTER TABLE budgets ADD COLUMN IF NOT EXISTS config_managed BOOLEAN NOT NULL DEFAULT FALSE;`,
+	`
+        CREATE TABLE IF NOT EXISTS model_pricing (
+            model VARCHAR(255) PRIMARY KEY,
+            price_per_million DOUBLE PRECISION NOT NULL
+        );
+    `,
+	`
+        CREATE TABLE IF NOT EXISTS model_templates (
+            id SERIAL PRIMARY KEY,
+            pattern VARCHAR(255) NOT NULL,
+            priority INTEGER NOT NULL DEFAULT 0,
+            price_per_million DOUBLE PRECISION,
+            period VARCHAR(16) NOT NULL DEFAULT '',
+            limit_tokens BIGINT NOT NULL DEFAULT 0,
+            limit_usd DOUBLE PRECISION NOT NULL DEFAULT 0,
+            cooldown_minutes INTEGER NOT NULL DEFAULT 60,
+            enforce BOOLEAN NOT NULL DEFAULT FALSE,
+            thresholds TEXT NOT NULL DEFAULT '[]'
+        );
+    `,
+	`
+        CREATE TABLE IF NOT EXISTS provider_invoice_lines (
+            id SERIAL PRIMARY KEY,
+            provider VARCHAR(32) NOT NULL,
+            date DATE NOT NULL,
+            model VARCHAR(255) NOT NULL,
+            tokens BIGINT NOT NULL,
+            cost DOUBLE PRECISION NOT NULL DEFAULT 0,
+            imported_at TIMESTAMP NOT NULL DEFAULT NOW(),
+            UNIQUE (provider, date, model)
+        );
+    `,
+	`ALTER TABLE token_usage ADD COLUMN IF NOT EXISTS project VARCHAR(255) NOT NULL DEFAULT '';`,
+	`ALTER TABLE token_usage ADD COLUMN IF NOT EXISTS cost DOUBLE PRECISION;`,
+	`
+        CREATE TABLE IF NOT EXISTS azure_deployments (
+            deployment VARCHAR(255) PRIMARY KEY,
+            model VARCHAR(255) NOT NULL
+        );
+    `,
+	// token_usage is range partitioned by month. Rows outside every monthly partition land in
+	// token_usage_default; creating the month's partition later moves them into it.
+	`
+        CREATE OR REPLACE FUNCTION token_usage_ensure_partition(d DATE) RETURNS VOID AS $$
+        DECLARE
+            start_date DATE := date_trunc('month', d)::DATE;
+            end_date DATE := (date_trunc('month', d) + INTERVAL '1 month')::DATE;
+            part TEXT := 'token_usage_' || to_char(d, 'YYYY_MM');
+        BEGIN
+            IF to_regclass(part) IS NOT NULL THEN
+                RETURN;
+            END IF;
+            PERFORM pg_advisory_xact_lock(hashtext(part));
+            IF to_regclass(part) IS NOT NULL THEN
+                RETURN;
+            END IF;
+            IF EXISTS (SELECT 1 FROM token_usage_default WHERE date >= start_date AND date < end_date) THEN
+                CREATE TEMP TABLE token_usage_moving AS
+                    SELECT * FROM token_usage_default WHERE date >= start_date AND date < end_date;
+                DELETE FROM token_usage_default WHERE date >= start_date AND date < end_date;
+                EXECUTE format('CREATE TABLE %I PARTITION OF token_usage FOR VALUES FROM (%L) TO (%L)', part, start_date, end_date);
+                INSERT INTO token_usage SELECT * FROM token_usage_moving;
+                DROP TABLE token_usage_moving;
+            ELSE
+                EXECUTE format('CREATE TABLE %I PARTITION OF token_usage FOR VALUES FROM (%L) TO (%L)', part, start_date, end_date);
+            END IF;
+        END
+        $$ LANGUAGE plpgsql;
+    `,
+	`
+        DO $$
+        DECLARE
+            m DATE;
+        BEGIN
+            IF EXISTS (SELECT 1 FROM pg_class WHERE relname = 'token_usage' AND relkind = 'r'
+                    AND relnamespace = current_schema()::REGNAMESPACE) THEN
+                ALTER TABLE token_usage RENAME TO token_usage_unpartitioned;
+                ALTER TABLE token_usage_unpartitioned RENAME CONSTRAINT token_usage_pkey TO token_usage_unpartitioned_pkey;
+                CREATE TABLE token_usage (
+                    id INTEGER NOT NULL DEFAULT nextval('token_usage_id_seq'),
+                    date DATE NOT NULL,
+                    model VARCHAR(255) NOT NULL,
+                    total_tokens INTEGER NOT NULL,
+                    project VARCHAR(255) NOT NULL DEFAULT '',
+                    cost DOUBLE PRECISION,
+                    PRIMARY KEY (id, date)
+                ) PARTITION BY RANGE (date);
+                ALTER SEQUENCE token_usage_id_seq OWNED BY token_usage.id;
+                CREATE TABLE token_usage_default PARTITION OF token_usage DEFAULT;
+                FOR m IN SELECT DISTINCT date_trunc('month', date)::DATE FROM token_usage_unpartitioned LOOP
+                    PERFORM token_usage_ensure_partition(m);
+                END LOOP;
+                INSERT INTO token_usage (id, date, model, total_tokens, project, cost)
+                    SELECT id, date, model, total_tokens, project, cost FROM token_usage_unpartitioned;
+                DROP TABLE token_usage_unpartitioned;
+            END IF;
+        END
+        $$;
+    `,
+	// Period queries filter on model and a date range; breakdowns by day filter on date first.
+	// INCLUDE lets per-model sums be answered from the index alone.
+	`CREATE INDEX IF NOT EXISTS token_usage_model_date_idx ON token_usage (model, date) INCLUDE (project, total_tokens);`,
+	`CREATE INDEX IF NOT EXISTS token_usage_date_model_idx ON token_usage (date, model);`,
+	`
+        CREATE TABLE IF NOT EXISTS models (
+            name VARCHAR(255) PRIMARY KEY,
+            provider VARCHAR(64) NOT NULL DEFAULT '',
+            context_window INTEGER,
+            max_output_tokens INTEGER,
+            deprecation_date DATE,
+            pricing_model VARCHAR(255),
+            auto_registered BOOLEAN NOT NULL DEFAULT FALSE,
+            created_at TIMESTAMP NOT NULL DEFAULT NOW()
+        );
+    `,
+	// Register models recorded before the registry existed
+	`INSERT INTO models (name, auto_registered) SELECT DISTINCT model, TRUE FROM token_usage ON CONFLICT (name) DO NOTHING;`,
+	`
+        CREATE TABLE IF NOT EXISTS deprecation_alerts (
+            model VARCHAR(255) NOT NULL,
+            deprecation_date DATE NOT NULL,
+            sent_at TIMESTAMP NOT NULL DEFAULT NOW(),
+            PRIMARY KEY (model, deprecation_date)
+        );
+    `,
+	`
+        CREATE TABLE IF NOT EXISTS organizations (
+            id SERIAL PRIMARY KEY,
+            name VARCHAR(255) NOT NULL UNIQUE
+        );
+    `,
+	`
+        CREATE TABLE IF NOT EXISTS projects (
+            name VARCHAR(255) PRIMARY KEY,
+            organization_id INTEGER REFERENCES organizations(id) ON DELETE SET NULL
+        );
+    `,
+	`
+        CREATE TABLE IF NOT EXISTS project_keys (
+            key VARCHAR(255) PRIMARY KEY,
+            project VARCHAR(255) NOT NULL REFERENCES projects(name) ON DELETE CASCADE
+        );
+    `,
+	`ALTER TABLE projects ADD COLUMN IF NOT EXISTS monthly_budget_usd DOUBLE PRECISION;`,
+	`
+        CREATE TABLE IF NOT EXISTS notification_rules (
+            id SERIAL PRIMARY KEY,
+            name VARCHAR(255) NOT NULL,
+            condition TEXT NOT NULL,
+            channel VARCHAR(32) NOT NULL,
+            target TEXT NOT NULL DEFAULT '',
+            enabled BOOLEAN NOT NULL DEFAULT TRUE
+        );
+    `,
+	`
+        CREATE TABLE IF NOT EXISTS rule_firings (
+            rule_id INTEGER NOT NULL REFERENCES notification_rules(id) ON DELETE CASCADE,
+            window_start DATE NOT NULL,
+            value DOUBLE PRECISION NOT NULL,
+            fired_at TIMESTAMP NOT NULL DEFAULT NOW(),
+            PRIMARY KEY (rule_id, window_start)
+        );
+    `,
+	`
+        CREATE TABLE IF NOT EXISTS usage_day_hashes (
+            date DATE PRIMARY KEY,
+            content_hash CHAR(64) NOT NULL,
+            chain_hash CHAR(64) NOT NULL,
+            sealed_at TIMESTAMP NOT NULL DEFAULT NOW()
+        );
+    `,
+	`
+        CREATE TABLE IF NOT EXISTS reports (
+            name VARCHAR(255) PRIMARY KEY,
+            description TEXT NOT NULL DEFAULT '',
+            models TEXT[] NOT NULL DEFAULT '{}',
+            projects TEXT[] NOT NULL DEFAULT '{}',
+            group_by TEXT[] NOT NULL DEFAULT '{}',
+            period VARCHAR(20) NOT NULL DEFAULT 'month',
+            schedule VARCHAR(100) NOT NULL DEFAULT '',
+            channel VARCHAR(20) NOT NULL DEFAULT '',
+            target TEXT NOT NULL DEFAULT ''
+        );
+    `,
+	`ALTER TABLE token_usage ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW();`,
+	`
+        CREATE OR REPLACE FUNCTION touch_updated_at() RETURNS TRIGGER AS $$
+        BEGIN
+            NEW.updated_at := NOW();
+            RETURN NEW;
+        END
+        $$ LANGUAGE plpgsql;
+    `,
+	`DROP TRIGGER IF EXISTS token_usage_touch ON token_usage;`,
+	// Reporters resend unchanged totals, which must not look like changes
+	`CREATE TRIGGER token_usage_touch BEFORE UPDATE ON token_usage FOR EACH ROW WHEN (OLD.* IS DISTINCT FROM NEW.*) EXECUTE FUNCTION touch_updated_at();`,
+	`ALTER TABLE token_usage ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ NOT NULL DEFAULT NOW();`,
+	`CREATE INDEX IF NOT EXISTS token_usage_updated_at_idx ON token_usage (updated_at, id);`,
+	`ALTER TABLE model_pricing ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ NOT NULL DEFAULT NOW();`,
+	`ALTER TABLE model_pricing ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW();`,
+	`DROP TRIGGER IF EXISTS model_pricing_touch ON model_pricing;`,
+	`CREATE TRIGGER model_pricing_touch BEFORE UPDATE ON model_pricing FOR EACH ROW WHEN (OLD.* IS DISTINCT FROM NEW.*) EXECUTE FUNCTION touch_updated_at();`,
+	`
+        CREATE TABLE IF NOT EXISTS upstreams (
+            name VARCHAR(255) PRIMARY KEY,
+            provider VARCHAR(50) NOT NULL,
+            base_url TEXT NOT NULL,
+            api_key TEXT NOT NULL DEFAULT '',
+            timeout_seconds INTEGER NOT NULL DEFAULT 0
+        );
+    `,
+	`
+        CREATE TABLE IF NOT EXISTS upstream_usage (
+            upstream VARCHAR(255) NOT NULL,
+            date DATE NOT NULL,
+            model VARCHAR(255) NOT NULL,
+            requests BIGINT NOT NULL,
+            total_tokens BIGINT NOT NULL,
+            PRIMARY KEY (upstream, date, model)
+        );
+    `,
+	`
+        CREATE TABLE IF NOT EXISTS upstream_routes (
+            id SERIAL PRIMARY KEY,
+            pool VARCHAR(255) NOT NULL,
+            model VARCHAR(255) NOT NULL DEFAULT '*',
+            upstream VARCHAR(255) NOT NULL REFERENCES upstreams(name) ON DELETE CASCADE,
+            priority INTEGER NOT NULL DEFAULT 0,
+            weight INTEGER NOT NULL DEFAULT 1 CHECK (weight > 0)
+        );
+    `,
+	`CREATE INDEX IF NOT EXISTS upstream_routes_pool_idx ON upstream_routes (pool);`,
+	`
+        CREATE TABLE IF NOT EXISTS concurrency_limits (
+            id SERIAL PRIMARY KEY,
+            upstream VARCHAR(255) NOT NULL DEFAULT '*',
+            model VARCHAR(255) NOT NULL DEFAULT '*',
+            max_concurrent INTEGER NOT NULL CHECK (max_concurrent > 0),
+            queue_seconds INTEGER NOT NULL DEFAULT 0
+        );
+    `,
+	`
+        CREATE TABLE IF NOT EXISTS payload_samples (
+            id BIGSERIAL PRIMARY KEY,
+            captured_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+            upstream VARCHAR(255) NOT NULL,
+            path TEXT NOT NULL,
+            model VARCHAR(255) NOT NULL,
+            project VARCHAR(255) NOT NULL DEFAULT '',
+            prompt_tokens INTEGER NOT NULL,
+            completion_tokens INTEGER NOT NULL,
+            total_tokens INTEGER NOT NULL,
+            request_body TEXT NOT NULL,
+            response_body TEXT NOT NULL
+        );
+    `,
+	`CREATE INDEX IF NOT EXISTS payload_samples_captured_at_idx ON payload_samples (captured_at);`,
+	`
+        CREATE TABLE IF NOT EXISTS usage_requests (
+            id BIGSERIAL PRIMARY KEY,
+            logged_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+            date DATE NOT NULL,
+            model VARCHAR(255) NOT NULL,
+            project VARCHAR(255) NOT NULL DEFAULT '',
+            total_tokens INTEGER NOT NULL,
+            cost DOUBLE PRECISION
+        );
+    `,
+	`CREATE INDEX IF NOT EXISTS usage_requests_date_idx ON usage_requests (date, model, project);`,
+	`ALTER TABLE token_usage ADD COLUMN IF NOT EXISTS requests BIGINT NOT NULL DEFAULT 0;`,
+	`ALTER TABLE token_usage ADD COLUMN IF NOT EXISTS characters BIGINT NOT NULL DEFAULT 0;`,
+	`ALTER TABLE token_usage ADD COLUMN IF NOT EXISTS credits DOUBLE PRECISION NOT NULL DEFAULT 0;`,
+	`
+        CREATE TABLE IF NOT EXISTS usage_attribution (
+            date DATE NOT NULL,
+            model VARCHAR(255) NOT NULL,
+            project VARCHAR(255) NOT NULL DEFAULT '',
+            feature VARCHAR(255) NOT NULL DEFAULT '',
+            end_user VARCHAR(255) NOT NULL DEFAULT '',
+            requests BIGINT NOT NULL,
+            total_tokens BIGINT NOT NULL,
+            cost DOUBLE PRECISION,
+            PRIMARY KEY (date, model, project, feature, end_user)
+        );
+    `,
+	`
+        CREATE TABLE IF NOT EXISTS fallback_policies (
+            id SERIAL PRIMARY KEY,
+            project VARCHAR(255) NOT NULL DEFAULT '',
+            model VARCHAR(255) NOT NULL,
+            fallback_model VARCHAR(255) NOT NULL,
+            threshold_percent DOUBLE PRECISION NOT NULL
+        );
+    `,
+	`
+        CREATE TABLE IF NOT EXISTS model_downgrades (
+            date DATE NOT NULL,
+            policy_id INTEGER NOT NULL,
+            project VARCHAR(255) NOT NULL,
+            model VARCHAR(255) NOT NULL,
+            fallback_model VARCHAR(255) NOT NULL,
+            requests BIGINT NOT NULL,
+            PRIMARY KEY (date, policy_id, project, model)
+        );
+    `,
+	`
+        CREATE TABLE IF NOT EXISTS model_price_history (
+            model VARCHAR(255) NOT NULL,
+            effective_from DATE NOT NULL,
+            price_per_million DOUBLE PRECISION NOT NULL,
+            PRIMARY KEY (model, effective_from)
+        );
+    `,
+	`
+        CREATE TABLE IF NOT EXISTS pricing_catalog (
+            model VARCHAR(255) PRIMARY KEY,
+            price_per_million DOUBLE PRECISION NOT NULL,
+            source TEXT NOT NULL,
+            updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+        );
+    `,
+	`
+        CREATE TABLE IF NOT EXISTS annotations (
+            id SERIAL PRIMARY KEY,
+            ts TIMESTAMPTZ NOT NULL,
+            ends_at TIMESTAMPTZ,
+            text TEXT NOT NULL,
+            tags TEXT[] NOT NULL DEFAULT '{}',
+            created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+        );
+    `,
+	`CREATE INDEX IF NOT EXISTS annotations_ts_idx ON annotations (ts);`,
+	`
+        CREATE TABLE IF NOT EXISTS sheets_exports (
+            date DATE PRIMARY KEY,
+            rows INTEGER NOT NULL,
+            exported_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+        );
+    `,
+	`
+        CREATE TABLE IF NOT EXISTS federation_sources (
+            name VARCHAR(255) PRIMARY KEY,
+            url TEXT NOT NULL DEFAULT '',
+            token TEXT NOT NULL DEFAULT '',
+            cursor TEXT NOT NULL DEFAULT '',
+            last_synced_at TIMESTAMPTZ,
+            last_error TEXT NOT NULL DEFAULT ''
+        );
+    `,
+	`
+        CREATE TABLE IF NOT EXISTS federated_usage (
+            source VARCHAR(255) NOT NULL,
+            remote_id BIGINT NOT NULL,
+            date DATE NOT NULL,
+            model VARCHAR(255) NOT NULL,
+            project VARCHAR(255) NOT NULL DEFAULT '',
+            total_tokens BIGINT NOT NULL,
+            cost DOUBLE PRECISION,
+            requests BIGINT NOT NULL DEFAULT 0,
+            characters BIGINT NOT NULL DEFAULT 0,
+            credits DOUBLE PRECISION NOT NULL DEFAULT 0,
+            synced_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+            PRIMARY KEY (source, remote_id)
+        );
+    `,
+	`CREATE INDEX IF NOT EXISTS federated_usage_date_idx ON federated_usage (date);`,
+	`
+        CREATE TABLE IF NOT EXISTS federation_push_state (
+            id INTEGER PRIMARY KEY,
+            cursor TEXT NOT NULL
+        );
+    `,
+	`
+        CREATE TABLE IF NOT EXISTS replication_state (
+            id INTEGER PRIMARY KEY,
+            cursor TEXT NOT NULL,
+            replicated_through TIMESTAMPTZ,
+            last_run TIMESTAMPTZ,
+            last_error TEXT NOT NULL DEFAULT ''
+        );
+    `,
+	// Requests scoped by a project key run as tokencounter_scoped. Creating the role needs
+	// CREATEROLE; without it scoped requests fail until an administrator creates it.
+	`
+        DO $$
+        BEGIN
+            IF NOT EXISTS (SELECT 1 FROM pg_roles WHERE rolname = 'tokencounter_scoped') THEN
+                CREATE ROLE tokencounter_scoped NOLOGIN;
+            END IF;
+            IF NOT pg_has_role(current_user, 'tokencounter_scoped', 'MEMBER') THEN
+                EXECUTE format('GRANT tokencounter_scoped TO %I', current_user);
+            END IF;
+        EXCEPTION WHEN insufficient_privilege OR duplicate_object OR unique_violation THEN
+            RAISE NOTICE 'tokencounter_scoped role not set up: %', SQLERRM;
+        END
+        $$;
+    `,
+	`
+        DO $$
+        BEGIN
+            IF EXISTS (SELECT 1 FROM pg_roles WHERE rolname = 'tokencounter_scoped') THEN
+                GRANT USAGE ON ALL SEQUENCES IN SCHEMA public TO tokencounter_scoped;
+                ALTER DEFAULT PRIVILEGES IN SCHEMA public GRANT USAGE ON SEQUENCES TO tokencounter_scoped;
+            END IF;
+        END
+        $$;
+    `,
+	// Row-level security limits tokencounter_scoped to its project's rows; other roles see
+	// everything. Fallback policies for all projects ('') are visible to every project.
+	`
+        DO $$
+        DECLARE
+            t RECORD;
+        BEGIN
+            FOR t IN SELECT * FROM (VALUES
+                ('token_usage', 'project'), ('usage_requests', 'project'), ('usage_attribution', 'project'),
+                ('model_downgrades', 'project'), ('payload_samples', 'project'), ('federated_usage', 'project'),
+                ('projects', 'name'), ('project_keys', 'project'), ('fallback_policies', 'NULLIF(project, '''')')
+            ) AS v(tbl, col) LOOP
+                IF NOT EXISTS (SELECT 1 FROM pg_policies WHERE tablename = t.tbl AND policyname = 'project_scope') THEN
+                    EXECUTE format('CREATE POLICY project_scope ON %I USING (current_user <> ''tokencounter_scoped'' '
+                        'OR COALESCE(%s, current_setting(''tokencounter.project'', true)) = current_setting(''tokencounter.project'', true))',
+                        t.tbl, t.col);
+                END IF;
+                EXECUTE format('ALTER TABLE %I ENABLE ROW LEVEL SECURITY', t.tbl);
+            END LOOP;
+        END
+        $$;
+    `,
+	`
+        CREATE TABLE IF NOT EXISTS key_activity (
+            key VARCHAR(255) NOT NULL,
+            date DATE NOT NULL,
+            requests BIGINT NOT NULL,
+            errors BIGINT NOT NULL,
+            last_used_at TIMESTAMPTZ NOT NULL,
+            PRIMARY KEY (key, date)
+        );
+    `,
+	// Monthly totals per model and project for completed months, kept by the monthly_summary
+	// job. monthly_summaries records the state of the usage and prices each month was computed
+	// from, to tell when it needs computing again.
+	`
+        CREATE TABLE IF NOT EXISTS monthly_usage (
+            month DATE NOT NULL,
+            model VARCHAR(255) NOT NULL,
+            project VARCHAR(255) NOT NULL DEFAULT '',
+            total_tokens BIGINT NOT NULL,
+            cost_micros BIGINT NOT NULL,
+            PRIMARY KEY (month, model, project)
+        );
+        CREATE TABLE IF NOT EXISTS monthly_summaries (
+            month DATE PRIMARY KEY,
+            source_updated_at TIMESTAMPTZ,
+            source_rows BIGINT NOT NULL,
+            pricing_state TEXT NOT NULL,
+            computed_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+        );
+    `,
+	`
+        DO $$
+        BEGIN
+            IF NOT EXISTS (SELECT 1 FROM pg_policies WHERE tablename = 'monthly_usage' AND policyname = 'project_scope') THEN
+                CREATE POLICY project_scope ON monthly_usage USING (current_user <> 'tokencounter_scoped'
+                    OR COALESCE(project, current_setting('tokencounter.project', true)) = current_setting('tokencounter.project', true));
+            END IF;
+            ALTER TABLE monthly_usage ENABLE ROW LEVEL SECURITY;
+        END
+        $$;
+    `,
+	`
+        CREATE TABLE IF NOT EXISTS seen_requests (
+            request_id VARCHAR(255) NOT NULL,
+            model VARCHAR(255) NOT NULL,
+            seen_at TIMESTAMPTZ NOT NULL,
+            PRIMARY KEY (request_id, model)
+        );
+        CREATE INDEX IF NOT EXISTS seen_requests_seen_at_idx ON seen_requests (seen_at);
+    `,
+	// Fields added by API v2; rows recorded before, or through v1, have no provider or split
+	`
+        ALTER TABLE token_usage ADD COLUMN IF NOT EXISTS provider VARCHAR(255) NOT NULL DEFAULT '';
+        ALTER TABLE token_usage ADD COLUMN IF NOT EXISTS prompt_tokens BIGINT NOT NULL DEFAULT 0;
+        ALTER TABLE token_usage ADD COLUMN IF NOT EXISTS completion_tokens BIGINT NOT NULL DEFAULT 0;
+    `,
+	`ALTER TABLE reports ADD COLUMN IF NOT EXISTS locale VARCHAR(20) NOT NULL DEFAULT '';`,
+	// Rows logged before requests was recorded are NULL: how many requests they held is unknown
+	`ALTER TABLE usage_requests ADD COLUMN IF NOT EXISTS requests BIGINT;`,
+	`
+        CREATE TABLE IF NOT EXISTS usage_archives (
+            id SERIAL PRIMARY KEY,
+            month DATE NOT NULL,
+            object TEXT NOT NULL,
+            destination TEXT NOT NULL,
+            records INTEGER NOT NULL,
+            total_tokens BIGINT NOT NULL,
+            bytes BIGINT NOT NULL,
+            sha256 CHAR(64) NOT NULL,
+            archived_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+            restored_at TIMESTAMPTZ
+        );
+    `,
+	`
+        CREATE TABLE IF NOT EXISTS provider_outages (
+            id SERIAL PRIMARY KEY,
+            provider VARCHAR(64) NOT NULL,
+            starts_at TIMESTAMPTZ NOT NULL,
+            ends_at TIMESTAMPTZ,
+            description TEXT NOT NULL DEFAULT '',
+            source TEXT NOT NULL,
+            external_id TEXT,
+            created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+            UNIQUE (provider, external_id)
+        );
+    `,
+	`CREATE INDEX IF NOT EXISTS provider_outages_starts_at_idx ON provider_outages (starts_at);`,
+	`
+        CREATE TABLE IF NOT EXISTS usage_jobs (
+            job_id VARCHAR(255) NOT NULL,
+            job_type VARCHAR(64) NOT NULL,
+            date DATE NOT NULL,
+            model VARCHAR(255) NOT NULL,
+            project VARCHAR(255) NOT NULL DEFAULT '',
+            total_tokens BIGINT NOT NULL DEFAULT 0,
+            requests BIGINT NOT NULL DEFAULT 0,
+            characters BIGINT NOT NULL DEFAULT 0,
+            credits DOUBLE PRECISION NOT NULL DEFAULT 0,
+            prompt_tokens BIGINT NOT NULL DEFAULT 0,
+            completion_tokens BIGINT NOT NULL DEFAULT 0,
+            cost DOUBLE PRECISION,
+            created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+            updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+            PRIMARY KEY (job_id, date, model, project)
+        );
+    `,
+	`CREATE INDEX IF NOT EXISTS usage_jobs_date_idx ON usage_jobs (date, job_type);`,
+	`
+        DO $$
+        BEGIN
+            IF NOT EXISTS (SELECT 1 FROM pg_policies WHERE tablename = 'usage_jobs' AND policyname = 'project_scope') THEN
+                CREATE POLICY project_scope ON usage_jobs USING (current_user <> 'tokencounter_scoped'
+                    OR COALESCE(project, current_setting('tokencounter.project', true)) = current_setting('tokencounter.project', true));
+            END IF;
+            ALTER TABLE usage_jobs ENABLE ROW LEVEL SECURITY;
+        END
+        $$;
+    `,
+	`
+        CREATE TABLE IF NOT EXISTS recent_ingestions (
+            id BIGSERIAL PRIMARY KEY,
+            received_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+            date DATE NOT NULL,
+            model VARCHAR(255) NOT NULL,
+            project VARCHAR(255) NOT NULL DEFAULT '',
+            total_tokens BIGINT NOT NULL,
+            source VARCHAR(64) NOT NULL,
+            key_hint VARCHAR(16) NOT NULL DEFAULT '',
+            caller TEXT NOT NULL DEFAULT '',
+            ip VARCHAR(64) NOT NULL,
+            user_agent TEXT NOT NULL DEFAULT ''
+        );
+    `,
+	`CREATE INDEX IF NOT EXISTS recent_ingestions_received_at_idx ON recent_ingestions (received_at);`,
+	`
+        DO $$
+        BEGIN
+            IF NOT EXISTS (SELECT 1 FROM pg_policies WHERE tablename = 'recent_ingestions' AND policyname = 'project_scope') THEN
+                CREATE POLICY project_scope ON recent_ingestions USING (current_user <> 'tokencounter_scoped'
+                    OR COALESCE(project, current_setting('tokencounter.project', true)) = current_setting('tokencounter.project', true));
+            END IF;
+            ALTER TABLE recent_ingestions ENABLE ROW LEVEL SECURITY;
+        END
+        $$;
+    `,
+	`
+        CREATE TABLE IF NOT EXISTS ingestion_errors (
+            id BIGSERIAL PRIMARY KEY,
+            received_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+            source VARCHAR(64) NOT NULL,
+            status INT NOT NULL,
+            message TEXT NOT NULL,
+            key_hint VARCHAR(16) NOT NULL DEFAULT '',
+            ip VARCHAR(64) NOT NULL,
+            user_agent TEXT NOT NULL DEFAULT ''
+        );
+    `,
+	`CREATE INDEX IF NOT EXISTS ingestion_errors_received_at_idx ON ingestion_errors (received_at);`,
+	`ALTER TABLE budgets ADD COLUMN IF NOT EXISTS window_days INTEGER NOT NULL DEFAULT 0;`,
+	`ALTER TABLE budgets ADD COLUMN IF NOT EXISTS carry_over_max_tokens BIGINT NOT NULL DEFAULT 0;`,
+	// Budgets that predate this column count as created now, so they carry nothing over
+	// until they have a full cycle behind them
+	`ALTER TABLE budgets ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ NOT NULL DEFAULT NOW();`,
+	`
+        CREATE TABLE IF NOT EXISTS usage_conversations (
+            date DATE NOT NULL,
+            model VARCHAR(255) NOT NULL,
+            project VARCHAR(255) NOT NULL DEFAULT '',
+            conversation_id VARCHAR(255) NOT NULL,
+            requests BIGINT NOT NULL,
+            total_tokens BIGINT NOT NULL,
+            cost DOUBLE PRECISION,
+            PRIMARY KEY (date, model, project, conversation_id)
+        );
+    `,
+	`
+        DO $$
+        BEGIN
+            IF NOT EXISTS (SELECT 1 FROM pg_policies WHERE tablename = 'usage_conversations' AND policyname = 'project_scope') THEN
+                CREATE POLICY project_scope ON usage_conversations USING (current_user <> 'tokencounter_scoped'
+                    OR COALESCE(project, current_setting('tokencounter.project', true)) = current_setting('tokencounter.project', true));
+            END IF;
+            ALTER TABLE usage_conversations ENABLE ROW LEVEL SECURITY;
+        END
+        $$;
+    `,
+	// The request log of an archived month goes to an object of its own; archives made before
+	// it did have none, their request log having been deleted
+	`ALTER TABLE usage_archives ADD COLUMN IF NOT EXISTS requests_object TEXT NOT NULL DEFAULT '';`,
+	`ALTER TABLE usage_archives ADD COLUMN IF NOT EXISTS request_records INTEGER NOT NULL DEFAULT 0;`,
+	`ALTER TABLE usage_archives ADD COLUMN IF NOT EXISTS requests_sha256 VARCHAR(64) NOT NULL DEFAULT '';`,
+	// tokencounter_scoped gets nothing by default: it may write the usage tables scoped requests
+	// record to, under row-level security but for seen_requests, which only holds request IDs,
+	// and read the ones below, which are under row-level security or hold configuration such as
+	// pricing and budgets.
+	// Tables holding totals over every project, such as budget_alerts, rule_firings and
+	// usage_archives, aren't granted; a table added later is granted here if scoped requests
+	// need it. Revoking first takes back the grants of earlier versions.
+	`
+        DO $$
+        BEGIN
+            IF EXISTS (SELECT 1 FROM pg_roles WHERE rolname = 'tokencounter_scoped') THEN
+                ALTER DEFAULT PRIVILEGES IN SCHEMA public REVOKE SELECT, INSERT, UPDATE, DELETE ON TABLES FROM tokencounter_scoped;
+                REVOKE ALL ON ALL TABLES IN SCHEMA public FROM tokencounter_scoped;
+                GRANT SELECT, INSERT, UPDATE, DELETE ON token_usage, usage_requests, usage_attribution, model_downgrades,
+                    payload_samples, usage_conversations, usage_jobs, recent_ingestions, seen_requests TO tokencounter_scoped;
+                GRANT SELECT ON federated_usage, monthly_usage, projects, project_keys, fallback_policies,
+                    budgets, budget_thresholds, model_pricing, model_price_history, pricing_catalog, model_templates,
+                    models, azure_deployments, organizations, notification_rules, reports, annotations,
+                    provider_outages, monthly_summaries, upstreams, upstream_routes, concurrency_limits TO tokencounter_scoped;
+            END IF;
+        END
+        $$;
+    `,
+}
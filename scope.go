@@ -0,0 +1,259 @@
+// scope.go
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/XSAM/otelsql"
+	"github.com/lib/pq"
+)
+
+// Requests carrying a project key in X-Tokencounter-Key are scoped to the key's project: they
+// only see and write that project's usage. The scope is enforced by Postgres rather than by each
+// query, so endpoints added later are covered too. Connections serving a scoped request switch
+// to the tokencounter_scoped role, with tokencounter.project set to the project, and row-level
+// security policies on every table holding per-project data hide other projects' rows from that
+// role. Anything without a scope in its context, such as jobs and admin requests, runs as the
+// connecting user and sees everything. The role is only granted the tables scoped requests
+// use, and endpoints for configuration shared by every project reject scoped callers.
+//
+// The key is one kind of credentials; callers authenticated by another provider (see auth.go)
+// with a project are scoped the same way. REQUIRE_PROJECT_KEY=true rejects requests without
+// credentials, except admin requests, /health, federation pushes and webhooks, which
+// authenticate separately.
+const (
+	scopedRole       = "tokencounter_scoped"
+	projectScopeGUC  = "tokencounter.project"
+	projectKeyHeader = proxyHeaderPrefix + "Key"
+)
+
+type projectScopeKey struct{}
+
+// withProjectScope limits the database queries made with ctx to project's rows
+func withProjectScope(ctx context.Context, project string) context.Context {
+	return context.WithValue(ctx, projectScopeKey{}, project)
+}
+
+// projectScope returns the project ctx is scoped to; ok is false if it is unscoped
+func projectScope(ctx context.Context) (string, bool) {
+	project, ok := ctx.Value(projectScopeKey{}).(string)
+	return project, ok
+}
+
+func projectKeyRequired() bool {
+	return os.Getenv("REQUIRE_PROJECT_KEY") == "true"
+}
+
+// scopeByKey authenticates requests and scopes them to the project of their credentials
+func scopeByKey(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/admin/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		p, err := authenticate(r)
+		// Webhooks and federation pushes carry bearer tokens of their own, which aren't
+		// credentials for the providers
+		if err != nil && keyOptional(r) && r.Header.Get(projectKeyHeader) == "" {
+			p, err = nil, nil
+		}
+		if err != nil {
+			respondAuthError(w, err)
+			return
+		}
+		if p == nil {
+			if projectKeyRequired() && !keyOptional(r) {
+				respondJSON(w, http.StatusUnauthorized, map[string]string{"message": "Credentials are required, such as a project key in " + projectKeyHeader})
+				return
+			}
+			trackKeyUse(w, r, next, "")
+			return
+		}
+		ctx := withPrincipal(r.Context(), p)
+		if p.Project != "" {
+			// Responses differ per caller, so shared caches must not serve one's to another
+			w.Header().Add("Vary", p.header)
+			ctx = withProjectScope(ctx, p.Project)
+		}
+		trackKeyUse(w, r.WithContext(ctx), next, p.key)
+	})
+}
+
+// unscopedOnly rejects callers scoped to a project. It guards the endpoints changing or
+// reading configuration shared by every project, such as budgets, pricing and rules, which a
+// project key must not reach.
+func unscopedOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if scope, ok := projectScope(r.Context()); ok {
+			respondJSON(w, http.StatusForbidden, map[string]string{"message": "This endpoint is shared by every project; this key is limited to project " + scope})
+			return
+		}
+		next(w, r)
+	}
+}
+
+// keyOptional reports whether r may come without credentials when they are required
+func keyOptional(r *http.Request) bool {
+	switch {
+	case r.URL.Path == "/health",
+		r.URL.Path == "/federation/push",
+		strings.HasPrefix(r.URL.Path, "/ingest/"),
+		strings.HasPrefix(r.URL.Path, "/admin/"),
+		strings.HasPrefix(r.URL.Path, "/debug/"):
+		return true
+	}
+	return false
+}
+
+// openScopedDB opens the database like otelsql.Open, with connections that apply the project
+// scope of each query's context
+func openScopedDB(dsn string) (*sql.DB, error) {
+	connector, err := pq.NewConnector(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return otelsql.OpenDB(scopedConnector{connector}), nil
+}
+
+type scopedConnector struct {
+	driver.Connector
+}
+
+func (c scopedConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &scopedConn{conn: conn}, nil
+}
+
+// The pq connection's methods used by database/sql
+type pqConn interface {
+	driver.Conn
+	driver.QueryerContext
+	driver.ExecerContext
+	driver.ConnPrepareContext
+	driver.ConnBeginTx
+	driver.Pinger
+	driver.SessionResetter
+	driver.Validator
+}
+
+// scopedConn switches its session to the scope of each query's context before running it. The
+// session keeps the scope between queries, so it is only changed when the scope differs.
+// Transactions keep the scope they began with.
+type scopedConn struct {
+	conn driver.Conn
+	// scope is the project the session is scoped to, "" when unscoped
+	scope string
+	inTx  bool
+}
+
+func (c *scopedConn) pq() pqConn {
+	return c.conn.(pqConn)
+}
+
+func (c *scopedConn) applyScope(ctx context.Context) error {
+	project, _ := projectScope(ctx)
+	if c.inTx || project == c.scope {
+		return nil
+	}
+	// Unknown until both statements succeed, so a failure is retried on the next query
+	c.scope = "\x00"
+	if project == "" {
+		if _, err := c.pq().ExecContext(ctx, "RESET ROLE", nil); err != nil {
+			return err
+		}
+	} else if _, err := c.pq().ExecContext(ctx, "SET ROLE "+scopedRole, nil); err != nil {
+		return err
+	}
+	args := []driver.NamedValue{{Ordinal: 1, Value: projectScopeGUC}, {Ordinal: 2, Value: project}}
+	if _, err := c.pq().ExecContext(ctx, "SELECT set_config($1, $2, false)", args); err != nil {
+		return err
+	}
+	c.scope = project
+	return nil
+}
+
+func (c *scopedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if err := injectDBFault(ctx, isWriteStatement(query)); err != nil {
+		return nil, err
+	}
+	if err := c.applyScope(ctx); err != nil {
+		return nil, err
+	}
+	return c.pq().QueryContext(ctx, query, args)
+}
+
+func (c *scopedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if err := injectDBFault(ctx, isWriteStatement(query)); err != nil {
+		return nil, err
+	}
+	if err := c.applyScope(ctx); err != nil {
+		return nil, err
+	}
+	return c.pq().ExecContext(ctx, query, args)
+}
+
+func (c *scopedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	if err := c.applyScope(ctx); err != nil {
+		return nil, err
+	}
+	return c.pq().PrepareContext(ctx, query)
+}
+
+func (c *scopedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if err := c.applyScope(ctx); err != nil {
+		return nil, err
+	}
+	tx, err := c.pq().BeginTx(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	c.inTx = true
+	return scopedTx{tx, c}, nil
+}
+
+func (c *scopedConn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c *scopedConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *scopedConn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *scopedConn) Ping(ctx context.Context) error {
+	return c.pq().Ping(ctx)
+}
+
+func (c *scopedConn) ResetSession(ctx context.Context) error {
+	return c.pq().ResetSession(ctx)
+}
+
+func (c *scopedConn) IsValid() bool {
+	return c.pq().IsValid()
+}
+
+type scopedTx struct {
+	driver.Tx
+	conn *scopedConn
+}
+
+func (t scopedTx) Commit() error {
+	t.conn.inTx = false
+	return t.Tx.Commit()
+}
+
+func (t scopedTx) Rollback() error {
+	t.conn.inTx = false
+	return t.Tx.Rollback()
+}
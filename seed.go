@@ -0,0 +1,148 @@
+// seed.go
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"math"
+	"math/rand"
+	"net/http"
+	"os"
+	"time"
+)
+
+// POST /admin/seed fills a development instance with plausible random usage. It is only
+// mounted when ENABLE_SEED=true, since it overwrites whatever usage the seeded days hold.
+func seedEnabled() bool {
+	return os.Getenv("ENABLE_SEED") == "true"
+}
+
+// seedModels are used when a request doesn't name its own; weight is the model's share of traffic
+var seedModels = []struct {
+	name   string
+	weight float64
+}{
+	{"gpt-4o", 0.30},
+	{"gpt-4o-mini", 0.25},
+	{"claude-3-5-sonnet", 0.20},
+	{"gemini-1.5-pro", 0.15},
+	{"gemini-1.5-flash", 0.10},
+}
+
+// SeedRequest controls what POST /admin/seed generates. Every field is optional.
+type SeedRequest struct {
+	Days     int      `json:"days"`
+	End      string   `json:"end"`
+	Models   []string `json:"models"`
+	Projects []string `json:"projects"`
+	// DailyTokens is the average tokens per day across all models and projects
+	DailyTokens int `json:"daily_tokens"`
+	// Seed makes the output reproducible; 0 picks one from the clock
+	Seed int64 `json:"seed"`
+}
+
+const maxSeedDays = 730
+
+func seedUsage(w http.ResponseWriter, r *http.Request) {
+	req := SeedRequest{Days: 30, Projects: []string{""}, DailyTokens: 2_000_000}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		respondError(w, http.StatusBadRequest, "Invalid request payload", err)
+		return
+	}
+	if req.Days <= 0 || req.Days > maxSeedDays {
+		respondJSON(w, http.StatusBadRequest, map[string]string{"message": "days must be between 1 and 730"})
+		return
+	}
+	if req.DailyTokens <= 0 {
+		respondJSON(w, http.StatusBadRequest, map[string]string{"message": "daily_tokens must be positive"})
+		return
+	}
+	end := time.Now().UTC().Truncate(24 * time.Hour)
+	if req.End != "" {
+		var err error
+		if end, err = time.Parse("2006-01-02", req.End); err != nil {
+			respondError(w, http.StatusBadRequest, "Invalid end date, expected YYYY-MM-DD", err)
+			return
+		}
+	}
+	if len(req.Projects) == 0 {
+		req.Projects = []string{""}
+	}
+	weights := map[string]float64{}
+	if len(req.Models) == 0 {
+		for _, m := range seedModels {
+			req.Models = append(req.Models, m.name)
+			weights[m.name] = m.weight
+		}
+	} else {
+		for _, m := range req.Models {
+			weights[m] = 1 / float64(len(req.Models))
+		}
+	}
+	if req.Seed == 0 {
+		req.Seed = time.Now().UnixNano()
+	}
+	rng := rand.New(rand.NewSource(req.Seed))
+
+	// Usage grows slowly over the range, dips at weekends and is noisy day to day
+	start := end.AddDate(0, 0, -(req.Days - 1))
+	var usages []TokenUsage
+	for i := 0; i < req.Days; i++ {
+		date := start.AddDate(0, 0, i)
+		day := float64(req.DailyTokens) * (0.7 + 0.6*float64(i)/float64(req.Days))
+		if wd := date.Weekday(); wd == time.Saturday || wd == time.Sunday {
+			day *= 0.35
+		}
+		for _, project := range req.Projects {
+			for _, model := range req.Models {
+				tokens := day * weights[model] / float64(len(req.Projects)) * math.Exp(rng.NormFloat64()*0.3)
+				if rng.Float64() < 0.05 {
+					continue // the odd day without traffic
+				}
+				usages = append(usages, TokenUsage{Date: date, Model: model, Project: project, TotalTokens: int(tokens)})
+			}
+		}
+	}
+
+	for m := time.Date(start.Year(), start.Month(), 1, 0, 0, 0, 0, time.UTC); !m.After(end); m = m.AddDate(0, 1, 0) {
+		if err := ensurePartition(r.Context(), m); err != nil {
+			respondError(w, http.StatusInternalServerError, "Failed to create partition", err)
+			return
+		}
+	}
+	tx, err := db.BeginTx(r.Context(), nil)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to start transaction", err)
+		return
+	}
+	defer tx.Rollback()
+	for _, usage := range usages {
+		res, err := tx.ExecContext(r.Context(), "UPDATE token_usage SET total_tokens = $1, cost = NULL WHERE date = $2 AND model = $3 AND project = $4", usage.TotalTokens, usage.Date, usage.Model, usage.Project)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, "Failed to seed token usage", err)
+			return
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			continue
+		}
+		if _, err := tx.ExecContext(r.Context(), "INSERT INTO token_usage (date, model, project, total_tokens) VALUES ($1, $2, $3, $4)", usage.Date, usage.Model, usage.Project, usage.TotalTokens); err != nil {
+			respondError(w, http.StatusInternalServerError, "Failed to seed token usage", err)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to commit seed data", err)
+		return
+	}
+	for _, model := range req.Models {
+		registerModel(model)
+	}
+	infof("Seeded %d token usage records from %s to %s\n", len(usages), start.Format("2006-01-02"), end.Format("2006-01-02"))
+	respondJSON(w, http.StatusCreated, map[string]interface{}{
+		"message": "Seed data created",
+		"records": len(usages),
+		"start":   start.Format("2006-01-02"),
+		"end":     end.Format("2006-01-02"),
+		"seed":    req.Seed,
+	})
+}
@@ -0,0 +1,281 @@
+// selfcheck.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/joho/godotenv"
+)
+
+// `tokencounter selfcheck` starts the service in-process on throwaway storage and drives its
+// endpoints as a client would, printing PASS or FAIL per check, so an operator can validate an
+// upgrade with one command. With DATABASE_URL set the checks run against that Postgres, in a
+// schema created for the run and dropped after it, so existing data is never read or written;
+// without it they run on the memory store and cover the core usage endpoints only. Admin
+// endpoints are checked with ADMIN_TOKEN, when it is set.
+
+// selfCheck is one request to the service and what its response must look like
+type selfCheck struct {
+	name   string
+	method string
+	path   string
+	body   interface{}
+	status int
+	// admin sends ADMIN_TOKEN, for checks of admin endpoints
+	admin bool
+	// verify inspects the response body, if set
+	verify func(body []byte) error
+}
+
+const selfCheckModel = "selfcheck-model"
+
+// runSelfCheck runs the checks and returns an error if any failed
+func runSelfCheck() error {
+	godotenv.Load()
+	setLogLevel("warn")
+
+	router, kind, cleanup, err := selfCheckRouter()
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	server := &http.Server{Handler: corsMiddleware(instrumentHandler(router))}
+	go server.Serve(listener)
+	defer server.Shutdown(context.Background())
+	base := "http://" + listener.Addr().String()
+
+	fmt.Printf("Running self-check on %s storage\n", kind)
+	failed := 0
+	client := &http.Client{Timeout: 30 * time.Second}
+	for _, check := range selfChecks(kind == "postgres") {
+		if err := check.run(client, base); err != nil {
+			failed++
+			fmt.Printf("FAIL  %s: %v\n", check.name, err)
+			continue
+		}
+		fmt.Printf("PASS  %s\n", check.name)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d checks failed", failed)
+	}
+	fmt.Println("All checks passed")
+	return nil
+}
+
+// selfCheckRouter sets up throwaway storage and the router serving it; cleanup removes the
+// storage again
+func selfCheckRouter() (router *mux.Router, kind string, cleanup func(), err error) {
+	dbUrl := os.Getenv("DATABASE_URL")
+	if dbUrl == "" {
+		store = newMemoryStore()
+		cfg, err := loadConfig(configPath())
+		if err != nil {
+			return nil, "", nil, fmt.Errorf("loading configuration: %w", err)
+		}
+		currentConfig.Store(cfg)
+		return newStandaloneRouter("memory"), "memory", func() {}, nil
+	}
+
+	schema := fmt.Sprintf("tokencounter_selfcheck_%d", time.Now().UnixNano())
+	admin, err := sql.Open("postgres", dbUrl)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	if _, err := admin.Exec("CREATE SCHEMA " + schema); err != nil {
+		admin.Close()
+		return nil, "", nil, fmt.Errorf("creating schema %s: %w", schema, err)
+	}
+	cleanup = func() {
+		if db != nil {
+			db.Close()
+		}
+		if _, err := admin.Exec("DROP SCHEMA " + schema + " CASCADE"); err != nil {
+			fmt.Printf("Failed to drop schema %s, drop it by hand: %v\n", schema, err)
+		}
+		admin.Close()
+	}
+	if db, err = openScopedDB(withSearchPath(dbUrl, schema)); err != nil {
+		cleanup()
+		return nil, "", nil, err
+	}
+	for _, stmt := range schemaStatements {
+		if _, err := db.Exec(stmt); err != nil {
+			cleanup()
+			return nil, "", nil, fmt.Errorf("creating tables: %w", err)
+		}
+	}
+	if err := ensureUsageKeyIndex(context.Background()); err != nil {
+		cleanup()
+		return nil, "", nil, fmt.Errorf("creating tables: %w", err)
+	}
+	if _, err := reloadConfig(); err != nil {
+		cleanup()
+		return nil, "", nil, fmt.Errorf("loading configuration: %w", err)
+	}
+	return newRouter(), "postgres", cleanup, nil
+}
+
+// withSearchPath points a connection string, URL or key=value, at schema
+func withSearchPath(dsn, schema string) string {
+	if u, err := url.Parse(dsn); err == nil && (u.Scheme == "postgres" || u.Scheme == "postgresql") {
+		q := u.Query()
+		q.Set("search_path", schema)
+		u.RawQuery = q.Encode()
+		return u.String()
+	}
+	return dsn + " search_path=" + schema
+}
+
+// selfChecks lists the checks in order; later ones rely on the usage recorded by earlier ones.
+// The Postgres-only endpoints are checked when postgres is set.
+func selfChecks(postgres bool) []selfCheck {
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	day := today.Format("2006-01-02")
+	record := func(tokens int) map[string]interface{} {
+		return map[string]interface{}{"date": today, "model": selfCheckModel, "total_tokens": tokens}
+	}
+	checks := []selfCheck{
+		{name: "health", method: "GET", path: "/health", status: http.StatusOK},
+		{name: "record usage", method: "POST", path: "/token_usage", body: record(1000), status: http.StatusCreated},
+		{name: "update usage", method: "POST", path: "/token_usage", body: record(1500), status: http.StatusOK},
+		{name: "usage by date and model", method: "GET", path: "/token_usage/" + day + "/" + selfCheckModel, status: http.StatusOK,
+			verify: expectTotalTokens(1500)},
+		{name: "usage by period", method: "GET", path: "/token_usage/" + selfCheckModel + "/month", status: http.StatusOK,
+			verify: expectTotalTokens(1500)},
+		{name: "list usage", method: "GET", path: "/token_usage", status: http.StatusOK, verify: expectListedModel(selfCheckModel)},
+		{name: "v1 record usage", method: "POST", path: apiV1Prefix + "/token_usage", status: http.StatusCreated,
+			body: map[string]interface{}{"date": today, "model": selfCheckModel + "-v1", "total_tokens": 200}},
+		{name: "v1 usage by date and model", method: "GET", path: apiV1Prefix + "/token_usage/" + day + "/" + selfCheckModel + "-v1",
+			status: http.StatusOK, verify: expectTotalTokens(200)},
+		{name: "v2 usage by period", method: "GET", path: apiV2Prefix + "/token_usage/" + selfCheckModel + "/lifetime", status: http.StatusOK,
+			verify: expectTotalTokens(1500)},
+	}
+	if !postgres {
+		return checks
+	}
+	checks = append(checks,
+		selfCheck{name: "set pricing", method: "PUT", path: "/pricing/" + selfCheckModel, status: http.StatusOK,
+			body: map[string]interface{}{"price_per_million": 2}},
+		selfCheck{name: "bulk query", method: "POST", path: "/token_usage/query", status: http.StatusOK,
+			body:   map[string]interface{}{"queries": []UsageQuery{{Model: selfCheckModel, Start: day, End: day}}},
+			verify: expectQueryTokens(1500)},
+		selfCheck{name: "usage series", method: "GET", path: "/token_usage/series?model=" + selfCheckModel, status: http.StatusOK},
+		selfCheck{name: "monthly usage", method: "GET", path: "/token_usage/monthly", status: http.StatusOK},
+		selfCheck{name: "usage diff", method: "GET", path: "/token_usage/diff?a_start=" + day + "&b_start=" + day, status: http.StatusOK},
+		selfCheck{name: "measure totals", method: "GET", path: "/measures/tokens", status: http.StatusOK},
+		selfCheck{name: "rollup", method: "GET", path: "/rollup", status: http.StatusOK},
+	)
+	if os.Getenv("ADMIN_TOKEN") != "" {
+		checks = append(checks, selfCheck{name: "export", method: "GET", path: "/admin/export", status: http.StatusOK, admin: true, verify: expectGzip})
+	}
+	return checks
+}
+
+func (c selfCheck) run(client *http.Client, base string) error {
+	var body io.Reader
+	if c.body != nil {
+		payload, err := json.Marshal(c.body)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequest(c.method, base+c.path, body)
+	if err != nil {
+		return err
+	}
+	if c.body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.admin {
+		req.Header.Set("Authorization", "Bearer "+os.Getenv("ADMIN_TOKEN"))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != c.status {
+		return fmt.Errorf("%s %s answered %d, expected %d: %s", c.method, c.path, resp.StatusCode, c.status, strings.TrimSpace(string(respBody)))
+	}
+	if c.verify != nil {
+		return c.verify(respBody)
+	}
+	return nil
+}
+
+// expectTotalTokens checks a response's total_tokens
+func expectTotalTokens(want int64) func([]byte) error {
+	return func(body []byte) error {
+		var resp struct {
+			TotalTokens int64 `json:"total_tokens"`
+		}
+		if err := json.Unmarshal(body, &resp); err != nil {
+			return err
+		}
+		if resp.TotalTokens != want {
+			return fmt.Errorf("total_tokens is %d, expected %d", resp.TotalTokens, want)
+		}
+		return nil
+	}
+}
+
+// expectListedModel checks a list of records includes model
+func expectListedModel(model string) func([]byte) error {
+	return func(body []byte) error {
+		var usages []TokenUsage
+		if err := json.Unmarshal(body, &usages); err != nil {
+			return err
+		}
+		for _, usage := range usages {
+			if usage.Model == model {
+				return nil
+			}
+		}
+		return fmt.Errorf("no record for %s in %d records", model, len(usages))
+	}
+}
+
+// expectQueryTokens checks the first result of a bulk query
+func expectQueryTokens(want int64) func([]byte) error {
+	return func(body []byte) error {
+		var results []UsageQueryResult
+		if err := json.Unmarshal(body, &results); err != nil {
+			return err
+		}
+		if len(results) != 1 || results[0].TotalTokens != want {
+			return fmt.Errorf("expected one result of %d tokens, got %+v", want, results)
+		}
+		return nil
+	}
+}
+
+// expectGzip checks the body is a gzip stream
+func expectGzip(body []byte) error {
+	if !bytes.HasPrefix(body, []byte{0x1f, 0x8b}) {
+		return errors.New("export is not a gzip archive")
+	}
+	return nil
+}
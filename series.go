@@ -0,0 +1,125 @@
+// series.go
+package main
+
+import (
+	"math"
+	"net/http"
+	"time"
+)
+
+// Series formats for GET /token_usage/series. Long ranges are mostly repeated keys and, for
+// sparse models, zero days, so the compact formats drop one or both:
+//
+//	full:  [{"date": "2024-01-01", "label": "01/01/2024", "total_tokens": 120}, ...], every
+//	       day, labelled for charts in the locale or ?locale=
+//	pairs: [["2024-01-01", 120], ...], days with usage only
+//	rle:   {"start": "2024-01-01", "values": [120, 300, -45, 80]}, one value per day from
+//	       start, with a run of n zero days written as -n
+const (
+	seriesFull  = "full"
+	seriesPairs = "pairs"
+	seriesRLE   = "rle"
+)
+
+// getUsageSeries returns daily token totals over a date range, this month by default, in the
+// format chosen by ?format=. ?model= and ?project= narrow it down. A lifetime range starts
+// at the first day with usage.
+func getUsageSeries(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	format := q.Get("format")
+	if format == "" {
+		format = seriesFull
+	}
+	if format != seriesFull && format != seriesPairs && format != seriesRLE {
+		respondJSON(w, http.StatusBadRequest, map[string]string{"message": "Unknown format " + format + ", use full, pairs or rle"})
+		return
+	}
+	start, end, err := parseDateRange(q, "month")
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid date range", err)
+		return
+	}
+	loc, err := resolveLocale(q.Get("locale"))
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid locale", err)
+		return
+	}
+	model, project := q.Get("model"), q.Get("project")
+	where := "u.date >= $1 AND u.date <= $2 AND ($3 = '' OR u.model = $3) AND ($4 = '' OR u.project = $4)"
+	if notModified(w, r, false, where, start, end, model, project) {
+		return
+	}
+	rows, err := db.QueryContext(r.Context(), "SELECT u.date, SUM(u.total_tokens) FROM token_usage u WHERE "+where+
+		" GROUP BY u.date HAVING SUM(u.total_tokens) <> 0 ORDER BY u.date", start, end, model, project)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database query error", err)
+		return
+	}
+	defer rows.Close()
+	type day struct {
+		date   time.Time
+		tokens int64
+	}
+	var days []day
+	for rows.Next() {
+		var d day
+		if err := rows.Scan(&d.date, &d.tokens); err != nil {
+			respondError(w, http.StatusInternalServerError, "Error scanning row", err)
+			return
+		}
+		days = append(days, d)
+	}
+	if err = rows.Err(); err != nil {
+		respondError(w, http.StatusInternalServerError, "Error reading data", err)
+		return
+	}
+	if start.IsZero() {
+		if len(days) == 0 {
+			start = end
+		} else {
+			start = days[0].date
+		}
+	}
+
+	out := map[string]interface{}{"start": start.Format("2006-01-02"), "end": end.Format("2006-01-02"), "format": format}
+	switch format {
+	case seriesPairs:
+		pairs := make([][2]interface{}, len(days))
+		for i, d := range days {
+			pairs[i] = [2]interface{}{d.date.Format("2006-01-02"), d.tokens}
+		}
+		out["series"] = pairs
+	case seriesRLE:
+		values := []int64{}
+		next := start
+		for _, d := range days {
+			if gap := daysBetween(next, d.date); gap > 0 {
+				values = append(values, -gap)
+			}
+			values = append(values, d.tokens)
+			next = d.date.AddDate(0, 0, 1)
+		}
+		if gap := daysBetween(next, end) + 1; gap > 0 {
+			values = append(values, -gap)
+		}
+		out["values"] = values
+	default:
+		series := []map[string]interface{}{}
+		i := 0
+		for date := start; !date.After(end); date = date.AddDate(0, 0, 1) {
+			var tokens int64
+			if i < len(days) && days[i].date.Equal(date) {
+				tokens = days[i].tokens
+				i++
+			}
+			series = append(series, map[string]interface{}{"date": date.Format("2006-01-02"), "label": loc.date(date), "total_tokens": tokens})
+		}
+		out["series"] = series
+	}
+	respondJSON(w, http.StatusOK, out)
+}
+
+// daysBetween counts the days from a to b, negative if b is before a
+func daysBetween(a, b time.Time) int64 {
+	return int64(math.Round(b.Sub(a).Hours() / 24))
+}
@@ -0,0 +1,162 @@
+// shedding.go
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Load shedding keeps a stampede of reads, such as many dashboards refreshing at once, from
+// starving ingestion. With load_shedding.max_in_flight set, a read is only started while
+// fewer requests than that are in flight; otherwise it waits in a queue of at most max_queued
+// reads for up to queue_timeout_ms, and is turned away with 503 and Retry-After if the queue
+// is full or the wait runs out. Writes are never shed, but count as in flight, so they take
+// capacity ahead of waiting reads. /health, /events, admin and debug requests are exempt.
+// Limits apply per instance.
+
+// LoadSheddingConfig configures load shedding. It is off while MaxInFlight is 0. MaxQueued
+// defaults to 0, shedding reads as soon as the limit is reached, QueueTimeoutMs to 1000 and
+// RetryAfterSeconds to 1.
+type LoadSheddingConfig struct {
+	MaxInFlight       int `json:"max_in_flight"`
+	MaxQueued         int `json:"max_queued"`
+	QueueTimeoutMs    int `json:"queue_timeout_ms"`
+	RetryAfterSeconds int `json:"retry_after_seconds"`
+}
+
+const (
+	defaultShedQueueTimeout = time.Second
+	defaultShedRetryAfter   = 1
+)
+
+func (c LoadSheddingConfig) validate() error {
+	if c.MaxInFlight < 0 || c.MaxQueued < 0 || c.QueueTimeoutMs < 0 || c.RetryAfterSeconds < 0 {
+		return fmt.Errorf("limits must not be negative")
+	}
+	return nil
+}
+
+// loadSheddingFromEnv reads MAX_IN_FLIGHT and MAX_QUEUED
+func loadSheddingFromEnv() LoadSheddingConfig {
+	var c LoadSheddingConfig
+	c.MaxInFlight, _ = strconv.Atoi(os.Getenv("MAX_IN_FLIGHT"))
+	c.MaxQueued, _ = strconv.Atoi(os.Getenv("MAX_QUEUED"))
+	return c
+}
+
+var requestsShedVar = expvar.NewInt("requests_shed")
+
+// admission counts the requests in flight and queues reads waiting for capacity
+type admission struct {
+	mu       sync.Mutex
+	inFlight int
+	// waiting holds a channel per queued read, first come first served
+	waiting []chan struct{}
+}
+
+var requestAdmission = &admission{}
+
+// admitWrite counts a write in flight; writes never wait
+func (a *admission) admitWrite() {
+	a.mu.Lock()
+	a.inFlight++
+	a.mu.Unlock()
+}
+
+// admitRead starts a read if there is capacity, or queues it; it reports false if the read
+// is shed
+func (a *admission) admitRead(r *http.Request, cfg LoadSheddingConfig) bool {
+	a.mu.Lock()
+	if a.inFlight < cfg.MaxInFlight && len(a.waiting) == 0 {
+		a.inFlight++
+		a.mu.Unlock()
+		return true
+	}
+	if len(a.waiting) >= cfg.MaxQueued {
+		a.mu.Unlock()
+		return false
+	}
+	turn := make(chan struct{})
+	a.waiting = append(a.waiting, turn)
+	a.mu.Unlock()
+
+	timeout := defaultShedQueueTimeout
+	if cfg.QueueTimeoutMs > 0 {
+		timeout = time.Duration(cfg.QueueTimeoutMs) * time.Millisecond
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-turn:
+		return true
+	case <-timer.C:
+	case <-r.Context().Done():
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for i, ch := range a.waiting {
+		if ch == turn {
+			a.waiting = append(a.waiting[:i], a.waiting[i+1:]...)
+			return false
+		}
+	}
+	// Admitted just as the wait ended
+	return true
+}
+
+// done ends a request, handing its capacity to the next queued read
+func (a *admission) done(maxInFlight int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.inFlight--
+	for len(a.waiting) > 0 && a.inFlight < maxInFlight {
+		close(a.waiting[0])
+		a.waiting = a.waiting[1:]
+		a.inFlight++
+	}
+}
+
+// sheddingExempt reports whether r bypasses load shedding
+func sheddingExempt(r *http.Request) bool {
+	switch {
+	case r.URL.Path == "/health",
+		r.URL.Path == "/events",
+		strings.HasPrefix(r.URL.Path, "/admin/"),
+		strings.HasPrefix(r.URL.Path, "/debug/"):
+		return true
+	}
+	return false
+}
+
+// shedLoad applies load shedding to requests
+func shedLoad(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := currentConfig.Load().LoadShedding
+		if cfg.MaxInFlight == 0 || sheddingExempt(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			if !requestAdmission.admitRead(r, cfg) {
+				requestsShedVar.Add(1)
+				retryAfter := cfg.RetryAfterSeconds
+				if retryAfter == 0 {
+					retryAfter = defaultShedRetryAfter
+				}
+				w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+				respondJSON(w, http.StatusServiceUnavailable, map[string]string{"message": "Server busy, retry later"})
+				return
+			}
+		} else {
+			requestAdmission.admitWrite()
+		}
+		defer requestAdmission.done(cfg.MaxInFlight)
+		next.ServeHTTP(w, r)
+	})
+}
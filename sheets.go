@@ -0,0 +1,214 @@
+// sheets.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The sheets_export job appends each finished day's usage to a Google Sheet, one row per model
+// and project: date, model, project, total tokens, cost. It authenticates as a service
+// account, which needs edit access to the sheet. Days are appended once, in order; usage that
+// arrives for a day after it was exported is not sent again.
+//
+// GOOGLE_SHEETS_SPREADSHEET_ID and GOOGLE_SHEETS_CREDENTIALS_FILE, the service account's JSON
+// key, enable it; GOOGLE_SHEETS_RANGE picks the sheet, "Usage!A:E" by default.
+const (
+	sheetsScope        = "https://www.googleapis.com/auth/spreadsheets"
+	sheetsAPI          = "https://sheets.googleapis.com/v4/spreadsheets/"
+	defaultSheetsRange = "Usage!A:E"
+)
+
+// serviceAccountKey is the part of a Google service account key file used to get tokens
+type serviceAccountKey struct {
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+}
+
+// sheetsToken caches the access token between runs
+var sheetsToken struct {
+	sync.Mutex
+	value   string
+	expires time.Time
+}
+
+func sheetsConfigured() bool {
+	return os.Getenv("GOOGLE_SHEETS_SPREADSHEET_ID") != "" && os.Getenv("GOOGLE_SHEETS_CREDENTIALS_FILE") != ""
+}
+
+// sheetsAccessToken exchanges a signed JWT for an access token, as described in Google's
+// OAuth 2.0 for service accounts
+func sheetsAccessToken(ctx context.Context) (string, error) {
+	sheetsToken.Lock()
+	defer sheetsToken.Unlock()
+	if sheetsToken.value != "" && time.Now().Before(sheetsToken.expires) {
+		return sheetsToken.value, nil
+	}
+	data, err := os.ReadFile(os.Getenv("GOOGLE_SHEETS_CREDENTIALS_FILE"))
+	if err != nil {
+		return "", err
+	}
+	var key serviceAccountKey
+	if err := json.Unmarshal(data, &key); err != nil {
+		return "", fmt.Errorf("parsing service account key: %w", err)
+	}
+	if key.TokenURI == "" {
+		key.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+	block, _ := pem.Decode([]byte(key.PrivateKey))
+	if block == nil {
+		return "", fmt.Errorf("service account key has no PEM private key")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return "", fmt.Errorf("parsing service account private key: %w", err)
+	}
+	rsaKey, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return "", fmt.Errorf("service account private key is not RSA")
+	}
+
+	now := time.Now()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":   key.ClientEmail,
+		"scope": sheetsScope,
+		"aud":   key.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(nil, rsaKey, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {unsigned + "." + base64.RawURLEncoding.EncodeToString(signature)},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, key.TokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := exportClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("getting Google access token: %s", resp.Status)
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", err
+	}
+	sheetsToken.value = token.AccessToken
+	// Renew a minute early so a token never expires mid-request
+	sheetsToken.expires = now.Add(time.Duration(token.ExpiresIn)*time.Second - time.Minute)
+	return token.AccessToken, nil
+}
+
+// appendSheetRows appends rows to the configured sheet range
+func appendSheetRows(ctx context.Context, rows [][]interface{}) error {
+	token, err := sheetsAccessToken(ctx)
+	if err != nil {
+		return err
+	}
+	sheetRange := os.Getenv("GOOGLE_SHEETS_RANGE")
+	if sheetRange == "" {
+		sheetRange = defaultSheetsRange
+	}
+	body, err := json.Marshal(map[string]interface{}{"values": rows})
+	if err != nil {
+		return err
+	}
+	endpoint := sheetsAPI + url.PathEscape(os.Getenv("GOOGLE_SHEETS_SPREADSHEET_ID")) + "/values/" + url.PathEscape(sheetRange) +
+		":append?valueInputOption=USER_ENTERED&insertDataOption=INSERT_ROWS"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return postExport(req)
+}
+
+// exportToSheets is the sheets_export job: it appends every finished day since the last one
+// exported, starting with yesterday
+func exportToSheets(ctx context.Context) error {
+	if !sheetsConfigured() {
+		return nil
+	}
+	yesterday := time.Now().Truncate(24*time.Hour).AddDate(0, 0, -1)
+	var last sql.NullTime
+	if err := db.QueryRowContext(ctx, "SELECT MAX(date) FROM sheets_exports").Scan(&last); err != nil {
+		return err
+	}
+	day := yesterday
+	if last.Valid {
+		day = last.Time.AddDate(0, 0, 1)
+	}
+	exported := 0
+	for ; !day.After(yesterday); day = day.AddDate(0, 0, 1) {
+		rows, err := sheetRowsForDay(ctx, day)
+		if err != nil {
+			return err
+		}
+		if len(rows) > 0 {
+			if err := appendSheetRows(ctx, rows); err != nil {
+				return fmt.Errorf("appending %s: %w", day.Format("2006-01-02"), err)
+			}
+		}
+		if _, err := db.ExecContext(ctx, "INSERT INTO sheets_exports (date, rows) VALUES ($1, $2)", day, len(rows)); err != nil {
+			return err
+		}
+		exported += len(rows)
+	}
+	if exported > 0 {
+		infof("Appended %d usage rows to Google Sheets\n", exported)
+	}
+	return nil
+}
+
+func sheetRowsForDay(ctx context.Context, day time.Time) ([][]interface{}, error) {
+	rows, err := db.QueryContext(ctx, `
+        SELECT u.model, u.project, SUM(u.total_tokens), `+usageCostMicrosSum+`
+        FROM token_usage u `+usagePriceJoin+`
+        WHERE u.date = $1
+        GROUP BY u.model, u.project ORDER BY u.model, u.project`, day)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	date := day.Format("2006-01-02")
+	var out [][]interface{}
+	for rows.Next() {
+		var model, project string
+		var tokens, cost int64
+		if err := rows.Scan(&model, &project, &tokens, &cost); err != nil {
+			return nil, err
+		}
+		out = append(out, []interface{}{date, model, project, tokens, costFromMicros(cost)})
+	}
+	return out, rows.Err()
+}
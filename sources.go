@@ -0,0 +1,160 @@
+// sources.go
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// GET /admin/sources tells what each reporter has been up to over the last day, to answer "why
+// did my bot stop reporting" without the logs. A source is where records come from, the API or
+// a webhook, and who sends them: the key or caller, IP and user agent. Records stored are taken
+// from recent_ingestions; ingestion requests answered with a client error, such as a record
+// that fails validation or a revoked key, are noted in ingestion_errors with the reason given.
+
+// IngestionSource sums up a reporter's last day
+type IngestionSource struct {
+	Source    string `json:"source"`
+	Key       string `json:"key,omitempty"`
+	Caller    string `json:"caller,omitempty"`
+	IP        string `json:"ip"`
+	UserAgent string `json:"user_agent,omitempty"`
+	// LastEventAt is when the source last sent anything, LastRecordedAt when a record of it
+	// was last stored
+	LastEventAt    time.Time  `json:"last_event_at"`
+	LastRecordedAt *time.Time `json:"last_recorded_at,omitempty"`
+	Recorded       int64      `json:"recorded"`
+	// RecordsPerHour is Recorded averaged over the day
+	RecordsPerHour float64    `json:"records_per_hour"`
+	Errors         int64      `json:"errors"`
+	LastError      *string    `json:"last_error,omitempty"`
+	LastErrorAt    *time.Time `json:"last_error_at,omitempty"`
+}
+
+// ingestionSource names the source of an ingestion request, as recent_ingestions does; ok is
+// false for other requests
+func ingestionSource(r *http.Request) (source string, ok bool) {
+	route := mux.CurrentRoute(r)
+	if r.Method != http.MethodPost || route == nil {
+		return "", false
+	}
+	switch tpl, _ := route.GetPathTemplate(); tpl {
+	case "/token_usage", apiV1Prefix + "/token_usage", apiV2Prefix + "/token_usage":
+		return "api", true
+	case "/ingest/{provider}":
+		return "webhook-" + mux.Vars(r)["provider"], true
+	}
+	return "", false
+}
+
+// rejectionWriter keeps the body of a client error response to read the reason from
+type rejectionWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *rejectionWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *rejectionWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if w.status >= 400 && w.status < 500 && w.body.Len() < 4096 {
+		w.body.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *rejectionWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// noteRejectedIngestions notes ingestion requests answered with a client error. It runs ahead
+// of authentication so requests with bad credentials are noted too.
+func noteRejectedIngestions(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		source, ok := ingestionSource(r)
+		if !ok || db == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		rw := &rejectionWriter{ResponseWriter: w}
+		next.ServeHTTP(rw, r)
+		if rw.status < 400 || rw.status >= 500 {
+			return
+		}
+		var body struct {
+			Message string `json:"message"`
+			Error   string `json:"error"`
+		}
+		reason := http.StatusText(rw.status)
+		if json.Unmarshal(rw.body.Bytes(), &body) == nil && body.Message != "" {
+			reason = body.Message
+			if body.Error != "" {
+				reason += ": " + body.Error
+			}
+		}
+		var key string
+		if k := r.Header.Get(projectKeyHeader); k != "" {
+			key = keyHint(k)
+		}
+		_, err := db.ExecContext(r.Context(), `INSERT INTO ingestion_errors (source, status, message, key_hint, ip, user_agent)
+        VALUES ($1, $2, $3, $4, $5, $6)`, source, rw.status, reason, key, clientIP(r), r.UserAgent())
+		if err != nil {
+			log.Printf("Failed to note rejected %s ingestion: %v", source, err)
+		}
+	})
+}
+
+// getIngestionSources lists the sources heard from in the last day, the most recent first
+func getIngestionSources(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.QueryContext(r.Context(), `
+        WITH events AS (
+            SELECT source, key_hint, caller, ip, user_agent, received_at, NULL::TEXT AS message
+            FROM recent_ingestions WHERE received_at >= $1
+            UNION ALL
+            SELECT source, key_hint, '', ip, user_agent, received_at, message
+            FROM ingestion_errors WHERE received_at >= $1
+        )
+        SELECT source, key_hint, caller, ip, user_agent, MAX(received_at),
+            MAX(received_at) FILTER (WHERE message IS NULL), COUNT(*) FILTER (WHERE message IS NULL),
+            COUNT(message), (ARRAY_AGG(message ORDER BY received_at DESC) FILTER (WHERE message IS NOT NULL))[1],
+            MAX(received_at) FILTER (WHERE message IS NOT NULL)
+        FROM events
+        GROUP BY source, key_hint, caller, ip, user_agent
+        ORDER BY MAX(received_at) DESC`, time.Now().Add(-recentIngestionRetention))
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database query error", err)
+		return
+	}
+	defer rows.Close()
+	hours := recentIngestionRetention.Hours()
+	sources := []IngestionSource{}
+	for rows.Next() {
+		var s IngestionSource
+		if err := rows.Scan(&s.Source, &s.Key, &s.Caller, &s.IP, &s.UserAgent, &s.LastEventAt,
+			&s.LastRecordedAt, &s.Recorded, &s.Errors, &s.LastError, &s.LastErrorAt); err != nil {
+			respondError(w, http.StatusInternalServerError, "Error scanning row", err)
+			return
+		}
+		s.RecordsPerHour = math.Round(float64(s.Recorded)/hours*100) / 100
+		sources = append(sources, s)
+	}
+	if err = rows.Err(); err != nil {
+		respondError(w, http.StatusInternalServerError, "Error reading data", err)
+		return
+	}
+	respondJSON(w, http.StatusOK, sources)
+}
@@ -0,0 +1,187 @@
+// spread.go
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+)
+
+// A record with end_date covers every day from date to end_date and is stored as one record
+// per day, for backfilling coarse historical totals such as a monthly invoice. The totals are
+// split evenly, or in proportion to weights, one per day, with distribution "weighted". Each
+// day's share is a whole number of tokens, requests and characters, and of micro-dollars of
+// cost and millionths of credits; the days still sum to exactly the totals given.
+
+// maxSpreadDays bounds the days one record may cover
+const maxSpreadDays = 1000
+
+// spreadDays expands a record with an end date into one record per day
+func spreadDays(usage TokenUsage) ([]TokenUsage, error) {
+	end := usage.EndDate.Truncate(24 * time.Hour)
+	start := usage.Date.Truncate(24 * time.Hour)
+	if end.Before(start) {
+		return nil, fmt.Errorf("end_date must not be before date")
+	}
+	days := int(end.Sub(start).Hours()/24) + 1
+	if days > maxSpreadDays {
+		return nil, fmt.Errorf("a record may cover at most %d days", maxSpreadDays)
+	}
+	weights := make([]float64, days)
+	switch usage.Distribution {
+	case "", "even":
+		for i := range weights {
+			weights[i] = 1
+		}
+	case "weighted":
+		if len(usage.Weights) != days {
+			return nil, fmt.Errorf("weights must have one entry per day, %d", days)
+		}
+		sum := 0.0
+		for _, w := range usage.Weights {
+			if w < 0 || math.IsNaN(w) || math.IsInf(w, 0) {
+				return nil, fmt.Errorf("weights must not be negative")
+			}
+			sum += w
+		}
+		if sum == 0 {
+			return nil, fmt.Errorf("weights must not all be zero")
+		}
+		copy(weights, usage.Weights)
+	default:
+		return nil, fmt.Errorf("unknown distribution %q, use even or weighted", usage.Distribution)
+	}
+
+	records := splitUsage(usage, weights)
+	for i := range records {
+		records[i].Date = start.AddDate(0, 0, i)
+		records[i].EndDate, records[i].Distribution, records[i].Weights = nil, "", nil
+	}
+	return records, nil
+}
+
+// splitUsage divides a record's tokens, requests, characters, credits and cost into one copy
+// per weight, in proportion to the weights, keeping its other fields
+func splitUsage(usage TokenUsage, weights []float64) []TokenUsage {
+	tokens := splitTotal(int64(usage.TotalTokens), weights)
+	prompt := splitTotal(int64(usage.PromptTokens), weights)
+	completion := splitTotal(int64(usage.CompletionTokens), weights)
+	requests := splitTotal(usage.Requests, weights)
+	characters := splitTotal(usage.Characters, weights)
+	credits := splitTotal(toMicros(usage.Credits), weights)
+	var costs []int64
+	if usage.Cost != nil {
+		costs = splitTotal(toMicros(*usage.Cost), weights)
+	}
+	records := make([]TokenUsage, len(weights))
+	for i := range records {
+		part := usage
+		part.TotalTokens = int(tokens[i])
+		part.PromptTokens, part.CompletionTokens = int(prompt[i]), int(completion[i])
+		part.UsageMeasures = UsageMeasures{Requests: requests[i], Characters: characters[i], Credits: float64(credits[i]) / microsPerDollar}
+		if costs != nil {
+			cost := float64(costs[i]) / microsPerDollar
+			part.Cost = &cost
+		}
+		records[i] = part
+	}
+	return records
+}
+
+// splitTotal divides total in proportion to weights, giving the units left over after rounding
+// down to the shares with the largest remainders, earliest first
+func splitTotal(total int64, weights []float64) []int64 {
+	sum := 0.0
+	for _, w := range weights {
+		sum += w
+	}
+	shares := make([]int64, len(weights))
+	remainders := make([]float64, len(weights))
+	left := total
+	for i, w := range weights {
+		exact := float64(total) * w / sum
+		shares[i] = int64(math.Floor(exact))
+		remainders[i] = exact - float64(shares[i])
+		left -= shares[i]
+	}
+	for ; left > 0; left-- {
+		best := 0
+		for i := range remainders {
+			if remainders[i] > remainders[best] {
+				best = i
+			}
+		}
+		shares[best]++
+		remainders[best] = -1
+	}
+	return shares
+}
+
+// recordTokenUsages stores the records one reported record became: one per day for those
+// with an end date, and one per part for those split by ingest transforms
+func recordTokenUsages(w http.ResponseWriter, r *http.Request, usages []TokenUsage) {
+	var records []TokenUsage
+	days := map[time.Time]bool{}
+	for _, usage := range usages {
+		if usage.EndDate == nil {
+			records = append(records, usage)
+			days[usage.Date.Truncate(24*time.Hour)] = true
+			continue
+		}
+		spread, err := spreadDays(usage)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, "Invalid token usage", err)
+			return
+		}
+		records = append(records, spread...)
+		for _, day := range spread {
+			days[day.Date] = true
+		}
+	}
+	var err error
+	if isDryRun(r) {
+		previews := make([]UsagePreview, len(records))
+		for i, day := range records {
+			if previews[i], err = previewTokenUsage(r.Context(), day); err != nil {
+				respondError(w, http.StatusInternalServerError, "Database query error", err)
+				return
+			}
+		}
+		respondJSON(w, http.StatusOK, previews)
+		return
+	}
+	debugf("Received token usage as %d records over %d days\n", len(records), len(days))
+	created, anyBuffered := 0, false
+	for _, day := range records {
+		liveUsage.add(day)
+		dayCreated, buffered, err := storeOrBuffer(r.Context(), DeadLetter{Mode: "set", Source: "api", Usage: day})
+		if !buffered {
+			liveUsage.flushed(day)
+		}
+		if err != nil {
+			deadLetter("set", "api", day, err)
+			status := http.StatusInternalServerError
+			if errors.Is(err, errBufferFull) {
+				status = http.StatusServiceUnavailable
+			}
+			respondError(w, status, fmt.Sprintf("Failed to record token usage for %s on %s", day.Model, day.Date.Format("2006-01-02")), err)
+			return
+		}
+		if !buffered && db != nil {
+			noteIngestion(r, day, "api")
+		}
+		if dayCreated {
+			created++
+		}
+		anyBuffered = anyBuffered || buffered
+	}
+	status, message := http.StatusOK, "Token usage recorded successfully"
+	if anyBuffered {
+		status, message = http.StatusAccepted, "Database unavailable, token usage buffered"
+	} else if created > 0 {
+		status = http.StatusCreated
+	}
+	respondJSON(w, status, map[string]interface{}{"message": message, "days": len(days), "records": len(records), "created": created})
+}
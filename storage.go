@@ -0,0 +1,106 @@
+// storage.go
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"time"
+
+	"tokencounter/version"
+
+	"github.com/gorilla/mux"
+)
+
+// UsageStore is the storage behind the core usage endpoints: recording, listing and totals.
+// Postgres is the default; everything else in the service (budgets, pricing, the hierarchy,
+// jobs and admin tooling) is built on Postgres directly and is only mounted with it.
+// The standalone stores, memory and embedded, need no database server.
+type UsageStore interface {
+	// SetUsage replaces the day's total for a model and project, reporting whether the row is new
+	SetUsage(ctx context.Context, usage TokenUsage, source string) (bool, error)
+	// AddUsage increments the day's total for a model and project
+	AddUsage(ctx context.Context, usage TokenUsage, source string) error
+	// ListUsage returns the records updated after since; the zero time lists everything
+	ListUsage(ctx context.Context, since time.Time) ([]TokenUsage, error)
+	// SumUsage totals a model's tokens over an inclusive date range; found is false if no row matched
+	SumUsage(ctx context.Context, model string, start, end time.Time) (total int64, found bool, err error)
+}
+
+var store UsageStore = postgresStore{}
+
+type postgresStore struct{}
+
+func (postgresStore) SetUsage(ctx context.Context, usage TokenUsage, source string) (bool, error) {
+	return setTokenUsage(ctx, usage, source)
+}
+
+func (postgresStore) AddUsage(ctx context.Context, u TokenUsage, source string) error {
+	if err := addTokenUsage(ctx, u); err != nil {
+		return err
+	}
+	usageRecorded(UsageEvent{Date: u.Date, Model: u.Model, Project: u.Project, Source: source, TotalTokens: u.TotalTokens, Cost: u.Cost})
+	return nil
+}
+
+func (postgresStore) ListUsage(ctx context.Context, since time.Time) ([]TokenUsage, error) {
+	rows, err := db.QueryContext(ctx, `SELECT id, date, model, project, total_tokens, cost, requests, characters, credits, provider, prompt_tokens, completion_tokens, created_at, updated_at
+        FROM token_usage WHERE updated_at > $1`, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var usages []TokenUsage
+	for rows.Next() {
+		var usage TokenUsage
+		if err := rows.Scan(&usage.ID, &usage.Date, &usage.Model, &usage.Project, &usage.TotalTokens, &usage.Cost, &usage.Requests, &usage.Characters, &usage.Credits,
+			&usage.Provider, &usage.PromptTokens, &usage.CompletionTokens, &usage.CreatedAt, &usage.UpdatedAt); err != nil {
+			return nil, err
+		}
+		usages = append(usages, usage)
+	}
+	return usages, rows.Err()
+}
+
+func (postgresStore) SumUsage(ctx context.Context, model string, start, end time.Time) (int64, bool, error) {
+	// A closed range on (model, date) is an index range scan and lets Postgres skip
+	// partitions outside it; NULL means there is no record at all
+	var total sql.NullInt64
+	err := db.QueryRowContext(ctx, "SELECT SUM(total_tokens) FROM token_usage WHERE model = $1 AND date >= $2 AND date <= $3", model, start, end).Scan(&total)
+	return total.Int64, total.Valid, err
+}
+
+// serveStandalone runs the service on a standalone store. Only the core usage endpoints are
+// mounted; Azure deployments, project keys and dry runs need Postgres and are refused.
+func serveStandalone(kind string, s UsageStore) {
+	store = s
+	cfg, err := loadConfig(configPath())
+	if err != nil {
+		log.Fatal("Error loading configuration:", err)
+	}
+	if cfg.LogLevel != "" {
+		setLogLevel(cfg.LogLevel)
+	}
+	currentConfig.Store(cfg)
+
+	router := newStandaloneRouter(kind)
+	log.Printf("Using %s storage", kind)
+	log.Println("Server listening on port 5001")
+	http.ListenAndServe(":5001", corsMiddleware(instrumentHandler(router)))
+}
+
+// newStandaloneRouter mounts the core usage endpoints served on a standalone store
+func newStandaloneRouter(kind string) *mux.Router {
+	router := mux.NewRouter()
+	router.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		respondJSON(w, http.StatusOK, map[string]string{"storage": kind, "version": version.Version})
+	}).Methods("GET")
+	router.HandleFunc("/token_usage", recordTokenUsage).Methods("POST")
+	router.HandleFunc("/token_usage", getTokenUsageAll).Methods("GET")
+	router.HandleFunc(datedUsagePath, getTokenUsageByDateAndModel).Methods("GET")
+	router.HandleFunc(periodUsagePath, getTokenUsageByPeriod).Methods("GET")
+	router.HandleFunc("/events", streamUsageEvents).Methods("GET")
+	registerAPIRoutes(router)
+	return router
+}
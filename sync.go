@@ -0,0 +1,114 @@
+// sync.go
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GET /sync pages through token_usage in (updated_at, id) order so a downstream loader can
+// replicate it incrementally: start without a cursor, then pass back next_cursor each time.
+// Rows deleted from the service, e.g. by dropping a partition, are not reported.
+const (
+	syncDefaultLimit = 1000
+	syncMaxLimit     = 10000
+	// syncSettleDelay holds back the newest rows: a transaction can commit after a later one,
+	// and a row it wrote must not land behind a cursor that has already moved past it
+	syncSettleDelay = 5 * time.Second
+)
+
+func encodeSyncCursor(updatedAt time.Time, id int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d:%d", updatedAt.UnixMicro(), id)))
+}
+
+func decodeSyncCursor(cursor string) (time.Time, int, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	micros, id, ok := strings.Cut(string(raw), ":")
+	if !ok {
+		return time.Time{}, 0, fmt.Errorf("malformed cursor")
+	}
+	us, err := strconv.ParseInt(micros, 10, 64)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	n, err := strconv.Atoi(id)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	return time.UnixMicro(us), n, nil
+}
+
+func syncUsage(w http.ResponseWriter, r *http.Request) {
+	var since time.Time
+	sinceID := 0
+	cursor := r.URL.Query().Get("cursor")
+	if cursor != "" {
+		var err error
+		if since, sinceID, err = decodeSyncCursor(cursor); err != nil {
+			respondError(w, http.StatusBadRequest, "Invalid cursor", err)
+			return
+		}
+	}
+	limit := syncDefaultLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			respondJSON(w, http.StatusBadRequest, map[string]string{"message": "limit must be a positive integer"})
+			return
+		}
+		limit = min(n, syncMaxLimit)
+	}
+
+	records, hasMore, err := syncPage(r.Context(), since, sinceID, limit)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database query error", err)
+		return
+	}
+
+	// With nothing new the cursor stays where it was
+	next := cursor
+	if n := len(records); n > 0 {
+		next = encodeSyncCursor(*records[n-1].UpdatedAt, records[n-1].ID)
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"records":     records,
+		"next_cursor": next,
+		"has_more":    hasMore,
+	})
+}
+
+// syncPage reads up to limit rows after the cursor position (since, sinceID), and whether
+// there are more
+func syncPage(ctx context.Context, since time.Time, sinceID, limit int) ([]TokenUsage, bool, error) {
+	// One extra row tells us whether there is more to fetch
+	rows, err := db.QueryContext(ctx, `
+        SELECT id, date, model, project, total_tokens, cost, requests, characters, credits, provider, prompt_tokens, completion_tokens, created_at, updated_at
+        FROM token_usage
+        WHERE (updated_at, id) > ($1, $2) AND updated_at < NOW() - $3 * INTERVAL '1 millisecond'
+        ORDER BY updated_at, id LIMIT $4`, since, sinceID, syncSettleDelay.Milliseconds(), limit+1)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+	records := []TokenUsage{}
+	for rows.Next() {
+		if len(records) == limit {
+			return records, true, nil
+		}
+		var usage TokenUsage
+		if err := rows.Scan(&usage.ID, &usage.Date, &usage.Model, &usage.Project, &usage.TotalTokens, &usage.Cost, &usage.Requests, &usage.Characters, &usage.Credits,
+			&usage.Provider, &usage.PromptTokens, &usage.CompletionTokens, &usage.CreatedAt, &usage.UpdatedAt); err != nil {
+			return nil, false, err
+		}
+		records = append(records, usage)
+	}
+	return records, false, rows.Err()
+}
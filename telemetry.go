@@ -0,0 +1,109 @@
+// telemetry.go
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/gorilla/mux"
+	"tokencounter/version"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/propagation"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "tokencounter"
+
+var tokensRecorded metric.Int64Counter
+
+// setupTelemetry configures OTLP/HTTP trace and metric export when OTEL_EXPORTER_OTLP_ENDPOINT
+// (or a signal-specific endpoint) is set. The exporters read the standard OTEL_* variables.
+func setupTelemetry(ctx context.Context) (func(context.Context) error, error) {
+	noop := func(context.Context) error { return nil }
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" &&
+		os.Getenv("OTEL_EXPORTER_OTLP_METRICS_ENDPOINT") == "" {
+		return noop, nil
+	}
+	if os.Getenv("OTEL_SERVICE_NAME") == "" {
+		os.Setenv("OTEL_SERVICE_NAME", instrumentationName)
+	}
+	res, err := resource.New(ctx, resource.WithFromEnv(), resource.WithTelemetrySDK(), resource.WithHost(),
+		resource.WithAttributes(attribute.String("service.version", version.Version)))
+	if err != nil {
+		return noop, err
+	}
+
+	traceExporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return noop, err
+	}
+	tracerProvider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(traceExporter), sdktrace.WithResource(res))
+
+	metricExporter, err := otlpmetrichttp.New(ctx)
+	if err != nil {
+		tracerProvider.Shutdown(ctx)
+		return noop, err
+	}
+	meterProvider := sdkmetric.NewMeterProvider(sdkmetric.WithReader(sdkmetric.NewPeriodicReader(metricExporter)), sdkmetric.WithResource(res))
+
+	otel.SetTracerProvider(tracerProvider)
+	otel.SetMeterProvider(meterProvider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	tokensRecorded, err = meterProvider.Meter(instrumentationName).Int64Counter("tokencounter.tokens.recorded",
+		metric.WithDescription("Tokens recorded, by model and source"), metric.WithUnit("{token}"))
+	if err != nil {
+		log.Printf("Failed to create tokens metric: %v", err)
+	}
+	log.Println("OpenTelemetry export enabled")
+
+	return func(ctx context.Context) error {
+		return errors.Join(tracerProvider.Shutdown(ctx), meterProvider.Shutdown(ctx))
+	}, nil
+}
+
+// instrumentHandler wraps the router so every request gets a server span and duration metrics
+func instrumentHandler(router *mux.Router) http.Handler {
+	router.Use(routeTagger)
+	return otelhttp.NewHandler(router, "http.request")
+}
+
+// routeTagger names spans and labels metrics after the matched route template instead of the raw path
+func routeTagger(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if route := mux.CurrentRoute(r); route != nil {
+			if tmpl, err := route.GetPathTemplate(); err == nil {
+				routeAttr := attribute.String("http.route", tmpl)
+				span := trace.SpanFromContext(r.Context())
+				span.SetName(r.Method + " " + tmpl)
+				span.SetAttributes(routeAttr)
+				if labeler, ok := otelhttp.LabelerFromContext(r.Context()); ok {
+					labeler.Add(routeAttr)
+				}
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func recordTokenMetric(event UsageEvent) {
+	if tokensRecorded == nil || event.TotalTokens <= 0 {
+		return
+	}
+	tokensRecorded.Add(context.Background(), int64(event.TotalTokens), metric.WithAttributes(
+		attribute.String("model", event.Model),
+		attribute.String("source", event.Source),
+	))
+}
@@ -0,0 +1,221 @@
+// templates.go
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// ModelTemplate holds the pricing and budget applied automatically to new models matching Pattern.
+// Pattern is a glob where * matches any run of characters, e.g. "gpt-*".
+type ModelTemplate struct {
+	ID              int               `json:"id"`
+	Pattern         string            `json:"pattern"`
+	Priority        int               `json:"priority"`
+	PricePerMillion *float64          `json:"price_per_million,omitempty"`
+	Period          string            `json:"period,omitempty"`
+	LimitTokens     int64             `json:"limit_tokens,omitempty"`
+	LimitUSD        float64           `json:"limit_usd,omitempty"`
+	CooldownMinutes int               `json:"cooldown_minutes"`
+	Enforce         bool              `json:"enforce"`
+	Thresholds      []BudgetThreshold `json:"thresholds,omitempty"`
+}
+
+// hasBudget reports whether the template creates a budget as well as pricing
+func (t ModelTemplate) hasBudget() bool {
+	return t.Period != "" || t.LimitTokens > 0 || t.LimitUSD > 0
+}
+
+// matchModelPattern reports whether model matches a glob pattern where * matches anything, including '/'
+func matchModelPattern(pattern, model string) bool {
+	parts := strings.Split(pattern, "*")
+	for i, p := range parts {
+		parts[i] = regexp.QuoteMeta(p)
+	}
+	re, err := regexp.Compile("^" + strings.Join(parts, ".*") + "$")
+	return err == nil && re.MatchString(model)
+}
+
+func createModelTemplate(w http.ResponseWriter, r *http.Request) {
+	t := ModelTemplate{CooldownMinutes: defaultBudgetCooldownMinutes}
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request payload", err)
+		return
+	}
+	if err := validateModelTemplate(&t); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid template", err)
+		return
+	}
+	thresholds, err := json.Marshal(t.Thresholds)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to encode thresholds", err)
+		return
+	}
+	err = db.QueryRowContext(r.Context(), `INSERT INTO model_templates (pattern, priority, price_per_million, period, limit_tokens, limit_usd, cooldown_minutes, enforce, thresholds)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id`,
+		t.Pattern, t.Priority, t.PricePerMillion, t.Period, t.LimitTokens, t.LimitUSD, t.CooldownMinutes, t.Enforce, string(thresholds)).Scan(&t.ID)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to create template", err)
+		return
+	}
+	infof("Created model template %d for pattern %s\n", t.ID, t.Pattern)
+	respondJSON(w, http.StatusCreated, t)
+}
+
+func validateModelTemplate(t *ModelTemplate) error {
+	if t.Pattern == "" {
+		return fmt.Errorf("pattern is required")
+	}
+	if t.PricePerMillion != nil && *t.PricePerMillion < 0 {
+		return fmt.Errorf("price_per_million must not be negative")
+	}
+	if !t.hasBudget() {
+		if t.PricePerMillion == nil {
+			return fmt.Errorf("template must set pricing, a budget, or both")
+		}
+		return nil
+	}
+	if t.LimitUSD > 0 && t.LimitTokens > 0 {
+		return fmt.Errorf("set either limit_tokens or limit_usd, not both")
+	}
+	if t.LimitUSD > 0 && (t.PricePerMillion == nil || *t.PricePerMillion == 0) {
+		return fmt.Errorf("limit_usd needs a non-zero price_per_million to convert to tokens")
+	}
+	if len(t.Thresholds) == 0 {
+		t.Thresholds = append([]BudgetThreshold(nil), defaultBudgetThresholds...)
+	}
+	// Validate the budget fields with a placeholder model and a non-zero limit
+	b := Budget{Model: t.Pattern, Period: t.Period, LimitTokens: 1, CooldownMinutes: t.CooldownMinutes, Thresholds: t.Thresholds}
+	if err := validateBudget(&b, currentConfig.Load().Notifications); err != nil {
+		return err
+	}
+	if t.LimitTokens <= 0 && t.LimitUSD <= 0 {
+		return fmt.Errorf("limit_tokens or limit_usd must be positive")
+	}
+	return nil
+}
+
+func getModelTemplates(w http.ResponseWriter, r *http.Request) {
+	templates, err := loadModelTemplates()
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database query error", err)
+		return
+	}
+	respondJSON(w, http.StatusOK, templates)
+}
+
+func deleteModelTemplate(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid template id", err)
+		return
+	}
+	res, err := db.ExecContext(r.Context(), "DELETE FROM model_templates WHERE id = $1", id)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to delete template", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		respondJSON(w, http.StatusNotFound, map[string]string{"message": "Template not found"})
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]string{"message": "Template deleted successfully"})
+}
+
+// loadModelTemplates returns templates in the order they are tried: highest priority first
+func loadModelTemplates() ([]ModelTemplate, error) {
+	rows, err := db.Query(`SELECT id, pattern, priority, price_per_million, period, limit_tokens, limit_usd, cooldown_minutes, enforce, thresholds
+        FROM model_templates ORDER BY priority DESC, id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	templates := []ModelTemplate{}
+	for rows.Next() {
+		var t ModelTemplate
+		var thresholds string
+		if err := rows.Scan(&t.ID, &t.Pattern, &t.Priority, &t.PricePerMillion, &t.Period, &t.LimitTokens, &t.LimitUSD, &t.CooldownMinutes, &t.Enforce, &thresholds); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(thresholds), &t.Thresholds); err != nil {
+			return nil, fmt.Errorf("template %d has invalid thresholds: %w", t.ID, err)
+		}
+		templates = append(templates, t)
+	}
+	return templates, rows.Err()
+}
+
+// applyModelDefaults is called the first time a model is recorded. It adds the model to the
+// registry, and the first matching template seeds its pricing and budget unless the model
+// already has its own.
+func applyModelDefaults(model string) {
+	registerModel(model)
+	templates, err := loadModelTemplates()
+	if err != nil {
+		log.Printf("Failed to load model templates: %v", err)
+		return
+	}
+	for _, t := range templates {
+		if !matchModelPattern(t.Pattern, model) {
+			continue
+		}
+		if err := applyModelTemplate(t, model); err != nil {
+			log.Printf("Failed to apply template %d to %s: %v", t.ID, model, err)
+		}
+		return
+	}
+}
+
+func applyModelTemplate(t ModelTemplate, model string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if t.PricePerMillion != nil {
+		_, err = tx.Exec("INSERT INTO model_pricing (model, price_per_million) VALUES ($1, $2) ON CONFLICT (model) DO NOTHING", model, *t.PricePerMillion)
+		if err != nil {
+			return err
+		}
+	}
+	if t.hasBudget() {
+		var exists bool
+		if err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM budgets WHERE model = $1)", model).Scan(&exists); err != nil {
+			return err
+		}
+		if !exists {
+			limit := t.LimitTokens
+			if t.LimitUSD > 0 {
+				// Budgets are tracked in tokens, so a dollar limit is converted at the template's list price
+				limit = int64(math.Floor(t.LimitUSD / *t.PricePerMillion * 1e6))
+			}
+			var budgetID int
+			err = tx.QueryRow("INSERT INTO budgets (model, period, limit_tokens, cooldown_minutes, enforce) VALUES ($1, $2, $3, $4, $5) RETURNING id",
+				model, t.Period, limit, t.CooldownMinutes, t.Enforce).Scan(&budgetID)
+			if err != nil {
+				return err
+			}
+			for _, th := range t.Thresholds {
+				_, err = tx.Exec("INSERT INTO budget_thresholds (budget_id, percent, channel, target) VALUES ($1, $2, $3, $4)",
+					budgetID, th.Percent, th.Channel, th.Target)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	infof("Applied template %d (%s) to new model %s\n", t.ID, t.Pattern, model)
+	return nil
+}
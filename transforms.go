@@ -0,0 +1,163 @@
+// transforms.go
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Every ingested record, whether reported to /token_usage, delivered by a webhook or measured
+// by the proxy, passes through the config's ingest_transforms in order before it is stored,
+// so deployment-specific rewriting doesn't need a fork. A step is either a rule, which applies
+// its actions to the records matching model (a * glob), project and source (a * glob over
+// "api", "webhook-<provider>" and "proxy-<provider>"):
+//
+//	"ingest_transforms": [
+//	  {"model": "*-test", "drop": true},
+//	  {"model": "gpt-4o-2024-*", "set_model": "gpt-4o"},
+//	  {"project": "shared", "split": {"search": 3, "chat": 1}}
+//	]
+//
+// or the name of a hook, Go code compiled in that registers itself with registerIngestHook in
+// its file's init:
+//
+//	"ingest_transforms": [{"hook": "tag-staging"}]
+//
+// A split divides the record's tokens, requests, characters, credits and cost between the
+// projects in proportion to their weights, as spreading a record over days does. Records
+// already split are matched by the steps after as any other.
+
+// IngestHook rewrites an ingested record, returning the records to store in its place: none
+// drops it, several split it. An error rejects the record.
+type IngestHook interface {
+	Transform(ctx context.Context, usage TokenUsage, source string) ([]TokenUsage, error)
+}
+
+var ingestHooks = map[string]IngestHook{}
+
+// registerIngestHook makes a hook available to ingest_transforms; hooks register in init
+func registerIngestHook(name string, hook IngestHook) {
+	if _, ok := ingestHooks[name]; ok {
+		panic("ingest hook registered twice: " + name)
+	}
+	ingestHooks[name] = hook
+}
+
+// IngestTransform is a step of ingest_transforms: a registered hook, or a rule
+type IngestTransform struct {
+	Hook string `json:"hook"`
+	// Model and Source are globs; Project matches exactly, "" being usage without a project
+	Model   string  `json:"model"`
+	Project *string `json:"project"`
+	Source  string  `json:"source"`
+	// Drop discards the record; the other actions rewrite it
+	Drop        bool               `json:"drop"`
+	SetModel    string             `json:"set_model"`
+	SetProject  *string            `json:"set_project"`
+	SetProvider string             `json:"set_provider"`
+	Split       map[string]float64 `json:"split"`
+}
+
+func (t IngestTransform) validate() error {
+	if t.Hook != "" {
+		if _, ok := ingestHooks[t.Hook]; !ok {
+			return fmt.Errorf("unknown hook %q", t.Hook)
+		}
+		if t.Model != "" || t.Project != nil || t.Source != "" || t.hasAction() {
+			return fmt.Errorf("hook %q can't have rule fields", t.Hook)
+		}
+		return nil
+	}
+	if !t.hasAction() {
+		return fmt.Errorf("needs a hook or an action: drop, set_model, set_project, set_provider or split")
+	}
+	if t.Drop && (t.SetModel != "" || t.SetProject != nil || t.SetProvider != "" || t.Split != nil) {
+		return fmt.Errorf("drop can't be combined with other actions")
+	}
+	if t.Split != nil && t.SetProject != nil {
+		return fmt.Errorf("split and set_project both set the project")
+	}
+	if t.Split != nil && len(t.Split) < 2 {
+		return fmt.Errorf("split needs at least two projects")
+	}
+	for project, weight := range t.Split {
+		if weight <= 0 || math.IsNaN(weight) || math.IsInf(weight, 0) {
+			return fmt.Errorf("split weight for %q must be positive", project)
+		}
+	}
+	return nil
+}
+
+func (t IngestTransform) hasAction() bool {
+	return t.Drop || t.SetModel != "" || t.SetProject != nil || t.SetProvider != "" || t.Split != nil
+}
+
+func (t IngestTransform) matches(usage TokenUsage, source string) bool {
+	return (t.Model == "" || matchModelPattern(t.Model, usage.Model)) &&
+		(t.Project == nil || *t.Project == usage.Project) &&
+		(t.Source == "" || matchModelPattern(t.Source, source))
+}
+
+// apply runs the step on one record
+func (t IngestTransform) apply(ctx context.Context, usage TokenUsage, source string) ([]TokenUsage, error) {
+	if t.Hook != "" {
+		records, err := ingestHooks[t.Hook].Transform(ctx, usage, source)
+		if err != nil {
+			return nil, fmt.Errorf("hook %s: %w", t.Hook, err)
+		}
+		return records, nil
+	}
+	if !t.matches(usage, source) {
+		return []TokenUsage{usage}, nil
+	}
+	if t.Drop {
+		return nil, nil
+	}
+	if t.SetModel != "" {
+		usage.Model = t.SetModel
+	}
+	if t.SetProject != nil {
+		usage.Project = *t.SetProject
+	}
+	if t.SetProvider != "" {
+		usage.Provider = t.SetProvider
+	}
+	if t.Split == nil {
+		return []TokenUsage{usage}, nil
+	}
+	// Sorted so a record always splits the same way
+	projects := make([]string, 0, len(t.Split))
+	for project := range t.Split {
+		projects = append(projects, project)
+	}
+	sort.Strings(projects)
+	weights := make([]float64, len(projects))
+	for i, project := range projects {
+		weights[i] = t.Split[project]
+	}
+	records := splitUsage(usage, weights)
+	for i := range records {
+		records[i].Project = projects[i]
+	}
+	return records, nil
+}
+
+// transformUsage runs ingest_transforms on a record from source, returning the records to
+// store in its place
+func transformUsage(ctx context.Context, usage TokenUsage, source string) ([]TokenUsage, error) {
+	records := []TokenUsage{usage}
+	for _, t := range currentConfig.Load().IngestTransforms {
+		var next []TokenUsage
+		for _, record := range records {
+			out, err := t.apply(ctx, record, source)
+			if err != nil {
+				return nil, err
+			}
+			next = append(next, out...)
+		}
+		records = next
+	}
+	return records, nil
+}
@@ -0,0 +1,175 @@
+// update.go
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"tokencounter/version"
+)
+
+// `tokencounter update` replaces the running binary with the latest GitHub release, for
+// installs that don't use Docker. Releases carry one binary per platform, named by
+// releaseAssetName, and a checksums.txt in sha256sum format that downloads are checked against.
+const releasesURL = "https://api.github.com/repos/rahulvk007/TokenCounter-GoBackend/releases/latest"
+
+var updateClient = &http.Client{Timeout: 5 * time.Minute}
+
+type githubRelease struct {
+	TagName string `json:"tag_name"`
+	Assets  []struct {
+		Name string `json:"name"`
+		URL  string `json:"browser_download_url"`
+	} `json:"assets"`
+}
+
+func releaseAssetName() string {
+	name := "tokencounter-" + runtime.GOOS + "-" + runtime.GOARCH
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+	return name
+}
+
+// runSelfUpdate implements the update command; with check it only reports whether an update exists
+func runSelfUpdate(check bool) error {
+	release, err := latestRelease()
+	if err != nil {
+		return fmt.Errorf("checking for updates: %w", err)
+	}
+	if release.TagName == version.Version {
+		fmt.Printf("tokencounter %s is up to date\n", version.Version)
+		return nil
+	}
+	fmt.Printf("tokencounter %s is available (running %s)\n", release.TagName, version.Version)
+	if check {
+		return nil
+	}
+
+	var binaryURL, checksumsURL string
+	for _, a := range release.Assets {
+		switch a.Name {
+		case releaseAssetName():
+			binaryURL = a.URL
+		case "checksums.txt":
+			checksumsURL = a.URL
+		}
+	}
+	if binaryURL == "" {
+		return fmt.Errorf("release %s has no binary for %s/%s", release.TagName, runtime.GOOS, runtime.GOARCH)
+	}
+	if checksumsURL == "" {
+		return fmt.Errorf("release %s has no checksums.txt", release.TagName)
+	}
+	want, err := releaseChecksum(checksumsURL, releaseAssetName())
+	if err != nil {
+		return err
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return err
+	}
+	// Download next to the binary so the final rename stays on one filesystem
+	tmp, err := os.CreateTemp(filepath.Dir(exe), ".tokencounter-update-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	got, err := download(binaryURL, tmp)
+	tmp.Close()
+	if err != nil {
+		return fmt.Errorf("downloading %s: %w", releaseAssetName(), err)
+	}
+	if got != want {
+		return fmt.Errorf("checksum mismatch for %s: got %s, want %s", releaseAssetName(), got, want)
+	}
+	if err := os.Chmod(tmp.Name(), 0o755); err != nil {
+		return err
+	}
+	// Windows can't replace a running executable, but it can rename it out of the way
+	if runtime.GOOS == "windows" {
+		old := exe + ".old"
+		os.Remove(old)
+		if err := os.Rename(exe, old); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(tmp.Name(), exe); err != nil {
+		return err
+	}
+	fmt.Printf("Updated %s to %s; restart the service to run it\n", exe, release.TagName)
+	return nil
+}
+
+func latestRelease() (githubRelease, error) {
+	var release githubRelease
+	req, err := http.NewRequest("GET", releasesURL, nil)
+	if err != nil {
+		return release, err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	resp, err := updateClient.Do(req)
+	if err != nil {
+		return release, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return release, fmt.Errorf("GitHub returned %s", resp.Status)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&release)
+	return release, err
+}
+
+// releaseChecksum finds the SHA-256 of name in a sha256sum-format checksums file
+func releaseChecksum(url, name string) (string, error) {
+	resp, err := updateClient.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("fetching checksums: %s", resp.Status)
+	}
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == name {
+			return strings.ToLower(fields[0]), nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("no checksum listed for %s", name)
+}
+
+// download writes url to w and returns the SHA-256 of what it wrote
+func download(url string, w io.Writer) (string, error) {
+	resp, err := updateClient.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("server returned %s", resp.Status)
+	}
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(w, h), resp.Body); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,227 @@
+// upstreams.go
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// An upstream is a named proxy target: a provider type (one of proxyProviders, which decides
+// how requests and usage are parsed), a base URL, an optional API key injected into proxied
+// requests, and a response timeout. /proxy/{upstream}/... routes to it by name, and usage
+// is attributed to it. The built-in provider names remain usable as upstreams configured from
+// the environment, unless an upstream of the same name overrides them.
+type Upstream struct {
+	Name     string `json:"name"`
+	Provider string `json:"provider"`
+	BaseURL  string `json:"base_url"`
+	// APIKey is write-only; responses report HasAPIKey instead
+	APIKey         string `json:"api_key,omitempty"`
+	HasAPIKey      bool   `json:"has_api_key"`
+	TimeoutSeconds int    `json:"timeout_seconds"`
+}
+
+const defaultUpstreamTimeout = 120 * time.Second
+
+// proxyTarget is a resolved upstream, ready to proxy to
+type proxyTarget struct {
+	name     string
+	provider proxyProvider
+	baseURL  *url.URL
+	apiKey   string
+	timeout  time.Duration
+}
+
+var errUnknownUpstream = fmt.Errorf("unknown upstream")
+
+// resolveUpstream finds the upstream named name: from the upstreams table when the database
+// is reachable, otherwise from the built-in providers
+func resolveUpstream(ctx context.Context, name string) (proxyTarget, error) {
+	if dbHealth.available() {
+		var u Upstream
+		err := db.QueryRowContext(ctx, "SELECT provider, base_url, api_key, timeout_seconds FROM upstreams WHERE name = $1", name).
+			Scan(&u.Provider, &u.BaseURL, &u.APIKey, &u.TimeoutSeconds)
+		if err == nil {
+			u.Name = name
+			return upstreamTarget(u)
+		}
+		if err != sql.ErrNoRows && !isUnavailable(err) {
+			return proxyTarget{}, err
+		}
+	}
+	provider, ok := proxyProviders[name]
+	if !ok {
+		return proxyTarget{}, errUnknownUpstream
+	}
+	baseURL := os.Getenv(provider.baseURLEnv)
+	if baseURL == "" {
+		baseURL = provider.defaultBaseURL
+	}
+	target, err := url.Parse(baseURL)
+	if err != nil || target.Host == "" {
+		return proxyTarget{}, fmt.Errorf("%s is not configured", provider.baseURLEnv)
+	}
+	return proxyTarget{name: name, provider: provider, baseURL: target, timeout: defaultUpstreamTimeout}, nil
+}
+
+func upstreamTarget(u Upstream) (proxyTarget, error) {
+	provider, ok := proxyProviders[u.Provider]
+	if !ok {
+		return proxyTarget{}, fmt.Errorf("upstream %s has unknown provider %q", u.Name, u.Provider)
+	}
+	target, err := url.Parse(u.BaseURL)
+	if err != nil || target.Host == "" {
+		return proxyTarget{}, fmt.Errorf("upstream %s has an invalid base URL", u.Name)
+	}
+	timeout := defaultUpstreamTimeout
+	if u.TimeoutSeconds > 0 {
+		timeout = time.Duration(u.TimeoutSeconds) * time.Second
+	}
+	return proxyTarget{name: u.Name, provider: provider, baseURL: target, apiKey: u.APIKey, timeout: timeout}, nil
+}
+
+// proxyTransports shares one transport, and so one connection pool, per timeout
+var proxyTransports sync.Map
+
+// transport bounds the wait for response headers; streamed bodies may take longer
+func (t proxyTarget) transport() http.RoundTripper {
+	if rt, ok := proxyTransports.Load(t.timeout); ok {
+		return rt.(http.RoundTripper)
+	}
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.ResponseHeaderTimeout = t.timeout
+	tr.DialContext = (&net.Dialer{Timeout: 10 * time.Second, KeepAlive: 30 * time.Second}).DialContext
+	rt, _ := proxyTransports.LoadOrStore(t.timeout, tr)
+	return rt.(http.RoundTripper)
+}
+
+func validateUpstream(u *Upstream) error {
+	if _, ok := proxyProviders[u.Provider]; !ok {
+		return fmt.Errorf("unknown provider %q, use gemini, openrouter or vertex", u.Provider)
+	}
+	if target, err := url.Parse(u.BaseURL); err != nil || target.Host == "" || (target.Scheme != "http" && target.Scheme != "https") {
+		return fmt.Errorf("base_url must be an http or https URL")
+	}
+	if u.TimeoutSeconds < 0 {
+		return fmt.Errorf("timeout_seconds must not be negative")
+	}
+	return nil
+}
+
+func getUpstreams(w http.ResponseWriter, r *http.Request) {
+	rows, err := db.QueryContext(r.Context(), "SELECT name, provider, base_url, api_key <> '', timeout_seconds FROM upstreams ORDER BY name")
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database query error", err)
+		return
+	}
+	defer rows.Close()
+	upstreams := []Upstream{}
+	for rows.Next() {
+		var u Upstream
+		if err := rows.Scan(&u.Name, &u.Provider, &u.BaseURL, &u.HasAPIKey, &u.TimeoutSeconds); err != nil {
+			respondError(w, http.StatusInternalServerError, "Error scanning row", err)
+			return
+		}
+		upstreams = append(upstreams, u)
+	}
+	if err = rows.Err(); err != nil {
+		respondError(w, http.StatusInternalServerError, "Error reading data", err)
+		return
+	}
+	respondJSON(w, http.StatusOK, upstreams)
+}
+
+// putUpstream creates or replaces an upstream. Omitting api_key keeps the stored key.
+func putUpstream(w http.ResponseWriter, r *http.Request) {
+	var u Upstream
+	if err := json.NewDecoder(r.Body).Decode(&u); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request payload", err)
+		return
+	}
+	u.Name = mux.Vars(r)["name"]
+	if err := validateUpstream(&u); err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid upstream", err)
+		return
+	}
+	err := db.QueryRowContext(r.Context(), `INSERT INTO upstreams (name, provider, base_url, api_key, timeout_seconds) VALUES ($1, $2, $3, $4, $5)
+        ON CONFLICT (name) DO UPDATE SET provider = EXCLUDED.provider, base_url = EXCLUDED.base_url,
+            api_key = CASE WHEN EXCLUDED.api_key = '' THEN upstreams.api_key ELSE EXCLUDED.api_key END,
+            timeout_seconds = EXCLUDED.timeout_seconds
+        RETURNING api_key <> ''`, u.Name, u.Provider, u.BaseURL, u.APIKey, u.TimeoutSeconds).Scan(&u.HasAPIKey)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to save upstream", err)
+		return
+	}
+	u.APIKey = ""
+	infof("Configured upstream %s (%s at %s)\n", u.Name, u.Provider, u.BaseURL)
+	respondJSON(w, http.StatusOK, u)
+}
+
+func deleteUpstream(w http.ResponseWriter, r *http.Request) {
+	res, err := db.ExecContext(r.Context(), "DELETE FROM upstreams WHERE name = $1", mux.Vars(r)["name"])
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Failed to delete upstream", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		respondJSON(w, http.StatusNotFound, map[string]string{"message": "Upstream not found"})
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]string{"message": "Upstream deleted successfully"})
+}
+
+// recordUpstreamUsage attributes proxied usage to the upstream that served it
+func recordUpstreamUsage(upstream string, date time.Time, model string, tokens int) error {
+	_, err := db.Exec(`INSERT INTO upstream_usage (upstream, date, model, requests, total_tokens) VALUES ($1, $2, $3, 1, $4)
+        ON CONFLICT (upstream, date, model) DO UPDATE SET requests = upstream_usage.requests + 1,
+            total_tokens = upstream_usage.total_tokens + EXCLUDED.total_tokens`, upstream, date, model, tokens)
+	return err
+}
+
+// getUpstreamUsage reports requests and tokens per upstream and model for a date range
+func getUpstreamUsage(w http.ResponseWriter, r *http.Request) {
+	start, end, err := parseDateRange(r.URL.Query(), "month")
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid date range", err)
+		return
+	}
+	rows, err := db.QueryContext(r.Context(), `
+        SELECT upstream, model, SUM(requests), SUM(total_tokens) FROM upstream_usage
+        WHERE date >= $1 AND date <= $2 AND ($3 = '' OR upstream = $3)
+        GROUP BY upstream, model ORDER BY upstream, model`, start, end, r.URL.Query().Get("upstream"))
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database query error", err)
+		return
+	}
+	defer rows.Close()
+	type upstreamUsage struct {
+		Upstream    string `json:"upstream"`
+		Model       string `json:"model"`
+		Requests    int64  `json:"requests"`
+		TotalTokens int64  `json:"total_tokens"`
+	}
+	usage := []upstreamUsage{}
+	for rows.Next() {
+		var u upstreamUsage
+		if err := rows.Scan(&u.Upstream, &u.Model, &u.Requests, &u.TotalTokens); err != nil {
+			respondError(w, http.StatusInternalServerError, "Error scanning row", err)
+			return
+		}
+		usage = append(usage, u)
+	}
+	if err = rows.Err(); err != nil {
+		respondError(w, http.StatusInternalServerError, "Error reading data", err)
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{"start": start.Format("2006-01-02"), "end": end.Format("2006-01-02"), "usage": usage})
+}
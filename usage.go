@@ -0,0 +1,142 @@
+// usage.go
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+)
+
+// usageCostExpr is the cost of a token_usage row aliased u joined to its price with usagePriceJoin:
+// the provider-reported cost when there is one, otherwise tokens at list price.
+const usageCostExpr = "COALESCE(u.cost, u.total_tokens / 1e6 * COALESCE(p.price_per_million, 0))"
+
+// usagePriceJoin joins each usage row aliased u to the price in force on its date, as p: the
+// latest model_price_history entry effective by then, the model_pricing price for models
+// whose price has never changed, or else the pricing catalog's
+const usagePriceJoin = `LEFT JOIN LATERAL (SELECT COALESCE(
+            (SELECT h.price_per_million FROM model_price_history h WHERE h.model = u.model AND h.effective_from <= u.date
+                ORDER BY h.effective_from DESC LIMIT 1),
+            (SELECT mp.price_per_million FROM model_pricing mp WHERE mp.model = u.model),
+            (SELECT c.price_per_million FROM pricing_catalog c WHERE c.model = u.model)) AS price_per_million) p ON TRUE`
+
+// usageRecorded fans a newly stored increment of usage out to metrics and external exporters
+func usageRecorded(event UsageEvent) {
+	recordTokenMetric(event)
+	if event.TotalTokens > 0 {
+		tokensRecordedVar.Add(event.Model, int64(event.TotalTokens))
+	}
+	exportUsageEvent(event)
+	publishUsageChange(event)
+}
+
+// setTokenUsage stores a reporter's running total for a day, model and project, replacing any
+// previous total. It reports whether a new row was created.
+func setTokenUsage(ctx context.Context, usage TokenUsage, source string) (bool, error) {
+	if usage.JobID != "" {
+		return setJobUsage(ctx, usage, source)
+	}
+	// Check if there's a record for the date, model and project
+	var existingID, existingTokens int
+	err := db.QueryRowContext(ctx, "SELECT id, total_tokens FROM token_usage WHERE date = $1 AND model = $2 AND project = $3", usage.Date, usage.Model, usage.Project).Scan(&existingID, &existingTokens)
+	if err != nil && err != sql.ErrNoRows {
+		return false, err
+	}
+	if err == sql.ErrNoRows { // No record exists for this date, model and project
+		var knownModel bool
+		if err = db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM token_usage WHERE model = $1)", usage.Model).Scan(&knownModel); err != nil {
+			return false, err
+		}
+		if err := ensurePartition(ctx, usage.Date); err != nil {
+			log.Printf("Failed to create partition for %s, using the default partition: %v", usage.Date.Format("2006-01"), err)
+		}
+		_, err = db.ExecContext(ctx, `INSERT INTO token_usage (date, model, project, total_tokens, cost, requests, characters, credits, provider, prompt_tokens, completion_tokens)
+            VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`,
+			usage.Date, usage.Model, usage.Project, usage.TotalTokens, usage.Cost, usage.Requests, usage.Characters, usage.Credits, usage.Provider, usage.PromptTokens, usage.CompletionTokens)
+		if err != nil {
+			return false, err
+		}
+		infof("Recorded token usage on %s for %s with %d\n", usage.Date.Format("2006-01-02"), usage.Model, usage.TotalTokens)
+		if !knownModel {
+			applyModelDefaults(usage.Model)
+		}
+		go checkBudgets(usage.Model)
+		usageRecorded(UsageEvent{Date: usage.Date, Model: usage.Model, Project: usage.Project, Source: source, TotalTokens: usage.TotalTokens, Cost: usage.Cost})
+		return true, nil
+	}
+	// Record exists, update
+	_, err = db.ExecContext(ctx, `UPDATE token_usage SET total_tokens = $1, cost = $2, requests = $5, characters = $6, credits = $7,
+            provider = $8, prompt_tokens = $9, completion_tokens = $10 WHERE id = $3 AND date = $4`,
+		usage.TotalTokens, usage.Cost, existingID, usage.Date, usage.Requests, usage.Characters, usage.Credits, usage.Provider, usage.PromptTokens, usage.CompletionTokens)
+	if err != nil {
+		return false, err
+	}
+	infof("Updated token usage on %s for %s with %d\n", usage.Date.Format("2006-01-02"), usage.Model, usage.TotalTokens)
+	go checkBudgets(usage.Model)
+	// Reporters send running daily totals, so only the increase is a new event
+	usageRecorded(UsageEvent{Date: usage.Date, Model: usage.Model, Project: usage.Project, Source: source, TotalTokens: usage.TotalTokens - existingTokens})
+	return false, nil
+}
+
+// addTokenUsage increments the day's total for a model and project, creating the row if needed.
+// Unlike POST /token_usage, which replaces the day's total, this is used by sources that
+// observe individual requests, such as the proxy. Cost is the provider-reported cost, if any.
+// Each increment is also logged to usage_requests, from which POST /admin/recalculate can
+// rebuild the total. With write_batching enabled it is written together with others.
+func addTokenUsage(ctx context.Context, usage TokenUsage) error {
+	if currentConfig.Load().WriteBatching.Enabled {
+		return writeBatches.add(usage)
+	}
+	// Partition DDL must not wait on the write's own locks, so it runs before the transaction
+	if err := ensurePartition(context.Background(), usage.Date); err != nil {
+		log.Printf("Failed to create partition for %s, using the default partition: %v", usage.Date.Format("2006-01"), err)
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, "INSERT INTO usage_requests (date, model, project, total_tokens, cost, requests) VALUES ($1, $2, $3, $4, $5, $6)",
+		usage.Date, usage.Model, usage.Project, usage.TotalTokens, usage.Cost, usage.Requests); err != nil {
+		return err
+	}
+	res, err := tx.ExecContext(ctx, `UPDATE token_usage SET total_tokens = total_tokens + $1,
+        cost = CASE WHEN $5::DOUBLE PRECISION IS NULL THEN cost ELSE ROUND(COALESCE(cost, 0)::NUMERIC + $5::NUMERIC, 6)::DOUBLE PRECISION END,
+        requests = requests + $6, characters = characters + $7, credits = credits + $8,
+        provider = COALESCE(NULLIF($9, ''), provider), prompt_tokens = prompt_tokens + $10, completion_tokens = completion_tokens + $11
+        WHERE date = $2 AND model = $3 AND project = $4`,
+		usage.TotalTokens, usage.Date, usage.Model, usage.Project, usage.Cost, usage.Requests, usage.Characters, usage.Credits, usage.Provider, usage.PromptTokens, usage.CompletionTokens)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		go checkBudgets(usage.Model)
+		return nil
+	}
+
+	var knownModel bool
+	if err := tx.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM token_usage WHERE model = $1)", usage.Model).Scan(&knownModel); err != nil {
+		return err
+	}
+	insert := `INSERT INTO token_usage (date, model, project, total_tokens, cost, requests, characters, credits, provider, prompt_tokens, completion_tokens)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`
+	if usageKeyIndexed.Load() {
+		insert += usageIncrementOnConflict
+	}
+	if _, err := tx.ExecContext(ctx, insert,
+		usage.Date, usage.Model, usage.Project, usage.TotalTokens, usage.Cost, usage.Requests, usage.Characters, usage.Credits, usage.Provider, usage.PromptTokens, usage.CompletionTokens); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	infof("Recorded token usage on %s for %s with %d\n", usage.Date.Format("2006-01-02"), usage.Model, usage.TotalTokens)
+	if !knownModel {
+		applyModelDefaults(usage.Model)
+	}
+	go checkBudgets(usage.Model)
+	return nil
+}
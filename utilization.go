@@ -0,0 +1,140 @@
+// utilization.go
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+)
+
+// Context utilization is the share of a model's context window a request took up, its total
+// tokens over the window in the model registry. It is computed from the request log, over the
+// increments logged as a single request, such as proxied requests and webhook events; usage
+// reported as daily totals says nothing about individual requests.
+
+// ContextUtilization summarizes how much of its context window a model's requests used.
+// Flags lists the problems found: "near_limit" when the 95th percentile reaches the near-limit
+// threshold, so prompts risk being truncated or rejected, and "padded" when the average
+// request already fills the padded threshold and the 95th percentile is hardly above it, so
+// nearly every request carries the same large context, like an oversized system prompt or
+// documents sent whether needed or not, which is paid for on every request.
+type ContextUtilization struct {
+	Model          string  `json:"model"`
+	ContextWindow  int     `json:"context_window"`
+	Requests       int64   `json:"requests"`
+	AvgTokens      float64 `json:"avg_tokens"`
+	AvgUtilization float64 `json:"avg_utilization"`
+	P95Utilization float64 `json:"p95_utilization"`
+	MaxUtilization float64 `json:"max_utilization"`
+	// NearLimitRequests counts the requests at or above the near-limit threshold
+	NearLimitRequests int64    `json:"near_limit_requests"`
+	Flags             []string `json:"flags"`
+}
+
+const (
+	defaultNearLimit   = 0.9
+	defaultPaddedAbove = 0.5
+	// paddedSpread is how far above the average the 95th percentile may be for a model's
+	// requests to count as uniformly padded
+	paddedSpread = 1.2
+)
+
+// getContextUtilization reports the average and 95th percentile context utilization per model
+// over a date range, this month by default, highest first. ?near_limit= and ?padded_above=
+// set the flag thresholds as fractions of the window, 0.9 and 0.5 by default, and ?project=
+// narrows it to one project. Models without a context window in the registry are listed in
+// without_context_window.
+func getContextUtilization(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	start, end, err := parseDateRange(q, "month")
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid date range", err)
+		return
+	}
+	thresholds := map[string]float64{"near_limit": defaultNearLimit, "padded_above": defaultPaddedAbove}
+	for name := range thresholds {
+		if v := q.Get(name); v != "" {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil || f <= 0 || f > 1 {
+				respondJSON(w, http.StatusBadRequest, map[string]string{"message": name + " must be a fraction between 0 and 1"})
+				return
+			}
+			thresholds[name] = f
+		}
+	}
+	nearLimit, paddedAbove := thresholds["near_limit"], thresholds["padded_above"]
+
+	rows, err := db.QueryContext(r.Context(), `
+        SELECT r.model, m.context_window, COUNT(*), AVG(r.total_tokens),
+            AVG(r.total_tokens::DOUBLE PRECISION / m.context_window),
+            percentile_cont(0.95) WITHIN GROUP (ORDER BY r.total_tokens::DOUBLE PRECISION / m.context_window),
+            MAX(r.total_tokens::DOUBLE PRECISION / m.context_window),
+            COUNT(*) FILTER (WHERE r.total_tokens >= $4::DOUBLE PRECISION * m.context_window)
+        FROM usage_requests r JOIN models m ON m.name = r.model AND m.context_window > 0
+        WHERE r.requests = 1 AND r.date >= $1 AND r.date <= $2 AND ($3 = '' OR r.project = $3)
+        GROUP BY r.model, m.context_window
+        ORDER BY 6 DESC, r.model`, start, end, q.Get("project"), nearLimit)
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database query error", err)
+		return
+	}
+	defer rows.Close()
+	models := []ContextUtilization{}
+	for rows.Next() {
+		var u ContextUtilization
+		if err := rows.Scan(&u.Model, &u.ContextWindow, &u.Requests, &u.AvgTokens, &u.AvgUtilization, &u.P95Utilization,
+			&u.MaxUtilization, &u.NearLimitRequests); err != nil {
+			respondError(w, http.StatusInternalServerError, "Error scanning row", err)
+			return
+		}
+		u.Flags = []string{}
+		if u.P95Utilization >= nearLimit {
+			u.Flags = append(u.Flags, "near_limit")
+		}
+		if u.AvgUtilization >= paddedAbove && u.P95Utilization <= u.AvgUtilization*paddedSpread {
+			u.Flags = append(u.Flags, "padded")
+		}
+		u.AvgTokens = math.Round(u.AvgTokens)
+		for _, f := range []*float64{&u.AvgUtilization, &u.P95Utilization, &u.MaxUtilization} {
+			*f = math.Round(*f*10000) / 10000
+		}
+		models = append(models, u)
+	}
+	if err = rows.Err(); err != nil {
+		respondError(w, http.StatusInternalServerError, "Error reading data", err)
+		return
+	}
+
+	unknown := []string{}
+	missing, err := db.QueryContext(r.Context(), `
+        SELECT DISTINCT r.model FROM usage_requests r LEFT JOIN models m ON m.name = r.model
+        WHERE r.requests = 1 AND r.date >= $1 AND r.date <= $2 AND ($3 = '' OR r.project = $3)
+            AND COALESCE(m.context_window, 0) <= 0
+        ORDER BY r.model`, start, end, q.Get("project"))
+	if err != nil {
+		respondError(w, http.StatusInternalServerError, "Database query error", err)
+		return
+	}
+	defer missing.Close()
+	for missing.Next() {
+		var model string
+		if err := missing.Scan(&model); err != nil {
+			respondError(w, http.StatusInternalServerError, "Error scanning row", err)
+			return
+		}
+		unknown = append(unknown, model)
+	}
+	if err = missing.Err(); err != nil {
+		respondError(w, http.StatusInternalServerError, "Error reading data", err)
+		return
+	}
+
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"start":                  start.Format("2006-01-02"),
+		"end":                    end.Format("2006-01-02"),
+		"near_limit":             nearLimit,
+		"padded_above":           paddedAbove,
+		"models":                 models,
+		"without_context_window": unknown,
+	})
+}
@@ -0,0 +1,32 @@
+// Package version holds build metadata, set at link time with
+//
+//	go build -ldflags "-X tokencounter/version.Version=v1.2.3 -X tokencounter/version.Commit=abc123 -X tokencounter/version.Date=2024-01-01T00:00:00Z"
+package version
+
+import (
+	"fmt"
+	"runtime"
+)
+
+var (
+	// Version is the release tag; development builds report "dev"
+	Version = "dev"
+	Commit  = "unknown"
+	Date    = "unknown"
+)
+
+// String describes the build in one line
+func String() string {
+	return fmt.Sprintf("tokencounter %s (commit %s, built %s, %s %s/%s)", Version, Commit, Date, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+}
+
+// Info is the build metadata as reported by the API
+func Info() map[string]string {
+	return map[string]string{
+		"version":    Version,
+		"commit":     Commit,
+		"date":       Date,
+		"go_version": runtime.Version(),
+		"platform":   runtime.GOOS + "/" + runtime.GOARCH,
+	}
+}
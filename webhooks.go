@@ -0,0 +1,338 @@
+// webhooks.go
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Tools that log LLM requests can push them to POST /ingest/{provider} as they happen, in their
+// own webhook format. Each provider's parser turns a delivery into usage events, which are
+// added to the day's totals like proxied requests. Deliveries are authenticated with the secret
+// in <PROVIDER>_WEBHOOK_SECRET, e.g. LITELLM_WEBHOOK_SECRET, as the provider's verifier
+// expects; a provider without a secret refuses deliveries. The project is the one of the
+// project key in X-Tokencounter-Key or ?key=, for tools that cannot set headers, or else the
+// project the event names.
+
+// webhookEvent is one request's usage parsed from a webhook delivery
+type webhookEvent struct {
+	proxyUsage
+	// RequestID is the tool's identifier for the request, if it has one
+	RequestID string
+	// Time is when the request was made, the delivery time if the payload doesn't say
+	Time    time.Time
+	Project string
+}
+
+// webhookParser reads one tool's webhook format
+type webhookParser struct {
+	// parse returns the events in a delivery; events without usage are skipped on ingest
+	parse func(body []byte) ([]webhookEvent, error)
+	// verify reports whether a delivery was signed with secret
+	verify func(r *http.Request, body []byte, secret string) bool
+}
+
+// webhookParsers maps the {provider} of /ingest/{provider} to its parser. Supporting another
+// tool takes a parse function for its payload and a verify function for its signature scheme.
+var webhookParsers = map[string]webhookParser{
+	"litellm":  {parse: parseLiteLLMWebhook, verify: verifyBearerSecret},
+	"helicone": {parse: parseHeliconeWebhook, verify: verifyHMACHeader("Helicone-Signature", "")},
+	"custom":   {parse: parseCustomWebhook, verify: verifyHMACHeader(proxyHeaderPrefix+"Signature", "sha256=")},
+}
+
+// maxWebhookBody bounds the size of a delivery
+const maxWebhookBody = 8 << 20
+
+// webhookSecret returns the secret deliveries from provider are signed with
+func webhookSecret(provider string) string {
+	return os.Getenv(strings.ToUpper(provider) + "_WEBHOOK_SECRET")
+}
+
+// verifyBearerSecret accepts deliveries sent with "Authorization: Bearer <secret>", which
+// tools without request signing can be configured to send
+func verifyBearerSecret(r *http.Request, body []byte, secret string) bool {
+	given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(given), []byte(secret)) == 1
+}
+
+// verifyHMACHeader accepts deliveries whose header holds the hex HMAC-SHA256 of the body keyed
+// with the secret, after prefix
+func verifyHMACHeader(header, prefix string) func(r *http.Request, body []byte, secret string) bool {
+	return func(r *http.Request, body []byte, secret string) bool {
+		given, ok := strings.CutPrefix(r.Header.Get(header), prefix)
+		if !ok {
+			return false
+		}
+		signature, err := hex.DecodeString(given)
+		if err != nil {
+			return false
+		}
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+		return hmac.Equal(signature, mac.Sum(nil))
+	}
+}
+
+// jsonObjects splits a JSON object or an array of them into the objects
+func jsonObjects(body []byte) ([]json.RawMessage, error) {
+	if trimmed := strings.TrimSpace(string(body)); strings.HasPrefix(trimmed, "[") {
+		var list []json.RawMessage
+		err := json.Unmarshal(body, &list)
+		return list, err
+	}
+	if !json.Valid(body) {
+		return nil, errors.New("payload is not valid JSON")
+	}
+	return []json.RawMessage{body}, nil
+}
+
+// parseLiteLLMWebhook reads the standard logging payloads LiteLLM's generic API callback sends,
+// one object or a batch of them
+func parseLiteLLMWebhook(body []byte) ([]webhookEvent, error) {
+	objects, err := jsonObjects(body)
+	if err != nil {
+		return nil, err
+	}
+	var events []webhookEvent
+	for _, object := range objects {
+		var p struct {
+			ID               string   `json:"id"`
+			Model            string   `json:"model"`
+			PromptTokens     int      `json:"prompt_tokens"`
+			CompletionTokens int      `json:"completion_tokens"`
+			ResponseCost     *float64 `json:"response_cost"`
+			StartTime        float64  `json:"startTime"`
+			Metadata         struct {
+				TeamAlias string `json:"user_api_key_team_alias"`
+			} `json:"metadata"`
+		}
+		if err := json.Unmarshal(object, &p); err != nil {
+			return nil, err
+		}
+		event := webhookEvent{
+			proxyUsage: proxyUsage{Model: p.Model, PromptTokens: p.PromptTokens, CompletionTokens: p.CompletionTokens, Cost: p.ResponseCost},
+			RequestID:  p.ID,
+			Project:    p.Metadata.TeamAlias,
+		}
+		if p.StartTime > 0 {
+			sec, frac := math.Modf(p.StartTime)
+			event.Time = time.Unix(int64(sec), int64(frac*1e9))
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+// parseHeliconeWebhook reads a Helicone webhook, taking the usage from its metadata or else
+// from the OpenAI-style response body
+func parseHeliconeWebhook(body []byte) ([]webhookEvent, error) {
+	var payload struct {
+		RequestID    string `json:"request_id"`
+		ResponseBody string `json:"response_body"`
+		Metadata     struct {
+			Model            string   `json:"model"`
+			PromptTokens     int      `json:"promptTokens"`
+			CompletionTokens int      `json:"completionTokens"`
+			Cost             *float64 `json:"cost"`
+		} `json:"metadata"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, err
+	}
+	m := payload.Metadata
+	usage := proxyUsage{Model: m.Model, PromptTokens: m.PromptTokens, CompletionTokens: m.CompletionTokens, Cost: m.Cost}
+	if usage.total() == 0 {
+		if fromBody, ok := extractOpenRouterUsage("", []byte(payload.ResponseBody)); ok {
+			if usage.Model != "" {
+				fromBody.Model = usage.Model
+			}
+			if fromBody.Cost == nil {
+				fromBody.Cost = usage.Cost
+			}
+			usage = fromBody
+		}
+	}
+	return []webhookEvent{{proxyUsage: usage, RequestID: payload.RequestID}}, nil
+}
+
+// parseCustomWebhook reads TokenCounter's own format, for tools with configurable webhooks: an
+// object or array of objects with model, prompt_tokens, completion_tokens and optionally
+// request_id, timestamp (RFC 3339), project and cost. total_tokens may be sent instead of the
+// prompt/completion split.
+func parseCustomWebhook(body []byte) ([]webhookEvent, error) {
+	objects, err := jsonObjects(body)
+	if err != nil {
+		return nil, err
+	}
+	var events []webhookEvent
+	for _, object := range objects {
+		var p struct {
+			RequestID        string    `json:"request_id"`
+			Timestamp        time.Time `json:"timestamp"`
+			Model            string    `json:"model"`
+			Project          string    `json:"project"`
+			PromptTokens     int       `json:"prompt_tokens"`
+			CompletionTokens int       `json:"completion_tokens"`
+			TotalTokens      int       `json:"total_tokens"`
+			Cost             *float64  `json:"cost"`
+		}
+		if err := json.Unmarshal(object, &p); err != nil {
+			return nil, err
+		}
+		usage := proxyUsage{Model: p.Model, PromptTokens: p.PromptTokens, CompletionTokens: p.CompletionTokens, Cost: p.Cost}
+		if usage.total() == 0 {
+			usage.PromptTokens = p.TotalTokens
+		}
+		events = append(events, webhookEvent{proxyUsage: usage, RequestID: p.RequestID, Time: p.Timestamp, Project: p.Project})
+	}
+	return events, nil
+}
+
+// ingestWebhook records the usage in a webhook delivery from a tool in webhookParsers
+func ingestWebhook(w http.ResponseWriter, r *http.Request) {
+	provider := mux.Vars(r)["provider"]
+	parser, ok := webhookParsers[provider]
+	if !ok {
+		respondJSON(w, http.StatusNotFound, map[string]string{"message": "Unknown webhook provider: " + provider})
+		return
+	}
+	secret := webhookSecret(provider)
+	if secret == "" {
+		respondJSON(w, http.StatusForbidden, map[string]string{"message": fmt.Sprintf("Webhooks from %s are disabled; set %s_WEBHOOK_SECRET to enable them", provider, strings.ToUpper(provider))})
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookBody))
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request payload", err)
+		return
+	}
+	if !parser.verify(r, body, secret) {
+		respondJSON(w, http.StatusUnauthorized, map[string]string{"message": "Invalid webhook signature"})
+		return
+	}
+	events, err := parser.parse(body)
+	if err != nil {
+		respondError(w, http.StatusBadRequest, "Invalid request payload", err)
+		return
+	}
+
+	project, scoped := projectScope(r.Context())
+	if key := r.URL.Query().Get("key"); key != "" && !scoped {
+		resolved, ok, err := resolveProjectKey(key)
+		if err != nil {
+			respondError(w, http.StatusInternalServerError, "Database query error", err)
+			return
+		}
+		if !ok {
+			respondJSON(w, http.StatusBadRequest, map[string]string{"message": "Unknown project key: " + key})
+			return
+		}
+		noteKeyUse(r.Context(), key)
+		project, scoped = resolved, true
+	}
+
+	// Validate every event before storing any, so a rejected delivery can be resent whole
+	now := time.Now()
+	var usages []TokenUsage
+	var requestIDs []string
+	for _, event := range events {
+		if event.Model == "" || event.total() == 0 {
+			continue
+		}
+		if event.Time.IsZero() {
+			event.Time = now
+		}
+		if scoped {
+			event.Project = project
+		}
+		usage := TokenUsage{
+			Date:           event.Time.UTC().Truncate(24 * time.Hour),
+			Model:          event.Model,
+			Project:        event.Project,
+			TotalTokens:    event.total(),
+			UsageBreakdown: UsageBreakdown{PromptTokens: event.PromptTokens, CompletionTokens: event.CompletionTokens},
+			UsageMeasures:  UsageMeasures{Requests: 1},
+			Cost:           event.Cost,
+		}
+		if err := validateTokenUsage(usage); err != nil {
+			respondError(w, http.StatusBadRequest, "Invalid token usage", err)
+			return
+		}
+		usages = append(usages, usage)
+		requestIDs = append(requestIDs, event.RequestID)
+	}
+	// Transforms run per event, so duplicates are recognized by what the provider sent
+	source := "webhook-" + provider
+	transformed := make([][]TokenUsage, len(usages))
+	for i, usage := range usages {
+		records, err := transformUsage(r.Context(), usage, source)
+		if err != nil {
+			respondError(w, http.StatusBadRequest, "Rejected by an ingest transform", err)
+			return
+		}
+		for _, record := range records {
+			if err := validateTokenUsage(record); err != nil {
+				respondError(w, http.StatusBadRequest, "Invalid token usage after ingest transforms", err)
+				return
+			}
+		}
+		transformed[i] = records
+	}
+	recorded, duplicates, dropped, anyBuffered := 0, 0, 0, false
+	for i, usage := range usages {
+		claimed, seenAt, err := claimRequest(r.Context(), requestIDs[i], usage.Model)
+		if err != nil {
+			log.Printf("Failed to check request %s for duplicates, recording it: %v", requestIDs[i], err)
+		} else if !claimed {
+			duplicates++
+			continue
+		}
+		if len(transformed[i]) == 0 {
+			dropped++
+			continue
+		}
+		for _, record := range transformed[i] {
+			_, buffered, err := storeOrBuffer(r.Context(), DeadLetter{Mode: "add", Source: source, Usage: record})
+			if err != nil {
+				if rerr := releaseRequest(r.Context(), requestIDs[i], usage.Model, seenAt); rerr != nil {
+					log.Printf("Failed to release request %s: %v", requestIDs[i], rerr)
+				}
+				deadLetter("add", source, record, err)
+				status := http.StatusInternalServerError
+				if errors.Is(err, errBufferFull) {
+					status = http.StatusServiceUnavailable
+				}
+				respondError(w, status, "Failed to record token usage", err)
+				return
+			}
+			if !buffered && db != nil {
+				noteIngestion(r, record, source)
+			}
+			anyBuffered = anyBuffered || buffered
+		}
+		recorded++
+	}
+	skipped := len(events) - len(usages)
+	debugf("Received %d usage events from %s webhook, %d duplicates, %d without usage\n", recorded, provider, duplicates, skipped)
+	status := http.StatusOK
+	if anyBuffered {
+		status = http.StatusAccepted
+	}
+	// duplicate is set when the delivery had usage and all of it was ingested before
+	respondJSON(w, status, map[string]interface{}{"received": len(events), "recorded": recorded, "skipped": skipped,
+		"dropped": dropped, "duplicates": duplicates, "duplicate": duplicates > 0 && duplicates == len(usages)})
+}